@@ -1,10 +1,15 @@
 package cfg
 
 import (
-	"io"
+	"errors"
+	"fmt"
+	"maps"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 
-	"gopkg.in/yaml.v3"
+	"github.com/creativeprojects/imap/schedule"
 )
 
 type AccountType string
@@ -13,10 +18,16 @@ const (
 	IMAP    AccountType = "imap"
 	MAILDIR AccountType = "maildir"
 	LOCAL   AccountType = "local"
+	MEMORY  AccountType = "memory"
 )
 
 type Config struct {
 	Accounts map[string]Account `yaml:"accounts"`
+	Serve    Serve              `yaml:"serve"`
+	// Credentials is the file of secrets encrypted with a master passphrase
+	Credentials string `yaml:"credentials"`
+	// Jobs are named copies run with the "run" command, or on a schedule with the "daemon" command
+	Jobs map[string]Job `yaml:"jobs"`
 }
 
 type Account struct {
@@ -27,34 +38,175 @@ type Account struct {
 	Root                string      `yaml:"root"`
 	File                string      `yaml:"file"`
 	SkipTLSVerification bool        `yaml:"skipTLSverification"`
+	// PasswordCommand is run in a shell: the first line of its output is the password
+	PasswordCommand string `yaml:"passwordCommand"`
+	// PasswordFile contains the password
+	PasswordFile string `yaml:"passwordFile"`
+	// PasswordEnv is the name of the environment variable containing the password
+	PasswordEnv string `yaml:"passwordEnv"`
+	// Credential is the name of the password in the encrypted credentials file
+	Credential string `yaml:"credential"`
+	// Layout of a maildir account: "flat" (default), "maildir++" or "fs"
+	Layout string `yaml:"layout"`
+	// Passphrase to encrypt a local database
+	Passphrase string `yaml:"passphrase"`
+	// KeyFile to encrypt a local database (instead of a passphrase)
+	KeyFile string `yaml:"keyFile"`
+	// SearchIndex maintains a full-text search index in a local database
+	SearchIndex bool `yaml:"searchIndex"`
+	// HistoryStore of an imap account: "local" (default) in the .cache directory, or "server" on the IMAP server
+	// ("metadata" or "mailbox" to choose how)
+	HistoryStore string `yaml:"historyStore"`
+}
+
+// Serve is the configuration of the built-in IMAP server
+type Serve struct {
+	Listen  string               `yaml:"listen"`
+	TLSCert string               `yaml:"tlsCert"`
+	TLSKey  string               `yaml:"tlsKey"`
+	Users   map[string]ServeUser `yaml:"users"`
+}
+
+// ServeUser gives access to an account through the built-in IMAP server
+type ServeUser struct {
+	Password string `yaml:"password"`
+	Account  string `yaml:"account"`
+	ReadOnly bool   `yaml:"readOnly"`
 }
 
 func newConfig() *Config {
 	return &Config{}
 }
 
-// LoadFromFile loads the configuration from the file
+// LoadFromFile loads the configuration from the file, and from the files it includes.
+// The environment variables are expanded, and the configuration is validated.
 func LoadFromFile(fileName string) (*Config, error) {
-	file, err := os.Open(fileName)
+	loader := newLoader()
+	config, err := loader.load(fileName)
 	if err != nil {
 		return nil, err
 	}
-	return loadConfig(file)
+	errs := append(loader.errs, validateConfiguration(config, loader.positions)...)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return config, nil
 }
 
-// loadConfig from a io.ReadCloser
-func loadConfig(reader io.ReadCloser) (*Config, error) {
-	defer reader.Close()
-	decoder := yaml.NewDecoder(reader)
-	config := newConfig()
-	err := decoder.Decode(config)
-	if err != nil {
-		return nil, err
+// validateConfiguration returns the required fields missing from the accounts and users
+func validateConfiguration(config *Config, positions map[string]position) []error {
+	errs := make([]error, 0)
+	for _, name := range slices.Sorted(maps.Keys(config.Accounts)) {
+		account := config.Accounts[name]
+		prefix := fmt.Sprintf("%s: account %s", positions["accounts."+name], name)
+		missing := func(keys ...string) {
+			for _, key := range keys {
+				errs = append(errs, fmt.Errorf("%s: missing required key %q", prefix, key))
+			}
+		}
+		switch account.Type {
+		case IMAP:
+			if account.ServerURL == "" {
+				missing("serverURL")
+			}
+			if account.Username == "" {
+				missing("username")
+			}
+			source, err := account.PasswordSource()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", prefix, err))
+			} else if source == "" {
+				missing("password")
+			}
+			switch account.HistoryStore {
+			case "", "local", "server", "mailbox", "metadata":
+			default:
+				errs = append(errs, fmt.Errorf("%s: unknown history store %q", prefix, account.HistoryStore))
+			}
+		case MAILDIR:
+			if account.Root == "" {
+				missing("root")
+			}
+		case LOCAL:
+			if account.File == "" {
+				missing("file")
+			}
+		case MEMORY:
+		case "":
+			missing("type")
+		default:
+			errs = append(errs, fmt.Errorf("%s: unknown account type %q", prefix, account.Type))
+		}
 	}
-	validateConfiguration(config)
-	return config, nil
+	for _, name := range slices.Sorted(maps.Keys(config.Serve.Users)) {
+		user := config.Serve.Users[name]
+		prefix := fmt.Sprintf("%s: user %s", positions["serve.users."+name], name)
+		if user.Password == "" {
+			errs = append(errs, fmt.Errorf("%s: missing required key %q", prefix, "password"))
+		}
+		if user.Account == "" {
+			errs = append(errs, fmt.Errorf("%s: missing required key %q", prefix, "account"))
+		} else if _, found := config.Accounts[user.Account]; !found {
+			errs = append(errs, fmt.Errorf("%s: account %s not found", prefix, user.Account))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(config.Jobs)) {
+		job := config.Jobs[name]
+		prefix := fmt.Sprintf("%s: job %s", positions["jobs."+name], name)
+		for _, key := range []string{"source", "destination"} {
+			account := job.Source
+			if key == "destination" {
+				account = job.Destination
+			}
+			if account == "" {
+				errs = append(errs, fmt.Errorf("%s: missing required key %q", prefix, key))
+			} else if _, found := config.Accounts[account]; !found {
+				errs = append(errs, fmt.Errorf("%s: %s account %s not found", prefix, key, account))
+			}
+		}
+		switch job.Mode {
+		case "", ModeCopy, ModeMove, ModeMirror:
+		default:
+			errs = append(errs, fmt.Errorf("%s: unknown mode %q", prefix, job.Mode))
+		}
+		if _, err := job.Renamer(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", prefix, err))
+		}
+		if job.Schedule != "" {
+			if _, err := schedule.Parse(job.Schedule); err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid schedule %q: %w", prefix, job.Schedule, err))
+			}
+		}
+	}
+	return errs
 }
 
-func validateConfiguration(config *Config) {
+// SearchPaths returns the places where the configuration file is searched when none is given:
+// the current directory, then the imap directory of the user configuration (~/.config/imap/)
+func SearchPaths(fileName string) []string {
+	paths := []string{fileName}
+	if filepath.IsAbs(fileName) {
+		return paths
+	}
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if configDir == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			configDir = filepath.Join(home, ".config")
+		}
+	}
+	if configDir != "" {
+		paths = append(paths, filepath.Join(configDir, "imap", fileName))
+	}
+	return paths
+}
 
+// FindConfigFile returns the first configuration file found in the search paths
+func FindConfigFile(fileName string) (string, error) {
+	paths := SearchPaths(fileName)
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("configuration file not found in %s", strings.Join(paths, ", "))
 }
@@ -0,0 +1,282 @@
+package cfg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, filename, content string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(filename), 0o755))
+	require.NoError(t, os.WriteFile(filename, []byte(content), 0o600))
+}
+
+func TestLoadConfigWithEnvironment(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "imap.yaml")
+	writeFile(t, filename, `
+accounts:
+  work:
+    type: imap
+    serverURL: ${TEST_IMAP_SERVER}:993
+    username: ${TEST_IMAP_USER:-john}
+    passwordEnv: TEST_IMAP_PASSWORD
+    skipTLSverification: ${TEST_IMAP_SKIP_TLS}
+  backup:
+    type: local
+    file: "${TEST_IMAP_DIR:-/var/backup}/backup.db"
+`)
+	t.Setenv("TEST_IMAP_SERVER", "imap.example.com")
+	t.Setenv("TEST_IMAP_SKIP_TLS", "true")
+
+	config, err := LoadFromFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "imap.example.com:993", config.Accounts["work"].ServerURL)
+	assert.Equal(t, "john", config.Accounts["work"].Username)
+	assert.Equal(t, "TEST_IMAP_PASSWORD", config.Accounts["work"].PasswordEnv)
+	assert.True(t, config.Accounts["work"].SkipTLSVerification)
+	assert.Equal(t, "/var/backup/backup.db", config.Accounts["backup"].File)
+}
+
+func TestLoadConfigWithIncludes(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "imap.yaml")
+	writeFile(t, filename, `
+include:
+  - accounts/work.yaml
+  - accounts/home.yaml
+accounts:
+  backup:
+    type: local
+    file: backup.db
+serve:
+  listen: localhost:1143
+`)
+	writeFile(t, filepath.Join(dir, "accounts", "work.yaml"), `
+include: ../users.yaml
+accounts:
+  work:
+    type: maildir
+    root: work
+`)
+	writeFile(t, filepath.Join(dir, "accounts", "home.yaml"), `
+accounts:
+  home:
+    type: memory
+serve:
+  listen: localhost:2143
+`)
+	writeFile(t, filepath.Join(dir, "users.yaml"), `
+serve:
+  users:
+    backup:
+      password: secret
+      account: backup
+`)
+
+	config, err := LoadFromFile(filename)
+	require.NoError(t, err)
+	assert.Len(t, config.Accounts, 3)
+	assert.Equal(t, "work", config.Accounts["work"].Root)
+	assert.Equal(t, MEMORY, config.Accounts["home"].Type)
+	assert.Equal(t, "localhost:1143", config.Serve.Listen)
+	assert.Equal(t, "backup", config.Serve.Users["backup"].Account)
+}
+
+func TestLoadConfigIncludeErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	loop := filepath.Join(dir, "loop.yaml")
+	writeFile(t, loop, "include: loop.yaml\n")
+	_, err := LoadFromFile(loop)
+	assert.ErrorContains(t, err, "including itself")
+
+	duplicate := filepath.Join(dir, "duplicate.yaml")
+	writeFile(t, duplicate, "include: other.yaml\naccounts:\n  home:\n    type: memory\n")
+	writeFile(t, filepath.Join(dir, "other.yaml"), "accounts:\n  home:\n    type: memory\n")
+	_, err = LoadFromFile(duplicate)
+	assert.ErrorContains(t, err, "account home is already defined")
+
+	missing := filepath.Join(dir, "missing.yaml")
+	writeFile(t, missing, "include: not-there.yaml\n")
+	_, err = LoadFromFile(missing)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "imap.yaml")
+	writeFile(t, filename, `accounts:
+  work:
+    type: imap
+    serverURL: localhost:993
+    pasword: secret
+    historyStore: cloud
+  maildir:
+    type: maildir
+  local:
+    type: local
+    file: local.db
+    searchIndex: true
+  other:
+    type: pop3
+serve:
+  listen: localhost:1143
+  users:
+    backup:
+      password: secret
+      account: unknown
+`)
+
+	_, err := LoadFromFile(filename)
+	require.Error(t, err)
+	message := err.Error()
+	assert.Contains(t, message, filename+`:5: unknown key "pasword"`)
+	assert.Contains(t, message, filename+`:2: account work: missing required key "username"`)
+	assert.Contains(t, message, filename+`:2: account work: missing required key "password"`)
+	assert.Contains(t, message, filename+`:2: account work: unknown history store "cloud"`)
+	assert.Contains(t, message, filename+`:7: account maildir: missing required key "root"`)
+	assert.Contains(t, message, filename+`:13: account other: unknown account type "pop3"`)
+	assert.Contains(t, message, filename+`:18: user backup: account unknown not found`)
+	assert.NotContains(t, message, "account local")
+}
+
+func TestFindConfigFile(t *testing.T) {
+	configHome := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", configHome)
+	t.Chdir(t.TempDir())
+
+	_, err := FindConfigFile("imap.yaml")
+	assert.ErrorContains(t, err, "configuration file not found")
+
+	userFile := filepath.Join(configHome, "imap", "imap.yaml")
+	writeFile(t, userFile, "accounts:\n")
+	found, err := FindConfigFile("imap.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, userFile, found)
+
+	// the current directory comes first
+	writeFile(t, "imap.yaml", "accounts:\n")
+	found, err = FindConfigFile("imap.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, "imap.yaml", found)
+}
+
+func TestLoadExampleConfig(t *testing.T) {
+	config, err := LoadFromFile("../config-example.yaml")
+	require.NoError(t, err)
+	assert.NotEmpty(t, config.Accounts)
+}
+
+func TestLoadJobs(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "imap.yaml")
+	writeFile(t, filename, `accounts:
+  source:
+    type: memory
+  backup:
+    type: local
+    file: backup.db
+jobs:
+  archive:
+    source: source
+    destination: backup
+    mailboxes: [INBOX, "Projects*"]
+    exclude: [Projects.Old]
+    rename:
+      - from: Projects\.(.*)
+        to: Archive.$1
+    filter:
+      since: 2024-01-01
+      olderThan: 720h
+      maxSize: 10MB
+      excludeFlags: [\Deleted]
+    rateLimit: 512K
+    mode: move
+    schedule: "30 2 * * *"
+`)
+
+	config, err := LoadFromFile(filename)
+	require.NoError(t, err)
+	job := config.Jobs["archive"]
+	assert.Equal(t, ModeMove, job.Mode)
+	assert.Equal(t, "30 2 * * *", job.Schedule)
+	assert.Equal(t, Size(512*1024), job.RateLimit)
+	assert.Equal(t, Size(10*1024*1024), job.Filter.MaxSize)
+	assert.Equal(t, 720*time.Hour, job.Filter.OlderThan)
+	assert.Equal(t, 2024, job.Filter.Since.Year())
+	assert.Equal(t, []string{"\\Deleted"}, job.Filter.ExcludeFlags)
+
+	assert.True(t, job.MatchMailbox("INBOX"))
+	assert.True(t, job.MatchMailbox("Projects.New"))
+	assert.False(t, job.MatchMailbox("Projects.Old"))
+	assert.False(t, job.MatchMailbox("Sent"))
+
+	rename, err := job.Renamer()
+	require.NoError(t, err)
+	assert.Equal(t, "Archive.New", rename("Projects.New"))
+	assert.Equal(t, "INBOX", rename("INBOX"))
+}
+
+func TestLoadJobsValidation(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "imap.yaml")
+	writeFile(t, filename, `accounts:
+  source:
+    type: memory
+jobs:
+  broken:
+    source: source
+    mode: sync
+    rename:
+      - from: "(unclosed"
+        to: x
+    rateLimit: fast
+`)
+
+	_, err := LoadFromFile(filename)
+	require.Error(t, err)
+	assert.ErrorContains(t, err, `invalid size "FAST"`)
+
+	writeFile(t, filename, `accounts:
+  source:
+    type: memory
+jobs:
+  broken:
+    source: source
+    mode: sync
+    rename:
+      - from: "(unclosed"
+        to: x
+    schedule: "every day"
+`)
+	_, err = LoadFromFile(filename)
+	require.Error(t, err)
+	message := err.Error()
+	assert.Contains(t, message, filename+`:5: job broken: missing required key "destination"`)
+	assert.Contains(t, message, `job broken: unknown mode "sync"`)
+	assert.Contains(t, message, `job broken: invalid rename rule "(unclosed"`)
+	assert.Contains(t, message, `job broken: invalid schedule "every day"`)
+}
+
+func TestParseSize(t *testing.T) {
+	testData := []struct {
+		value string
+		size  Size
+	}{
+		{"0", 0},
+		{"1024", 1024},
+		{"2k", 2048},
+		{"2KB", 2048},
+		{"1 MB", 1024 * 1024},
+		{"3G", 3 * 1024 * 1024 * 1024},
+	}
+	for _, testItem := range testData {
+		size, err := ParseSize(testItem.value)
+		require.NoError(t, err)
+		assert.Equal(t, testItem.size, size)
+	}
+	_, err := ParseSize("1TB")
+	assert.Error(t, err)
+}
@@ -0,0 +1,177 @@
+package cfg
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/creativeprojects/imap/lib"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	credentialsAlgorithm = "xchacha20-poly1305"
+	credentialsSalt      = 16
+	argon2Time           = 3
+	argon2Memory         = 64 * 1024
+	argon2Threads        = 4
+	// limits of the key derivation parameters read from a file, so a corrupted file can't exhaust the memory
+	argon2MaxTime   = 16
+	argon2MaxMemory = 1024 * 1024
+)
+
+var (
+	ErrInvalidMasterPassphrase = errors.New("invalid master passphrase")
+	ErrCredentialNotFound      = errors.New("credential not found")
+)
+
+// Credentials is a set of named secrets saved in a file encrypted with a master passphrase
+type Credentials struct {
+	secrets map[string]string
+}
+
+// credentialsFile is the content of the file on disk: the secrets are encrypted with a key derived from the passphrase with Argon2id
+type credentialsFile struct {
+	Algorithm string
+	Salt      []byte
+	Time      uint32
+	Memory    uint32
+	Threads   uint8
+	// Data is the nonce followed by the encrypted secrets
+	Data []byte
+}
+
+// NewCredentials returns an empty set of credentials
+func NewCredentials() *Credentials {
+	return &Credentials{
+		secrets: make(map[string]string),
+	}
+}
+
+// LoadCredentials decrypts the credentials file with the master passphrase
+func LoadCredentials(filename string, passphrase []byte) (*Credentials, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read credentials file: %w", err)
+	}
+	file := credentialsFile{}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials file: %w", err)
+	}
+	if file.Algorithm != credentialsAlgorithm {
+		return nil, fmt.Errorf("unsupported encryption algorithm %q", file.Algorithm)
+	}
+	if file.Time == 0 || file.Time > argon2MaxTime || file.Memory == 0 || file.Memory > argon2MaxMemory || file.Threads == 0 {
+		return nil, fmt.Errorf("invalid credentials file: invalid key derivation parameters (time %d, memory %d KiB, threads %d)",
+			file.Time, file.Memory, file.Threads)
+	}
+	key := argon2.IDKey(passphrase, file.Salt, file.Time, file.Memory, file.Threads, chacha20poly1305.KeySize)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(file.Data) < aead.NonceSize() {
+		return nil, errors.New("invalid credentials file: encrypted data is too short")
+	}
+	nonce, encrypted := file.Data[:aead.NonceSize()], file.Data[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, encrypted, nil)
+	if err != nil {
+		return nil, ErrInvalidMasterPassphrase
+	}
+	credentials := NewCredentials()
+	err = json.Unmarshal(plain, &credentials.secrets)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials file: %w", err)
+	}
+	return credentials, nil
+}
+
+// Save encrypts the credentials with the master passphrase. Only the owner of the file can read it.
+func (c *Credentials) Save(filename string, passphrase []byte) error {
+	if len(passphrase) == 0 {
+		return errors.New("empty master passphrase")
+	}
+	file := credentialsFile{
+		Algorithm: credentialsAlgorithm,
+		Salt:      make([]byte, credentialsSalt),
+		Time:      argon2Time,
+		Memory:    argon2Memory,
+		Threads:   argon2Threads,
+	}
+	_, err := rand.Read(file.Salt)
+	if err != nil {
+		return err
+	}
+	key := argon2.IDKey(passphrase, file.Salt, file.Time, file.Memory, file.Threads, chacha20poly1305.KeySize)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+	plain, err := json.Marshal(c.secrets)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	file.Data = aead.Seal(nonce, nonce, plain, nil)
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(filename); dir != "" {
+		err = os.MkdirAll(dir, 0o700)
+		if err != nil {
+			return fmt.Errorf("cannot create credentials directory: %w", err)
+		}
+	}
+	err = lib.WriteFileAtomic(filename, 0o600, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot save credentials file: %w", err)
+	}
+	return nil
+}
+
+// Get returns the secret saved under this name
+func (c *Credentials) Get(name string) (string, error) {
+	secret, ok := c.secrets[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrCredentialNotFound, name)
+	}
+	return secret, nil
+}
+
+// Set saves the secret under this name (call Save to write the file)
+func (c *Credentials) Set(name, secret string) {
+	c.secrets[name] = secret
+}
+
+// Delete removes the secret: it returns false if it wasn't there
+func (c *Credentials) Delete(name string) bool {
+	_, ok := c.secrets[name]
+	delete(c.secrets, name)
+	return ok
+}
+
+// Names returns the sorted names of the secrets
+func (c *Credentials) Names() []string {
+	names := make([]string, 0, len(c.secrets))
+	for name := range c.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,132 @@
+package cfg
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentialsFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "credentials.json")
+	passphrase := []byte("master")
+
+	credentials := NewCredentials()
+	credentials.Set("work", "secret1")
+	credentials.Set("home", "secret2")
+	require.NoError(t, credentials.Save(filename, passphrase))
+
+	content, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), "secret1")
+
+	_, err = LoadCredentials(filename, []byte("wrong"))
+	assert.ErrorIs(t, err, ErrInvalidMasterPassphrase)
+
+	loaded, err := LoadCredentials(filename, passphrase)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"home", "work"}, loaded.Names())
+	secret, err := loaded.Get("work")
+	require.NoError(t, err)
+	assert.Equal(t, "secret1", secret)
+
+	assert.True(t, loaded.Delete("work"))
+	assert.False(t, loaded.Delete("work"))
+	_, err = loaded.Get("work")
+	assert.ErrorIs(t, err, ErrCredentialNotFound)
+}
+
+func TestCredentialsFileInvalidParameters(t *testing.T) {
+	dir := t.TempDir()
+	testData := []struct {
+		time    uint32
+		memory  uint32
+		threads uint8
+	}{
+		{0, argon2Memory, argon2Threads},
+		{argon2Time, 0, argon2Threads},
+		{argon2Time, argon2Memory, 0},
+		{argon2Time, math.MaxUint32, argon2Threads},
+		{math.MaxUint32, argon2Memory, argon2Threads},
+	}
+	for _, testItem := range testData {
+		filename := filepath.Join(dir, "credentials.json")
+		data, err := json.Marshal(credentialsFile{
+			Algorithm: credentialsAlgorithm,
+			Salt:      make([]byte, credentialsSalt),
+			Time:      testItem.time,
+			Memory:    testItem.memory,
+			Threads:   testItem.threads,
+			Data:      make([]byte, 64),
+		})
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filename, data, 0o600))
+
+		_, err = LoadCredentials(filename, []byte("master"))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid credentials file")
+	}
+}
+
+func TestResolvePassword(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("from file\n"), 0o600))
+	t.Setenv("TEST_IMAP_PASSWORD", "from env")
+
+	unlock := func() (*Credentials, error) {
+		credentials := NewCredentials()
+		credentials.Set("account", "from credentials")
+		return credentials, nil
+	}
+
+	testData := []struct {
+		account  Account
+		password string
+	}{
+		{Account{}, ""},
+		{Account{Password: "plain"}, "plain"},
+		{Account{PasswordFile: passwordFile}, "from file"},
+		{Account{PasswordEnv: "TEST_IMAP_PASSWORD"}, "from env"},
+		{Account{Credential: "account"}, "from credentials"},
+	}
+	if runtime.GOOS != "windows" {
+		testData = append(testData, struct {
+			account  Account
+			password string
+		}{Account{PasswordCommand: "printf 'from command\\nsecond line\\n'"}, "from command"})
+	}
+
+	for _, testItem := range testData {
+		password, err := testItem.account.ResolvePassword(context.Background(), unlock)
+		require.NoError(t, err)
+		assert.Equal(t, testItem.password, password)
+	}
+}
+
+func TestResolvePasswordErrors(t *testing.T) {
+	testData := []Account{
+		{Password: "plain", PasswordEnv: "TEST_IMAP_PASSWORD"},
+		{PasswordFile: filepath.Join(t.TempDir(), "missing")},
+		{PasswordEnv: "TEST_IMAP_PASSWORD_NOT_SET"},
+		{Credential: "account"},
+	}
+	if runtime.GOOS != "windows" {
+		testData = append(testData,
+			Account{PasswordCommand: "echo 'secret' && exit 1"},
+			Account{PasswordCommand: "true"},
+		)
+	}
+
+	for _, account := range testData {
+		_, err := account.ResolvePassword(context.Background(), nil)
+		require.Error(t, err)
+		assert.NotContains(t, err.Error(), "secret")
+	}
+}
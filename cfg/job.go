@@ -0,0 +1,142 @@
+package cfg
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// JobMode is what a job does with the messages
+type JobMode string
+
+const (
+	// ModeCopy copies the new messages (default)
+	ModeCopy JobMode = "copy"
+	// ModeMove copies the new messages, then deletes them from the source
+	ModeMove JobMode = "move"
+	// ModeMirror copies the new messages, and deletes from the destination the messages deleted from the source
+	ModeMirror JobMode = "mirror"
+)
+
+// Job is a named copy between two accounts
+type Job struct {
+	Source      string `yaml:"source"`
+	Destination string `yaml:"destination"`
+	// Mailboxes to copy (all when empty): names, or patterns where * matches any characters
+	Mailboxes []string `yaml:"mailboxes"`
+	// Exclude the mailboxes matching these names or patterns
+	Exclude []string `yaml:"exclude"`
+	// Rename the mailboxes in the destination: the first rule matching is used
+	Rename []RenameRule `yaml:"rename"`
+	// Filter selects the messages to copy
+	Filter MessageFilter `yaml:"filter"`
+	// RateLimit of the copy of the messages, per second (e.g. 512KB). The IMAP client downloads each message
+	// completely before it's copied: the average download speed is limited, but not the speed of each message.
+	RateLimit Size `yaml:"rateLimit"`
+	// Mode is copy (default), move or mirror
+	Mode JobMode `yaml:"mode"`
+	// Schedule of the job for the daemon: a cron expression, a descriptor like @daily, or an interval like @every 1h
+	Schedule string `yaml:"schedule"`
+}
+
+// RenameRule gives a new name to the mailboxes matching the regular expression From (on the whole name).
+// To can reference the groups of the expression, like $1.
+type RenameRule struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+// MessageFilter selects the messages to copy
+type MessageFilter struct {
+	Since        time.Time     `yaml:"since"`
+	Before       time.Time     `yaml:"before"`
+	OlderThan    time.Duration `yaml:"olderThan"`
+	NewerThan    time.Duration `yaml:"newerThan"`
+	MinSize      Size          `yaml:"minSize"`
+	MaxSize      Size          `yaml:"maxSize"`
+	Flags        []string      `yaml:"flags"`
+	ExcludeFlags []string      `yaml:"excludeFlags"`
+}
+
+// Size in bytes, written as a number with an optional unit: 1024, 512K, 10MB, 1G
+type Size uint64
+
+// UnmarshalYAML reads a number of bytes with an optional unit
+func (s *Size) UnmarshalYAML(value *yaml.Node) error {
+	size, err := ParseSize(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", value.Line, err)
+	}
+	*s = size
+	return nil
+}
+
+// ParseSize reads a number of bytes with an optional unit (K, M or G, with an optional B, in multiples of 1024)
+func ParseSize(value string) (Size, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	number := strings.TrimSuffix(value, "B")
+	multiplier := uint64(1)
+	switch {
+	case strings.HasSuffix(number, "K"):
+		multiplier = 1024
+	case strings.HasSuffix(number, "M"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(number, "G"):
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		number = number[:len(number)-1]
+	}
+	size, err := strconv.ParseUint(strings.TrimSpace(number), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return Size(size * multiplier), nil
+}
+
+// Renamer compiles the rename rules: the function returns the name of the mailbox in the destination
+func (j Job) Renamer() (func(name string) string, error) {
+	type rule struct {
+		from *regexp.Regexp
+		to   string
+	}
+	rules := make([]rule, len(j.Rename))
+	for i, rename := range j.Rename {
+		from, err := regexp.Compile("^(?:" + rename.From + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid rename rule %q: %w", rename.From, err)
+		}
+		rules[i] = rule{from: from, to: rename.To}
+	}
+	return func(name string) string {
+		for _, rule := range rules {
+			if rule.from.MatchString(name) {
+				return rule.from.ReplaceAllString(name, rule.to)
+			}
+		}
+		return name
+	}, nil
+}
+
+// MatchMailbox returns true when the mailbox is selected by the job
+func (j Job) MatchMailbox(name string) bool {
+	if len(j.Mailboxes) > 0 && !matchAny(j.Mailboxes, name) {
+		return false
+	}
+	return !matchAny(j.Exclude, name)
+}
+
+// matchAny returns true if the name matches one of the patterns, where * matches any characters
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		expression := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+		if matched, _ := regexp.MatchString(expression, name); matched {
+			return true
+		}
+	}
+	return false
+}
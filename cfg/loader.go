@@ -0,0 +1,317 @@
+package cfg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// includeKey lists the other configuration files to load, relative to the file including them
+const includeKey = "include"
+
+// envPattern matches ${VAR} and ${VAR:-default}
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// position of a value in a configuration file
+type position struct {
+	file string
+	line int
+}
+
+func (p position) String() string {
+	return fmt.Sprintf("%s:%d", p.file, p.line)
+}
+
+// loader reads a configuration file and the files it includes
+type loader struct {
+	// including contains the files being loaded, to detect an include loop
+	including map[string]bool
+	// positions of the accounts ("accounts.name"), users ("serve.users.name") and jobs ("jobs.name") in the files
+	positions map[string]position
+	// errs are the schema errors found so far
+	errs []error
+}
+
+func newLoader() *loader {
+	return &loader{
+		including: make(map[string]bool),
+		positions: make(map[string]position),
+		errs:      make([]error, 0),
+	}
+}
+
+func (l *loader) load(filename string) (*Config, error) {
+	absolute, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	if l.including[absolute] {
+		return nil, fmt.Errorf("%s: file is including itself", filename)
+	}
+	l.including[absolute] = true
+	defer delete(l.including, absolute)
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	document := &yaml.Node{}
+	err = yaml.Unmarshal(data, document)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	config := newConfig()
+	if len(document.Content) == 0 {
+		// empty file
+		return config, nil
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s:%d: the configuration should be a map of keys and values", filename, root.Line)
+	}
+	expandNode(root)
+	includes, err := extractIncludes(filename, root)
+	if err != nil {
+		return nil, err
+	}
+	l.checkKeys(filename, root, reflect.TypeFor[Config]())
+	err = root.Decode(config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	l.savePositions(filename, root)
+
+	for _, include := range includes {
+		included, err := l.load(include)
+		if err != nil {
+			return nil, err
+		}
+		err = mergeConfig(config, included)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", include, err)
+		}
+	}
+	return config, nil
+}
+
+// checkKeys reports the keys which are not in the configuration structure
+func (l *loader) checkKeys(filename string, node *yaml.Node, typ reflect.Type) {
+	if node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			// the type error is reported when decoding
+			return
+		}
+		fields := yamlFields(typ)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Value == "<<" {
+				// merge key
+				l.checkKeys(filename, value, typ)
+				continue
+			}
+			field, ok := fields[key.Value]
+			if !ok {
+				l.errs = append(l.errs, fmt.Errorf("%s:%d: unknown key %q", filename, key.Line, key.Value))
+				continue
+			}
+			l.checkKeys(filename, value, field.Type)
+		}
+
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 1; i < len(node.Content); i += 2 {
+			l.checkKeys(filename, node.Content[i], typ.Elem())
+		}
+
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return
+		}
+		for _, item := range node.Content {
+			l.checkKeys(filename, item, typ.Elem())
+		}
+	}
+}
+
+// savePositions keeps the line of each account and user, to report the missing fields
+func (l *loader) savePositions(filename string, root *yaml.Node) {
+	save := func(prefix string, node *yaml.Node) {
+		if node == nil || node.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := prefix + node.Content[i].Value
+			if _, found := l.positions[key]; !found {
+				l.positions[key] = position{file: filename, line: node.Content[i].Line}
+			}
+		}
+	}
+	save("accounts.", mapValue(root, "accounts"))
+	save("serve.users.", mapValue(mapValue(root, "serve"), "users"))
+	save("jobs.", mapValue(root, "jobs"))
+}
+
+// yamlFields returns the fields of the structure by their yaml name
+func yamlFields(typ reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField, typ.NumField())
+	for i := range typ.NumField() {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field
+	}
+	return fields
+}
+
+// mapValue returns the value of the key in the mapping node, or nil
+func mapValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// extractIncludes removes the include key from the root node, and returns the files to include
+func extractIncludes(filename string, root *yaml.Node) ([]string, error) {
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != includeKey {
+			continue
+		}
+		value := root.Content[i+1]
+		root.Content = append(root.Content[:i], root.Content[i+2:]...)
+
+		var names []string
+		switch value.Kind {
+		case yaml.ScalarNode:
+			names = []string{value.Value}
+		case yaml.SequenceNode:
+			for _, item := range value.Content {
+				if item.Kind != yaml.ScalarNode {
+					return nil, fmt.Errorf("%s:%d: %s should be a file name or a list of file names", filename, item.Line, includeKey)
+				}
+				names = append(names, item.Value)
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: %s should be a file name or a list of file names", filename, value.Line, includeKey)
+		}
+		dir := filepath.Dir(filename)
+		for i, name := range names {
+			if home, err := os.UserHomeDir(); err == nil && strings.HasPrefix(name, "~/") {
+				name = filepath.Join(home, name[2:])
+			}
+			if !filepath.IsAbs(name) {
+				name = filepath.Join(dir, name)
+			}
+			names[i] = name
+		}
+		return names, nil
+	}
+	return nil, nil
+}
+
+// expandNode replaces ${VAR} and ${VAR:-default} with the value of the environment variable in all the values
+func expandNode(node *yaml.Node) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		expanded := expandEnv(node.Value)
+		if expanded == node.Value {
+			return
+		}
+		node.Value = expanded
+		if node.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+			// the type of an unquoted value depends on the expanded value (e.g. a boolean)
+			node.Tag = ""
+		}
+	case yaml.MappingNode:
+		// the keys are not expanded
+		for i := 1; i < len(node.Content); i += 2 {
+			expandNode(node.Content[i])
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			expandNode(item)
+		}
+	}
+}
+
+func expandEnv(value string) string {
+	return envPattern.ReplaceAllStringFunc(value, func(match string) string {
+		parts := envPattern.FindStringSubmatch(match)
+		env := os.Getenv(parts[1])
+		if env == "" && parts[2] != "" {
+			return parts[3]
+		}
+		return env
+	})
+}
+
+// mergeConfig adds the configuration included into the config. The values already set in config are kept.
+func mergeConfig(config, included *Config) error {
+	for name, account := range included.Accounts {
+		if config.Accounts == nil {
+			config.Accounts = make(map[string]Account)
+		}
+		if _, found := config.Accounts[name]; found {
+			return fmt.Errorf("account %s is already defined", name)
+		}
+		config.Accounts[name] = account
+	}
+	for name, user := range included.Serve.Users {
+		if config.Serve.Users == nil {
+			config.Serve.Users = make(map[string]ServeUser)
+		}
+		if _, found := config.Serve.Users[name]; found {
+			return fmt.Errorf("user %s is already defined", name)
+		}
+		config.Serve.Users[name] = user
+	}
+	for name, job := range included.Jobs {
+		if config.Jobs == nil {
+			config.Jobs = make(map[string]Job)
+		}
+		if _, found := config.Jobs[name]; found {
+			return fmt.Errorf("job %s is already defined", name)
+		}
+		config.Jobs[name] = job
+	}
+	if config.Serve.Listen == "" {
+		config.Serve.Listen = included.Serve.Listen
+	}
+	if config.Serve.TLSCert == "" {
+		config.Serve.TLSCert = included.Serve.TLSCert
+	}
+	if config.Serve.TLSKey == "" {
+		config.Serve.TLSKey = included.Serve.TLSKey
+	}
+	if config.Credentials == "" {
+		config.Credentials = included.Credentials
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package cfg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// PasswordSource returns the name of the setting holding the password of the account, without revealing the secret.
+// It returns an empty string when no password is configured.
+func (a Account) PasswordSource() (string, error) {
+	sources := make([]string, 0, 1)
+	if a.Password != "" {
+		sources = append(sources, "password")
+	}
+	if a.PasswordCommand != "" {
+		sources = append(sources, "passwordCommand")
+	}
+	if a.PasswordFile != "" {
+		sources = append(sources, "passwordFile")
+	}
+	if a.PasswordEnv != "" {
+		sources = append(sources, "passwordEnv")
+	}
+	if a.Credential != "" {
+		sources = append(sources, "credential")
+	}
+	if len(sources) > 1 {
+		return "", fmt.Errorf("only one of %s can be used", strings.Join(sources, ", "))
+	}
+	if len(sources) == 0 {
+		return "", nil
+	}
+	return sources[0], nil
+}
+
+// ResolvePassword returns the password of the account from the source configured.
+// The credentials file is only unlocked when the account needs it.
+// The errors never contain the secret.
+func (a Account) ResolvePassword(ctx context.Context, unlock func() (*Credentials, error)) (string, error) {
+	source, err := a.PasswordSource()
+	if err != nil {
+		return "", err
+	}
+	switch source {
+	case "password":
+		return a.Password, nil
+
+	case "passwordCommand":
+		return runPasswordCommand(ctx, a.PasswordCommand)
+
+	case "passwordFile":
+		content, err := os.ReadFile(a.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("cannot read password file: %w", err)
+		}
+		password := strings.TrimRight(string(content), "\r\n")
+		if password == "" {
+			return "", fmt.Errorf("password file %q is empty", a.PasswordFile)
+		}
+		return password, nil
+
+	case "passwordEnv":
+		password := os.Getenv(a.PasswordEnv)
+		if password == "" {
+			return "", fmt.Errorf("environment variable %s is not set", a.PasswordEnv)
+		}
+		return password, nil
+
+	case "credential":
+		if unlock == nil {
+			return "", errors.New("no credentials file available")
+		}
+		credentials, err := unlock()
+		if err != nil {
+			return "", err
+		}
+		return credentials.Get(a.Credential)
+	}
+	return "", nil
+}
+
+// runPasswordCommand runs the command in a shell and returns the first line of its output
+func runPasswordCommand(ctx context.Context, command string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return "", fmt.Errorf("password command failed: %w: %s", err, message)
+		}
+		return "", fmt.Errorf("password command failed: %w", err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	password := ""
+	if scanner.Scan() {
+		password = strings.TrimRight(scanner.Text(), "\r")
+	}
+	if password == "" {
+		return "", errors.New("password command returned an empty password")
+	}
+	return password, nil
+}
@@ -1,38 +1,93 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/creativeprojects/imap/cfg"
 	"github.com/creativeprojects/imap/lib"
 	"github.com/creativeprojects/imap/storage"
 	"github.com/creativeprojects/imap/storage/local"
 	"github.com/creativeprojects/imap/storage/mdir"
+	"github.com/creativeprojects/imap/storage/mem"
 	"github.com/creativeprojects/imap/storage/remote"
 )
 
-func NewBackend(config cfg.Account, logger lib.Logger) (storage.Backend, error) {
+// NewBackend opens the account: the context can cancel the connection to an IMAP server
+func NewBackend(ctx context.Context, config cfg.Account, logger lib.Logger) (storage.Backend, error) {
 	if logger == nil {
 		logger = &lib.NoLog{}
 	}
 	switch config.Type {
 	case cfg.IMAP:
+		// the password is only read (or the credentials file unlocked) when the account is used
+		password, err := config.ResolvePassword(ctx, unlockCredentials)
+		if err != nil {
+			return nil, fmt.Errorf("cannot get password: %w", err)
+		}
 		wd, _ := os.Getwd()
-		return remote.NewImap(remote.Config{
+		return remote.NewImapWithContext(ctx, remote.Config{
 			ServerURL:           config.ServerURL,
 			Username:            config.Username,
-			Password:            config.Password,
+			Password:            password,
 			SkipTLSVerification: config.SkipTLSVerification,
 			CacheDir:            filepath.Join(wd, ".cache"),
+			HistoryStore:        remote.HistoryStore(config.HistoryStore),
 			DebugLogger:         logger,
 		})
 	case cfg.LOCAL:
-		return local.NewBoltStoreWithLogger(config.File, logger)
+		return local.NewBoltStoreWithConfig(local.Config{
+			Filename:    config.File,
+			DebugLogger: logger,
+			Passphrase:  config.Passphrase,
+			KeyFile:     config.KeyFile,
+			SearchIndex: config.SearchIndex,
+			LockTimeout: localLockTimeout(),
+		})
 	case cfg.MAILDIR:
-		return mdir.NewWithLogger(config.Root, logger)
+		return mdir.NewWithConfig(mdir.Config{
+			Root:        config.Root,
+			Layout:      mdir.Layout(config.Layout),
+			DebugLogger: logger,
+		})
+	case cfg.MEMORY:
+		return mem.NewWithConfig(mem.Config{
+			Snapshot:    config.File,
+			DebugLogger: logger,
+		})
 	default:
 		return nil, fmt.Errorf("unsupported account type %q", config.Type)
 	}
 }
+
+// ReadAccountID returns the ID of the account without opening the backend: nothing is created or changed,
+// and the accounts which were never used have no ID yet.
+func ReadAccountID(config cfg.Account) (string, error) {
+	switch config.Type {
+	case cfg.IMAP:
+		return lib.AccountTag(config.ServerURL, config.Username), nil
+	case cfg.LOCAL:
+		return local.ReadAccountID(config.File)
+	case cfg.MAILDIR:
+		return mdir.ReadAccountID(config.Root)
+	case cfg.MEMORY:
+		if config.File == "" {
+			// a new ID is given each time
+			return "", lib.ErrNoAccountID
+		}
+		return mem.ReadAccountID(config.File)
+	default:
+		return "", fmt.Errorf("unsupported account type %q", config.Type)
+	}
+}
+
+// localLockTimeout converts the lock timeout option for the local database, where zero is the default timeout
+func localLockTimeout() time.Duration {
+	if global.lockTimeout <= 0 {
+		return -1
+	}
+	return global.lockTimeout
+}
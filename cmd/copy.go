@@ -5,27 +5,52 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"os"
+	"reflect"
 	"time"
 
+	"github.com/creativeprojects/imap/cfg"
 	"github.com/creativeprojects/imap/lib"
 	"github.com/creativeprojects/imap/mailbox"
 	"github.com/creativeprojects/imap/storage"
 	"github.com/creativeprojects/imap/term"
 	"github.com/pterm/pterm"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
-var copyCmd = &cobra.Command{
-	Use:   "copy",
-	Short: "Copy an account mailboxes to another one",
-	RunE:  runCopy,
+type copyFlags struct {
+	checkpointMessages int
+	checkpointInterval time.Duration
+	retryAttempts      int
+	retryDelay         time.Duration
+	retryMaxDelay      time.Duration
 }
 
+var (
+	copyCmd = &cobra.Command{
+		Use:   "copy",
+		Short: "Copy an account mailboxes to another one",
+		RunE:  runCopy,
+	}
+	copyOptions copyFlags
+)
+
 func init() {
+	addCopyFlags(copyCmd.Flags())
 	rootCmd.AddCommand(copyCmd)
 }
 
+// addCopyFlags adds the flags shared by the commands copying messages
+func addCopyFlags(flag *pflag.FlagSet) {
+	flag.IntVar(&copyOptions.checkpointMessages, "checkpoint-messages", 100, "save the history after this number of messages copied (0 to disable)")
+	flag.DurationVar(&copyOptions.checkpointInterval, "checkpoint-interval", time.Minute, "save the history at least this often while copying (0 to disable)")
+	flag.IntVar(&copyOptions.retryAttempts, "retry-attempts", 3, "number of attempts to save a message after a transient error (1 to disable)")
+	flag.DurationVar(&copyOptions.retryDelay, "retry-delay", time.Second, "delay before the first retry, doubled after each attempt")
+	flag.DurationVar(&copyOptions.retryMaxDelay, "retry-max-delay", 30*time.Second, "maximum delay between two attempts")
+}
+
 func runCopy(cmd *cobra.Command, args []string) error {
 	if len(args) < 1 {
 		return errors.New("missing account names (source and destination)")
@@ -33,6 +58,27 @@ func runCopy(cmd *cobra.Command, args []string) error {
 		return errors.New("missing destination account name")
 	}
 
+	_, err := runJob(cmd.Context(), cfg.Job{
+		Source:      args[0],
+		Destination: args[1],
+	})
+	return err
+}
+
+// jobSummary counts what was done by a job
+type jobSummary struct {
+	mailboxes int
+	copied    int
+	skipped   int
+	failed    int
+	deleted   int
+	// errors is the number of mailboxes which could not be copied completely
+	errors int
+}
+
+// runJob copies the mailboxes of the source account to the destination account.
+// The errors on a mailbox are displayed, and the job continues with the next mailbox.
+func runJob(ctx context.Context, job cfg.Job) (*jobSummary, error) {
 	var sourceLogger lib.Logger
 	var destLogger lib.Logger
 
@@ -41,77 +87,218 @@ func runCopy(cmd *cobra.Command, args []string) error {
 		destLogger = log.New(os.Stdout, "dest: ", 0)
 	}
 
-	source := args[0]
-	accountSource, ok := config.Accounts[source]
+	rename, err := job.Renamer()
+	if err != nil {
+		return nil, err
+	}
+
+	accountSource, ok := config.Accounts[job.Source]
 	if !ok {
-		return fmt.Errorf("source account not found: %s", source)
+		return nil, fmt.Errorf("source account not found: %s", job.Source)
 	}
-	backendSource, err := NewBackend(accountSource, sourceLogger)
+	backendSource, err := NewBackend(ctx, accountSource, sourceLogger)
 	if err != nil {
-		return fmt.Errorf("cannot open source backend: %w", err)
+		return nil, fmt.Errorf("cannot open source backend: %w", err)
 	}
+	defer backendSource.Close()
 
-	destination := args[1]
-	accountDest, ok := config.Accounts[destination]
+	accountDest, ok := config.Accounts[job.Destination]
 	if !ok {
-		return fmt.Errorf("destination account not found: %s", destination)
+		return nil, fmt.Errorf("destination account not found: %s", job.Destination)
 	}
-	backendDest, err := NewBackend(accountDest, destLogger)
+	backendDest, err := NewBackend(ctx, accountDest, destLogger)
 	if err != nil {
-		return fmt.Errorf("cannot open destination backend: %w", err)
+		return nil, fmt.Errorf("cannot open destination backend: %w", err)
 	}
+	defer backendDest.Close()
 
-	mailboxes, err := backendSource.ListMailbox()
+	// another copy to the same account would read the same history and copy the same messages
+	if locker, ok := backendDest.(storage.AccountLocker); ok {
+		release, err := locker.LockAccount(ctx, global.lockTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("destination account %s is busy: %w", job.Destination, err)
+		}
+		defer release()
+	}
+
+	mailboxes, err := backendSource.ListMailbox(ctx)
 	if err != nil {
-		return fmt.Errorf("cannot list source account mailbox: %w", err)
+		return nil, fmt.Errorf("cannot list source account mailbox: %w", err)
+	}
+
+	if job.Mode == cfg.ModeMove || job.Mode == cfg.ModeMirror {
+		err = checkMergedMailboxes(job, mailboxes, rename)
+		if err != nil {
+			return nil, err
+		}
 	}
 
+	summary := &jobSummary{}
 	for _, mbox := range mailboxes {
-		status, err := backendSource.SelectMailbox(mbox)
+		if !job.MatchMailbox(mbox.Name) {
+			continue
+		}
+		handle, err := backendSource.OpenMailbox(ctx, mbox)
 		if err != nil {
 			continue
 		}
-		if status.Messages == 0 {
+		status := handle.Status()
+		// the mailbox is opened again to copy the messages
+		_ = handle.Close()
+		if status.Messages == 0 && job.Mode != cfg.ModeMirror {
 			// it's empty so don't bother
 			continue
 		}
+		summary.mailboxes++
 
-		// term.Infof("copying mailbox %s", mbox.Name)
-
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
+		destination := mbox
+		destination.Name = rename(mbox.Name)
 
 		// load mailbox history
-		history, err := backendDest.GetHistory(mbox)
+		history, err := backendDest.GetHistory(ctx, destination)
 		if err != nil {
-			term.Infof("\nno history found on mailbox %s", mbox.Name)
+			term.Infof("\nno history found on mailbox %s", destination.Name)
 		}
+		// the messages which failed last time are fetched once more
+		failed := mailbox.FindFailedEntries(backendSource.AccountID(), history)
 		var pbar *pterm.ProgressbarPrinter
-		if !global.quiet && !global.verbose {
-			pbar, _ = pterm.DefaultProgressbar.WithTitle(mbox.Name).WithTotal(int(status.Messages)).Start()
+		if !global.quiet && !global.verbose && !global.noProgress {
+			pbar, _ = pterm.DefaultProgressbar.WithTitle(mbox.Name).WithTotal(int(status.Messages) + len(failed)).Start()
+		}
+		// the history is saved while copying, and we still save it if an error occurred or the copy was interrupted
+		checkpoint := &storage.Checkpoint{
+			Messages: copyOptions.checkpointMessages,
+			Interval: copyOptions.checkpointInterval,
+			Save: func(entries []mailbox.HistoryEntry) error {
+				action := mailbox.HistoryAction{
+					SourceAccountTag: backendSource.AccountID(),
+					SourceMailbox:    mbox.Name,
+					Date:             time.Now(),
+					Action:           mailbox.ActionCopy,
+					UidValidity:      status.UidValidity,
+					Entries:          entries,
+				}
+				// the context is already cancelled when the copy was interrupted
+				return backendDest.AddToHistory(context.WithoutCancel(ctx), destination, action)
+			},
 		}
-		entries, err := storage.CopyMessages(ctx, backendSource, backendDest, mbox, newProgresser(pbar), history)
+		result, err := storage.CopyMessagesWithOptions(ctx, backendSource, backendDest, mbox, newProgresser(pbar), history, storage.CopyOptions{
+			Checkpoint: checkpoint,
+			Retry: storage.RetryPolicy{
+				Attempts: copyOptions.retryAttempts,
+				Delay:    copyOptions.retryDelay,
+				MaxDelay: copyOptions.retryMaxDelay,
+			},
+			Destination: destination,
+			Filter:      newMessageFilter(job.Filter),
+			RateLimit:   float64(job.RateLimit),
+		})
 		if pbar != nil {
 			pbar.Add(pbar.Total - pbar.Current)
 			_, _ = pbar.Stop()
 		}
-		if err != nil {
+		if err != nil && ctx.Err() == nil {
 			term.Error(err.Error())
+			summary.errors++
 		}
-		// we still save history even if an error occurred
-		if len(entries) > 0 {
+		if result != nil {
+			summary.copied += len(result.Entries)
+			summary.skipped += result.Skipped
+			summary.failed += len(result.Failed)
+		}
+		if result != nil && len(result.Failed) > 0 {
+			term.Warnf("%d messages could not be copied from mailbox %s: they will be tried again on the next copy", len(result.Failed), mbox.Name)
 			action := mailbox.HistoryAction{
 				SourceAccountTag: backendSource.AccountID(),
+				SourceMailbox:    mbox.Name,
 				Date:             time.Now(),
-				Action:           mailbox.ActionCopy,
+				Action:           mailbox.ActionFailed,
 				UidValidity:      status.UidValidity,
-				Entries:          entries,
+				Entries:          result.Failed,
 			}
-			err = backendDest.AddToHistory(mbox, action)
+			err = backendDest.AddToHistory(context.WithoutCancel(ctx), destination, action)
 			if err != nil {
+				term.Errorf("cannot save the list of failed messages: %s", err)
+			}
+		}
+		if ctx.Err() != nil {
+			return summary, fmt.Errorf("copy of mailbox %s interrupted: %w", mbox.Name, ctx.Err())
+		}
+
+		if job.Mode == cfg.ModeMove || job.Mode == cfg.ModeMirror {
+			deleted, err := syncDeletions(ctx, job.Mode, backendSource, backendDest, mbox, destination, status.UidValidity)
+			summary.deleted += deleted
+			if err != nil {
+				if ctx.Err() != nil {
+					return summary, fmt.Errorf("%s of mailbox %s interrupted: %w", job.Mode, mbox.Name, ctx.Err())
+				}
 				term.Error(err.Error())
+				summary.errors++
 			}
 		}
 	}
+	return summary, nil
+}
+
+// checkMergedMailboxes returns an error when the rename rules copy several source mailboxes to the same destination mailbox:
+// the deletions of a move or a mirror cannot tell which source mailbox a message of the destination was copied from
+func checkMergedMailboxes(job cfg.Job, mailboxes []mailbox.Info, rename func(string) string) error {
+	sources := make(map[string]string, len(mailboxes))
+	for _, mbox := range mailboxes {
+		if !job.MatchMailbox(mbox.Name) {
+			continue
+		}
+		destination := rename(mbox.Name)
+		if other, found := sources[destination]; found {
+			return fmt.Errorf("mode %s cannot copy both mailboxes %s and %s to mailbox %s: change the rename rules", job.Mode, other, mbox.Name, destination)
+		}
+		sources[destination] = mbox.Name
+	}
 	return nil
 }
+
+// syncDeletions deletes the messages copied from the source (move), or the messages deleted from the source in the destination (mirror)
+func syncDeletions(ctx context.Context, mode cfg.JobMode, backendSource, backendDest storage.Backend, mbox, destination mailbox.Info, uidValidity uint32) (int, error) {
+	// the history now contains the messages just copied
+	history, err := backendDest.GetHistory(ctx, destination)
+	if err != nil {
+		return 0, fmt.Errorf("cannot load history of mailbox %s: %w", destination.Name, err)
+	}
+	if mode == cfg.ModeMove {
+		return storage.DeleteCopiedMessages(ctx, backendSource, mbox, history)
+	}
+	deleted, err := storage.MirrorDeletions(ctx, backendSource, backendDest, mbox, destination, history)
+	if len(deleted) > 0 {
+		action := mailbox.HistoryAction{
+			SourceAccountTag: backendSource.AccountID(),
+			SourceMailbox:    mbox.Name,
+			Date:             time.Now(),
+			Action:           mailbox.ActionDelete,
+			UidValidity:      uidValidity,
+			Entries:          deleted,
+		}
+		saveErr := backendDest.AddToHistory(context.WithoutCancel(ctx), destination, action)
+		if saveErr != nil {
+			err = errors.Join(err, fmt.Errorf("cannot save the messages deleted in history: %w", saveErr))
+		}
+	}
+	return len(deleted), err
+}
+
+// newMessageFilter returns nil when the filter selects all the messages
+func newMessageFilter(filter cfg.MessageFilter) *storage.MessageFilter {
+	messageFilter := &storage.MessageFilter{
+		Since:        filter.Since,
+		Before:       filter.Before,
+		OlderThan:    filter.OlderThan,
+		NewerThan:    filter.NewerThan,
+		MinSize:      uint32(min(filter.MinSize, math.MaxUint32)),
+		MaxSize:      uint32(min(filter.MaxSize, math.MaxUint32)),
+		Flags:        filter.Flags,
+		ExcludeFlags: filter.ExcludeFlags,
+	}
+	if reflect.ValueOf(*messageFilter).IsZero() {
+		return nil
+	}
+	return messageFilter
+}
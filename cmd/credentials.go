@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/creativeprojects/imap/cfg"
+	"github.com/creativeprojects/imap/term"
+	"github.com/spf13/cobra"
+	xterm "golang.org/x/term"
+)
+
+// masterPassphraseEnv is the environment variable used instead of asking for the master passphrase
+const masterPassphraseEnv = "IMAP_MASTER_PASSPHRASE"
+
+var (
+	credentialsCmd = &cobra.Command{
+		Use:   "credentials",
+		Short: "Manage the passwords saved in the encrypted credentials file",
+	}
+	credentialsListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List the names of the passwords in the credentials file",
+		RunE:  runCredentialsList,
+	}
+	credentialsSetCmd = &cobra.Command{
+		Use:   "set",
+		Short: "Add or replace a password in the credentials file (the file is created if needed)",
+		RunE:  runCredentialsSet,
+	}
+	credentialsRemoveCmd = &cobra.Command{
+		Use:   "remove",
+		Short: "Remove a password from the credentials file",
+		RunE:  runCredentialsRemove,
+	}
+	// credentials are unlocked the first time an account needs them
+	credentials           *cfg.Credentials
+	credentialsPassphrase []byte
+)
+
+func init() {
+	credentialsCmd.AddCommand(credentialsListCmd)
+	credentialsCmd.AddCommand(credentialsRemoveCmd)
+	credentialsCmd.AddCommand(credentialsSetCmd)
+	rootCmd.AddCommand(credentialsCmd)
+}
+
+// unlockCredentials loads the credentials file with the master passphrase from the environment, or typed on the terminal.
+// The passphrase of the last unlock is used again when the file is reloaded.
+func unlockCredentials() (*cfg.Credentials, error) {
+	if credentials != nil {
+		return credentials, nil
+	}
+	if config.Credentials == "" {
+		return nil, errors.New("no credentials file in the configuration")
+	}
+	var err error
+	passphrase := credentialsPassphrase
+	if passphrase == nil {
+		passphrase, err = readMasterPassphrase()
+		if err != nil {
+			return nil, err
+		}
+	}
+	credentials, err = cfg.LoadCredentials(config.Credentials, passphrase)
+	if err != nil {
+		// the master passphrase may have changed: it's asked again next time
+		credentialsPassphrase = nil
+		return nil, err
+	}
+	credentialsPassphrase = passphrase
+	return credentials, nil
+}
+
+func readMasterPassphrase() ([]byte, error) {
+	if passphrase := os.Getenv(masterPassphraseEnv); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	if !xterm.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, fmt.Errorf("master passphrase needed: set the %s environment variable", masterPassphraseEnv)
+	}
+	fmt.Print("Master passphrase: ")
+	passphrase, err := xterm.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read passphrase: %w", err)
+	}
+	return passphrase, nil
+}
+
+func runCredentialsList(cmd *cobra.Command, args []string) error {
+	credentials, err := unlockCredentials()
+	if err != nil {
+		return err
+	}
+	for _, name := range credentials.Names() {
+		term.Info(name)
+	}
+	return nil
+}
+
+func runCredentialsSet(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 {
+		return errors.New("missing credential name")
+	}
+	if config.Credentials == "" {
+		return errors.New("no credentials file in the configuration")
+	}
+	var err error
+	if _, statErr := os.Stat(config.Credentials); statErr == nil {
+		_, err = unlockCredentials()
+		if err != nil {
+			return err
+		}
+	} else {
+		term.Infof("creating credentials file %s", config.Credentials)
+		passphrase := []byte(os.Getenv(masterPassphraseEnv))
+		if len(passphrase) == 0 {
+			newPassphrase, err := readNewPassphrase()
+			if err != nil {
+				return err
+			}
+			passphrase = []byte(newPassphrase)
+		}
+		credentials = cfg.NewCredentials()
+		credentialsPassphrase = passphrase
+	}
+	secret, err := readSecret(args[0])
+	if err != nil {
+		return err
+	}
+	credentials.Set(args[0], secret)
+	err = credentials.Save(config.Credentials, credentialsPassphrase)
+	if err != nil {
+		return err
+	}
+	term.Infof("password %s saved", args[0])
+	return nil
+}
+
+func runCredentialsRemove(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 {
+		return errors.New("missing credential name")
+	}
+	credentials, err := unlockCredentials()
+	if err != nil {
+		return err
+	}
+	if !credentials.Delete(args[0]) {
+		return fmt.Errorf("%w: %s", cfg.ErrCredentialNotFound, args[0])
+	}
+	err = credentials.Save(config.Credentials, credentialsPassphrase)
+	if err != nil {
+		return err
+	}
+	term.Infof("password %s removed", args[0])
+	return nil
+}
+
+// readSecret reads the password on the terminal, or the first line of the standard input when it's not a terminal
+func readSecret(name string) (string, error) {
+	if !xterm.IsTerminal(int(os.Stdin.Fd())) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if err != nil {
+				return "", fmt.Errorf("cannot read password: %w", err)
+			}
+			return "", errors.New("empty password")
+		}
+		return line, nil
+	}
+	fmt.Printf("Password for %s: ", name)
+	secret, err := xterm.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return "", fmt.Errorf("cannot read password: %w", err)
+	}
+	if len(secret) == 0 {
+		return "", errors.New("empty password")
+	}
+	return string(secret), nil
+}
@@ -0,0 +1,306 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/creativeprojects/imap/cfg"
+	"github.com/creativeprojects/imap/schedule"
+	"github.com/creativeprojects/imap/term"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+type daemonFlags struct {
+	runAtStart bool
+}
+
+var (
+	daemonCmd = &cobra.Command{
+		Use:   "daemon",
+		Short: "Run the jobs of the configuration on their schedule (send SIGHUP to reload the configuration)",
+		RunE:  runDaemon,
+	}
+	daemonOptions daemonFlags
+)
+
+func init() {
+	flag := daemonCmd.Flags()
+	flag.BoolVar(&daemonOptions.runAtStart, "run-at-start", false, "run all the scheduled jobs once when starting")
+	addCopyFlags(flag)
+	rootCmd.AddCommand(daemonCmd)
+}
+
+// scheduledJob is a job waiting for its next run
+type scheduledJob struct {
+	name     string
+	job      cfg.Job
+	schedule schedule.Schedule
+	next     time.Time
+}
+
+// jobStatus is the result of the last run of a job
+type jobStatus struct {
+	runs     int
+	start    time.Time
+	duration time.Duration
+	summary  *jobSummary
+	err      error
+}
+
+// daemon runs the scheduled jobs one at a time: a job is never started while another one is running
+type daemon struct {
+	jobs   map[string]*scheduledJob
+	status map[string]*jobStatus
+	// queue contains the jobs due, waiting for the running job to finish
+	queue []string
+}
+
+func runDaemon(cmd *cobra.Command, args []string) error {
+	// there's nobody to look at the progress bars
+	global.noProgress = true
+
+	d := &daemon{
+		status: make(map[string]*jobStatus),
+	}
+	d.schedule(config.Jobs, time.Now())
+	if len(d.jobs) == 0 {
+		return errors.New("no job with a schedule in the configuration")
+	}
+	if daemonOptions.runAtStart {
+		d.queue = slices.Sorted(maps.Keys(d.jobs))
+	}
+	d.display()
+	return d.run(cmd.Context())
+}
+
+// schedule replaces the jobs with the ones of the configuration. The next run of a job is kept when its schedule didn't change.
+func (d *daemon) schedule(jobs map[string]cfg.Job, now time.Time) {
+	scheduled := make(map[string]*scheduledJob, len(jobs))
+	for _, name := range slices.Sorted(maps.Keys(jobs)) {
+		job := jobs[name]
+		if job.Schedule == "" {
+			term.Debugf("job %s has no schedule", name)
+			continue
+		}
+		jobSchedule, err := schedule.Parse(job.Schedule)
+		if err != nil {
+			// the configuration was validated when loaded
+			term.Errorf("job %s: invalid schedule %q: %s", name, job.Schedule, err)
+			continue
+		}
+		next := jobSchedule.Next(now)
+		if previous, found := d.jobs[name]; found && previous.job.Schedule == job.Schedule {
+			next = previous.next
+		}
+		if next.IsZero() {
+			term.Warnf("job %s: schedule %q never runs", name, job.Schedule)
+		}
+		scheduled[name] = &scheduledJob{
+			name:     name,
+			job:      job,
+			schedule: jobSchedule,
+			next:     next,
+		}
+	}
+	d.jobs = scheduled
+	// forget the jobs removed from the configuration
+	d.queue = slices.DeleteFunc(d.queue, func(name string) bool {
+		return d.jobs[name] == nil
+	})
+	maps.DeleteFunc(d.status, func(name string, _ *jobStatus) bool {
+		return d.jobs[name] == nil
+	})
+}
+
+func (d *daemon) run(ctx context.Context) error {
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+
+	done := make(chan jobResult, 1)
+	running := ""
+	reloadPending := false
+
+	term.Info("daemon started: waiting for the next job")
+	for {
+		if running == "" && len(d.queue) > 0 {
+			running = d.queue[0]
+			d.queue = d.queue[1:]
+			d.start(ctx, d.jobs[running], done)
+		}
+
+		var wake <-chan time.Time
+		if next := d.nextRun(); !next.IsZero() {
+			wake = time.After(time.Until(next))
+		}
+
+		select {
+		case <-ctx.Done():
+			if running != "" {
+				term.Infof("waiting for job %s to stop", running)
+				d.finish(<-done)
+			}
+			d.display()
+			return nil
+
+		case <-reload:
+			if running != "" {
+				// the configuration is used by the running job
+				term.Infof("configuration will be reloaded after job %s", running)
+				reloadPending = true
+				continue
+			}
+			d.reload()
+
+		case result := <-done:
+			running = ""
+			d.finish(result)
+			if reloadPending {
+				reloadPending = false
+				d.reload()
+			}
+
+		case now := <-wake:
+			d.enqueue(now, running)
+		}
+	}
+}
+
+// nextRun returns the time of the next job to run, or zero if none
+func (d *daemon) nextRun() time.Time {
+	var next time.Time
+	for _, job := range d.jobs {
+		if job.next.IsZero() {
+			continue
+		}
+		if next.IsZero() || job.next.Before(next) {
+			next = job.next
+		}
+	}
+	return next
+}
+
+// enqueue adds the jobs due to the queue. A job already waiting or running is skipped.
+func (d *daemon) enqueue(now time.Time, running string) {
+	for _, name := range slices.Sorted(maps.Keys(d.jobs)) {
+		job := d.jobs[name]
+		if job.next.IsZero() || job.next.After(now) {
+			continue
+		}
+		job.next = job.schedule.Next(now)
+		if name == running || slices.Contains(d.queue, name) {
+			term.Warnf("job %s is still running or waiting: this run is skipped", name)
+			continue
+		}
+		d.queue = append(d.queue, name)
+	}
+}
+
+func (d *daemon) start(ctx context.Context, job *scheduledJob, done chan<- jobResult) {
+	term.Infof("running job %s: %s from %s to %s", job.name, jobMode(job.job), job.job.Source, job.job.Destination)
+	go func() {
+		start := time.Now()
+		summary, err := runJob(ctx, job.job)
+		done <- jobResult{
+			name:     job.name,
+			job:      job.job,
+			summary:  summary,
+			duration: time.Since(start),
+			err:      err,
+		}
+	}()
+}
+
+// finish saves the status of the job
+func (d *daemon) finish(result jobResult) {
+	status, found := d.status[result.name]
+	if !found {
+		status = &jobStatus{}
+		d.status[result.name] = status
+	}
+	status.runs++
+	status.start = time.Now().Add(-result.duration)
+	status.duration = result.duration
+	status.summary = result.summary
+	status.err = result.err
+
+	summary := result.summary
+	if summary == nil {
+		summary = &jobSummary{}
+	}
+	if result.err != nil {
+		term.Errorf("job %s failed after %s: %s", result.name, result.duration.Round(time.Second), result.err)
+	} else {
+		term.Infof("job %s finished in %s: %d copied, %d skipped, %d failed, %d deleted",
+			result.name, result.duration.Round(time.Second), summary.copied, summary.skipped, summary.failed, summary.deleted)
+	}
+	if job, found := d.jobs[result.name]; found && !job.next.IsZero() {
+		term.Infof("next run of job %s at %s", result.name, job.next.Format(time.DateTime))
+	}
+}
+
+// reload reads the configuration file again and reschedules the jobs
+func (d *daemon) reload() {
+	term.Infof("reloading configuration file %s", global.configFile)
+	newConfig, err := cfg.LoadFromFile(global.configFile)
+	if err != nil {
+		term.Errorf("cannot reload the configuration, keeping the current one: %s", err)
+		return
+	}
+	// the credentials file is read again with the same master passphrase, to pick up the changed passwords
+	credentials = nil
+	config = newConfig
+	d.schedule(config.Jobs, time.Now())
+	d.display()
+}
+
+// display shows the schedule and the last run of the jobs
+func (d *daemon) display() {
+	table := pterm.DefaultTable.WithBoxed(true).WithHasHeader().WithData(pterm.TableData{
+		{"Job", "Schedule", "Runs", "Last run", "Duration", "Copied", "Failed", "Deleted", "Result", "Next run"},
+	})
+	for _, name := range slices.Sorted(maps.Keys(d.jobs)) {
+		job := d.jobs[name]
+		next := "never"
+		if !job.next.IsZero() {
+			next = job.next.Format(time.DateTime)
+		}
+		line := []string{name, job.job.Schedule, "0", "", "", "", "", "", "", next}
+		if status, found := d.status[name]; found {
+			summary := status.summary
+			if summary == nil {
+				summary = &jobSummary{}
+			}
+			result := "ok"
+			switch {
+			case status.err != nil:
+				result = status.err.Error()
+			case summary.errors > 0:
+				result = fmt.Sprintf("%d mailboxes with errors", summary.errors)
+			}
+			line = []string{
+				name,
+				job.job.Schedule,
+				strconv.Itoa(status.runs),
+				status.start.Format(time.DateTime),
+				status.duration.Round(time.Second).String(),
+				strconv.Itoa(summary.copied),
+				strconv.Itoa(summary.failed),
+				strconv.Itoa(summary.deleted),
+				result,
+				next,
+			}
+		}
+		table.Data = append(table.Data, line)
+	}
+	_ = table.Render()
+}
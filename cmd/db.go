@@ -0,0 +1,240 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/creativeprojects/imap/cfg"
+	"github.com/creativeprojects/imap/storage/local"
+	"github.com/creativeprojects/imap/term"
+	"github.com/spf13/cobra"
+	xterm "golang.org/x/term"
+)
+
+type rekeyFlags struct {
+	newKeyFile string
+}
+
+type migrateFlags struct {
+	apply bool
+}
+
+type indexFlags struct {
+	drop bool
+}
+
+var (
+	dbCmd = &cobra.Command{
+		Use:   "db",
+		Short: "Maintenance of a local database",
+	}
+	dbEncryptCmd = &cobra.Command{
+		Use:   "encrypt",
+		Short: "Encrypt an existing local database with the passphrase or key file from its configuration",
+		RunE:  runDBEncrypt,
+	}
+	dbRekeyCmd = &cobra.Command{
+		Use:   "rekey",
+		Short: "Encrypt a local database with a new passphrase or key file",
+		RunE:  runDBRekey,
+	}
+	dbMigrateCmd = &cobra.Command{
+		Use:   "migrate",
+		Short: "Show the migrations needed to upgrade a local database to the current version",
+		RunE:  runDBMigrate,
+	}
+	dbIndexCmd = &cobra.Command{
+		Use:   "index",
+		Short: "Build (or rebuild) the full-text search index of a local database",
+		RunE:  runDBIndex,
+	}
+	rekeyOptions   rekeyFlags
+	migrateOptions migrateFlags
+	indexOptions   indexFlags
+)
+
+func init() {
+	dbRekeyCmd.Flags().StringVar(&rekeyOptions.newKeyFile, "new-key-file", "", "use this key file instead of asking for a new passphrase")
+	dbMigrateCmd.Flags().BoolVar(&migrateOptions.apply, "apply", false, "run the migrations (a backup of the database is saved first)")
+	dbIndexCmd.Flags().BoolVar(&indexOptions.drop, "drop", false, "delete the search index instead")
+	dbCmd.AddCommand(dbEncryptCmd)
+	dbCmd.AddCommand(dbIndexCmd)
+	dbCmd.AddCommand(dbMigrateCmd)
+	dbCmd.AddCommand(dbRekeyCmd)
+	rootCmd.AddCommand(dbCmd)
+}
+
+func runDBEncrypt(cmd *cobra.Command, args []string) error {
+	account, err := getLocalAccount(args)
+	if err != nil {
+		return err
+	}
+	if account.Passphrase == "" && account.KeyFile == "" {
+		return errors.New("no passphrase or key file configured on this account")
+	}
+	store, err := local.NewBoltStore(account.File)
+	if err != nil {
+		if errors.Is(err, local.ErrEncryptionKeyRequired) {
+			return errors.New("database is already encrypted")
+		}
+		return fmt.Errorf("cannot open database: %w", err)
+	}
+	defer store.Close()
+
+	err = store.Rekey(account.Passphrase, account.KeyFile)
+	if err != nil {
+		return err
+	}
+	term.Info("database encrypted")
+	return nil
+}
+
+func runDBRekey(cmd *cobra.Command, args []string) error {
+	account, err := getLocalAccount(args)
+	if err != nil {
+		return err
+	}
+	store, err := local.NewBoltStoreWithConfig(local.Config{
+		Filename:   account.File,
+		Passphrase: account.Passphrase,
+		KeyFile:    account.KeyFile,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot open database: %w", err)
+	}
+	defer store.Close()
+
+	passphrase := ""
+	if rekeyOptions.newKeyFile == "" {
+		passphrase, err = readNewPassphrase()
+		if err != nil {
+			return err
+		}
+	}
+	err = store.Rekey(passphrase, rekeyOptions.newKeyFile)
+	if err != nil {
+		return err
+	}
+	term.Info("database encrypted with the new key: don't forget to update your configuration")
+	return nil
+}
+
+func runDBMigrate(cmd *cobra.Command, args []string) error {
+	account, err := getLocalAccount(args)
+	if err != nil {
+		return err
+	}
+	store, err := local.NewBoltStoreWithConfig(local.Config{
+		Filename:    account.File,
+		Passphrase:  account.Passphrase,
+		KeyFile:     account.KeyFile,
+		SkipUpgrade: true,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot open database: %w", err)
+	}
+	defer store.Close()
+
+	version, err := store.Version()
+	if err != nil {
+		return err
+	}
+	pending, err := store.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		term.Infof("database is up to date (version %d)", version)
+		return nil
+	}
+	term.Infof("database version %d needs %d migration(s):", version, len(pending))
+	for _, migration := range pending {
+		fmt.Printf("  version %d: %s\n", migration.Version, migration.Description)
+	}
+	if !migrateOptions.apply {
+		err = store.CheckUpgrade()
+		if err != nil {
+			return err
+		}
+		term.Info("migrations checked successfully (nothing was changed): use --apply to run them")
+		return nil
+	}
+	err = store.Upgrade()
+	if err != nil {
+		return err
+	}
+	term.Info("database upgraded")
+	return nil
+}
+
+func runDBIndex(cmd *cobra.Command, args []string) error {
+	account, err := getLocalAccount(args)
+	if err != nil {
+		return err
+	}
+	store, err := local.NewBoltStoreWithConfig(local.Config{
+		Filename:   account.File,
+		Passphrase: account.Passphrase,
+		KeyFile:    account.KeyFile,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot open database: %w", err)
+	}
+	defer store.Close()
+
+	if indexOptions.drop {
+		if account.SearchIndex {
+			term.Warn("the search index will be built again next time: remove \"searchIndex\" from the account")
+		}
+		err = store.DropSearchIndex()
+		if err != nil {
+			return err
+		}
+		term.Info("search index deleted")
+		return nil
+	}
+	err = store.BuildSearchIndex()
+	if err != nil {
+		return err
+	}
+	term.Info("search index built")
+	return nil
+}
+
+func getLocalAccount(args []string) (cfg.Account, error) {
+	if len(args) < 1 {
+		return cfg.Account{}, errors.New("missing account name")
+	}
+	accountName := args[0]
+	account, ok := config.Accounts[accountName]
+	if !ok {
+		return account, fmt.Errorf("account not found: %s", accountName)
+	}
+	if account.Type != cfg.LOCAL {
+		return account, fmt.Errorf("account %s is not a local database", accountName)
+	}
+	return account, nil
+}
+
+func readNewPassphrase() (string, error) {
+	fmt.Print("New passphrase: ")
+	passphrase, err := xterm.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return "", fmt.Errorf("cannot read passphrase: %w", err)
+	}
+	if len(passphrase) == 0 {
+		return "", errors.New("empty passphrase")
+	}
+	fmt.Print("Confirm passphrase: ")
+	confirm, err := xterm.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return "", fmt.Errorf("cannot read passphrase: %w", err)
+	}
+	if string(passphrase) != string(confirm) {
+		return "", errors.New("passphrases don't match")
+	}
+	return string(passphrase), nil
+}
@@ -1,7 +1,6 @@
 package cmd
 
 import (
-	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -33,36 +32,40 @@ func runDuplicates(cmd *cobra.Command, args []string) error {
 	if !ok {
 		return fmt.Errorf("account not found: %s", accountName)
 	}
-	backend, err := NewBackend(accountSource, nil)
+	ctx := cmd.Context()
+	backend, err := NewBackend(ctx, accountSource, nil)
 	if err != nil {
 		return fmt.Errorf("cannot open backend: %w", err)
 	}
 
-	mailboxes, err := backend.ListMailbox()
+	mailboxes, err := backend.ListMailbox(ctx)
 	if err != nil {
 		return fmt.Errorf("cannot list source account mailbox: %w", err)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
 	duplicates := 0
 	hashes := make(map[string][]mailbox.Message, 0)
 	for _, mbox := range mailboxes {
-		status, err := backend.SelectMailbox(mbox)
+		handle, err := backend.OpenMailbox(ctx, mbox)
 		if err != nil {
 			continue
 		}
+		status := handle.Status()
 		if status.Messages == 0 {
 			// it's empty so don't bother
+			_ = handle.Close()
 			continue
 		}
 		term.Infof("reading mailbox %s", mbox.Name)
 		pbar, _ := pterm.DefaultProgressbar.WithTotal(int(status.Messages)).Start()
-		entries, err := storage.LoadMessageProperties(ctx, backend, mbox, newProgresser(pbar))
+		entries, err := storage.LoadMessageProperties(ctx, handle, newProgresser(pbar))
+		_ = handle.Close()
 		if pbar != nil {
 			_, _ = pbar.Stop()
 		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if err != nil {
 			term.Error(err.Error())
 		}
@@ -1,11 +1,19 @@
 package cmd
 
-import "github.com/creativeprojects/imap/cfg"
+import (
+	"time"
+
+	"github.com/creativeprojects/imap/cfg"
+)
 
 type GlobalFlags struct {
 	configFile string
 	quiet      bool
 	verbose    bool
+	// lockTimeout is how long to wait for an account used by another process
+	lockTimeout time.Duration
+	// noProgress hides the progress bars of the commands running in the background
+	noProgress bool
 }
 
 var (
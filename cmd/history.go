@@ -3,23 +3,68 @@ package cmd
 import (
 	"errors"
 	"fmt"
-	"strconv"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/creativeprojects/imap/cfg"
 	"github.com/creativeprojects/imap/mailbox"
+	"github.com/creativeprojects/imap/storage/remote"
 	"github.com/creativeprojects/imap/term"
-	"github.com/pterm/pterm"
 	"github.com/spf13/cobra"
 )
 
 const dateFormat = "2006-01-02 15:04:05 MST"
 
-var historyCmd = &cobra.Command{
-	Use:   "history",
-	Short: "Display history of mailbox copy",
-	RunE:  runHistory,
+// output formats of the history command
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+	formatCSV   = "csv"
+)
+
+type historyFlags struct {
+	source  string
+	since   string
+	before  string
+	actions []string
+	message string
+	format  string
+}
+
+type historyMigrateFlags struct {
+	from string
+	to   string
 }
 
+var (
+	historyCmd = &cobra.Command{
+		Use:   "history <account> [mailbox...]",
+		Short: "Display history of mailbox copy",
+		Example: `  imap history backup INBOX --source gmail --since 2024-01-01
+  imap history backup --message 1234 --format json`,
+		RunE: runHistory,
+	}
+	historyMigrateCmd = &cobra.Command{
+		Use:   "migrate <account>",
+		Short: "Move the history of an imap account between the local cache and the server",
+		RunE:  runHistoryMigrate,
+	}
+	historyOptions        historyFlags
+	historyMigrateOptions historyMigrateFlags
+)
+
 func init() {
+	flag := historyCmd.Flags()
+	flag.StringVar(&historyOptions.source, "source", "", "only display the actions of this source account (name in the configuration, or account ID)")
+	flag.StringVar(&historyOptions.since, "since", "", "only display the actions on or after this day (YYYY-MM-DD)")
+	flag.StringVar(&historyOptions.before, "before", "", "only display the actions before this day (YYYY-MM-DD)")
+	flag.StringSliceVar(&historyOptions.actions, "action", nil, "only display these actions: copy, failed or delete")
+	flag.StringVar(&historyOptions.message, "message", "", "display where this message of the source account (UID or key) was copied")
+	flag.StringVar(&historyOptions.format, "format", formatTable, "output format: table, json or csv")
+	historyMigrateCmd.Flags().StringVar(&historyMigrateOptions.to, "to", "", `where to move the history: "local", "server", "metadata" or "mailbox"`)
+	historyMigrateCmd.Flags().StringVar(&historyMigrateOptions.from, "from", "", `where the history is now (default "local", or the server when moving to "local")`)
+	historyCmd.AddCommand(historyMigrateCmd)
 	rootCmd.AddCommand(historyCmd)
 }
 
@@ -27,54 +72,160 @@ func runHistory(cmd *cobra.Command, args []string) error {
 	if len(args) < 1 {
 		return errors.New("missing account name")
 	}
+	output, err := newHistoryOutput(cmd.OutOrStdout(), historyOptions.format, historyOptions.message != "")
+	if err != nil {
+		return err
+	}
+	if historyOptions.format != formatTable {
+		// the output is read by a script
+		term.SetOutput(os.Stderr)
+	}
+	filter, err := newHistoryFilter(historyOptions)
+	if err != nil {
+		return err
+	}
+	ctx := cmd.Context()
+	if historyOptions.source != "" {
+		filter.SourceAccountTag, err = sourceAccountTag(historyOptions.source)
+		if err != nil {
+			return err
+		}
+	}
+
 	accountName := args[0]
 	account, ok := config.Accounts[accountName]
 	if !ok {
 		return fmt.Errorf("account not found: %s", accountName)
 	}
-	backend, err := NewBackend(account, nil)
+	backend, err := NewBackend(ctx, account, nil)
 	if err != nil {
 		return fmt.Errorf("cannot open backend: %w", err)
 	}
+	defer backend.Close()
 
-	mailboxes, err := backend.ListMailbox()
+	mailboxes, err := listHistoryMailboxes(ctx, backend, args[1:])
 	if err != nil {
-		return fmt.Errorf("cannot list account mailbox: %w", err)
+		return err
 	}
 
 	if len(mailboxes) == 0 {
 		term.Warn("No mailbox found on this account\n")
 	}
 
-	for _, mailbox := range mailboxes {
-		term.Infof("%s:", mailbox.Name)
-		history, err := backend.GetHistory(mailbox)
+	names := newAccountNames(accountName, backend.AccountID())
+	for _, mbox := range mailboxes {
+		history, err := backend.GetHistory(ctx, mbox)
 		if err != nil {
 			term.Error(err)
+			continue
+		}
+		output.mailbox(mbox.Name, mailbox.FilterHistory(history, filter), names)
+		if historyOptions.format == formatTable {
+			displayNextCopy(history, names)
+		}
+	}
+	return output.flush()
+}
+
+// newHistoryFilter returns the filter selected by the flags of the history command, except the source account
+func newHistoryFilter(options historyFlags) (mailbox.HistoryFilter, error) {
+	filter := mailbox.HistoryFilter{}
+	var err error
+	if options.since != "" {
+		filter.Since, err = time.ParseInLocation(time.DateOnly, options.since, time.Local)
+		if err != nil {
+			return filter, fmt.Errorf("invalid date %q: use YYYY-MM-DD", options.since)
+		}
+	}
+	if options.before != "" {
+		filter.Before, err = time.ParseInLocation(time.DateOnly, options.before, time.Local)
+		if err != nil {
+			return filter, fmt.Errorf("invalid date %q: use YYYY-MM-DD", options.before)
+		}
+	}
+	for _, action := range options.actions {
+		action = strings.ToUpper(action)
+		if action != mailbox.ActionCopy && action != mailbox.ActionFailed && action != mailbox.ActionDelete {
+			return filter, fmt.Errorf("unknown action %q: use copy, failed or delete", action)
+		}
+		filter.Actions = append(filter.Actions, action)
+	}
+	if options.message != "" {
+		err = filter.SourceID.UnmarshalText([]byte(options.message))
+		if err != nil || filter.SourceID.IsZero() {
+			// a zero ID would match all the messages
+			return filter, fmt.Errorf("invalid message ID %q", options.message)
 		}
-		displayHistory(history)
+	}
+	return filter, nil
+}
+
+func runHistoryMigrate(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 {
+		return errors.New("missing account name")
+	}
+	accountName := args[0]
+	account, ok := config.Accounts[accountName]
+	if !ok {
+		return fmt.Errorf("account not found: %s", accountName)
+	}
+	if account.Type != cfg.IMAP {
+		return fmt.Errorf("account %s is not an imap account", accountName)
+	}
+	to := remote.HistoryStore(historyMigrateOptions.to)
+	if to == "" {
+		return errors.New("missing destination of the history: use --to")
+	}
+	from := remote.HistoryStore(historyMigrateOptions.from)
+	if from == "" {
+		from = remote.HistoryLocal
+		if to == remote.HistoryLocal {
+			from = remote.HistoryServer
+			if configured := remote.HistoryStore(account.HistoryStore); configured == remote.HistoryMailbox || configured == remote.HistoryMetadata {
+				from = configured
+			}
+		}
+	}
+
+	backend, err := NewBackend(cmd.Context(), account, nil)
+	if err != nil {
+		return fmt.Errorf("cannot open backend: %w", err)
+	}
+	defer backend.Close()
+
+	imapBackend, ok := backend.(*remote.Imap)
+	if !ok {
+		return fmt.Errorf("account %s is not an imap account", accountName)
+	}
+	release, err := imapBackend.LockAccount(cmd.Context(), global.lockTimeout)
+	if err != nil {
+		return fmt.Errorf("account %s is busy: %w", accountName, err)
+	}
+	defer release()
+
+	moved, err := imapBackend.MigrateHistory(cmd.Context(), from, to)
+	term.Infof("history of %d mailboxes moved from %s to %s", moved, from, to)
+	if err != nil {
+		return err
+	}
+	configuredLocal := account.HistoryStore == "" || account.HistoryStore == string(remote.HistoryLocal)
+	if configuredLocal != (to == remote.HistoryLocal) {
+		term.Warnf("set historyStore: %s in the configuration of account %s to use the history moved", to, accountName)
 	}
 	return nil
 }
 
-func displayHistory(history *mailbox.History) {
-	table := pterm.DefaultTable.WithBoxed(true).WithHasHeader().WithData(pterm.TableData{
-		{"Date", "Action", "Source", "Messages"},
-	})
+// displayNextCopy displays where the next copy from each source account will start
+func displayNextCopy(history *mailbox.History, names *accountNames) {
 	accounts := make(map[string]bool, 0)
 	for _, action := range history.Actions {
-		table.Data = append(table.Data, []string{
-			action.Date.Format(dateFormat),
-			action.Action,
-			action.SourceAccountTag[0:16],
-			strconv.Itoa(len(action.Entries)),
-		})
 		accounts[action.SourceAccountTag] = true
 	}
-	_ = table.Render()
-
 	for accountID := range accounts {
 		latest := mailbox.FindLatestInternalDateFromHistory(accountID, history)
-		term.Debugf("account %s: next copy will start from %s", accountID[0:16], latest.Format(dateFormat))
+		term.Debugf("account %s: next copy will start from %s", names.name(accountID), latest.Format(dateFormat))
+		if failed := mailbox.FindFailedEntries(accountID, history); len(failed) > 0 {
+			term.Warnf("account %s: %d messages failed to copy and will be tried again on the next copy", names.name(accountID), len(failed))
+		}
 	}
 }
@@ -0,0 +1,426 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/creativeprojects/imap/lib"
+	"github.com/creativeprojects/imap/mailbox"
+	"github.com/creativeprojects/imap/storage"
+	"github.com/creativeprojects/imap/term"
+	"github.com/spf13/cobra"
+)
+
+type historyCompactFlags struct {
+	prune bool
+}
+
+type historyImportFlags struct {
+	replace         bool
+	clearMessageIDs bool
+}
+
+type historyResetFlags struct {
+	source string
+	force  bool
+}
+
+// minSourcePrefix is the shortest beginning of an account ID selecting a source account without --force
+const minSourcePrefix = 8
+
+var (
+	historyCompactCmd = &cobra.Command{
+		Use:   "compact <account> [mailbox...]",
+		Short: "Merge the actions in the history of the mailboxes of an account",
+		RunE:  runHistoryCompact,
+	}
+	historyExportCmd = &cobra.Command{
+		Use:   "export <account> <file>",
+		Short: "Save the history of all the mailboxes of an account to a JSON file",
+		RunE:  runHistoryExport,
+	}
+	historyImportCmd = &cobra.Command{
+		Use:   "import <account> <file>",
+		Short: "Load the history of the mailboxes of an account from a file saved by history export",
+		RunE:  runHistoryImport,
+	}
+	historyResetCmd = &cobra.Command{
+		Use:   "reset <account> [mailbox]",
+		Short: "Remove the history of a mailbox, or of a source account: the next copy starts over",
+		RunE:  runHistoryReset,
+	}
+	historyCompactOptions historyCompactFlags
+	historyImportOptions  historyImportFlags
+	historyResetOptions   historyResetFlags
+)
+
+func init() {
+	historyCompactCmd.Flags().BoolVar(&historyCompactOptions.prune, "prune", false, "also remove the messages no longer in the mailbox")
+	historyImportCmd.Flags().BoolVar(&historyImportOptions.replace, "replace", false, "replace the history of the mailboxes instead of merging it")
+	historyImportCmd.Flags().BoolVar(&historyImportOptions.clearMessageIDs, "clear-message-ids", false, "forget the IDs of the copied messages (when the file comes from another account)")
+	historyResetCmd.Flags().StringVar(&historyResetOptions.source, "source", "", "only remove the history of this source account (name in the configuration, or account ID)")
+	historyResetCmd.Flags().BoolVar(&historyResetOptions.force, "force", false, "remove the history of all the source accounts starting with the ID given by --source")
+	historyCmd.AddCommand(historyCompactCmd, historyExportCmd, historyImportCmd, historyResetCmd)
+}
+
+func runHistoryCompact(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 {
+		return errors.New("missing account name")
+	}
+	ctx := cmd.Context()
+	backend, replacer, release, err := openHistoryAccount(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	defer release()
+
+	mailboxes, err := listHistoryMailboxes(ctx, backend, args[1:])
+	if err != nil {
+		return err
+	}
+	for _, mbox := range mailboxes {
+		history, err := backend.GetHistory(ctx, mbox)
+		if err != nil {
+			term.Errorf("cannot load history of mailbox %s: %s", mbox.Name, err)
+			continue
+		}
+		var present func(mailbox.MessageID) bool
+		if historyCompactOptions.prune {
+			present, err = presentMessages(ctx, backend, mbox)
+			if err != nil {
+				term.Errorf("cannot list the messages of mailbox %s: %s", mbox.Name, err)
+				continue
+			}
+		}
+		compacted := mailbox.CompactHistory(history, present)
+		err = replacer.ReplaceHistory(ctx, mbox, compacted)
+		if err != nil {
+			return fmt.Errorf("cannot save history of mailbox %s: %w", mbox.Name, err)
+		}
+		term.Infof("%s: %s compacted to %s", mbox.Name, countHistory(history), countHistory(compacted))
+	}
+	return nil
+}
+
+// presentMessages returns a function telling if a message is in the mailbox
+func presentMessages(ctx context.Context, backend storage.Backend, mbox mailbox.Info) (func(mailbox.MessageID) bool, error) {
+	handle, err := backend.OpenMailbox(ctx, mbox)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	uids, err := handle.Uids(ctx)
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[mailbox.MessageID]bool, len(uids))
+	for _, uid := range uids {
+		present[uid] = true
+	}
+	return func(id mailbox.MessageID) bool {
+		return present[id]
+	}, nil
+}
+
+func runHistoryExport(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 {
+		return errors.New("missing account name")
+	} else if len(args) < 2 {
+		return errors.New("missing file name")
+	}
+	ctx := cmd.Context()
+	account, ok := config.Accounts[args[0]]
+	if !ok {
+		return fmt.Errorf("account not found: %s", args[0])
+	}
+	backend, err := NewBackend(ctx, account, nil)
+	if err != nil {
+		return fmt.Errorf("cannot open backend: %w", err)
+	}
+	defer backend.Close()
+
+	mailboxes, err := backend.ListMailbox(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot list account mailbox: %w", err)
+	}
+	export := &mailbox.HistoryExport{
+		Version:   mailbox.HistoryExportVersion,
+		AccountID: backend.AccountID(),
+		Date:      time.Now(),
+		Mailboxes: make([]mailbox.MailboxHistory, 0, len(mailboxes)),
+	}
+	for _, mbox := range mailboxes {
+		history, err := backend.GetHistory(ctx, mbox)
+		if err != nil {
+			return fmt.Errorf("cannot load history of mailbox %s: %w", mbox.Name, err)
+		}
+		if len(history.Actions) == 0 {
+			continue
+		}
+		export.Mailboxes = append(export.Mailboxes, mailbox.MailboxHistory{
+			Name:      mbox.Name,
+			Delimiter: mbox.Delimiter,
+			Actions:   history.Actions,
+		})
+	}
+	err = lib.WriteFileAtomic(args[1], 0600, func(w io.Writer) error {
+		return mailbox.WriteHistoryExport(w, export)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot save history export: %w", err)
+	}
+	term.Infof("history of %d mailboxes exported to %s", len(export.Mailboxes), args[1])
+	return nil
+}
+
+func runHistoryImport(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 {
+		return errors.New("missing account name")
+	} else if len(args) < 2 {
+		return errors.New("missing file name")
+	}
+	file, err := os.Open(args[1])
+	if err != nil {
+		return err
+	}
+	export, err := mailbox.ReadHistoryExport(file)
+	_ = file.Close()
+	if err != nil {
+		return err
+	}
+
+	ctx := cmd.Context()
+	backend, replacer, release, err := openHistoryAccount(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	defer release()
+
+	if export.AccountID != backend.AccountID() && !historyImportOptions.clearMessageIDs {
+		term.Warn("the history was exported from another account: use --clear-message-ids if the messages don't have the same IDs in this account")
+	}
+	mailboxes, err := backend.ListMailbox(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot list account mailbox: %w", err)
+	}
+	imported := 0
+	for _, exported := range export.Mailboxes {
+		info := mailbox.ChangeDelimiter(mailbox.Info{Name: exported.Name, Delimiter: exported.Delimiter}, backend.Delimiter())
+		if !slices.ContainsFunc(mailboxes, func(mbox mailbox.Info) bool { return mbox.Name == info.Name }) {
+			term.Warnf("mailbox %s not found: history skipped", info.Name)
+			continue
+		}
+		history := &mailbox.History{Actions: exported.Actions}
+		if historyImportOptions.clearMessageIDs {
+			history = clearMessageIDs(history)
+		}
+		if !historyImportOptions.replace {
+			existing, err := backend.GetHistory(ctx, info)
+			if err != nil {
+				return fmt.Errorf("cannot load history of mailbox %s: %w", info.Name, err)
+			}
+			history = mailbox.MergeHistory(existing, history)
+		}
+		err = replacer.ReplaceHistory(ctx, info, history)
+		if err != nil {
+			return fmt.Errorf("cannot save history of mailbox %s: %w", info.Name, err)
+		}
+		term.Infof("%s: %s", info.Name, countHistory(history))
+		imported++
+	}
+	term.Infof("history of %d mailboxes imported", imported)
+	return nil
+}
+
+// clearMessageIDs returns a copy of the history without the IDs of the messages in the destination
+func clearMessageIDs(history *mailbox.History) *mailbox.History {
+	cleared := &mailbox.History{
+		Actions: make([]mailbox.HistoryAction, len(history.Actions)),
+	}
+	for i, action := range history.Actions {
+		action.Entries = slices.Clone(action.Entries)
+		for j := range action.Entries {
+			action.Entries[j].MessageID = mailbox.MessageID{}
+		}
+		cleared.Actions[i] = action
+	}
+	return cleared
+}
+
+func runHistoryReset(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 {
+		return errors.New("missing account name")
+	}
+	if len(args) < 2 && historyResetOptions.source == "" {
+		return errors.New("missing mailbox name or source account (--source)")
+	}
+	ctx := cmd.Context()
+	sourceTag := ""
+	if historyResetOptions.source != "" {
+		var err error
+		sourceTag, err = sourceAccountTag(historyResetOptions.source)
+		if err != nil {
+			return err
+		}
+	}
+	backend, replacer, release, err := openHistoryAccount(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	defer release()
+
+	mailboxes, err := listHistoryMailboxes(ctx, backend, args[1:])
+	if err != nil {
+		return err
+	}
+	histories := make(map[string]*mailbox.History, len(mailboxes))
+	for _, mbox := range mailboxes {
+		history, err := backend.GetHistory(ctx, mbox)
+		if err != nil {
+			term.Errorf("cannot load history of mailbox %s: %s", mbox.Name, err)
+			continue
+		}
+		histories[mbox.Name] = history
+	}
+
+	// an account in the configuration is selected by its full ID
+	remove := func(action mailbox.HistoryAction) bool {
+		return sourceTag == "" || action.SourceAccountTag == sourceTag
+	}
+	if _, configured := config.Accounts[historyResetOptions.source]; sourceTag != "" && !configured {
+		tags := matchingSourceTags(sourceTag, histories)
+		switch {
+		case len(tags) == 0:
+			term.Infof("no action from a source account starting with %q", sourceTag)
+			return nil
+		case len(tags) == 1 && len(sourceTag) >= minSourcePrefix:
+			sourceTag = tags[0]
+		case !historyResetOptions.force:
+			term.Warnf("source accounts starting with %q:", sourceTag)
+			for _, tag := range tags {
+				term.Warnf("  %s", tag)
+			}
+			return fmt.Errorf("give at least %d characters of the ID of one source account, or add --force to remove all of them", minSourcePrefix)
+		default:
+			remove = func(action mailbox.HistoryAction) bool {
+				return strings.HasPrefix(action.SourceAccountTag, sourceTag)
+			}
+		}
+	}
+
+	for _, mbox := range mailboxes {
+		history, ok := histories[mbox.Name]
+		if !ok {
+			continue
+		}
+		kept := &mailbox.History{Actions: make([]mailbox.HistoryAction, 0)}
+		for _, action := range history.Actions {
+			if !remove(action) {
+				kept.Actions = append(kept.Actions, action)
+			}
+		}
+		if len(kept.Actions) == len(history.Actions) {
+			continue
+		}
+		err = replacer.ReplaceHistory(ctx, mbox, kept)
+		if err != nil {
+			return fmt.Errorf("cannot save history of mailbox %s: %w", mbox.Name, err)
+		}
+		term.Infof("%s: %d actions removed", mbox.Name, len(history.Actions)-len(kept.Actions))
+	}
+	return nil
+}
+
+// matchingSourceTags returns the sorted source account IDs starting with prefix in the histories
+func matchingSourceTags(prefix string, histories map[string]*mailbox.History) []string {
+	tags := make([]string, 0)
+	for _, history := range histories {
+		for _, action := range history.Actions {
+			if strings.HasPrefix(action.SourceAccountTag, prefix) && !slices.Contains(tags, action.SourceAccountTag) {
+				tags = append(tags, action.SourceAccountTag)
+			}
+		}
+	}
+	slices.Sort(tags)
+	return tags
+}
+
+// openHistoryAccount opens the account and locks it, so no copy is saving its history at the same time
+func openHistoryAccount(ctx context.Context, accountName string) (storage.Backend, storage.HistoryReplacer, func() error, error) {
+	account, ok := config.Accounts[accountName]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("account not found: %s", accountName)
+	}
+	backend, err := NewBackend(ctx, account, nil)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot open backend: %w", err)
+	}
+	replacer, ok := backend.(storage.HistoryReplacer)
+	if !ok {
+		_ = backend.Close()
+		return nil, nil, nil, fmt.Errorf("cannot change the history of account %s: %w", accountName, lib.ErrNotSupported)
+	}
+	release := func() error { return nil }
+	if locker, ok := backend.(storage.AccountLocker); ok {
+		release, err = locker.LockAccount(ctx, global.lockTimeout)
+		if err != nil {
+			_ = backend.Close()
+			return nil, nil, nil, fmt.Errorf("account %s is busy: %w", accountName, err)
+		}
+	}
+	return backend, replacer, release, nil
+}
+
+// listHistoryMailboxes returns the mailboxes with these names, or all the mailboxes of the account when names is empty
+func listHistoryMailboxes(ctx context.Context, backend storage.Backend, names []string) ([]mailbox.Info, error) {
+	mailboxes, err := backend.ListMailbox(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list account mailbox: %w", err)
+	}
+	if len(names) == 0 {
+		return mailboxes, nil
+	}
+	selected := make([]mailbox.Info, 0, len(names))
+	for _, name := range names {
+		index := slices.IndexFunc(mailboxes, func(mbox mailbox.Info) bool { return mbox.Name == name })
+		if index < 0 {
+			return nil, fmt.Errorf("mailbox not found: %s", name)
+		}
+		selected = append(selected, mailboxes[index])
+	}
+	return selected, nil
+}
+
+// sourceAccountTag returns the ID of a source account in the history: the name of an account in the configuration,
+// or the beginning of an account ID as displayed by the history command.
+// The account is not opened, so nothing is changed in it.
+func sourceAccountTag(name string) (string, error) {
+	account, ok := config.Accounts[name]
+	if !ok {
+		return name, nil
+	}
+	id, err := ReadAccountID(account)
+	if err != nil {
+		return "", fmt.Errorf("cannot find the ID of source account %s: %w", name, err)
+	}
+	return id, nil
+}
+
+// countHistory describes the size of a history
+func countHistory(history *mailbox.History) string {
+	entries := 0
+	for _, action := range history.Actions {
+		entries += len(action.Entries)
+	}
+	return fmt.Sprintf("%d actions (%d messages)", len(history.Actions), entries)
+}
@@ -0,0 +1,212 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/creativeprojects/imap/cfg"
+	"github.com/creativeprojects/imap/mailbox"
+	"github.com/creativeprojects/imap/term"
+	"github.com/pterm/pterm"
+)
+
+// historyRow is an action in the json output of the history command
+type historyRow struct {
+	Mailbox          string
+	Date             time.Time
+	Action           string
+	Source           string
+	SourceAccountTag string
+	UidValidity      uint32
+	Messages         int
+	// Entries are only displayed when looking for a message
+	Entries []mailbox.HistoryEntry `json:",omitempty"`
+}
+
+// historyOutput displays the history of the mailboxes as tables, or writes it as json or csv.
+// With entries, the messages of the actions are displayed instead of their number.
+type historyOutput struct {
+	w       io.Writer
+	format  string
+	entries bool
+	rows    []historyRow
+	csv     *csv.Writer
+}
+
+func newHistoryOutput(w io.Writer, format string, entries bool) (*historyOutput, error) {
+	output := &historyOutput{
+		w:       w,
+		format:  format,
+		entries: entries,
+	}
+	switch format {
+	case formatTable:
+	case formatJSON:
+		output.rows = make([]historyRow, 0)
+	case formatCSV:
+		output.csv = csv.NewWriter(w)
+		header := []string{"mailbox", "date", "action", "source", "source_account_tag", "uid_validity", "messages"}
+		if entries {
+			header = []string{"mailbox", "date", "action", "source", "source_account_tag", "uid_validity", "source_id", "source_internal_date", "message_id"}
+		}
+		_ = output.csv.Write(header)
+	default:
+		return nil, fmt.Errorf("unknown output format %q: use table, json or csv", format)
+	}
+	return output, nil
+}
+
+// mailbox adds the history of a mailbox to the output
+func (o *historyOutput) mailbox(name string, history *mailbox.History, names *accountNames) {
+	switch o.format {
+	case formatJSON:
+		for _, action := range history.Actions {
+			row := historyRow{
+				Mailbox:          name,
+				Date:             action.Date,
+				Action:           action.Action,
+				Source:           names.name(action.SourceAccountTag),
+				SourceAccountTag: action.SourceAccountTag,
+				UidValidity:      action.UidValidity,
+				Messages:         len(action.Entries),
+			}
+			if o.entries {
+				row.Entries = action.Entries
+			}
+			o.rows = append(o.rows, row)
+		}
+	case formatCSV:
+		for _, action := range history.Actions {
+			record := []string{
+				name,
+				action.Date.Format(time.RFC3339),
+				action.Action,
+				names.name(action.SourceAccountTag),
+				action.SourceAccountTag,
+				strconv.FormatUint(uint64(action.UidValidity), 10),
+			}
+			if !o.entries {
+				_ = o.csv.Write(append(record, strconv.Itoa(len(action.Entries))))
+				continue
+			}
+			for _, entry := range action.Entries {
+				_ = o.csv.Write(append(slices.Clone(record), entry.SourceID.String(), formatDate(entry.SourceInternalDate, time.RFC3339), entry.MessageID.String()))
+			}
+		}
+	default:
+		term.Infof("%s:", name)
+		o.table(history, names)
+	}
+}
+
+func (o *historyOutput) table(history *mailbox.History, names *accountNames) {
+	header := []string{"Date", "Action", "Source", "Messages"}
+	if o.entries {
+		header = []string{"Date", "Action", "Source", "Source ID", "Source date", "Message ID"}
+	}
+	table := pterm.DefaultTable.WithBoxed(true).WithHasHeader().WithData(pterm.TableData{header})
+	for _, action := range history.Actions {
+		row := []string{
+			action.Date.Format(dateFormat),
+			action.Action,
+			names.name(action.SourceAccountTag),
+		}
+		if !o.entries {
+			table.Data = append(table.Data, append(row, strconv.Itoa(len(action.Entries))))
+			continue
+		}
+		for _, entry := range action.Entries {
+			table.Data = append(table.Data, append(slices.Clone(row), entry.SourceID.String(), formatDate(entry.SourceInternalDate, dateFormat), entry.MessageID.String()))
+		}
+	}
+	_ = table.Render()
+}
+
+// flush writes the json document, or the end of the csv output
+func (o *historyOutput) flush() error {
+	switch o.format {
+	case formatJSON:
+		encoder := json.NewEncoder(o.w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(o.rows)
+	case formatCSV:
+		o.csv.Flush()
+		return o.csv.Error()
+	}
+	return nil
+}
+
+func formatDate(date time.Time, layout string) string {
+	if date.IsZero() {
+		return ""
+	}
+	return date.Format(layout)
+}
+
+// accountNames finds the name in the configuration of the source accounts in the history.
+// The IDs of the accounts are only read when needed, the imap accounts first as their ID is not saved in a file.
+// The accounts are never opened: an account which was never used is skipped.
+type accountNames struct {
+	names   map[string]string
+	pending []string
+}
+
+// newAccountNames already knows the account displayed
+func newAccountNames(accountName, accountID string) *accountNames {
+	pending := make([]string, 0, len(config.Accounts))
+	for name := range config.Accounts {
+		if name != accountName {
+			pending = append(pending, name)
+		}
+	}
+	slices.SortFunc(pending, func(a, b string) int {
+		imapA, imapB := config.Accounts[a].Type == cfg.IMAP, config.Accounts[b].Type == cfg.IMAP
+		if imapA != imapB {
+			if imapA {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a, b)
+	})
+	return &accountNames{
+		names:   map[string]string{accountID: accountName},
+		pending: pending,
+	}
+}
+
+// name returns the name of the account in the configuration, or the beginning of its ID when it's not found
+func (a *accountNames) name(accountID string) string {
+	for {
+		if name, ok := a.names[accountID]; ok {
+			return name
+		}
+		if len(a.pending) == 0 {
+			return shortAccountID(accountID)
+		}
+		name := a.pending[0]
+		a.pending = a.pending[1:]
+		id, err := sourceAccountTag(name)
+		if err != nil {
+			term.Debugf("cannot find the ID of account %s: %s", name, err)
+			continue
+		}
+		if _, found := a.names[id]; !found {
+			a.names[id] = name
+		}
+	}
+}
+
+// shortAccountID returns the beginning of the account ID, like git does with commit hashes
+func shortAccountID(accountID string) string {
+	if len(accountID) > 16 {
+		return accountID[:16]
+	}
+	return accountID
+}
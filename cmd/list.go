@@ -29,7 +29,7 @@ func runList(cmd *cobra.Command, args []string) error {
 	if !ok {
 		return fmt.Errorf("account not found: %s", accountName)
 	}
-	backend, err := NewBackend(account, nil)
+	backend, err := NewBackend(cmd.Context(), account, nil)
 	if err != nil {
 		return fmt.Errorf("cannot open backend: %w", err)
 	}
@@ -39,7 +39,7 @@ func runList(cmd *cobra.Command, args []string) error {
 		term.Debugf("Account ID: %s", accountID)
 	}
 
-	mailboxes, err := backend.ListMailbox()
+	mailboxes, err := backend.ListMailbox(cmd.Context())
 	if err != nil {
 		return fmt.Errorf("cannot list account mailbox: %w", err)
 	}
@@ -52,9 +52,10 @@ func runList(cmd *cobra.Command, args []string) error {
 	})
 	for _, mailbox := range mailboxes {
 		var messages string
-		status, err := backend.SelectMailbox(mailbox)
+		handle, err := backend.OpenMailbox(cmd.Context(), mailbox)
 		if err == nil {
-			messages = strconv.FormatUint(uint64(status.Messages), 10)
+			messages = strconv.FormatUint(uint64(handle.Status().Messages), 10)
+			_ = handle.Close()
 		}
 		table.Data = append(table.Data, []string{mailbox.Name, messages})
 	}
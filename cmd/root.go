@@ -1,7 +1,11 @@
 package cmd
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/creativeprojects/imap/cfg"
 	"github.com/creativeprojects/imap/term"
@@ -20,13 +24,22 @@ var rootCmd = &cobra.Command{
 func init() {
 	cobra.OnInitialize(initConfig, initLog)
 	flag := rootCmd.PersistentFlags()
-	flag.StringVarP(&global.configFile, "config", "c", "imap.yaml", "configuration file")
+	flag.StringVarP(&global.configFile, "config", "c", "imap.yaml", "configuration file (searched in the current directory then in ~/.config/imap/ by default)")
 	flag.BoolVarP(&global.quiet, "quiet", "q", false, "only display warnings and errors")
 	flag.BoolVarP(&global.verbose, "verbose", "v", false, "display debugging information")
+	flag.DurationVar(&global.lockTimeout, "lock-timeout", 10*time.Second, "how long to wait for an account used by another process (0 to fail straight away)")
 }
 
 func initConfig() {
 	var err error
+	if !rootCmd.PersistentFlags().Changed("config") {
+		// also search in the user configuration directory
+		global.configFile, err = cfg.FindConfigFile(global.configFile)
+		if err != nil {
+			term.Error(err)
+			os.Exit(1)
+		}
+	}
 	config, err = cfg.LoadFromFile(global.configFile)
 	if err != nil {
 		term.Errorf("cannot open or read configuration file: %s", err)
@@ -44,11 +57,18 @@ func initLog() {
 }
 
 func Execute(buildVersion, buildCommit, buildDate, buildBy string) {
+	// the banner is displayed before the flags are parsed: keep it out of the output read by scripts
+	term.SetOutput(os.Stderr)
 	term.Infof("IMAP tools version %s built by %s (%s)", buildVersion, buildBy, buildDate)
+	term.SetOutput(os.Stdout)
 
 	appVersion = buildVersion // used by self-update
 
-	if err := rootCmd.Execute(); err != nil {
+	// the commands are cancelled on the first interrupt: they can still save what was done so far
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := rootCmd.ExecuteContext(ctx)
+	stop()
+	if err != nil {
 		term.Error(err)
 		os.Exit(1)
 	}
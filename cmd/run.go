@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/creativeprojects/imap/cfg"
+	"github.com/creativeprojects/imap/term"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+type runFlags struct {
+	all bool
+}
+
+var (
+	runCmd = &cobra.Command{
+		Use:   "run",
+		Short: "Run a job from the configuration (or all of them in sequence with --all)",
+		RunE:  runRun,
+	}
+	runOptions runFlags
+)
+
+func init() {
+	flag := runCmd.Flags()
+	flag.BoolVar(&runOptions.all, "all", false, "run all the jobs in sequence")
+	addCopyFlags(flag)
+	rootCmd.AddCommand(runCmd)
+}
+
+// jobResult is a line of the summary table
+type jobResult struct {
+	name     string
+	job      cfg.Job
+	summary  *jobSummary
+	duration time.Duration
+	err      error
+}
+
+func runRun(cmd *cobra.Command, args []string) error {
+	var names []string
+	switch {
+	case runOptions.all:
+		names = slices.Sorted(maps.Keys(config.Jobs))
+		if len(names) == 0 {
+			return errors.New("no job in the configuration")
+		}
+	case len(args) < 1:
+		return errors.New("missing job name (or --all)")
+	default:
+		names = args
+	}
+	for _, name := range names {
+		if _, ok := config.Jobs[name]; !ok {
+			return fmt.Errorf("job not found: %s", name)
+		}
+	}
+
+	ctx := cmd.Context()
+	results := make([]jobResult, 0, len(names))
+	failed := 0
+	for _, name := range names {
+		job := config.Jobs[name]
+		term.Infof("running job %s: %s from %s to %s", name, jobMode(job), job.Source, job.Destination)
+		start := time.Now()
+		summary, err := runJob(ctx, job)
+		results = append(results, jobResult{
+			name:     name,
+			job:      job,
+			summary:  summary,
+			duration: time.Since(start),
+			err:      err,
+		})
+		if err != nil || summary.errors > 0 {
+			failed++
+		}
+		if err != nil {
+			term.Errorf("job %s failed: %s", name, err)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	displayJobResults(results)
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d jobs failed", failed, len(names))
+	}
+	return nil
+}
+
+func jobMode(job cfg.Job) cfg.JobMode {
+	if job.Mode == "" {
+		return cfg.ModeCopy
+	}
+	return job.Mode
+}
+
+func displayJobResults(results []jobResult) {
+	table := pterm.DefaultTable.WithBoxed(true).WithHasHeader().WithData(pterm.TableData{
+		{"Job", "Mode", "Mailboxes", "Copied", "Skipped", "Failed", "Deleted", "Duration", "Result"},
+	})
+	for _, result := range results {
+		summary := result.summary
+		if summary == nil {
+			summary = &jobSummary{}
+		}
+		status := "ok"
+		switch {
+		case result.err != nil:
+			status = result.err.Error()
+		case summary.errors > 0:
+			status = fmt.Sprintf("%d mailboxes with errors", summary.errors)
+		}
+		table.Data = append(table.Data, []string{
+			result.name,
+			string(jobMode(result.job)),
+			strconv.Itoa(summary.mailboxes),
+			strconv.Itoa(summary.copied),
+			strconv.Itoa(summary.skipped),
+			strconv.Itoa(summary.failed),
+			strconv.Itoa(summary.deleted),
+			result.duration.Round(time.Second).String(),
+			status,
+		})
+	}
+	_ = table.Render()
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/creativeprojects/imap/search"
+	"github.com/creativeprojects/imap/storage/local"
+	"github.com/creativeprojects/imap/term"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+type searchFlags struct {
+	mailbox string
+}
+
+var (
+	searchCmd = &cobra.Command{
+		Use:   "search <account> <query>",
+		Short: "Search messages in a local database",
+		Long: `Search messages in a local database with a full-text search index.
+
+The query is a list of words which must all be found in the message. A word can be restricted to a field:
+  from:<word>        sender (name or email address)
+  to:<word>          recipients (To, Cc and Bcc)
+  subject:<word>     subject
+  after:YYYY-MM-DD   messages received on this day or later
+  before:YYYY-MM-DD  messages received before this day
+Use quotes to search for a group of words in a field: subject:"weekly report"`,
+		Example: `  imap search local-test from:john subject:budget after:2023-01-01`,
+		RunE:    runSearch,
+	}
+	searchOptions searchFlags
+)
+
+func init() {
+	searchCmd.Flags().StringVarP(&searchOptions.mailbox, "mailbox", "m", "", "only search in this mailbox")
+	rootCmd.AddCommand(searchCmd)
+}
+
+func runSearch(cmd *cobra.Command, args []string) error {
+	account, err := getLocalAccount(args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 2 {
+		return errors.New("missing search query")
+	}
+	query, err := search.ParseQuery(strings.Join(args[1:], " "))
+	if err != nil {
+		return err
+	}
+	store, err := local.NewBoltStoreWithConfig(local.Config{
+		Filename:    account.File,
+		Passphrase:  account.Passphrase,
+		KeyFile:     account.KeyFile,
+		SearchIndex: account.SearchIndex,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot open database: %w", err)
+	}
+	defer store.Close()
+
+	if !store.HasSearchIndex() {
+		return errors.New("no search index in this database: add \"searchIndex: true\" to the account or run the \"db index\" command")
+	}
+	results, err := store.Search(query)
+	if err != nil {
+		return err
+	}
+	table := pterm.DefaultTable.WithHasHeader().WithData(pterm.TableData{
+		{"Mailbox", "UID", "Date", "Size"},
+	})
+	for _, result := range results {
+		if searchOptions.mailbox != "" && result.Mailbox != searchOptions.mailbox {
+			continue
+		}
+		table.Data = append(table.Data, []string{
+			result.Mailbox,
+			result.UID.String(),
+			result.Date.Format(dateFormat),
+			strconv.FormatUint(uint64(result.Size), 10),
+		})
+	}
+	if len(table.Data) == 1 {
+		term.Info("No message found")
+		return nil
+	}
+	_ = table.Render()
+	term.Infof("%d message(s) found", len(table.Data)-1)
+	return nil
+}
@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"github.com/creativeprojects/imap/lib"
+	"github.com/creativeprojects/imap/server"
+	"github.com/creativeprojects/imap/storage"
+	"github.com/creativeprojects/imap/term"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/spf13/cobra"
+)
+
+const defaultListenAddress = "localhost:1143"
+
+type serveFlags struct {
+	listen   string
+	readOnly bool
+}
+
+var (
+	serveCmd = &cobra.Command{
+		Use:   "serve",
+		Short: "Serve the accounts configured in the serve section over IMAP",
+		RunE:  runServe,
+	}
+	serveOptions serveFlags
+)
+
+func init() {
+	flag := serveCmd.Flags()
+	flag.StringVarP(&serveOptions.listen, "listen", "l", "", "address to listen to (default from configuration or "+defaultListenAddress+")")
+	flag.BoolVar(&serveOptions.readOnly, "read-only", false, "forbid any modification to the accounts")
+	rootCmd.AddCommand(serveCmd)
+}
+
+func runServe(cmd *cobra.Command, args []string) error {
+	if len(config.Serve.Users) == 0 {
+		return errors.New("no user defined in the serve section of the configuration")
+	}
+
+	var logger lib.Logger
+	if global.verbose {
+		logger = log.New(os.Stdout, "serve: ", 0)
+	}
+
+	// backends are shared between users pointing to the same account
+	backends := make(map[string]storage.Backend)
+	defer func() {
+		for _, backend := range backends {
+			_ = backend.Close()
+		}
+	}()
+
+	accounts := make([]server.Account, 0, len(config.Serve.Users))
+	for username, user := range config.Serve.Users {
+		backend, ok := backends[user.Account]
+		if !ok {
+			account, ok := config.Accounts[user.Account]
+			if !ok {
+				return fmt.Errorf("account not found for user %s: %s", username, user.Account)
+			}
+			var err error
+			backend, err = NewBackend(cmd.Context(), account, logger)
+			if err != nil {
+				return fmt.Errorf("cannot open backend %s: %w", user.Account, err)
+			}
+			backends[user.Account] = backend
+		}
+		accounts = append(accounts, server.Account{
+			Username: username,
+			Password: user.Password,
+			Backend:  backend,
+			ReadOnly: user.ReadOnly || serveOptions.readOnly,
+		})
+	}
+
+	imapServer := imapserver.New(server.NewBackend(accounts, logger))
+	imapServer.Addr = serveOptions.listen
+	if imapServer.Addr == "" {
+		imapServer.Addr = config.Serve.Listen
+	}
+	if imapServer.Addr == "" {
+		imapServer.Addr = defaultListenAddress
+	}
+	if global.verbose {
+		imapServer.ErrorLog = log.New(os.Stderr, "server: ", 0)
+	}
+
+	if config.Serve.TLSCert != "" && config.Serve.TLSKey != "" {
+		certificate, err := tls.LoadX509KeyPair(config.Serve.TLSCert, config.Serve.TLSKey)
+		if err != nil {
+			return fmt.Errorf("cannot load TLS certificate: %w", err)
+		}
+		imapServer.TLSConfig = &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{certificate},
+		}
+	} else {
+		term.Warn("no TLS certificate configured: passwords will be sent in clear text")
+		imapServer.AllowInsecureAuth = true
+	}
+
+	go func() {
+		// cancelled by an interrupt signal
+		<-cmd.Context().Done()
+		term.Info("stopping IMAP server")
+		_ = imapServer.Close()
+	}()
+
+	term.Infof("IMAP server listening on %s", imapServer.Addr)
+	var err error
+	if imapServer.TLSConfig != nil {
+		err = imapServer.ListenAndServeTLS()
+	} else {
+		err = imapServer.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/creativeprojects/imap/cfg"
+	"github.com/creativeprojects/imap/lib"
+	"github.com/creativeprojects/imap/mailbox"
+	"github.com/creativeprojects/imap/storage"
+	"github.com/creativeprojects/imap/term"
+	"github.com/spf13/cobra"
+)
+
+type watchFlags struct {
+	mailboxes         []string
+	pollInterval      time.Duration
+	reconnectDelay    time.Duration
+	reconnectMaxDelay time.Duration
+}
+
+var (
+	watchCmd = &cobra.Command{
+		Use:   "watch",
+		Short: "Copy the new messages as soon as they arrive in the source mailboxes (from a job, or between two accounts)",
+		RunE:  runWatch,
+	}
+	watchOptions watchFlags
+)
+
+func init() {
+	flag := watchCmd.Flags()
+	flag.StringSliceVarP(&watchOptions.mailboxes, "mailbox", "m", nil, "source mailboxes to watch (default the mailboxes of the job, or INBOX)")
+	flag.DurationVar(&watchOptions.pollInterval, "poll-interval", time.Minute, "interval between two checks when the server doesn't support IDLE")
+	flag.DurationVar(&watchOptions.reconnectDelay, "reconnect-delay", time.Second, "delay before reconnecting after the connection is lost, doubled after each attempt")
+	flag.DurationVar(&watchOptions.reconnectMaxDelay, "reconnect-max-delay", 5*time.Minute, "maximum delay between two attempts to reconnect")
+	addCopyFlags(flag)
+	rootCmd.AddCommand(watchCmd)
+}
+
+func runWatch(cmd *cobra.Command, args []string) error {
+	var job cfg.Job
+	switch len(args) {
+	case 1:
+		var ok bool
+		job, ok = config.Jobs[args[0]]
+		if !ok {
+			return fmt.Errorf("job not found: %s", args[0])
+		}
+	case 2:
+		job = cfg.Job{
+			Source:      args[0],
+			Destination: args[1],
+			Mailboxes:   []string{"INBOX"},
+		}
+	default:
+		return errors.New("missing job name, or source and destination account names")
+	}
+	if len(watchOptions.mailboxes) > 0 {
+		job.Mailboxes = watchOptions.mailboxes
+	}
+	if _, ok := config.Accounts[job.Destination]; !ok {
+		return fmt.Errorf("destination account not found: %s", job.Destination)
+	}
+	account, ok := config.Accounts[job.Source]
+	if !ok {
+		return fmt.Errorf("source account not found: %s", job.Source)
+	}
+
+	ctx := cmd.Context()
+	mailboxes, err := watchedMailboxes(ctx, account, job)
+	if err != nil {
+		return err
+	}
+	if len(mailboxes) == 0 {
+		return errors.New("no mailbox to watch in the source account")
+	}
+	if job.Mode == cfg.ModeMove || job.Mode == cfg.ModeMirror {
+		rename, err := job.Renamer()
+		if err != nil {
+			return err
+		}
+		err = checkMergedMailboxes(job, mailboxes, rename)
+		if err != nil {
+			return err
+		}
+	}
+	// there's nobody to look at the progress bars
+	global.noProgress = true
+
+	// the copies are made one at a time, so they don't change the same history at the same time
+	var copying sync.Mutex
+	var wg sync.WaitGroup
+	for _, mbox := range mailboxes {
+		changed := make(chan struct{}, 1)
+		wg.Go(func() {
+			watchMailbox(ctx, account, mbox, changed)
+		})
+		wg.Go(func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-changed:
+					copying.Lock()
+					copyWatchedMailbox(ctx, job, mbox)
+					copying.Unlock()
+				}
+			}
+		})
+	}
+	term.Infof("watching %d mailboxes from %s to %s", len(mailboxes), job.Source, job.Destination)
+	wg.Wait()
+	return nil
+}
+
+// watchedMailboxes returns the source mailboxes selected by the job. The source account must support watching.
+func watchedMailboxes(ctx context.Context, account cfg.Account, job cfg.Job) ([]mailbox.Info, error) {
+	backend, err := NewBackend(ctx, account, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open source backend: %w", err)
+	}
+	defer backend.Close()
+
+	if _, ok := backend.(storage.Watcher); !ok {
+		return nil, fmt.Errorf("account %s cannot be watched: only IMAP accounts can notify the new messages", job.Source)
+	}
+	mailboxes, err := backend.ListMailbox(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list source account mailbox: %w", err)
+	}
+	selected := make([]mailbox.Info, 0, len(mailboxes))
+	for _, mbox := range mailboxes {
+		if job.MatchMailbox(mbox.Name) {
+			selected = append(selected, mbox)
+		}
+	}
+	return selected, nil
+}
+
+// watchMailbox keeps a connection to the server watching the mailbox, until the context is cancelled.
+// It reconnects when the connection is lost.
+func watchMailbox(ctx context.Context, account cfg.Account, mbox mailbox.Info, changed chan<- struct{}) {
+	var logger lib.Logger
+	if global.verbose {
+		logger = log.New(os.Stdout, mbox.Name+": ", 0)
+	}
+
+	delay := watchOptions.reconnectDelay
+	for {
+		start := time.Now()
+		err := watchOnce(ctx, account, mbox, logger, changed)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > watchOptions.reconnectMaxDelay {
+			// the connection was working for a while
+			delay = watchOptions.reconnectDelay
+		}
+		term.Warnf("watching mailbox %s: %s (reconnecting in %s)", mbox.Name, err, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, watchOptions.reconnectMaxDelay)
+	}
+}
+
+// watchOnce opens a connection dedicated to watching the mailbox, and returns when the connection is lost
+func watchOnce(ctx context.Context, account cfg.Account, mbox mailbox.Info, logger lib.Logger, changed chan<- struct{}) error {
+	backend, err := NewBackend(ctx, account, logger)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	watcher, ok := backend.(storage.Watcher)
+	if !ok {
+		return errors.New("the account cannot be watched")
+	}
+	// a notification is sent once connected: the messages received while disconnected are copied straight away
+	return watcher.Watch(ctx, mbox, watchOptions.pollInterval, changed)
+}
+
+// copyWatchedMailbox runs an incremental copy of the mailbox with the options of the job
+func copyWatchedMailbox(ctx context.Context, job cfg.Job, mbox mailbox.Info) {
+	job.Mailboxes = []string{mbox.Name}
+	job.Exclude = nil
+	start := time.Now()
+	summary, err := runJob(ctx, job)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		term.Errorf("copy of mailbox %s failed: %s", mbox.Name, err)
+		return
+	}
+	if summary.copied > 0 || summary.failed > 0 || summary.deleted > 0 {
+		term.Infof("mailbox %s: %d copied, %d failed, %d deleted in %s",
+			mbox.Name, summary.copied, summary.failed, summary.deleted, time.Since(start).Round(time.Millisecond))
+	}
+}
@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/creativeprojects/imap/term"
+)
+
+const (
+	// BackupSuffix is added to the name of the previous version of a file written by WriteFileWithBackup
+	BackupSuffix = ".bak"
+	// CorruptSuffix is added to the name of a corrupt file replaced by its backup
+	CorruptSuffix = ".corrupt"
+)
+
+// WriteFileAtomic replaces the file with the content sent by the write function.
+// The content goes to a temporary file in the same directory, which is synced then renamed over the file:
+// a crash or a full disk leaves the previous version of the file, never a truncated one.
+func WriteFileAtomic(filename string, perm os.FileMode, write func(w io.Writer) error) error {
+	return writeFileAtomic(filename, perm, false, write)
+}
+
+// WriteFileWithBackup is like WriteFileAtomic, and also keeps the previous version of the file with the BackupSuffix.
+// Read the file with ReadFileWithBackup to recover from the backup automatically.
+func WriteFileWithBackup(filename string, perm os.FileMode, write func(w io.Writer) error) error {
+	return writeFileAtomic(filename, perm, true, write)
+}
+
+func writeFileAtomic(filename string, perm os.FileMode, backup bool, write func(w io.Writer) error) error {
+	dir := filepath.Dir(filename)
+	temp, err := os.CreateTemp(dir, filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tempName := temp.Name()
+	err = write(temp)
+	if err == nil {
+		err = temp.Chmod(perm)
+	}
+	if err == nil {
+		err = temp.Sync()
+	}
+	err = errors.Join(err, temp.Close())
+	if err != nil {
+		_ = os.Remove(tempName)
+		return err
+	}
+
+	if backup {
+		err = backupFile(filename)
+		if err != nil {
+			_ = os.Remove(tempName)
+			return err
+		}
+	}
+	err = os.Rename(tempName, filename)
+	if err != nil {
+		_ = os.Remove(tempName)
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// backupFile keeps the current version of the file as a hard link, so the file is never missing.
+// It's moved instead when the file system doesn't support hard links.
+// The previous backup is kept when there's no current version (after recovering from a corrupt file).
+func backupFile(filename string) error {
+	_, err := os.Lstat(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	backup := filename + BackupSuffix
+	err = os.Remove(backup)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	err = os.Link(filename, backup)
+	if err == nil {
+		return nil
+	}
+	return os.Rename(filename, backup)
+}
+
+// syncDir saves the new entries of the directory on disk (it's not supported on all the systems)
+func syncDir(dir string) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = file.Sync()
+	_ = file.Close()
+}
+
+// ReadFileWithBackup reads the file with the read function. When the file is missing or corrupt (read returns an error),
+// the backup kept by WriteFileWithBackup is read instead, and a warning is displayed. The corrupt file is renamed
+// with the CorruptSuffix, so the next write doesn't replace the backup with it.
+// The read function is called again for the backup: it must start from scratch each time.
+// The error matches fs.ErrNotExist when there's no file and no backup.
+func ReadFileWithBackup(filename string, read func(r io.Reader) error) error {
+	err := readFile(filename, read)
+	if err == nil {
+		return nil
+	}
+	backupErr := readFile(filename+BackupSuffix, read)
+	if backupErr != nil {
+		return err
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		term.Warnf("file %s is missing: using its backup", filename)
+		return nil
+	}
+	term.Warnf("file %s is corrupt (%s): using its backup", filename, err)
+	_ = os.Rename(filename, filename+CorruptSuffix)
+	return nil
+}
+
+func readFile(filename string, read func(r io.Reader) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return read(file)
+}
@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeString(content string) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		_, err := io.WriteString(w, content)
+		return err
+	}
+}
+
+func readString(content *string) func(r io.Reader) error {
+	return func(r io.Reader) error {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 || data[len(data)-1] != '}' {
+			return errors.New("truncated")
+		}
+		*content = string(data)
+		return nil
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "file.json")
+
+	require.NoError(t, WriteFileAtomic(filename, 0600, writeString("{1}")))
+	require.NoError(t, WriteFileAtomic(filename, 0600, writeString("{2}")))
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "{2}", string(data))
+	assert.NoFileExists(t, filename+BackupSuffix)
+
+	// a failed write leaves the file untouched, without temporary file
+	err = WriteFileAtomic(filename, 0600, func(w io.Writer) error {
+		_, _ = io.WriteString(w, "{3")
+		return errors.New("disk full")
+	})
+	require.Error(t, err)
+	data, err = os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "{2}", string(data))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestWriteFileWithBackup(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "file.json")
+
+	require.NoError(t, WriteFileWithBackup(filename, 0600, writeString("{1}")))
+	assert.NoFileExists(t, filename+BackupSuffix)
+
+	require.NoError(t, WriteFileWithBackup(filename, 0600, writeString("{2}")))
+	require.NoError(t, WriteFileWithBackup(filename, 0600, writeString("{3}")))
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "{3}", string(data))
+	data, err = os.ReadFile(filename + BackupSuffix)
+	require.NoError(t, err)
+	assert.Equal(t, "{2}", string(data))
+}
+
+func TestReadFileWithBackup(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "file.json")
+	content := ""
+
+	err := ReadFileWithBackup(filename, readString(&content))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	require.NoError(t, WriteFileWithBackup(filename, 0600, writeString("{1}")))
+	require.NoError(t, WriteFileWithBackup(filename, 0600, writeString("{2}")))
+	require.NoError(t, ReadFileWithBackup(filename, readString(&content)))
+	assert.Equal(t, "{2}", content)
+
+	// the file was truncated by a crash
+	require.NoError(t, os.WriteFile(filename, []byte("{2"), 0600))
+	require.NoError(t, ReadFileWithBackup(filename, readString(&content)))
+	assert.Equal(t, "{1}", content)
+	assert.FileExists(t, filename+CorruptSuffix)
+
+	// the next write keeps the good backup
+	require.NoError(t, WriteFileWithBackup(filename, 0600, writeString("{3}")))
+	data, err := os.ReadFile(filename + BackupSuffix)
+	require.NoError(t, err)
+	assert.Equal(t, "{1}", string(data))
+
+	// the file is missing
+	require.NoError(t, os.Remove(filename))
+	require.NoError(t, ReadFileWithBackup(filename, readString(&content)))
+	assert.Equal(t, "{1}", content)
+
+	// the backup is corrupt too
+	require.NoError(t, os.WriteFile(filename, []byte("{4"), 0600))
+	require.NoError(t, os.WriteFile(filename+BackupSuffix, []byte("{5"), 0600))
+	err = ReadFileWithBackup(filename, readString(&content))
+	assert.EqualError(t, err, "truncated")
+}
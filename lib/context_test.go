@@ -0,0 +1,26 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContextReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reader := NewContextReader(ctx, strings.NewReader("0123456789"))
+	buffer := make([]byte, 4)
+	read, err := reader.Read(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "0123", string(buffer[:read]))
+
+	cancel()
+	_, err = io.ReadAll(reader)
+	assert.ErrorIs(t, err, context.Canceled)
+}
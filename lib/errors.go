@@ -7,4 +7,7 @@ var (
 	ErrInfoNotFound    = errors.New("mailbox info not found")
 	ErrStatusNotFound  = errors.New("mailbox status not found")
 	ErrNotSelected     = errors.New("mailbox not selected")
+	ErrMessageNotFound = errors.New("message not found")
+	ErrNotSupported    = errors.New("operation not supported by the backend")
+	ErrNoAccountID     = errors.New("no account ID saved yet")
 )
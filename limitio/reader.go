@@ -24,30 +24,28 @@ func (s *Reader) SetRateLimit(bytesPerSec float64, burst int) {
 	s.limiter = rate.NewLimiter(rate.Limit(bytesPerSec), burst)
 }
 
+// SetLimiter shares the limiter with other readers: their total rate is limited.
+func (s *Reader) SetLimiter(limiter *rate.Limiter) {
+	s.limiter = limiter
+}
+
 // Read bytes into p.
 func (s *Reader) Read(p []byte) (int, error) {
 	if s.limiter == nil {
 		return s.source.Read(p)
 	}
-	// ask for a burst of data
-	err := s.limiter.WaitN(context.Background(), s.limiter.Burst())
-	if err != nil {
-		return 0, err
+	// read no more than a burst at a time
+	if len(p) > s.limiter.Burst() {
+		p = p[:s.limiter.Burst()]
 	}
-	// read all data
 	n, err := s.source.Read(p)
-	if err != nil {
+	if n == 0 {
 		return n, err
 	}
-	// then wait for the tokens to allow the time needed for reading it all
-	left := n - s.limiter.Burst() // remove first burst
-	for left > 0 {
-		singleRead := min(left, s.limiter.Burst())
-		err = s.limiter.WaitN(context.Background(), singleRead)
-		if err != nil {
-			return n, err
-		}
-		left -= singleRead
+	// then wait for the tokens of the data actually read
+	waitErr := s.limiter.WaitN(context.Background(), n)
+	if waitErr != nil {
+		return n, waitErr
 	}
-	return n, nil
+	return n, err
 }
@@ -11,6 +11,7 @@ import (
 	"github.com/creativeprojects/imap/limitio"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
 )
 
 const burst = 1024 // 1KB of burst
@@ -67,6 +68,23 @@ func TestRead(t *testing.T) {
 	}
 }
 
+func TestReadSmallMessagesWithSharedLimiter(t *testing.T) {
+	t.Parallel()
+	// the small reads only use the tokens of the data read, and share the burst
+	limiter := rate.NewLimiter(rate.Limit(100*1024), 32*1024)
+	start := time.Now()
+	total := int64(0)
+	for range 200 {
+		reader := limitio.NewReader(bytes.NewReader(bytes.Repeat([]byte{13}, 100)))
+		reader.SetLimiter(limiter)
+		n, err := io.Copy(io.Discard, reader)
+		require.NoError(t, err)
+		total += n
+	}
+	assert.Equal(t, int64(20000), total)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
 func TestWrite(t *testing.T) {
 	t.Parallel()
 	if testing.Short() {
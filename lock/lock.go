@@ -0,0 +1,162 @@
+// Package lock gives exclusive access to an account between processes, with a lock file.
+//
+// The file is locked by the operating system (flock or LockFileEx): the lock is released when the process ends,
+// even if it crashed. The file also contains the process holding the lock, to explain who is using the account.
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/creativeprojects/imap/lib"
+)
+
+// retryInterval is the delay between two attempts to get the lock
+const retryInterval = 100 * time.Millisecond
+
+// ErrLocked is returned when the lock is held by another process
+var ErrLocked = errors.New("locked by another process")
+
+// Owner is the process holding the lock
+type Owner struct {
+	PID      int       `json:"pid"`
+	Hostname string    `json:"hostname"`
+	Since    time.Time `json:"since"`
+}
+
+func (o Owner) String() string {
+	return fmt.Sprintf("process %d on %s since %s", o.PID, o.Hostname, o.Since.Format(time.DateTime))
+}
+
+// LockedError explains who is holding the lock. It matches ErrLocked with errors.Is.
+type LockedError struct {
+	Path string
+	// Owner is nil when the file doesn't say who is holding it
+	Owner *Owner
+}
+
+func (e *LockedError) Error() string {
+	if e.Owner == nil {
+		return fmt.Sprintf("%s is %s", e.Path, ErrLocked)
+	}
+	return fmt.Sprintf("%s is locked by %s", e.Path, e.Owner)
+}
+
+func (e *LockedError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// Lock is an exclusive lock on a file
+type Lock struct {
+	file *os.File
+	path string
+}
+
+// Acquire locks the file, waiting up to timeout when another process holds it (zero to fail straight away).
+// The file and its directory are created if needed. A stale lock, left by a process which ended without releasing it, is reported to the logger.
+func Acquire(ctx context.Context, path string, timeout time.Duration, logger lib.Logger) (*Lock, error) {
+	if logger == nil {
+		logger = &lib.NoLog{}
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err = lockFile(file)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errWouldBlock) {
+			_ = file.Close()
+			return nil, fmt.Errorf("cannot lock %s: %w", path, err)
+		}
+		if !time.Now().Before(deadline) {
+			owner, _ := readOwner(file)
+			_ = file.Close()
+			return nil, &LockedError{Path: path, Owner: owner}
+		}
+		select {
+		case <-ctx.Done():
+			_ = file.Close()
+			return nil, ctx.Err()
+		case <-time.After(retryInterval):
+		}
+	}
+
+	if owner, _ := readOwner(file); owner != nil {
+		// the previous owner didn't release the lock properly
+		logger.Printf("removing stale lock %s left by %s", path, owner)
+	}
+	lock := &Lock{file: file, path: path}
+	err = lock.writeOwner()
+	if err != nil {
+		_ = lock.Release()
+		return nil, fmt.Errorf("cannot write lock file %s: %w", path, err)
+	}
+	return lock, nil
+}
+
+// Release empties the lock file and unlocks it. The file is not deleted: another process might be waiting on it.
+func (l *Lock) Release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	err := l.file.Truncate(0)
+	err = errors.Join(err, unlockFile(l.file))
+	err = errors.Join(err, l.file.Close())
+	l.file = nil
+	return err
+}
+
+// Path of the lock file
+func (l *Lock) Path() string {
+	return l.path
+}
+
+func (l *Lock) writeOwner() error {
+	hostname, _ := os.Hostname()
+	data, err := json.Marshal(Owner{
+		PID:      os.Getpid(),
+		Hostname: hostname,
+		Since:    time.Now().Truncate(time.Second),
+	})
+	if err != nil {
+		return err
+	}
+	err = l.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.WriteAt(data, 0)
+	if err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// readOwner returns nil when the file is empty
+func readOwner(file *os.File) (*Owner, error) {
+	data, err := io.ReadAll(io.NewSectionReader(file, 0, 1<<16))
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	owner := &Owner{}
+	err = json.Unmarshal(data, owner)
+	if err != nil {
+		return nil, err
+	}
+	return owner, nil
+}
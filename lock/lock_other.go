@@ -0,0 +1,20 @@
+//go:build !unix && !windows
+
+package lock
+
+import (
+	"errors"
+	"os"
+
+	"github.com/creativeprojects/imap/lib"
+)
+
+var errWouldBlock = errors.New("would block")
+
+func lockFile(file *os.File) error {
+	return lib.ErrNotSupported
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,96 @@
+package lock
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcquireAndRelease(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "account", ".imap.lock")
+
+	lock, err := Acquire(t.Context(), path, 0, nil)
+	require.NoError(t, err)
+	assert.Equal(t, path, lock.Path())
+
+	_, err = Acquire(t.Context(), path, 0, nil)
+	require.ErrorIs(t, err, ErrLocked)
+	lockedErr := &LockedError{}
+	require.ErrorAs(t, err, &lockedErr)
+	require.NotNil(t, lockedErr.Owner)
+	assert.Equal(t, os.Getpid(), lockedErr.Owner.PID)
+	assert.Contains(t, err.Error(), "is locked by process")
+
+	require.NoError(t, lock.Release())
+	// released twice
+	require.NoError(t, lock.Release())
+
+	lock, err = Acquire(t.Context(), path, 0, nil)
+	require.NoError(t, err)
+	require.NoError(t, lock.Release())
+}
+
+func TestAcquireTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".imap.lock")
+	lock, err := Acquire(t.Context(), path, 0, nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = Acquire(t.Context(), path, 300*time.Millisecond, nil)
+	assert.ErrorIs(t, err, ErrLocked)
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+
+	// the lock is released while waiting
+	time.AfterFunc(200*time.Millisecond, func() {
+		_ = lock.Release()
+	})
+	second, err := Acquire(t.Context(), path, 5*time.Second, nil)
+	require.NoError(t, err)
+	require.NoError(t, second.Release())
+}
+
+func TestAcquireCancelled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".imap.lock")
+	lock, err := Acquire(t.Context(), path, 0, nil)
+	require.NoError(t, err)
+	defer lock.Release()
+
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	_, err = Acquire(ctx, path, time.Minute, nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestAcquireStaleLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".imap.lock")
+	// a process ended without releasing the lock
+	data, err := json.Marshal(Owner{PID: 123456, Hostname: "elsewhere", Since: time.Now().Add(-time.Hour)})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data, 0600))
+
+	buffer := &bytes.Buffer{}
+	lock, err := Acquire(t.Context(), path, 0, log.New(buffer, "", 0))
+	require.NoError(t, err)
+	assert.Contains(t, buffer.String(), "removing stale lock")
+	assert.Contains(t, buffer.String(), "process 123456 on elsewhere")
+
+	// the file now belongs to this process
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	owner := Owner{}
+	require.NoError(t, json.Unmarshal(data, &owner))
+	assert.Equal(t, os.Getpid(), owner.PID)
+
+	require.NoError(t, lock.Release())
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Empty(t, data)
+}
@@ -0,0 +1,93 @@
+package mailbox
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/creativeprojects/imap/lib"
+)
+
+// Handle is a mailbox opened by a storage backend. It carries its own status:
+// many mailboxes can be opened at the same time, and used from different goroutines.
+type Handle interface {
+	// Status of the mailbox when it was opened
+	Status() *Status
+	// Fetch sends the messages of the mailbox to the channel, and closes it when done.
+	// Use the zero Time to fetch all messages.
+	Fetch(ctx context.Context, since time.Time, messages chan *Message) error
+	// FetchUids sends the messages with these UIDs to the channel, and closes it when done.
+	// The UIDs not found in the mailbox are skipped.
+	FetchUids(ctx context.Context, uids []MessageID, messages chan *Message) error
+	// Uids returns the UIDs of all the messages in the mailbox, in ascending order
+	Uids(ctx context.Context) ([]MessageID, error)
+	// LatestDate returns the internal date of the latest message
+	LatestDate(ctx context.Context) (time.Time, error)
+	// Put saves a new message in the mailbox
+	Put(ctx context.Context, props MessageProperties, body io.Reader) (MessageID, error)
+	// Delete removes a single message from the mailbox
+	Delete(ctx context.Context, uid MessageID) error
+	// SetFlags replaces the flags of a message
+	SetFlags(ctx context.Context, uid MessageID, flags []string) error
+	// Close releases the handle: it cannot be used afterwards
+	Close() error
+}
+
+// Selection keeps the handle of the mailbox selected by the SelectMailbox method of the backends
+type Selection struct {
+	mutex  sync.Mutex
+	handle Handle
+}
+
+// Select replaces the selected mailbox, closing the previous one
+func (s *Selection) Select(handle Handle) *Status {
+	s.mutex.Lock()
+	previous := s.handle
+	s.handle = handle
+	s.mutex.Unlock()
+
+	if previous != nil {
+		_ = previous.Close()
+	}
+	return handle.Status()
+}
+
+// Fetch the messages of the selected mailbox. The channel is closed even when no mailbox is selected.
+func (s *Selection) Fetch(ctx context.Context, since time.Time, messages chan *Message) error {
+	handle := s.get()
+	if handle == nil {
+		close(messages)
+		return lib.ErrNotSelected
+	}
+	return handle.Fetch(ctx, since, messages)
+}
+
+// LatestDate returns the internal date of the latest message of the selected mailbox
+func (s *Selection) LatestDate(ctx context.Context) (time.Time, error) {
+	handle := s.get()
+	if handle == nil {
+		return time.Time{}, lib.ErrNotSelected
+	}
+	return handle.LatestDate(ctx)
+}
+
+// Unselect closes the selected mailbox, if any
+func (s *Selection) Unselect() error {
+	s.mutex.Lock()
+	handle := s.handle
+	s.handle = nil
+	s.mutex.Unlock()
+
+	if handle == nil {
+		return nil
+	}
+	return handle.Close()
+}
+
+func (s *Selection) get() Handle {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.handle
+}
@@ -0,0 +1,88 @@
+package mailbox
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/creativeprojects/imap/lib"
+	"github.com/stretchr/testify/assert"
+)
+
+type testHandle struct {
+	status Status
+	closed bool
+}
+
+func (h *testHandle) Status() *Status {
+	return &h.status
+}
+
+func (h *testHandle) Fetch(ctx context.Context, since time.Time, messages chan *Message) error {
+	close(messages)
+	return nil
+}
+
+func (h *testHandle) FetchUids(ctx context.Context, uids []MessageID, messages chan *Message) error {
+	close(messages)
+	return nil
+}
+
+func (h *testHandle) Uids(ctx context.Context) ([]MessageID, error) {
+	return nil, nil
+}
+
+func (h *testHandle) LatestDate(ctx context.Context) (time.Time, error) {
+	return time.Unix(1000, 0), nil
+}
+
+func (h *testHandle) Put(ctx context.Context, props MessageProperties, body io.Reader) (MessageID, error) {
+	return EmptyMessageID, nil
+}
+
+func (h *testHandle) Delete(ctx context.Context, uid MessageID) error {
+	return nil
+}
+
+func (h *testHandle) SetFlags(ctx context.Context, uid MessageID, flags []string) error {
+	return nil
+}
+
+func (h *testHandle) Close() error {
+	h.closed = true
+	return nil
+}
+
+func TestSelectionNotSelected(t *testing.T) {
+	selection := Selection{}
+
+	messages := make(chan *Message)
+	err := selection.Fetch(context.Background(), time.Time{}, messages)
+	assert.ErrorIs(t, err, lib.ErrNotSelected)
+	_, open := <-messages
+	assert.False(t, open)
+
+	_, err = selection.LatestDate(context.Background())
+	assert.ErrorIs(t, err, lib.ErrNotSelected)
+
+	assert.NoError(t, selection.Unselect())
+}
+
+func TestSelectionClosesHandles(t *testing.T) {
+	selection := Selection{}
+	first := &testHandle{status: Status{Name: "first"}}
+	second := &testHandle{status: Status{Name: "second"}}
+
+	assert.Equal(t, "first", selection.Select(first).Name)
+	assert.Equal(t, "second", selection.Select(second).Name)
+	assert.True(t, first.closed)
+	assert.False(t, second.closed)
+
+	latest, err := selection.LatestDate(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, time.Unix(1000, 0), latest)
+
+	assert.NoError(t, selection.Unselect())
+	assert.True(t, second.closed)
+}
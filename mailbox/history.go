@@ -2,10 +2,16 @@ package mailbox
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"io/fs"
+	"slices"
 	"sort"
+	"strings"
 	"time"
+
+	"github.com/creativeprojects/imap/lib"
 )
 
 type History struct {
@@ -14,10 +20,12 @@ type History struct {
 
 type HistoryAction struct {
 	SourceAccountTag string
-	Date             time.Time
-	Action           string
-	UidValidity      uint32
-	Entries          []HistoryEntry
+	// SourceMailbox is the name of the mailbox copied (empty in the actions saved by older versions)
+	SourceMailbox string `json:",omitempty"`
+	Date          time.Time
+	Action        string
+	UidValidity   uint32
+	Entries       []HistoryEntry
 }
 
 type HistoryEntry struct {
@@ -28,20 +36,23 @@ type HistoryEntry struct {
 
 const (
 	ActionCopy = "COPY"
+	// ActionFailed lists the messages which could not be copied: the entries have no MessageID
+	ActionFailed = "FAILED"
+	// ActionDelete lists the messages deleted from the destination because they were deleted from the source
+	ActionDelete = "DELETE"
 )
 
+// GetHistoryFromFile reads the history saved by SaveHistoryToFile.
+// A corrupt file is replaced by its backup, and a missing file returns an empty history.
 func GetHistoryFromFile(filename string) (*History, error) {
-	history := &History{}
-	file, err := os.Open(filename)
-	if err != nil {
-		// return nil, fmt.Errorf("cannot open history file: %w", err)
-		// return an empty history instead
-		return history, nil
+	var history *History
+	err := lib.ReadFileWithBackup(filename, func(r io.Reader) error {
+		history = &History{}
+		return json.NewDecoder(r).Decode(history)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return &History{}, nil
 	}
-	defer file.Close()
-
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(history)
 	if err != nil {
 		return nil, fmt.Errorf("error reading history file: %w", err)
 	}
@@ -52,19 +63,42 @@ func GetHistoryFromFile(filename string) (*History, error) {
 	return history, nil
 }
 
+// SaveHistoryToFile replaces the history file atomically, keeping the previous version as a backup
 func SaveHistoryToFile(filename string, history *History) error {
-	file, err := os.Create(filename)
+	err := lib.WriteFileWithBackup(filename, 0600, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(history)
+	})
 	if err != nil {
 		return fmt.Errorf("cannot save history: %w", err)
 	}
-	defer file.Close()
+	return nil
+}
 
-	encoder := json.NewEncoder(file)
-	err = encoder.Encode(history)
-	if err != nil {
-		return fmt.Errorf("cannot encode history: %w", err)
+// MergeHistory returns the actions of both histories sorted by date: the actions of other already in history are skipped
+func MergeHistory(history, other *History) *History {
+	merged := &History{
+		Actions: make([]HistoryAction, 0, len(history.Actions)+len(other.Actions)),
 	}
-	return nil
+	merged.Actions = append(merged.Actions, history.Actions...)
+	for _, action := range other.Actions {
+		if !slices.ContainsFunc(history.Actions, action.sameAs) {
+			merged.Actions = append(merged.Actions, action)
+		}
+	}
+	sort.SliceStable(merged.Actions, func(i, j int) bool {
+		return merged.Actions[i].Date.Before(merged.Actions[j].Date)
+	})
+	return merged
+}
+
+// sameAs returns true when both actions record the same operation
+func (a HistoryAction) sameAs(other HistoryAction) bool {
+	return a.Date.Equal(other.Date) &&
+		a.Action == other.Action &&
+		a.SourceAccountTag == other.SourceAccountTag &&
+		a.SourceMailbox == other.SourceMailbox &&
+		a.UidValidity == other.UidValidity &&
+		len(a.Entries) == len(other.Entries)
 }
 
 func FindHistoryEntryFromSourceID(history *History, sourceMessageID MessageID) *HistoryEntry {
@@ -72,6 +106,9 @@ func FindHistoryEntryFromSourceID(history *History, sourceMessageID MessageID) *
 		return nil
 	}
 	for _, action := range history.Actions {
+		if action.Action == ActionFailed || action.Action == ActionDelete {
+			continue
+		}
 		for _, entry := range action.Entries {
 			if entry.SourceID == sourceMessageID {
 				return &entry
@@ -114,6 +151,9 @@ func FindLatestInternalDateFromHistory(sourceAccountTag string, history *History
 		if sourceAccountTag != "" && sourceAccountTag != action.SourceAccountTag {
 			continue
 		}
+		if action.Action == ActionFailed || action.Action == ActionDelete {
+			continue
+		}
 		// we also believe messages are in order
 		for entryID := len(action.Entries) - 1; entryID >= 0; entryID-- {
 			if action.Entries[entryID].SourceInternalDate.After(zero) {
@@ -123,3 +163,334 @@ func FindLatestInternalDateFromHistory(sourceAccountTag string, history *History
 	}
 	return zero
 }
+
+// FindFailedEntries returns the messages from the source account which could not be copied, and were not copied since
+func FindFailedEntries(sourceAccountTag string, history *History) []HistoryEntry {
+	if history == nil {
+		return nil
+	}
+	failed := make([]HistoryEntry, 0)
+	found := make(map[MessageID]bool)
+	for _, action := range history.Actions {
+		if action.Action != ActionFailed {
+			continue
+		}
+		if sourceAccountTag != "" && sourceAccountTag != action.SourceAccountTag {
+			continue
+		}
+		for _, entry := range action.Entries {
+			if found[entry.SourceID] || FindHistoryEntryFromSourceID(history, entry.SourceID) != nil {
+				// already listed, or copied since
+				continue
+			}
+			found[entry.SourceID] = true
+			failed = append(failed, entry)
+		}
+	}
+	return failed
+}
+
+// FindCopiedEntries returns the messages copied from the source account which were not deleted since, by source ID
+func FindCopiedEntries(sourceAccountTag string, history *History) map[MessageID]HistoryEntry {
+	copied := make(map[MessageID]HistoryEntry)
+	if history == nil {
+		return copied
+	}
+	for _, action := range history.Actions {
+		if sourceAccountTag != "" && sourceAccountTag != action.SourceAccountTag {
+			continue
+		}
+		switch action.Action {
+		case ActionFailed:
+			continue
+		case ActionDelete:
+			for _, entry := range action.Entries {
+				delete(copied, entry.SourceID)
+			}
+		default:
+			for _, entry := range action.Entries {
+				copied[entry.SourceID] = entry
+			}
+		}
+	}
+	return copied
+}
+
+// SourceMailboxHistory returns the actions of the history copying from this mailbox of the source account with this UID validity:
+// the UIDs are only valid in one mailbox, and they are reused after the UID validity of the mailbox changed.
+// The actions saved without their source mailbox (by older versions) are kept.
+func SourceMailboxHistory(history *History, sourceAccountTag, sourceMailbox string, uidValidity uint32) *History {
+	selected := &History{
+		Actions: make([]HistoryAction, 0),
+	}
+	if history == nil {
+		return selected
+	}
+	for _, action := range history.Actions {
+		if action.SourceAccountTag != sourceAccountTag ||
+			action.UidValidity != uidValidity ||
+			(action.SourceMailbox != "" && action.SourceMailbox != sourceMailbox) {
+			continue
+		}
+		selected.Actions = append(selected.Actions, action)
+	}
+	return selected
+}
+
+// HasStringSourceIDs returns true when some messages copied from the source mailbox are identified by a string:
+// the maildir messages were identified by their key before they had a UID.
+func HasStringSourceIDs(history *History, sourceAccountTag, sourceMailbox string) bool {
+	if history == nil {
+		return false
+	}
+	for _, action := range history.Actions {
+		if action.SourceAccountTag != sourceAccountTag ||
+			(action.SourceMailbox != "" && action.SourceMailbox != sourceMailbox) {
+			continue
+		}
+		for _, entry := range action.Entries {
+			if entry.SourceID.IsString() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MigrateSourceIDs returns a copy of the history where the string IDs of the messages copied from the source mailbox
+// are replaced by their new ID from ids. The actions migrated get the UID validity of the new IDs.
+// It returns false when no ID was found in ids.
+func MigrateSourceIDs(history *History, sourceAccountTag, sourceMailbox string, uidValidity uint32, ids map[string]MessageID) (*History, bool) {
+	if history == nil {
+		return history, false
+	}
+	migrated := &History{
+		Actions: make([]HistoryAction, len(history.Actions)),
+	}
+	changed := false
+	for i, action := range history.Actions {
+		migrated.Actions[i] = action
+		if action.SourceAccountTag != sourceAccountTag ||
+			(action.SourceMailbox != "" && action.SourceMailbox != sourceMailbox) {
+			continue
+		}
+		entries := slices.Clone(action.Entries)
+		found := false
+		for j, entry := range entries {
+			if !entry.SourceID.IsString() {
+				continue
+			}
+			if id, ok := ids[entry.SourceID.AsString()]; ok {
+				entries[j].SourceID = id
+				found = true
+			}
+		}
+		if found {
+			migrated.Actions[i].Entries = entries
+			migrated.Actions[i].UidValidity = uidValidity
+			changed = true
+		}
+	}
+	return migrated, changed
+}
+
+// CompactHistory merges the actions of each source mailbox and UID validity into one COPY action with the messages
+// still copied, one DELETE action and one FAILED action with the messages which failed and were not copied since.
+// The messages copied then deleted by a mirror copy are dropped, and the messages no longer in the destination too
+// when present is not nil (entries without a MessageID are always kept).
+// The entry giving the date of the next copy is always kept, so the next copy doesn't start over from an older date.
+func CompactHistory(history *History, present func(MessageID) bool) *History {
+	compacted := &History{
+		Actions: make([]HistoryAction, 0),
+	}
+	if history == nil {
+		return compacted
+	}
+	actions := slices.Clone(history.Actions)
+	sort.SliceStable(actions, func(i, j int) bool {
+		return actions[i].Date.Before(actions[j].Date)
+	})
+
+	type groupKey struct {
+		sourceAccountTag string
+		sourceMailbox    string
+		uidValidity      uint32
+	}
+	groups := make(map[groupKey]*historyGroup)
+	order := make([]groupKey, 0)
+	for _, action := range actions {
+		key := groupKey{action.SourceAccountTag, action.SourceMailbox, action.UidValidity}
+		group, ok := groups[key]
+		if !ok {
+			group = newHistoryGroup(action.SourceAccountTag, action.SourceMailbox, action.UidValidity)
+			groups[key] = group
+			order = append(order, key)
+		}
+		group.add(action)
+	}
+	for _, key := range order {
+		compacted.Actions = append(compacted.Actions, groups[key].actions(present)...)
+	}
+	sort.SliceStable(compacted.Actions, func(i, j int) bool {
+		return compacted.Actions[i].Date.Before(compacted.Actions[j].Date)
+	})
+	return compacted
+}
+
+// historyGroup collects the actions of one source mailbox and UID validity, to compact them
+type historyGroup struct {
+	sourceAccountTag string
+	sourceMailbox    string
+	uidValidity      uint32
+	copyDate         time.Time
+	deleteDate       time.Time
+	failedDate       time.Time
+	// entries are in the order they were copied: a message copied again is moved to the end (the previous one is nil)
+	entries []*historyGroupEntry
+	index   map[MessageID]int
+	failed  []HistoryEntry
+}
+
+type historyGroupEntry struct {
+	HistoryEntry
+	deleted bool
+}
+
+func newHistoryGroup(sourceAccountTag, sourceMailbox string, uidValidity uint32) *historyGroup {
+	return &historyGroup{
+		sourceAccountTag: sourceAccountTag,
+		sourceMailbox:    sourceMailbox,
+		uidValidity:      uidValidity,
+		index:            make(map[MessageID]int),
+	}
+}
+
+func (g *historyGroup) add(action HistoryAction) {
+	switch action.Action {
+	case ActionFailed:
+		g.failedDate = action.Date
+		g.failed = append(g.failed, action.Entries...)
+	case ActionDelete:
+		g.deleteDate = action.Date
+		for _, entry := range action.Entries {
+			if i, ok := g.index[entry.SourceID]; ok && g.entries[i] != nil {
+				g.entries[i].deleted = true
+			}
+		}
+	default:
+		g.copyDate = action.Date
+		for _, entry := range action.Entries {
+			if i, ok := g.index[entry.SourceID]; ok {
+				g.entries[i] = nil
+			}
+			g.index[entry.SourceID] = len(g.entries)
+			g.entries = append(g.entries, &historyGroupEntry{HistoryEntry: entry})
+		}
+	}
+}
+
+// actions returns the compacted actions of the group
+func (g *historyGroup) actions(present func(MessageID) bool) []HistoryAction {
+	// same search as FindLatestInternalDateFromHistory
+	var latest *historyGroupEntry
+	for i := len(g.entries) - 1; i >= 0 && latest == nil; i-- {
+		if g.entries[i] != nil && !g.entries[i].SourceInternalDate.IsZero() {
+			latest = g.entries[i]
+		}
+	}
+	copies := make([]HistoryEntry, 0)
+	deletes := make([]HistoryEntry, 0)
+	for _, entry := range g.entries {
+		if entry == nil {
+			continue
+		}
+		keep := !entry.deleted && (present == nil || entry.MessageID.IsZero() || present(entry.MessageID))
+		if !keep && entry != latest {
+			continue
+		}
+		copies = append(copies, entry.HistoryEntry)
+		if entry.deleted {
+			deletes = append(deletes, entry.HistoryEntry)
+		}
+	}
+	failed := make([]HistoryEntry, 0)
+	found := make(map[MessageID]bool)
+	for _, entry := range g.failed {
+		// the UIDs are only unique in the same source mailbox and UID validity
+		if _, copied := g.index[entry.SourceID]; copied || found[entry.SourceID] {
+			continue
+		}
+		found[entry.SourceID] = true
+		failed = append(failed, entry)
+	}
+
+	actions := make([]HistoryAction, 0, 3)
+	for _, action := range []HistoryAction{
+		{Date: g.copyDate, Action: ActionCopy, Entries: copies},
+		// the deletion must stay after the copy of the same message
+		{Date: latestDate(g.deleteDate, g.copyDate), Action: ActionDelete, Entries: deletes},
+		{Date: g.failedDate, Action: ActionFailed, Entries: failed},
+	} {
+		if len(action.Entries) == 0 {
+			continue
+		}
+		action.SourceAccountTag = g.sourceAccountTag
+		action.SourceMailbox = g.sourceMailbox
+		action.UidValidity = g.uidValidity
+		actions = append(actions, action)
+	}
+	return actions
+}
+
+func latestDate(date, other time.Time) time.Time {
+	if other.After(date) {
+		return other
+	}
+	return date
+}
+
+// HistoryFilter selects the actions returned by FilterHistory: the zero value selects everything
+type HistoryFilter struct {
+	// SourceAccountTag can be the beginning of the tag only
+	SourceAccountTag string
+	// Since selects the actions on or after this date
+	Since time.Time
+	// Before selects the actions before this date
+	Before time.Time
+	// Actions selects the actions of these types
+	Actions []string
+	// SourceID only keeps the entries of this source message, and the actions containing it
+	SourceID MessageID
+}
+
+// FilterHistory returns the actions of the history selected by the filter
+func FilterHistory(history *History, filter HistoryFilter) *History {
+	filtered := &History{
+		Actions: make([]HistoryAction, 0),
+	}
+	if history == nil {
+		return filtered
+	}
+	for _, action := range history.Actions {
+		if !strings.HasPrefix(action.SourceAccountTag, filter.SourceAccountTag) ||
+			(!filter.Since.IsZero() && action.Date.Before(filter.Since)) ||
+			(!filter.Before.IsZero() && !action.Date.Before(filter.Before)) ||
+			(len(filter.Actions) > 0 && !slices.Contains(filter.Actions, action.Action)) {
+			continue
+		}
+		if !filter.SourceID.IsZero() {
+			entries := make([]HistoryEntry, 0, 1)
+			for _, entry := range action.Entries {
+				if entry.SourceID == filter.SourceID {
+					entries = append(entries, entry)
+				}
+			}
+			if len(entries) == 0 {
+				continue
+			}
+			action.Entries = entries
+		}
+		filtered.Actions = append(filtered.Actions, action)
+	}
+	return filtered
+}
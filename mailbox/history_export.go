@@ -0,0 +1,51 @@
+package mailbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// HistoryExportVersion is the version of the format written by WriteHistoryExport
+const HistoryExportVersion = 1
+
+// HistoryExport is the history of all the mailboxes of an account, in the format of the history export command
+type HistoryExport struct {
+	Version int
+	// AccountID is the ID of the account the history was exported from
+	AccountID string
+	Date      time.Time
+	Mailboxes []MailboxHistory
+}
+
+// MailboxHistory is the history of one mailbox in a HistoryExport
+type MailboxHistory struct {
+	Name      string
+	Delimiter string
+	Actions   []HistoryAction
+}
+
+// WriteHistoryExport writes the export as indented JSON
+func WriteHistoryExport(w io.Writer, export *HistoryExport) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(export)
+}
+
+// ReadHistoryExport reads an export written by WriteHistoryExport
+func ReadHistoryExport(r io.Reader) (*HistoryExport, error) {
+	export := &HistoryExport{}
+	err := json.NewDecoder(r).Decode(export)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read history export: %w", err)
+	}
+	if export.Version == 0 {
+		return nil, errors.New("not a history export: missing version")
+	}
+	if export.Version > HistoryExportVersion {
+		return nil, fmt.Errorf("unsupported history export version %d (maximum %d)", export.Version, HistoryExportVersion)
+	}
+	return export, nil
+}
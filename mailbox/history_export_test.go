@@ -0,0 +1,54 @@
+package mailbox
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistoryExport(t *testing.T) {
+	export := &HistoryExport{
+		Version:   HistoryExportVersion,
+		AccountID: "account",
+		Date:      time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC),
+		Mailboxes: []MailboxHistory{
+			{
+				Name:      "INBOX",
+				Delimiter: "/",
+				Actions: []HistoryAction{{
+					SourceAccountTag: "source",
+					Date:             time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC),
+					Action:           ActionCopy,
+					UidValidity:      12,
+					Entries: []HistoryEntry{
+						{SourceID: NewMessageIDFromUint(1), MessageID: NewMessageIDFromString("key")},
+					},
+				}},
+			},
+		},
+	}
+	buffer := &bytes.Buffer{}
+	require.NoError(t, WriteHistoryExport(buffer, export))
+
+	read, err := ReadHistoryExport(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, export, read)
+}
+
+func TestReadInvalidHistoryExport(t *testing.T) {
+	testCases := []string{
+		`not json`,
+		`{"Actions": []}`,
+		`{"Version": 2}`,
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			_, err := ReadHistoryExport(strings.NewReader(testCase))
+			assert.Error(t, err)
+		})
+	}
+}
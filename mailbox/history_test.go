@@ -1,6 +1,7 @@
 package mailbox
 
 import (
+	"os"
 	"path/filepath"
 	"testing"
 	"time"
@@ -134,3 +135,364 @@ func TestFindLatestActionFromHistory(t *testing.T) {
 	latestMessage := FindLatestInternalDateFromHistory("source", history)
 	assert.True(t, latestMessage.Equal(dayBefore))
 }
+
+func TestFindFailedEntries(t *testing.T) {
+	day := 24 * time.Hour
+	initialTime := time.Date(2020, 1, 1, 12, 20, 0, 0, time.Local)
+	history := &History{
+		Actions: []HistoryAction{
+			{
+				SourceAccountTag: "source",
+				Action:           ActionCopy,
+				Entries: []HistoryEntry{
+					{NewMessageIDFromUint(1), initialTime, NewMessageIDFromUint(11)},
+				},
+			},
+			{
+				SourceAccountTag: "source",
+				Action:           ActionFailed,
+				Entries: []HistoryEntry{
+					{NewMessageIDFromUint(2), initialTime.Add(day), EmptyMessageID},
+					{NewMessageIDFromUint(3), initialTime.Add(2 * day), EmptyMessageID},
+				},
+			},
+			{
+				SourceAccountTag: "another source",
+				Action:           ActionFailed,
+				Entries: []HistoryEntry{
+					{NewMessageIDFromUint(4), initialTime, EmptyMessageID},
+				},
+			},
+			{
+				SourceAccountTag: "source",
+				Action:           ActionCopy,
+				Entries: []HistoryEntry{
+					{NewMessageIDFromUint(2), initialTime.Add(day), NewMessageIDFromUint(12)},
+				},
+			},
+			{
+				SourceAccountTag: "source",
+				Action:           ActionFailed,
+				Entries: []HistoryEntry{
+					{NewMessageIDFromUint(3), initialTime.Add(2 * day), EmptyMessageID},
+				},
+			},
+		},
+	}
+
+	failed := FindFailedEntries("source", history)
+	require.Len(t, failed, 1)
+	assert.Equal(t, NewMessageIDFromUint(3), failed[0].SourceID)
+
+	// the failed messages are not taken as copied
+	assert.Nil(t, FindHistoryEntryFromSourceID(history, NewMessageIDFromUint(3)))
+	latest := FindLatestInternalDateFromHistory("source", history)
+	assert.True(t, latest.Equal(initialTime.Add(day)))
+}
+
+func TestFindCopiedEntries(t *testing.T) {
+	initialTime := time.Date(2020, 1, 1, 12, 20, 0, 0, time.Local)
+	history := &History{
+		Actions: []HistoryAction{
+			{
+				SourceAccountTag: "source",
+				Action:           ActionCopy,
+				Entries: []HistoryEntry{
+					{NewMessageIDFromUint(1), initialTime, NewMessageIDFromUint(11)},
+					{NewMessageIDFromUint(2), initialTime, NewMessageIDFromUint(12)},
+				},
+			},
+			{
+				SourceAccountTag: "another source",
+				Action:           ActionCopy,
+				Entries: []HistoryEntry{
+					{NewMessageIDFromUint(3), initialTime, NewMessageIDFromUint(13)},
+				},
+			},
+			{
+				SourceAccountTag: "source",
+				Action:           ActionFailed,
+				Entries: []HistoryEntry{
+					{NewMessageIDFromUint(4), initialTime, EmptyMessageID},
+				},
+			},
+			{
+				SourceAccountTag: "source",
+				Action:           ActionDelete,
+				Entries: []HistoryEntry{
+					{NewMessageIDFromUint(1), initialTime, NewMessageIDFromUint(11)},
+				},
+			},
+		},
+	}
+
+	copied := FindCopiedEntries("source", history)
+	require.Len(t, copied, 1)
+	assert.Equal(t, NewMessageIDFromUint(12), copied[NewMessageIDFromUint(2)].MessageID)
+	assert.Empty(t, FindCopiedEntries("source", nil))
+}
+
+func TestSourceMailboxHistory(t *testing.T) {
+	action := func(tag, mailbox string, uidValidity uint32) HistoryAction {
+		return HistoryAction{
+			SourceAccountTag: tag,
+			SourceMailbox:    mailbox,
+			Action:           ActionCopy,
+			UidValidity:      uidValidity,
+		}
+	}
+	history := &History{
+		Actions: []HistoryAction{
+			action("source", "", 1),
+			action("source", "Archive/2023", 1),
+			action("source", "Archive/2024", 1),
+			action("source", "Archive/2023", 2),
+			action("other", "Archive/2023", 1),
+		},
+	}
+
+	selected := SourceMailboxHistory(history, "source", "Archive/2023", 1)
+	assert.Equal(t, []HistoryAction{history.Actions[0], history.Actions[1]}, selected.Actions)
+
+	// the UIDs copied before the UID validity changed are not the same messages
+	selected = SourceMailboxHistory(history, "source", "Archive/2023", 2)
+	assert.Equal(t, []HistoryAction{history.Actions[3]}, selected.Actions)
+
+	assert.Empty(t, SourceMailboxHistory(history, "source", "Archive/2023", 3).Actions)
+	assert.Empty(t, SourceMailboxHistory(nil, "source", "INBOX", 1).Actions)
+}
+
+func TestMigrateSourceIDs(t *testing.T) {
+	entry := func(sourceID MessageID) HistoryEntry {
+		return HistoryEntry{SourceID: sourceID, MessageID: NewMessageIDFromUint(100)}
+	}
+	history := &History{
+		Actions: []HistoryAction{
+			{SourceAccountTag: "source", Action: ActionCopy, UidValidity: 1, Entries: []HistoryEntry{
+				entry(NewMessageIDFromString("1650000001.M1P1.host")),
+				entry(NewMessageIDFromString("1650000002.M2P2.host")),
+			}},
+			{SourceAccountTag: "source", SourceMailbox: "Archive", Action: ActionCopy, UidValidity: 1, Entries: []HistoryEntry{
+				entry(NewMessageIDFromString("1650000003.M3P3.host")),
+			}},
+			{SourceAccountTag: "other", Action: ActionCopy, UidValidity: 1, Entries: []HistoryEntry{
+				entry(NewMessageIDFromString("1650000001.M1P1.host")),
+			}},
+		},
+	}
+	assert.True(t, HasStringSourceIDs(history, "source", "INBOX"))
+	assert.False(t, HasStringSourceIDs(history, "unknown", "INBOX"))
+
+	ids := map[string]MessageID{
+		"1650000001.M1P1.host": NewMessageIDFromUint(1),
+		"1650000003.M3P3.host": NewMessageIDFromUint(3),
+	}
+	migrated, changed := MigrateSourceIDs(history, "source", "INBOX", 7, ids)
+	require.True(t, changed)
+	require.Len(t, migrated.Actions, 3)
+	assert.Equal(t, uint32(7), migrated.Actions[0].UidValidity)
+	assert.Equal(t, NewMessageIDFromUint(1), migrated.Actions[0].Entries[0].SourceID)
+	// the messages deleted since are not found
+	assert.Equal(t, NewMessageIDFromString("1650000002.M2P2.host"), migrated.Actions[0].Entries[1].SourceID)
+	// the other mailboxes and accounts are left as they are
+	assert.Equal(t, history.Actions[1:], migrated.Actions[1:])
+	// and the history given is not modified
+	assert.Equal(t, NewMessageIDFromString("1650000001.M1P1.host"), history.Actions[0].Entries[0].SourceID)
+
+	_, changed = MigrateSourceIDs(migrated, "source", "INBOX", 7, ids)
+	assert.False(t, changed)
+}
+
+func TestLoadCorruptHistory(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "history.json")
+	first := &History{
+		Actions: []HistoryAction{
+			{SourceAccountTag: "source", Action: ActionCopy, UidValidity: 1},
+		},
+	}
+	require.NoError(t, SaveHistoryToFile(filename, first))
+	second := &History{
+		Actions: append(first.Actions, HistoryAction{SourceAccountTag: "source", Action: ActionCopy, UidValidity: 2}),
+	}
+	require.NoError(t, SaveHistoryToFile(filename, second))
+
+	// the file was truncated by a crash
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filename, data[:len(data)/2], 0600))
+
+	loaded, err := GetHistoryFromFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, first, loaded)
+}
+
+func TestMergeHistory(t *testing.T) {
+	date := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	action := func(minutes int) HistoryAction {
+		return HistoryAction{
+			SourceAccountTag: "source",
+			Date:             date.Add(time.Duration(minutes) * time.Minute),
+			Action:           ActionCopy,
+			Entries:          []HistoryEntry{{SourceID: NewMessageIDFromUint(uint32(minutes))}},
+		}
+	}
+	history := &History{Actions: []HistoryAction{action(1), action(3)}}
+	other := &History{Actions: []HistoryAction{action(0), action(1), action(2)}}
+
+	merged := MergeHistory(history, other)
+	assert.Equal(t, []HistoryAction{action(0), action(1), action(2), action(3)}, merged.Actions)
+	// the histories are not modified
+	assert.Len(t, history.Actions, 2)
+	assert.Len(t, other.Actions, 3)
+}
+
+func TestCompactHistory(t *testing.T) {
+	date := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	entry := func(id uint32) HistoryEntry {
+		return HistoryEntry{
+			SourceID:           NewMessageIDFromUint(id),
+			SourceInternalDate: date.Add(time.Duration(id) * time.Hour),
+			MessageID:          NewMessageIDFromUint(id + 100),
+		}
+	}
+	failedEntry := func(id uint32) HistoryEntry {
+		return HistoryEntry{SourceID: NewMessageIDFromUint(id)}
+	}
+	action := func(minutes int, tag, name string, entries ...HistoryEntry) HistoryAction {
+		return HistoryAction{
+			SourceAccountTag: tag,
+			Date:             date.Add(time.Duration(minutes) * time.Minute),
+			Action:           name,
+			UidValidity:      1,
+			Entries:          entries,
+		}
+	}
+	history := &History{Actions: []HistoryAction{
+		action(1, "source", ActionCopy, entry(1), entry(2)),
+		action(2, "source", ActionFailed, failedEntry(3), failedEntry(4)),
+		action(3, "other", ActionCopy, entry(10)),
+		action(4, "source", ActionCopy, entry(3), entry(5)),
+		action(5, "source", ActionFailed, failedEntry(4)),
+		action(6, "source", ActionDelete, entry(2), entry(5)),
+	}}
+
+	t.Run("merge", func(t *testing.T) {
+		compacted := CompactHistory(history, nil)
+		assert.Equal(t, []HistoryAction{
+			action(3, "other", ActionCopy, entry(10)),
+			action(4, "source", ActionCopy, entry(1), entry(3), entry(5)),
+			action(5, "source", ActionFailed, failedEntry(4)),
+			action(6, "source", ActionDelete, entry(5)),
+		}, compacted.Actions)
+
+		// the next copy behaves the same
+		for _, tag := range []string{"source", "other"} {
+			assert.Equal(t, FindLatestInternalDateFromHistory(tag, history), FindLatestInternalDateFromHistory(tag, compacted))
+			assert.Equal(t, FindFailedEntries(tag, history), FindFailedEntries(tag, compacted))
+			assert.Equal(t, FindCopiedEntries(tag, history), FindCopiedEntries(tag, compacted))
+		}
+		// compacting again changes nothing
+		assert.Equal(t, compacted, CompactHistory(compacted, nil))
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		compacted := CompactHistory(history, func(id MessageID) bool {
+			return id.AsUint() != 101 && id.AsUint() != 110
+		})
+		assert.Equal(t, []HistoryAction{
+			action(3, "other", ActionCopy, entry(10)),
+			action(4, "source", ActionCopy, entry(3), entry(5)),
+			action(5, "source", ActionFailed, failedEntry(4)),
+			action(6, "source", ActionDelete, entry(5)),
+		}, compacted.Actions)
+	})
+
+	t.Run("message copied again", func(t *testing.T) {
+		compacted := CompactHistory(&History{Actions: []HistoryAction{
+			action(1, "source", ActionCopy, entry(1), entry(2)),
+			action(2, "source", ActionDelete, entry(1)),
+			action(3, "source", ActionCopy, entry(1)),
+		}}, nil)
+		assert.Equal(t, []HistoryAction{
+			action(3, "source", ActionCopy, entry(2), entry(1)),
+		}, compacted.Actions)
+	})
+
+	t.Run("same UID in another mailbox", func(t *testing.T) {
+		inMailbox := func(action HistoryAction, name string, uidValidity uint32) HistoryAction {
+			action.SourceMailbox = name
+			action.UidValidity = uidValidity
+			return action
+		}
+		history := &History{Actions: []HistoryAction{
+			inMailbox(action(1, "source", ActionCopy, entry(42)), "INBOX", 1),
+			inMailbox(action(2, "source", ActionFailed, failedEntry(42)), "Sent", 1),
+			inMailbox(action(3, "source", ActionCopy, entry(43)), "Sent", 2),
+			inMailbox(action(4, "source", ActionFailed, failedEntry(43)), "Sent", 1),
+		}}
+		compacted := CompactHistory(history, nil)
+		// the failed messages of Sent were never copied from Sent with the same UID validity
+		assert.Equal(t, []HistoryAction{
+			history.Actions[0],
+			history.Actions[2],
+			inMailbox(action(4, "source", ActionFailed, failedEntry(42), failedEntry(43)), "Sent", 1),
+		}, compacted.Actions)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		assert.Empty(t, CompactHistory(nil, nil).Actions)
+		assert.Empty(t, CompactHistory(&History{}, nil).Actions)
+	})
+}
+
+func TestFilterHistory(t *testing.T) {
+	date := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	action := func(hours int, tag, name string, ids ...uint32) HistoryAction {
+		action := HistoryAction{
+			SourceAccountTag: tag,
+			Date:             date.Add(time.Duration(hours) * time.Hour),
+			Action:           name,
+			Entries:          make([]HistoryEntry, 0, len(ids)),
+		}
+		for _, id := range ids {
+			action.Entries = append(action.Entries, HistoryEntry{SourceID: NewMessageIDFromUint(id), MessageID: NewMessageIDFromUint(id + 100)})
+		}
+		return action
+	}
+	history := &History{Actions: []HistoryAction{
+		action(0, "source1", ActionCopy, 1, 2),
+		action(1, "source2", ActionCopy, 1),
+		action(2, "source1", ActionFailed, 3),
+		action(3, "source1", ActionCopy, 3, 4),
+		action(4, "source1", ActionDelete, 2),
+	}}
+
+	testCases := []struct {
+		name     string
+		filter   HistoryFilter
+		expected []HistoryAction
+	}{
+		{"all", HistoryFilter{}, history.Actions},
+		{"source", HistoryFilter{SourceAccountTag: "source2"}, []HistoryAction{history.Actions[1]}},
+		{"source prefix", HistoryFilter{SourceAccountTag: "source"}, history.Actions},
+		{"since", HistoryFilter{Since: date.Add(3 * time.Hour)}, history.Actions[3:]},
+		{"before", HistoryFilter{Before: date.Add(time.Hour)}, history.Actions[:1]},
+		{"actions", HistoryFilter{Actions: []string{ActionFailed, ActionDelete}}, []HistoryAction{history.Actions[2], history.Actions[4]}},
+		{"message", HistoryFilter{SourceID: NewMessageIDFromUint(3)}, []HistoryAction{
+			action(2, "source1", ActionFailed, 3),
+			action(3, "source1", ActionCopy, 3),
+		}},
+		{"message and source", HistoryFilter{SourceAccountTag: "source1", SourceID: NewMessageIDFromUint(1)}, []HistoryAction{
+			action(0, "source1", ActionCopy, 1),
+		}},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			filtered := FilterHistory(history, testCase.filter)
+			assert.Equal(t, testCase.expected, filtered.Actions)
+		})
+	}
+	// the history is not modified
+	assert.Len(t, history.Actions[0].Entries, 2)
+	assert.Empty(t, FilterHistory(nil, HistoryFilter{}).Actions)
+}
@@ -0,0 +1,226 @@
+// Package schedule parses the schedules of the jobs: cron expressions or intervals
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule gives the next time a job should run
+type Schedule interface {
+	// Next returns the first time after the time given
+	Next(after time.Time) time.Time
+}
+
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	monthNames = map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}
+	dayNames = map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}
+)
+
+// Parse reads a schedule:
+//   - an interval like "@every 30m" (or simply "30m")
+//   - a descriptor: @yearly, @monthly, @weekly, @daily (or @midnight) and @hourly
+//   - a cron expression with 5 fields: minute, hour, day of month, month and day of week
+func Parse(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, errors.New("empty schedule")
+	}
+	if interval, found := strings.CutPrefix(spec, "@every "); found {
+		return parseInterval(strings.TrimSpace(interval))
+	}
+	if expression, found := descriptors[strings.ToLower(spec)]; found {
+		spec = expression
+	}
+	if strings.HasPrefix(spec, "@") {
+		return nil, fmt.Errorf("unknown schedule %q", spec)
+	}
+	fields := strings.Fields(spec)
+	if len(fields) == 1 {
+		return parseInterval(spec)
+	}
+	return parseCron(fields)
+}
+
+// Interval runs a job at a fixed interval
+type Interval time.Duration
+
+func parseInterval(value string) (Schedule, error) {
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interval %q: %w", value, err)
+	}
+	if interval < time.Second {
+		return nil, fmt.Errorf("interval %q is too short", value)
+	}
+	return Interval(interval), nil
+}
+
+// Next returns the time after the interval
+func (i Interval) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(i))
+}
+
+// Cron runs a job at the times matching a cron expression (in the local time zone)
+type Cron struct {
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+	// anyDay is true when the day of month or the day of week is "*": only the other one is used
+	anyDay     bool
+	anyWeekday bool
+}
+
+func parseCron(fields []string) (Schedule, error) {
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("a cron expression needs 5 fields, found %d", len(fields))
+	}
+	var err error
+	cron := &Cron{}
+	cron.minutes, err = parseField(fields[0], 0, 59, nil)
+	if err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	cron.hours, err = parseField(fields[1], 0, 23, nil)
+	if err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	cron.days, err = parseField(fields[2], 1, 31, nil)
+	if err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	cron.months, err = parseField(fields[3], 1, 12, monthNames)
+	if err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	cron.weekdays, err = parseField(fields[4], 0, 7, dayNames)
+	if err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	// 7 is also sunday
+	if cron.weekdays&(1<<7) != 0 {
+		cron.weekdays |= 1
+	}
+	cron.anyDay = strings.HasPrefix(fields[2], "*")
+	cron.anyWeekday = strings.HasPrefix(fields[4], "*")
+	return cron, nil
+}
+
+// parseField returns the bits of the values allowed by the field: "*", "5", "1-5", "*/15", "1-30/2" or a list of them
+func parseField(field string, low, high int, names map[string]int) (uint64, error) {
+	var bits uint64
+	for part := range strings.SplitSeq(field, ",") {
+		valueRange, stepValue, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepValue)
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepValue)
+			}
+		}
+		start, end := low, high
+		if valueRange != "*" {
+			first, last, isRange := strings.Cut(valueRange, "-")
+			var err error
+			start, err = parseValue(first, low, high, names)
+			if err != nil {
+				return 0, err
+			}
+			end = start
+			if isRange {
+				end, err = parseValue(last, low, high, names)
+				if err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				end = high
+			}
+			if end < start {
+				return 0, fmt.Errorf("invalid range %q", valueRange)
+			}
+		}
+		for value := start; value <= end; value += step {
+			bits |= 1 << value
+		}
+	}
+	return bits, nil
+}
+
+func parseValue(value string, low, high int, names map[string]int) (int, error) {
+	if number, found := names[strings.ToLower(value)]; found {
+		return number, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", value)
+	}
+	if number < low || number > high {
+		return 0, fmt.Errorf("value %d out of range [%d-%d]", number, low, high)
+	}
+	return number, nil
+}
+
+// Next returns the next minute matching the expression after the time given.
+// It returns the zero time when the expression never matches (like the 31st of February).
+func (c *Cron) Next(after time.Time) time.Time {
+	next := after.Truncate(time.Minute).Add(time.Minute)
+	// no need to look further than a few years ahead (february 29th on a monday can take 28 years)
+	limit := next.AddDate(30, 0, 0)
+	for next.Before(limit) {
+		if c.months&(1<<int(next.Month())) == 0 {
+			next = time.Date(next.Year(), next.Month()+1, 1, 0, 0, 0, 0, next.Location())
+			continue
+		}
+		if !c.matchDay(next) {
+			next = time.Date(next.Year(), next.Month(), next.Day()+1, 0, 0, 0, 0, next.Location())
+			continue
+		}
+		if c.hours&(1<<next.Hour()) == 0 {
+			next = time.Date(next.Year(), next.Month(), next.Day(), next.Hour()+1, 0, 0, 0, next.Location())
+			continue
+		}
+		if c.minutes&(1<<next.Minute()) == 0 {
+			next = next.Add(time.Minute)
+			continue
+		}
+		return next
+	}
+	return time.Time{}
+}
+
+func (c *Cron) matchDay(date time.Time) bool {
+	day := c.days&(1<<date.Day()) != 0
+	weekday := c.weekdays&(1<<int(date.Weekday())) != 0
+	switch {
+	case c.anyDay && c.anyWeekday:
+		return true
+	case c.anyDay:
+		return weekday
+	case c.anyWeekday:
+		return day
+	default:
+		// like the original cron: either of them
+		return day || weekday
+	}
+}
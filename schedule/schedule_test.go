@@ -0,0 +1,71 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNext(t *testing.T) {
+	// a wednesday
+	start := time.Date(2024, 1, 10, 10, 32, 15, 0, time.UTC)
+
+	testData := []struct {
+		spec string
+		next time.Time
+	}{
+		{"@every 90m", start.Add(90 * time.Minute)},
+		{"2h", start.Add(2 * time.Hour)},
+		{"* * * * *", time.Date(2024, 1, 10, 10, 33, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 10, 10, 45, 0, 0, time.UTC)},
+		{"0 * * * *", time.Date(2024, 1, 10, 11, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 1, 10, 11, 0, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2024, 1, 11, 2, 30, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 1, 11, 0, 0, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2024, 1, 10, 13, 0, 0, 0, time.UTC)},
+		{"0 0 * * sun", time.Date(2024, 1, 14, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 1, 14, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2024, 1, 14, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 1-5", time.Date(2024, 1, 11, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 mar-apr *", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		// the day of month or the day of week
+		{"0 0 20 * mon", time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// never happens
+		{"0 0 31 feb *", time.Time{}},
+	}
+
+	for _, testItem := range testData {
+		t.Run(testItem.spec, func(t *testing.T) {
+			schedule, err := Parse(testItem.spec)
+			require.NoError(t, err)
+			assert.Equal(t, testItem.next, schedule.Next(start))
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	testData := []string{
+		"",
+		"@sometimes",
+		"@every forever",
+		"10ms",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	}
+	for _, spec := range testData {
+		_, err := Parse(spec)
+		assert.Error(t, err, spec)
+	}
+}
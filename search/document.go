@@ -0,0 +1,192 @@
+package search
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"unicode"
+
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+)
+
+// Fields of a message which can be searched
+const (
+	FieldFrom    = "from"
+	FieldTo      = "to"
+	FieldSubject = "subject"
+	// FieldText contains all the other fields and the text of the message
+	FieldText = "text"
+)
+
+const (
+	// maxBodySize is the maximum number of bytes read from each text part of a message
+	maxBodySize    = 1024 * 1024
+	minTokenLength = 2
+	maxTokenLength = 64
+)
+
+// Document is the searchable content of a message
+type Document struct {
+	From    []string
+	To      []string
+	Subject string
+	Body    []string
+}
+
+// Extract decodes a MIME message and returns its searchable content.
+// When the message cannot be fully decoded, the document contains the text found before the error.
+func Extract(body io.Reader) (*Document, error) {
+	doc := &Document{}
+	reader, err := mail.CreateReader(body)
+	if err != nil && reader == nil {
+		return doc, err
+	}
+	defer reader.Close()
+
+	doc.From = addresses(reader.Header, "From", "Sender", "Reply-To")
+	doc.To = addresses(reader.Header, "To", "Cc", "Bcc")
+	doc.Subject, _ = reader.Header.Subject()
+
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return doc, nil
+		}
+		if err != nil && !message.IsUnknownCharset(err) {
+			return doc, err
+		}
+		header, ok := part.Header.(*mail.InlineHeader)
+		if !ok {
+			// attachments are not indexed
+			continue
+		}
+		mediaType, _, _ := header.ContentType()
+		if mediaType != "" && !strings.HasPrefix(mediaType, "text/") {
+			continue
+		}
+		text, err := io.ReadAll(io.LimitReader(part.Body, maxBodySize))
+		if len(text) > 0 {
+			if mediaType == "text/html" {
+				doc.Body = append(doc.Body, stripTags(string(text)))
+			} else {
+				doc.Body = append(doc.Body, string(text))
+			}
+		}
+		if err != nil {
+			return doc, err
+		}
+	}
+}
+
+// Terms returns the list of unique terms of the document, in the form "field:token"
+func (d *Document) Terms() []string {
+	terms := newTermSet()
+	for _, from := range d.From {
+		terms.add(FieldFrom, from)
+		terms.add(FieldText, from)
+	}
+	for _, to := range d.To {
+		terms.add(FieldTo, to)
+		terms.add(FieldText, to)
+	}
+	terms.add(FieldSubject, d.Subject)
+	terms.add(FieldText, d.Subject)
+	for _, body := range d.Body {
+		terms.add(FieldText, body)
+	}
+	return terms.list
+}
+
+// Tokenize splits the text into lowercase words. Very short and very long words are ignored.
+func Tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	tokens := make([]string, 0, len(words))
+	for _, word := range words {
+		length := len([]rune(word))
+		if length < minTokenLength || length > maxTokenLength {
+			continue
+		}
+		tokens = append(tokens, word)
+	}
+	return tokens
+}
+
+// addresses returns the names and email addresses found in the header fields
+func addresses(header mail.Header, keys ...string) []string {
+	list := make([]string, 0)
+	for _, key := range keys {
+		addresses, err := header.AddressList(key)
+		if err != nil {
+			// keep the raw value of an invalid address list
+			value, _ := header.Text(key)
+			if value != "" {
+				list = append(list, value)
+			}
+			continue
+		}
+		for _, address := range addresses {
+			if address.Name != "" {
+				list = append(list, address.Name)
+			}
+			list = append(list, address.Address)
+		}
+	}
+	return list
+}
+
+// stripTags removes the HTML tags, and the content of the style and script elements
+func stripTags(html string) string {
+	builder := &strings.Builder{}
+	for len(html) > 0 {
+		start := strings.IndexByte(html, '<')
+		if start < 0 {
+			builder.WriteString(html)
+			break
+		}
+		builder.WriteString(html[:start])
+		builder.WriteByte(' ')
+		end := strings.IndexByte(html[start:], '>')
+		if end < 0 {
+			break
+		}
+		tag := strings.ToLower(html[start+1 : start+end])
+		html = html[start+end+1:]
+		for _, element := range []string{"style", "script"} {
+			if tag == element || strings.HasPrefix(tag, element+" ") {
+				closing := strings.Index(strings.ToLower(html), "</"+element)
+				if closing < 0 {
+					return builder.String()
+				}
+				html = html[closing:]
+			}
+		}
+	}
+	return builder.String()
+}
+
+type termSet struct {
+	seen map[string]bool
+	list []string
+}
+
+func newTermSet() *termSet {
+	return &termSet{
+		seen: make(map[string]bool),
+		list: make([]string, 0),
+	}
+}
+
+func (s *termSet) add(field, text string) {
+	for _, token := range Tokenize(text) {
+		term := field + ":" + token
+		if s.seen[term] {
+			continue
+		}
+		s.seen[term] = true
+		s.list = append(s.list, term)
+	}
+}
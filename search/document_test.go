@@ -0,0 +1,73 @@
+package search
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const multipartMessage = "From: John Doe <john@example.com>\r\n" +
+	"To: jane@example.org\r\n" +
+	"Cc: =?utf-8?q?Ren=C3=A9?= <rene@example.fr>\r\n" +
+	"Subject: =?iso-8859-1?q?R=E9union?= budget\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Caf=C3=A9 tomorrow?\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<html><style>body { color: red; }</style><body><b>Coffee</b> tomorrow?</body></html>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf\r\n" +
+	"Content-Disposition: attachment; filename=invoice.pdf\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"aW52b2ljZSBjb250ZW50\r\n" +
+	"--outer--\r\n"
+
+func TestExtract(t *testing.T) {
+	doc, err := Extract(strings.NewReader(multipartMessage))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"John Doe", "john@example.com"}, doc.From)
+	assert.Equal(t, []string{"jane@example.org", "René", "rene@example.fr"}, doc.To)
+	assert.Equal(t, "Réunion budget", doc.Subject)
+	require.Len(t, doc.Body, 2)
+	assert.Contains(t, doc.Body[0], "Café tomorrow?")
+	assert.Contains(t, doc.Body[1], "Coffee")
+	assert.NotContains(t, doc.Body[1], "color")
+
+	terms := doc.Terms()
+	assert.Contains(t, terms, "from:john")
+	assert.Contains(t, terms, "from:doe")
+	assert.Contains(t, terms, "to:rené")
+	assert.Contains(t, terms, "subject:réunion")
+	assert.Contains(t, terms, "text:café")
+	assert.Contains(t, terms, "text:coffee")
+	assert.Contains(t, terms, "text:john")
+	assert.NotContains(t, terms, "text:invoice")
+	assert.NotContains(t, terms, "text:html")
+}
+
+func TestExtractInvalidMessage(t *testing.T) {
+	doc, err := Extract(strings.NewReader("From: john@example.com\r\nSubject: hello\r\nContent-Type: multipart/mixed; boundary=missing\r\n\r\nno parts here"))
+	assert.Error(t, err)
+	require.NotNil(t, doc)
+	assert.Equal(t, "hello", doc.Subject)
+}
+
+func TestTokenize(t *testing.T) {
+	assert.Equal(t, []string{"hello", "world", "42"}, Tokenize("Hello, World! I'm 42"))
+	assert.Equal(t, []string{"élan", "naïve"}, Tokenize("élan naïve"))
+	assert.Empty(t, Tokenize(strings.Repeat("x", maxTokenLength+1)))
+}
@@ -0,0 +1,112 @@
+package search
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+var ErrEmptyQuery = errors.New("nothing to search for")
+
+// Query is a parsed search query. A message matches when it contains all the terms, in the date range.
+type Query struct {
+	// Terms in the form "field:token"
+	Terms []string
+	// After keeps the messages received on this day or later
+	After time.Time
+	// Before keeps the messages received strictly before this day
+	Before time.Time
+}
+
+// ParseQuery parses a query like:
+//
+//	from:john to:jane subject:"weekly report" after:2023-01-01 before:2023-02-01 budget
+//
+// Words without a field prefix are searched in the whole message (headers and text).
+// Dates are using the local timezone.
+func ParseQuery(query string) (*Query, error) {
+	result := &Query{}
+	terms := newTermSet()
+	for _, word := range splitQuery(query) {
+		field, value, found := strings.Cut(word, ":")
+		if !found {
+			terms.add(FieldText, unquote(word))
+			continue
+		}
+		value = unquote(value)
+		switch strings.ToLower(field) {
+		case FieldFrom, FieldTo, FieldSubject, FieldText:
+			terms.add(strings.ToLower(field), value)
+		case "after":
+			date, err := parseDate(value)
+			if err != nil {
+				return nil, err
+			}
+			result.After = date
+		case "before":
+			date, err := parseDate(value)
+			if err != nil {
+				return nil, err
+			}
+			result.Before = date
+		default:
+			// not a field: search the whole word
+			terms.add(FieldText, unquote(word))
+		}
+	}
+	result.Terms = terms.list
+	if len(result.Terms) == 0 && result.After.IsZero() && result.Before.IsZero() {
+		return nil, ErrEmptyQuery
+	}
+	return result, nil
+}
+
+// MatchDate returns true when the date is in the range of the query
+func (q *Query) MatchDate(date time.Time) bool {
+	if !q.After.IsZero() && date.Before(q.After) {
+		return false
+	}
+	if !q.Before.IsZero() && !date.Before(q.Before) {
+		return false
+	}
+	return true
+}
+
+// splitQuery splits the query on spaces, keeping quoted text together
+func splitQuery(query string) []string {
+	words := make([]string, 0)
+	builder := &strings.Builder{}
+	quoted := false
+	for _, r := range query {
+		if r == '"' {
+			quoted = !quoted
+		}
+		if !quoted && (r == ' ' || r == '\t') {
+			if builder.Len() > 0 {
+				words = append(words, builder.String())
+				builder.Reset()
+			}
+			continue
+		}
+		builder.WriteRune(r)
+	}
+	if builder.Len() > 0 {
+		words = append(words, builder.String())
+	}
+	return words
+}
+
+func unquote(value string) string {
+	return strings.ReplaceAll(value, `"`, "")
+}
+
+func parseDate(value string) (time.Time, error) {
+	date, err := time.ParseInLocation(dateLayout, value, time.Local)
+	if err != nil {
+		return date, fmt.Errorf("invalid date %q: expected format is YYYY-MM-DD", value)
+	}
+	return date, nil
+}
@@ -0,0 +1,56 @@
+package search
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQuery(t *testing.T) {
+	fixtures := []struct {
+		query    string
+		expected []string
+	}{
+		{"budget", []string{"text:budget"}},
+		{"Budget 2023", []string{"text:budget", "text:2023"}},
+		{"from:john@example.com", []string{"from:john", "from:example", "from:com"}},
+		{"FROM:John to:jane", []string{"from:john", "to:jane"}},
+		{`subject:"weekly report" budget`, []string{"subject:weekly", "subject:report", "text:budget"}},
+		{"see http://example.com", []string{"text:see", "text:http", "text:example", "text:com"}},
+		{"a budget a", []string{"text:budget"}},
+	}
+
+	for _, fixture := range fixtures {
+		t.Run(fixture.query, func(t *testing.T) {
+			query, err := ParseQuery(fixture.query)
+			require.NoError(t, err)
+			assert.Equal(t, fixture.expected, query.Terms)
+		})
+	}
+}
+
+func TestParseQueryDates(t *testing.T) {
+	query, err := ParseQuery("after:2023-01-01 before:2023-02-01")
+	require.NoError(t, err)
+	assert.Empty(t, query.Terms)
+	assert.Equal(t, time.Date(2023, 1, 1, 0, 0, 0, 0, time.Local), query.After)
+	assert.Equal(t, time.Date(2023, 2, 1, 0, 0, 0, 0, time.Local), query.Before)
+
+	assert.False(t, query.MatchDate(time.Date(2022, 12, 31, 23, 59, 59, 0, time.Local)))
+	assert.True(t, query.MatchDate(time.Date(2023, 1, 1, 0, 0, 0, 0, time.Local)))
+	assert.True(t, query.MatchDate(time.Date(2023, 1, 31, 23, 59, 59, 0, time.Local)))
+	assert.False(t, query.MatchDate(time.Date(2023, 2, 1, 0, 0, 0, 0, time.Local)))
+}
+
+func TestParseInvalidQuery(t *testing.T) {
+	_, err := ParseQuery("")
+	assert.ErrorIs(t, err, ErrEmptyQuery)
+
+	_, err = ParseQuery("a b c")
+	assert.ErrorIs(t, err, ErrEmptyQuery)
+
+	_, err = ParseQuery("after:yesterday")
+	assert.Error(t, err)
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/creativeprojects/imap/lib"
+	"github.com/creativeprojects/imap/storage"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+var (
+	ErrReadOnly     = errors.New("account is read-only")
+	ErrNotSupported = errors.New("operation not supported by the storage backend")
+)
+
+// Account gives an IMAP user access to a storage backend
+type Account struct {
+	Username string
+	Password string
+	Backend  storage.Backend
+	ReadOnly bool
+}
+
+// Backend is an adapter exposing storage backends to the go-imap server
+type Backend struct {
+	accounts map[string]Account
+	log      lib.Logger
+	// locks has one lock per account: the commands of all the sessions of an account run one at a time,
+	// so the sequence numbers of a command are the ones of the list of messages it loaded
+	locks map[string]*sync.Mutex
+	// mutex protects the uids of all the accounts
+	mutex sync.Mutex
+	uids  map[string]*uidMap
+}
+
+// NewBackend creates a go-imap backend serving the accounts
+func NewBackend(accounts []Account, logger lib.Logger) *Backend {
+	if logger == nil {
+		logger = &lib.NoLog{}
+	}
+	list := make(map[string]Account, len(accounts))
+	locks := make(map[string]*sync.Mutex, len(accounts))
+	for _, account := range accounts {
+		list[account.Username] = account
+		locks[account.Username] = &sync.Mutex{}
+	}
+	return &Backend{
+		accounts: list,
+		log:      logger,
+		locks:    locks,
+		uids:     make(map[string]*uidMap),
+	}
+}
+
+// Login authenticates a user against the list of accounts
+func (b *Backend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+	account, ok := b.accounts[username]
+	if !ok || subtle.ConstantTimeCompare([]byte(account.Password), []byte(password)) != 1 {
+		b.log.Printf("Authentication failed for user %q", username)
+		return nil, backend.ErrInvalidCredentials
+	}
+	b.log.Printf("User %q logged in", username)
+	return &user{
+		backend: b,
+		account: account,
+		lock:    b.locks[username],
+	}, nil
+}
+
+// uidFor returns a stable UID (for the lifetime of the server) for backends using string message IDs
+func (b *Backend) uidFor(accountID, mailboxName string, keys []string) map[string]uint32 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	index := accountID + "\x00" + mailboxName
+	uids, ok := b.uids[index]
+	if !ok {
+		uids = &uidMap{
+			keys: make(map[string]uint32),
+		}
+		b.uids[index] = uids
+	}
+	return uids.assign(keys)
+}
+
+type uidMap struct {
+	last uint32
+	keys map[string]uint32
+}
+
+// assign new UIDs to the unknown keys, in alphabetical order, and returns the UIDs of the keys
+func (m *uidMap) assign(keys []string) map[string]uint32 {
+	sort.Strings(keys)
+	uids := make(map[string]uint32, len(keys))
+	for _, key := range keys {
+		uid, found := m.keys[key]
+		if !found {
+			m.last++
+			uid = m.last
+			m.keys[key] = uid
+		}
+		uids[key] = uid
+	}
+	return uids
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/creativeprojects/imap/lib"
+	"github.com/creativeprojects/imap/mailbox"
+	"github.com/creativeprojects/imap/storage"
+	"github.com/creativeprojects/imap/storage/mem"
+	"github.com/creativeprojects/imap/storage/remote"
+	"github.com/creativeprojects/imap/storage/test"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/nettest"
+)
+
+func startServer(t *testing.T, accounts ...Account) string {
+	t.Helper()
+
+	imapServer := server.New(NewBackend(accounts, lib.NewTestLogger(t, "adapter")))
+	imapServer.ErrorLog = lib.NewTestLogger(t, "server")
+	imapServer.AllowInsecureAuth = true
+
+	listener, err := nettest.NewLocalListener("tcp")
+	require.NoError(t, err)
+
+	wg := sync.WaitGroup{}
+	wg.Go(func() {
+		_ = imapServer.Serve(listener)
+	})
+	t.Cleanup(func() {
+		_ = imapServer.Close()
+		wg.Wait()
+	})
+
+	time.Sleep(100 * time.Millisecond)
+	return listener.Addr().String()
+}
+
+func TestServeMemoryBackend(t *testing.T) {
+	memBackend := mem.New()
+	defer memBackend.Close()
+
+	err := test.PrepareBackend(memBackend)
+	require.NoError(t, err)
+
+	address := startServer(t, Account{
+		Username: "username",
+		Password: "password",
+		Backend:  memBackend,
+	})
+
+	backend, err := remote.NewImap(remote.Config{
+		ServerURL:   address,
+		Username:    "username",
+		Password:    "password",
+		NoTLS:       true,
+		CacheDir:    t.TempDir(),
+		DebugLogger: lib.NewTestLogger(t, "client"),
+	})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	test.RunTestsOnBackend(t, backend)
+}
+
+func TestServeWrongPassword(t *testing.T) {
+	address := startServer(t, Account{
+		Username: "username",
+		Password: "password",
+		Backend:  mem.New(),
+	})
+
+	_, err := remote.NewImap(remote.Config{
+		ServerURL: address,
+		Username:  "username",
+		Password:  "wrong",
+		NoTLS:     true,
+		CacheDir:  t.TempDir(),
+	})
+	assert.Error(t, err)
+}
+
+func TestServeReadOnly(t *testing.T) {
+	memBackend := mem.New()
+	defer memBackend.Close()
+
+	info := mailbox.Info{Delimiter: mem.Delimiter, Name: "INBOX"}
+	memBackend.GenerateFakeEmails(info, 5, 100, 1000)
+
+	address := startServer(t, Account{
+		Username: "username",
+		Password: "password",
+		Backend:  memBackend,
+		ReadOnly: true,
+	})
+
+	backend, err := remote.NewImap(remote.Config{
+		ServerURL: address,
+		Username:  "username",
+		Password:  "password",
+		NoTLS:     true,
+		CacheDir:  t.TempDir(),
+	})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	err = backend.CreateMailbox(t.Context(), mailbox.Info{Delimiter: mem.Delimiter, Name: "Work"})
+	assert.Error(t, err)
+
+	// we can still copy everything from the server
+	dest := mem.New()
+	defer dest.Close()
+
+	status, err := backend.SelectMailbox(t.Context(), info)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(5), status.Messages)
+
+	entries, err := storage.CopyMessages(t.Context(), backend, dest, info, nil, nil)
+	require.NoError(t, err)
+	assert.Len(t, entries, 5)
+}
+
+// countingBackend records the UIDs of the messages whose body is fetched
+type countingBackend struct {
+	*mem.Backend
+	mutex   sync.Mutex
+	fetched []uint32
+}
+
+func (b *countingBackend) OpenMailbox(ctx context.Context, info mailbox.Info) (mailbox.Handle, error) {
+	handle, err := b.Backend.OpenMailbox(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	return &countingHandle{Handle: handle, backend: b}, nil
+}
+
+// reset returns the UIDs fetched since the last call
+func (b *countingBackend) reset() []uint32 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	fetched := b.fetched
+	b.fetched = nil
+	slices.Sort(fetched)
+	return fetched
+}
+
+type countingHandle struct {
+	mailbox.Handle
+	backend *countingBackend
+}
+
+func (h *countingHandle) FetchUids(ctx context.Context, uids []mailbox.MessageID, messages chan *mailbox.Message) error {
+	h.backend.mutex.Lock()
+	for _, uid := range uids {
+		h.backend.fetched = append(h.backend.fetched, uid.AsUint())
+	}
+	h.backend.mutex.Unlock()
+	return h.Handle.FetchUids(ctx, uids, messages)
+}
+
+func TestServeOnlyFetchSelectedBodies(t *testing.T) {
+	memBackend := &countingBackend{Backend: mem.New()}
+	defer memBackend.Close()
+
+	info := mailbox.Info{Delimiter: mem.Delimiter, Name: "INBOX"}
+	memBackend.GenerateFakeEmails(info, 5, 100, 1000)
+	require.NoError(t, memBackend.CreateMailbox(t.Context(), mailbox.Info{Delimiter: mem.Delimiter, Name: "Archive"}))
+
+	address := startServer(t, Account{
+		Username: "username",
+		Password: "password",
+		Backend:  memBackend,
+	})
+	imapClient, err := client.Dial(address)
+	require.NoError(t, err)
+	defer imapClient.Logout()
+	require.NoError(t, imapClient.Login("username", "password"))
+	_, err = imapClient.Select("INBOX", false)
+	require.NoError(t, err)
+	memBackend.reset()
+
+	fetch := func(seqset string, items ...imap.FetchItem) []*imap.Message {
+		t.Helper()
+		set, err := imap.ParseSeqSet(seqset)
+		require.NoError(t, err)
+		messages := make(chan *imap.Message, 10)
+		require.NoError(t, imapClient.Fetch(set, items, messages))
+		list := make([]*imap.Message, 0)
+		for msg := range messages {
+			list = append(list, msg)
+		}
+		return list
+	}
+
+	// the flags don't need the bodies
+	assert.Len(t, fetch("1:*", imap.FetchFlags, imap.FetchUid), 5)
+	assert.Empty(t, memBackend.reset())
+
+	section := &imap.BodySectionName{}
+	messages := fetch("2:3", imap.FetchUid, section.FetchItem())
+	require.Len(t, messages, 2)
+	for _, msg := range messages {
+		assert.NotNil(t, msg.GetBody(section))
+	}
+	assert.Equal(t, []uint32{2, 3}, memBackend.reset())
+
+	criteria := imap.NewSearchCriteria()
+	criteria.WithFlags = []string{imap.FlaggedFlag}
+	_, err = imapClient.Search(criteria)
+	require.NoError(t, err)
+	assert.Empty(t, memBackend.reset())
+
+	criteria = imap.NewSearchCriteria()
+	criteria.Uid, _ = imap.ParseSeqSet("4:5")
+	criteria.Text = []string{"user1@example.com"}
+	ids, err := imapClient.Search(criteria)
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{4, 5}, ids)
+	assert.Equal(t, []uint32{4, 5}, memBackend.reset())
+
+	set, _ := imap.ParseSeqSet("1")
+	require.NoError(t, imapClient.Copy(set, "Archive"))
+	assert.Equal(t, []uint32{1}, memBackend.reset())
+	status, err := imapClient.Status("Archive", []imap.StatusItem{imap.StatusMessages})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), status.Messages)
+}
@@ -0,0 +1,434 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/creativeprojects/imap/lib"
+	"github.com/creativeprojects/imap/mailbox"
+	"github.com/creativeprojects/imap/storage"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+var permanentFlags = []string{
+	imap.SeenFlag,
+	imap.AnsweredFlag,
+	imap.FlaggedFlag,
+	imap.DeletedFlag,
+	imap.DraftFlag,
+}
+
+type serverMailbox struct {
+	user *user
+	info mailbox.Info
+}
+
+func newMailbox(u *user, info mailbox.Info) *serverMailbox {
+	return &serverMailbox{
+		user: u,
+		info: info,
+	}
+}
+
+func (m *serverMailbox) Name() string {
+	return m.info.Name
+}
+
+func (m *serverMailbox) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{
+		Delimiter: m.info.Delimiter,
+		Name:      m.info.Name,
+	}, nil
+}
+
+func (m *serverMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	m.lock()
+	defer m.unlock()
+
+	handle, messages, err := m.loadMessages()
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	status := imap.NewMailboxStatus(m.info.Name, items)
+	status.Flags = permanentFlags
+	status.PermanentFlags = permanentFlags
+	status.ReadOnly = m.user.account.ReadOnly
+
+	var unseen uint32
+	for _, msg := range messages {
+		if !slices.Contains(msg.Flags, imap.SeenFlag) {
+			unseen++
+			if status.UnseenSeqNum == 0 {
+				status.UnseenSeqNum = msg.seqNum
+			}
+		}
+	}
+
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(messages))
+		case imap.StatusUidNext:
+			status.UidNext = 1
+			if len(messages) > 0 {
+				status.UidNext = messages[len(messages)-1].uid + 1
+			}
+		case imap.StatusUidValidity:
+			status.UidValidity = handle.Status().UidValidity
+		case imap.StatusRecent:
+			status.Recent = 0
+		case imap.StatusUnseen:
+			status.Unseen = unseen
+		}
+	}
+	return status, nil
+}
+
+func (m *serverMailbox) SetSubscribed(_ bool) error {
+	return nil
+}
+
+func (m *serverMailbox) Check() error {
+	return nil
+}
+
+func (m *serverMailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	m.lock()
+	defer m.unlock()
+
+	handle, messages, err := m.loadMessages()
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	send := func(msg *message) error {
+		fetched, err := msg.fetch(items)
+		if err != nil {
+			m.user.backend.log.Printf("cannot fetch message %d: %s", msg.uid, err)
+			return nil
+		}
+		ch <- fetched
+		return nil
+	}
+	selected := selectMessages(messages, uid, seqset)
+	if !needBody(items) {
+		for _, msg := range selected {
+			_ = send(msg)
+		}
+		return nil
+	}
+	return readBodies(handle, selected, send)
+}
+
+func (m *serverMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	m.lock()
+	defer m.unlock()
+
+	handle, messages, err := m.loadMessages()
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	ids := make([]uint32, 0)
+	match := func(msg *message) error {
+		ok, err := msg.match(criteria)
+		if err == nil && ok {
+			ids = append(ids, msg.id(uid))
+		}
+		return nil
+	}
+	// the messages outside of the sequence set or UID set of the criteria cannot match
+	candidates := messages
+	if criteria.SeqNum != nil {
+		candidates = selectMessages(candidates, false, criteria.SeqNum)
+	}
+	if criteria.Uid != nil {
+		candidates = selectMessages(candidates, true, criteria.Uid)
+	}
+	if !searchBody(criteria) {
+		for _, msg := range candidates {
+			_ = match(msg)
+		}
+		return ids, nil
+	}
+	err = readBodies(handle, candidates, match)
+	if err != nil {
+		return nil, err
+	}
+	// the bodies may not be received in order
+	slices.Sort(ids)
+	return ids, nil
+}
+
+func (m *serverMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	if m.user.account.ReadOnly {
+		return ErrReadOnly
+	}
+	if date.IsZero() {
+		date = time.Now()
+	}
+	m.lock()
+	defer m.unlock()
+
+	props := mailbox.MessageProperties{
+		Flags:        lib.StripRecentFlag(flags),
+		InternalDate: date,
+		Size:         uint32(body.Len()),
+	}
+	_, err := m.user.account.Backend.PutMessage(context.Background(), m.info, props, body)
+	return err
+}
+
+func (m *serverMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
+	if m.user.account.ReadOnly {
+		return ErrReadOnly
+	}
+	updater, ok := m.user.account.Backend.(storage.FlagsUpdater)
+	if !ok {
+		return ErrNotSupported
+	}
+	m.lock()
+	defer m.unlock()
+
+	handle, messages, err := m.loadMessages()
+	if err != nil {
+		return err
+	}
+	_ = handle.Close()
+
+	for _, msg := range selectMessages(messages, uid, seqset) {
+		newFlags := lib.StripRecentFlag(backendutil.UpdateFlags(msg.Flags, operation, flags))
+		err = updater.SetMessageFlags(context.Background(), m.info, msg.messageID, newFlags)
+		if err != nil {
+			return fmt.Errorf("cannot update flags of message %d: %w", msg.uid, err)
+		}
+	}
+	return nil
+}
+
+func (m *serverMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	if m.user.account.ReadOnly {
+		return ErrReadOnly
+	}
+	m.lock()
+	defer m.unlock()
+
+	handle, messages, err := m.loadMessages()
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	// the bodies are read before saving the copies: some backends cannot save a message while they're fetching
+	type copied struct {
+		props mailbox.MessageProperties
+		uid   uint32
+		body  []byte
+	}
+	copies := make([]copied, 0)
+	err = readBodies(handle, selectMessages(messages, uid, seqset), func(msg *message) error {
+		copies = append(copies, copied{props: msg.MessageProperties, uid: msg.uid, body: msg.body})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(copies, func(a, b copied) int {
+		return cmp.Compare(a.uid, b.uid)
+	})
+	destInfo := m.user.mailboxInfo(dest)
+	for _, msg := range copies {
+		msg.props.Size = uint32(len(msg.body))
+		_, err = m.user.account.Backend.PutMessage(context.Background(), destInfo, msg.props, bytes.NewReader(msg.body))
+		if err != nil {
+			return fmt.Errorf("cannot copy message %d: %w", msg.uid, err)
+		}
+	}
+	return nil
+}
+
+func (m *serverMailbox) Expunge() error {
+	if m.user.account.ReadOnly {
+		return ErrReadOnly
+	}
+	deleter, ok := m.user.account.Backend.(storage.MessageDeleter)
+	if !ok {
+		return ErrNotSupported
+	}
+	m.lock()
+	defer m.unlock()
+
+	handle, messages, err := m.loadMessages()
+	if err != nil {
+		return err
+	}
+	_ = handle.Close()
+
+	for _, msg := range messages {
+		if !slices.Contains(msg.Flags, imap.DeletedFlag) {
+			continue
+		}
+		err = deleter.DeleteMessage(context.Background(), m.info, msg.messageID)
+		if err != nil {
+			return fmt.Errorf("cannot delete message %d: %w", msg.uid, err)
+		}
+	}
+	return nil
+}
+
+func (m *serverMailbox) lock() {
+	m.user.lock.Lock()
+}
+
+func (m *serverMailbox) unlock() {
+	m.user.lock.Unlock()
+}
+
+// loadMessages opens the mailbox and returns the list of messages sorted by UID, without their body.
+// The handle must be closed by the caller. The account lock must be held by the caller.
+func (m *serverMailbox) loadMessages() (mailbox.Handle, []*message, error) {
+	be := m.user.account.Backend
+	handle, err := be.OpenMailbox(context.Background(), m.info)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	messages := make([]*message, 0, handle.Status().Messages)
+	receiver := make(chan *mailbox.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- handle.Fetch(context.Background(), time.Time{}, receiver)
+	}()
+
+	for msg := range receiver {
+		messages = append(messages, &message{
+			messageID:         msg.Uid,
+			MessageProperties: msg.MessageProperties,
+		})
+		_ = msg.Body.Close()
+	}
+	err = <-done
+	if err != nil {
+		_ = handle.Close()
+		return nil, nil, err
+	}
+
+	// backends using string IDs need a UID for the IMAP protocol
+	keys := make([]string, 0)
+	for _, msg := range messages {
+		if msg.messageID.IsUint() {
+			msg.uid = msg.messageID.AsUint()
+			continue
+		}
+		keys = append(keys, msg.messageID.AsString())
+	}
+	if len(keys) > 0 {
+		uids := m.user.backend.uidFor(be.AccountID(), m.info.Name, keys)
+		for _, msg := range messages {
+			if msg.uid == 0 {
+				msg.uid = uids[msg.messageID.AsString()]
+			}
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].uid < messages[j].uid
+	})
+	for index, msg := range messages {
+		msg.seqNum = uint32(index + 1)
+	}
+	return handle, messages, nil
+}
+
+// selectMessages returns the messages in the sequence set, by UID or by sequence number
+func selectMessages(messages []*message, uid bool, seqset *imap.SeqSet) []*message {
+	selected := make([]*message, 0)
+	for _, msg := range messages {
+		if seqset.Contains(msg.id(uid)) {
+			selected = append(selected, msg)
+		}
+	}
+	return selected
+}
+
+// readBodies fetches the body of the messages from the backend, and calls read with each message while its body is loaded.
+// The messages may be received in any order. The account lock must be held by the caller.
+func readBodies(handle mailbox.Handle, messages []*message, read func(msg *message) error) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	byID := make(map[mailbox.MessageID]*message, len(messages))
+	ids := make([]mailbox.MessageID, len(messages))
+	for index, msg := range messages {
+		byID[msg.messageID] = msg
+		ids[index] = msg.messageID
+	}
+	receiver := make(chan *mailbox.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- handle.FetchUids(context.Background(), ids, receiver)
+	}()
+
+	var readErr error
+	for fetched := range receiver {
+		msg, found := byID[fetched.Uid]
+		if found && readErr == nil {
+			msg.body, readErr = io.ReadAll(fetched.Body)
+			if readErr == nil {
+				readErr = read(msg)
+			}
+			msg.body = nil
+		}
+		_ = fetched.Body.Close()
+	}
+	err := <-done
+	if err != nil {
+		return err
+	}
+	return readErr
+}
+
+// needBody returns true when the fetch items cannot be answered from the message properties
+func needBody(items []imap.FetchItem) bool {
+	for _, item := range items {
+		switch item {
+		case imap.FetchFlags, imap.FetchInternalDate, imap.FetchUid:
+			continue
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// searchBody returns true when the criteria need the headers or the content of the messages
+func searchBody(criteria *imap.SearchCriteria) bool {
+	if !criteria.SentBefore.IsZero() || !criteria.SentSince.IsZero() ||
+		len(criteria.Header) > 0 || len(criteria.Body) > 0 || len(criteria.Text) > 0 ||
+		criteria.Larger > 0 || criteria.Smaller > 0 {
+		return true
+	}
+	for _, not := range criteria.Not {
+		if searchBody(not) {
+			return true
+		}
+	}
+	for _, or := range criteria.Or {
+		if searchBody(or[0]) || searchBody(or[1]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/creativeprojects/imap/mailbox"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+	gomessage "github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+type message struct {
+	mailbox.MessageProperties
+	uid       uint32
+	seqNum    uint32
+	messageID mailbox.MessageID
+	// body is only loaded while the message is fetched, searched or copied
+	body []byte
+}
+
+// id returns either the UID or the sequence number of the message
+func (m *message) id(uid bool) uint32 {
+	if uid {
+		return m.uid
+	}
+	return m.seqNum
+}
+
+func (m *message) headerAndBody() (textproto.Header, io.Reader, error) {
+	body := bufio.NewReader(bytes.NewReader(m.body))
+	header, err := textproto.ReadHeader(body)
+	return header, body, err
+}
+
+func (m *message) fetch(items []imap.FetchItem) (*imap.Message, error) {
+	fetched := imap.NewMessage(m.seqNum, items)
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			header, _, _ := m.headerAndBody()
+			fetched.Envelope, _ = backendutil.FetchEnvelope(header)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			header, body, _ := m.headerAndBody()
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(header, body, item == imap.FetchBodyStructure)
+		case imap.FetchFlags:
+			fetched.Flags = m.Flags
+		case imap.FetchInternalDate:
+			fetched.InternalDate = m.InternalDate
+		case imap.FetchRFC822Size:
+			fetched.Size = uint32(len(m.body))
+		case imap.FetchUid:
+			fetched.Uid = m.uid
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				break
+			}
+			header, body, err := m.headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			literal, _ := backendutil.FetchBodySection(header, body, section)
+			fetched.Body[section] = literal
+		}
+	}
+	return fetched, nil
+}
+
+func (m *message) match(criteria *imap.SearchCriteria) (bool, error) {
+	entity, _ := gomessage.Read(bytes.NewReader(m.body))
+	return backendutil.Match(entity, m.seqNum, m.uid, m.InternalDate, m.Flags, criteria)
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/creativeprojects/imap/mailbox"
+	"github.com/emersion/go-imap/backend"
+)
+
+type user struct {
+	backend *Backend
+	account Account
+	// lock is shared by all the sessions of the account
+	lock *sync.Mutex
+}
+
+func (u *user) Username() string {
+	return u.account.Username
+}
+
+func (u *user) ListMailboxes(_ bool) ([]backend.Mailbox, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	list, err := u.account.Backend.ListMailbox(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	mailboxes := make([]backend.Mailbox, len(list))
+	for index, info := range list {
+		mailboxes[index] = newMailbox(u, info)
+	}
+	return mailboxes, nil
+}
+
+func (u *user) GetMailbox(name string) (backend.Mailbox, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	list, err := u.account.Backend.ListMailbox(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range list {
+		if info.Name == name || (strings.EqualFold(name, "INBOX") && strings.EqualFold(info.Name, "INBOX")) {
+			return newMailbox(u, info), nil
+		}
+	}
+	return nil, backend.ErrNoSuchMailbox
+}
+
+func (u *user) CreateMailbox(name string) error {
+	if u.account.ReadOnly {
+		return ErrReadOnly
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return u.account.Backend.CreateMailbox(context.Background(), u.mailboxInfo(name))
+}
+
+func (u *user) DeleteMailbox(name string) error {
+	if u.account.ReadOnly {
+		return ErrReadOnly
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return u.account.Backend.DeleteMailbox(context.Background(), u.mailboxInfo(name))
+}
+
+func (u *user) RenameMailbox(existingName, newName string) error {
+	return errors.New("renaming a mailbox is not supported")
+}
+
+func (u *user) Logout() error {
+	u.backend.log.Printf("User %q logged out", u.account.Username)
+	return nil
+}
+
+func (u *user) mailboxInfo(name string) mailbox.Info {
+	return mailbox.Info{
+		Delimiter: u.account.Backend.Delimiter(),
+		Name:      name,
+	}
+}
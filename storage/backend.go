@@ -8,6 +8,15 @@ import (
 	"github.com/creativeprojects/imap/mailbox"
 )
 
+// MailboxHandle is a mailbox opened by OpenMailbox, with its own status
+type MailboxHandle = mailbox.Handle
+
+// Backend is implemented by all the storage backends. They are safe for concurrent use,
+// but the mailbox selected by SelectMailbox is shared between all the callers:
+// use OpenMailbox to work on a mailbox without interfering with the other callers.
+//
+// The methods talking to the storage take a context: they return the error of the context
+// as soon as it's cancelled or its deadline is exceeded.
 type Backend interface {
 	// AccountID is an internal ID used to tag accounts in history
 	AccountID() string
@@ -20,12 +29,14 @@ type Backend interface {
 	// Close the backend
 	Close() error
 	// CreateMailbox doesn't return an error if the mailbox already exists
-	CreateMailbox(info mailbox.Info) error
-	ListMailbox() ([]mailbox.Info, error)
-	DeleteMailbox(info mailbox.Info) error
-	// SelectMailbox opens the current mailbox for fetching messages
-	SelectMailbox(info mailbox.Info) (*mailbox.Status, error)
-	PutMessage(info mailbox.Info, props mailbox.MessageProperties, body io.Reader) (mailbox.MessageID, error)
+	CreateMailbox(ctx context.Context, info mailbox.Info) error
+	ListMailbox(ctx context.Context) ([]mailbox.Info, error)
+	DeleteMailbox(ctx context.Context, info mailbox.Info) error
+	// OpenMailbox returns a handle to work on the mailbox. The handle must be closed after use.
+	OpenMailbox(ctx context.Context, info mailbox.Info) (MailboxHandle, error)
+	// SelectMailbox opens the current mailbox for fetching messages (it keeps the handle from OpenMailbox)
+	SelectMailbox(ctx context.Context, info mailbox.Info) (*mailbox.Status, error)
+	PutMessage(ctx context.Context, info mailbox.Info, props mailbox.MessageProperties, body io.Reader) (mailbox.MessageID, error)
 	// FetchMessages needs a mailbox to be selected first.
 	// Use the zero Time to fetch all messages.
 	FetchMessages(ctx context.Context, since time.Time, messages chan *mailbox.Message) error
@@ -33,6 +44,44 @@ type Backend interface {
 	LatestDate(ctx context.Context) (time.Time, error)
 	// UnselectMailbox after fetching messages
 	UnselectMailbox() error
-	AddToHistory(info mailbox.Info, actions ...mailbox.HistoryAction) error
-	GetHistory(info mailbox.Info) (*mailbox.History, error)
+	AddToHistory(ctx context.Context, info mailbox.Info, actions ...mailbox.HistoryAction) error
+	GetHistory(ctx context.Context, info mailbox.Info) (*mailbox.History, error)
+}
+
+// FlagsUpdater is implemented by backends able to change the flags of a message already stored
+type FlagsUpdater interface {
+	SetMessageFlags(ctx context.Context, info mailbox.Info, uid mailbox.MessageID, flags []string) error
+}
+
+// MessageDeleter is implemented by backends able to remove a single message from a mailbox
+type MessageDeleter interface {
+	DeleteMessage(ctx context.Context, info mailbox.Info, uid mailbox.MessageID) error
+}
+
+// AccountLocker is implemented by backends able to lock the account, so two processes cannot write to it at the same time.
+// LockAccount waits up to timeout for the lock held by another process (zero to fail straight away), and returns the function to release it.
+// The local database doesn't need it: the file is already locked while it's open.
+type AccountLocker interface {
+	LockAccount(ctx context.Context, timeout time.Duration) (release func() error, err error)
+}
+
+// Watcher is implemented by backends able to notify the changes in a mailbox (like IMAP IDLE).
+// Watch blocks until the context is cancelled or the connection is lost: it sends a notification to changed,
+// without blocking, when it starts watching and each time messages are added or removed.
+// It keeps the backend busy, so use one backend per mailbox.
+type Watcher interface {
+	Watch(ctx context.Context, info mailbox.Info, pollInterval time.Duration, changed chan<- struct{}) error
+}
+
+// HistoryReplacer is implemented by backends able to rewrite the whole history of a mailbox (to compact or import it).
+// An empty history removes all the actions.
+type HistoryReplacer interface {
+	ReplaceHistory(ctx context.Context, info mailbox.Info, history *mailbox.History) error
+}
+
+// MessageIDMigrator is implemented by backends which identified their messages differently in older versions
+// (the maildir messages were identified by their key before they had a UID).
+// MigratedIDs returns the current ID of the messages of the mailbox from their old ID.
+type MessageIDMigrator interface {
+	MigratedIDs(ctx context.Context, info mailbox.Info) (map[string]mailbox.MessageID, error)
 }
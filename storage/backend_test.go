@@ -164,7 +164,7 @@ func RunIntegrationTestsOnBackend(t *testing.T, backend Backend) {
 		memBackend := mem.New()
 		memBackend.GenerateFakeEmails(info, total, 100, 100000)
 
-		_, err := memBackend.SelectMailbox(info)
+		_, err := memBackend.SelectMailbox(context.Background(), info)
 		assert.NoError(t, err)
 
 		progress := &testProgress{}
@@ -175,7 +175,7 @@ func RunIntegrationTestsOnBackend(t *testing.T, backend Backend) {
 		assert.Equal(t, int(total), len(entries))
 
 		// Verify the mailbox shows the right number of messages
-		status, err := backend.SelectMailbox(info)
+		status, err := backend.SelectMailbox(context.Background(), info)
 		require.NoError(t, err)
 
 		assert.Equal(t, info.Name, status.Name)
@@ -183,7 +183,7 @@ func RunIntegrationTestsOnBackend(t *testing.T, backend Backend) {
 
 		err = backend.UnselectMailbox()
 		assert.NoError(t, err)
-		err = backend.DeleteMailbox(info)
+		err = backend.DeleteMailbox(context.Background(), info)
 		assert.NoError(t, err)
 	})
 }
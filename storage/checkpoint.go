@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/creativeprojects/imap/mailbox"
+	"github.com/creativeprojects/imap/term"
+)
+
+// Checkpoint saves the history entries while the messages are being copied,
+// so an interrupted copy doesn't lose track of the messages already copied.
+type Checkpoint struct {
+	// Messages is the number of messages copied between two saves (zero to disable)
+	Messages int
+	// Interval is the maximum time between two saves (zero to disable)
+	Interval time.Duration
+	// Save receives the entries copied since the previous save.
+	// It's called one last time with the remaining entries when the copy stops, even after the context is cancelled.
+	Save func(entries []mailbox.HistoryEntry) error
+}
+
+// checkpointer keeps the entries not saved yet
+type checkpointer struct {
+	checkpoint *Checkpoint
+	pending    []mailbox.HistoryEntry
+	saved      time.Time
+	err        error
+}
+
+func newCheckpointer(checkpoint *Checkpoint) *checkpointer {
+	return &checkpointer{
+		checkpoint: checkpoint,
+		saved:      time.Now(),
+	}
+}
+
+// add an entry, saving the pending entries when the checkpoint is due
+func (c *checkpointer) add(entry mailbox.HistoryEntry) {
+	if c.checkpoint == nil {
+		return
+	}
+	c.pending = append(c.pending, entry)
+	if c.checkpoint.Messages > 0 && len(c.pending) >= c.checkpoint.Messages ||
+		c.checkpoint.Interval > 0 && time.Since(c.saved) >= c.checkpoint.Interval {
+		c.save()
+	}
+}
+
+// flush saves the pending entries and returns the last error
+func (c *checkpointer) flush() error {
+	if c.checkpoint == nil {
+		return nil
+	}
+	c.save()
+	return c.err
+}
+
+func (c *checkpointer) save() {
+	if len(c.pending) == 0 || c.checkpoint.Save == nil {
+		return
+	}
+	err := c.checkpoint.Save(c.pending)
+	if err != nil {
+		// the entries are kept for the next checkpoint
+		term.Errorf("cannot save history checkpoint: %s", err)
+		c.err = err
+		return
+	}
+	c.pending = nil
+	c.saved = time.Now()
+	c.err = nil
+}
@@ -1,59 +1,231 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"time"
 
+	"github.com/creativeprojects/imap/lib"
+	"github.com/creativeprojects/imap/limitio"
 	"github.com/creativeprojects/imap/mailbox"
 	"github.com/creativeprojects/imap/term"
+	"golang.org/x/time/rate"
 )
 
 var (
 	ErrMessageAlreadyCopied = errors.New("message already copied")
 )
 
+// CopyOptions changes the way CopyMessagesWithOptions copies the messages
+type CopyOptions struct {
+	// Checkpoint saves the history entries while copying (nil to disable)
+	Checkpoint *Checkpoint
+	// Retry sends a message again after a transient error from the destination
+	Retry RetryPolicy
+	// Destination mailbox, when it's not the same name as the source
+	Destination mailbox.Info
+	// Filter selects the messages to copy (nil to copy all of them)
+	Filter *MessageFilter
+	// RateLimit limits the speed of the copy, in bytes per second (zero for no limit): it's shared by all the messages.
+	// It's applied to the message bodies as they're read from the source, so it doesn't limit the download
+	// from a source reading each message completely before returning it (like an IMAP server).
+	RateLimit float64
+}
+
+// CopyResult lists the messages copied, and the ones which could not be copied
+type CopyResult struct {
+	Entries []mailbox.HistoryEntry
+	// Failed entries have no MessageID: save them in the history with the ActionFailed action
+	// so the next copy tries them again first
+	Failed []mailbox.HistoryEntry
+	// Skipped is the number of messages not selected by the filter
+	Skipped int
+}
+
 func CopyMessages(ctx context.Context, backendSource, backendDest Backend, mbox mailbox.Info, pbar Progresser, history *mailbox.History) ([]mailbox.HistoryEntry, error) {
-	err := backendDest.CreateMailbox(mbox)
+	result, err := CopyMessagesWithOptions(ctx, backendSource, backendDest, mbox, pbar, history, CopyOptions{})
+	if result == nil {
+		return nil, err
+	}
+	return result.Entries, err
+}
+
+// CopyMessagesWithOptions copies the messages like CopyMessages. The messages which failed
+// during a previous copy (listed in the history) are copied first.
+// Only the actions of the history with the same source mailbox and UID validity are used.
+// All the entries are returned, even when they were already saved by the checkpoint.
+func CopyMessagesWithOptions(ctx context.Context, backendSource, backendDest Backend, mbox mailbox.Info, pbar Progresser, history *mailbox.History, options CopyOptions) (*CopyResult, error) {
+	destination := mbox
+	if options.Destination.Name != "" {
+		destination = options.Destination
+	}
+	err := backendDest.CreateMailbox(ctx, destination)
 	if err != nil {
 		return nil, fmt.Errorf("cannot create mailbox at destination: %w", err)
 	}
 
-	entries := make([]mailbox.HistoryEntry, 0)
+	source, err := backendSource.OpenMailbox(ctx, mbox)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open mailbox at source: %w", err)
+	}
+	defer source.Close()
+	history = migrateSourceIDs(ctx, backendSource, backendDest, mbox, destination, history, source.Status().UidValidity)
+	// the UIDs of another mailbox copied to the same destination, or copied before the UID validity changed, are not the same messages
+	history = mailbox.SourceMailboxHistory(history, backendSource.AccountID(), mbox.Name, source.Status().UidValidity)
+
+	c := &copier{
+		backendDest: backendDest,
+		mbox:        destination,
+		pbar:        pbar,
+		history:     history,
+		retry:       options.Retry,
+		filter:      options.Filter,
+		limiter:     newLimiter(options.RateLimit),
+		now:         time.Now(),
+		checkpoints: newCheckpointer(options.Checkpoint),
+		copied:      make(map[mailbox.MessageID]bool),
+		result: &CopyResult{
+			Entries: make([]mailbox.HistoryEntry, 0),
+			Failed:  make([]mailbox.HistoryEntry, 0),
+		},
+	}
+
+	var fetchErr error
+	if failed := mailbox.FindFailedEntries(backendSource.AccountID(), history); len(failed) > 0 {
+		uids := make([]mailbox.MessageID, len(failed))
+		for i, entry := range failed {
+			uids[i] = entry.SourceID
+		}
+		term.Infof("retrying %d messages which failed to copy before", len(uids))
+		fetchErr = c.copy(ctx, func(receiver chan *mailbox.Message) error {
+			return source.FetchUids(ctx, uids, receiver)
+		})
+	}
+	if ctx.Err() == nil {
+		// fetch from the latest message stored in the destination mailbox
+		since := mailbox.FindLatestInternalDateFromHistory(backendSource.AccountID(), history)
+		if filterSince := options.Filter.since(c.now); filterSince.After(since) {
+			since = filterSince
+		}
+		err = c.copy(ctx, func(receiver chan *mailbox.Message) error {
+			return source.Fetch(ctx, since, receiver)
+		})
+		fetchErr = errors.Join(fetchErr, err)
+	}
+	saveErr := c.checkpoints.flush()
+	if ctx.Err() != nil {
+		// the messages copied before the cancellation are still returned
+		return c.result, ctx.Err()
+	}
+	if fetchErr != nil {
+		return c.result, fmt.Errorf("error loading messages: %w", fetchErr)
+	}
+	if saveErr != nil {
+		return c.result, fmt.Errorf("cannot save history: %w", saveErr)
+	}
+	return c.result, nil
+}
+
+// migrateSourceIDs replaces the old IDs of the source messages in the history saved by an older version,
+// and saves the history in the destination so it's only done once.
+// The history is returned unchanged when it cannot be migrated.
+func migrateSourceIDs(ctx context.Context, backendSource, backendDest Backend, mbox, destination mailbox.Info, history *mailbox.History, uidValidity uint32) *mailbox.History {
+	migrator, ok := backendSource.(MessageIDMigrator)
+	if !ok || !mailbox.HasStringSourceIDs(history, backendSource.AccountID(), mbox.Name) {
+		return history
+	}
+	ids, err := migrator.MigratedIDs(ctx, mbox)
+	if err != nil {
+		term.Warnf("cannot migrate the history of mailbox %s: %s", destination.Name, err)
+		return history
+	}
+	migrated, changed := mailbox.MigrateSourceIDs(history, backendSource.AccountID(), mbox.Name, uidValidity, ids)
+	if !changed {
+		return history
+	}
+	if replacer, ok := backendDest.(HistoryReplacer); ok {
+		err = replacer.ReplaceHistory(ctx, destination, migrated)
+		if err != nil {
+			term.Warnf("cannot save the migrated history of mailbox %s: %s", destination.Name, err)
+		}
+	}
+	return migrated
+}
+
+// copier keeps the state of CopyMessagesWithOptions
+type copier struct {
+	backendDest Backend
+	mbox        mailbox.Info
+	pbar        Progresser
+	history     *mailbox.History
+	retry       RetryPolicy
+	filter      *MessageFilter
+	limiter     *rate.Limiter
+	now         time.Time
+	checkpoints *checkpointer
+	// copied during this run: the messages retried first can be fetched again afterwards
+	copied map[mailbox.MessageID]bool
+	result *CopyResult
+}
 
+// copy the messages sent by fetch, and returns the error from fetch
+func (c *copier) copy(ctx context.Context, fetch func(receiver chan *mailbox.Message) error) error {
 	receiver := make(chan *mailbox.Message, 10)
 	done := make(chan error, 1)
 	go func() {
-		// fetch from the latest message stored in the destination mailbox
-		done <- backendSource.FetchMessages(ctx, mailbox.FindLatestInternalDateFromHistory(backendSource.AccountID(), history), receiver)
+		done <- fetch(receiver)
 	}()
 
 	for msg := range receiver {
-		if pbar != nil {
-			pbar.Increment()
+		if c.pbar != nil {
+			c.pbar.Increment()
+		}
+		if c.copied[msg.Uid] {
+			msg.Body.Close()
+			continue
+		}
+		if !c.filter.Match(msg, c.now) {
+			msg.Body.Close()
+			c.result.Skipped++
+			continue
+		}
+		if c.limiter != nil {
+			msg.Body = limitBody(msg.Body, c.limiter)
+		}
+		id, err := copyMessage(ctx, msg, c.backendDest, c.mbox, c.history, c.retry)
+		if errors.Is(err, ErrMessageAlreadyCopied) {
+			continue
 		}
-		id, err := copyMessage(ctx, msg, backendDest, mbox, history)
 		if err != nil || id == nil {
-			// don't save this entry in history
+			if ctx.Err() != nil {
+				// a message interrupted is not a failed message
+				continue
+			}
+			// don't save this entry in history, but try again next time
+			c.result.Failed = append(c.result.Failed, mailbox.HistoryEntry{
+				SourceID:           msg.Uid,
+				SourceInternalDate: msg.InternalDate,
+			})
 			continue
 		}
-		entries = append(entries, mailbox.HistoryEntry{
+		entry := mailbox.HistoryEntry{
 			SourceID:           msg.Uid,
 			SourceInternalDate: msg.InternalDate,
 			MessageID:          *id,
-		})
+		}
+		c.copied[msg.Uid] = true
+		c.result.Entries = append(c.result.Entries, entry)
+		c.checkpoints.add(entry)
 	}
 	// wait until all the messages arrived
-	err = <-done
-	_ = backendSource.UnselectMailbox()
-	if err != nil {
-		return entries, fmt.Errorf("error loading messages: %w", err)
-	}
-	return entries, nil
+	return <-done
 }
 
 // copyMessage returns ErrMessageAlreadyCopied when the message is skipped
-func copyMessage(_ context.Context, msgSource *mailbox.Message, backendDest Backend, mboxDest mailbox.Info, history *mailbox.History) (*mailbox.MessageID, error) {
+func copyMessage(ctx context.Context, msgSource *mailbox.Message, backendDest Backend, mboxDest mailbox.Info, history *mailbox.History, retry RetryPolicy) (*mailbox.MessageID, error) {
 	defer msgSource.Body.Close()
 
 	if previousEntry := mailbox.FindHistoryEntryFromSourceID(history, msgSource.Uid); previousEntry != nil {
@@ -66,10 +238,59 @@ func copyMessage(_ context.Context, msgSource *mailbox.Message, backendDest Back
 		Size:         msgSource.Size,
 		Hash:         msgSource.Hash,
 	}
-	id, err := backendDest.PutMessage(mboxDest, props, msgSource.Body)
-	if err != nil {
+	body := func() io.Reader {
+		return msgSource.Body
+	}
+	if _, ok := backendDest.(RetryClassifier); !ok {
+		// nothing to retry: the body is not kept in memory
+		retry.Attempts = 1
+	}
+	if retry.Attempts > 1 {
+		// the body is sent again on each attempt
+		content, err := io.ReadAll(lib.NewContextReader(ctx, msgSource.Body))
+		if err != nil {
+			if ctx.Err() == nil {
+				term.Errorf("error reading message: %s", err)
+			}
+			return nil, err
+		}
+		if props.Size > 0 && len(content) != int(props.Size) {
+			err = fmt.Errorf("message body size advertised as %d bytes but read %d bytes from buffer", props.Size, len(content))
+			term.Errorf("error saving message: %s", err)
+			return nil, err
+		}
+		body = func() io.Reader {
+			return bytes.NewReader(content)
+		}
+	}
+	var id mailbox.MessageID
+	err := retry.run(ctx, backendDest, func() error {
+		var err error
+		id, err = backendDest.PutMessage(ctx, mboxDest, props, body())
+		return err
+	})
+	if err != nil && ctx.Err() == nil {
 		// display error but keep going
 		term.Errorf("error saving message: %s", err)
 	}
 	return &id, err
 }
+
+// newLimiter returns nil when there's no limit. The burst allows reading a small message in one go.
+func newLimiter(bytesPerSec float64) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	burst := int(min(bytesPerSec, 32*1024))
+	return rate.NewLimiter(rate.Limit(bytesPerSec), max(burst, 1))
+}
+
+// limitBody limits the reading speed of the body with the limiter shared by all the messages
+func limitBody(body io.ReadCloser, limiter *rate.Limiter) io.ReadCloser {
+	reader := limitio.NewReader(body)
+	reader.SetLimiter(limiter)
+	return struct {
+		io.Reader
+		io.Closer
+	}{reader, body}
+}
@@ -0,0 +1,358 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/creativeprojects/imap/lib"
+	"github.com/creativeprojects/imap/mailbox"
+	"github.com/creativeprojects/imap/storage/mdir"
+	"github.com/creativeprojects/imap/storage/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cancelProgress cancels the context when the message number "at" is received
+type cancelProgress struct {
+	count  int
+	at     int
+	cancel context.CancelFunc
+}
+
+func (p *cancelProgress) Increment() {
+	p.count++
+	if p.count == p.at {
+		p.cancel()
+	}
+}
+
+func TestCopyMessagesWithCheckpoint(t *testing.T) {
+	info := mailbox.Info{Name: "INBOX", Delimiter: "."}
+	source := mem.New()
+	source.GenerateFakeEmails(info, 23, 100, 1000)
+	dest := mem.New()
+
+	saved := make([]int, 0)
+	checkpoint := &Checkpoint{
+		Messages: 5,
+		Save: func(entries []mailbox.HistoryEntry) error {
+			saved = append(saved, len(entries))
+			return nil
+		},
+	}
+	result, err := CopyMessagesWithOptions(context.Background(), source, dest, info, nil, nil, CopyOptions{Checkpoint: checkpoint})
+	require.NoError(t, err)
+	assert.Len(t, result.Entries, 23)
+	assert.Equal(t, []int{5, 5, 5, 5, 3}, saved)
+}
+
+func TestCopyMessagesCheckpointRetry(t *testing.T) {
+	info := mailbox.Info{Name: "INBOX", Delimiter: "."}
+	source := mem.New()
+	source.GenerateFakeEmails(info, 10, 100, 1000)
+	dest := mem.New()
+
+	calls := 0
+	saved := make([]int, 0)
+	checkpoint := &Checkpoint{
+		Messages: 4,
+		Save: func(entries []mailbox.HistoryEntry) error {
+			calls++
+			if calls == 1 {
+				return errors.New("disk full")
+			}
+			saved = append(saved, len(entries))
+			return nil
+		},
+	}
+	result, err := CopyMessagesWithOptions(context.Background(), source, dest, info, nil, nil, CopyOptions{Checkpoint: checkpoint})
+	require.NoError(t, err)
+	assert.Len(t, result.Entries, 10)
+	// the entries of the failed checkpoint are saved with the next message
+	assert.Equal(t, []int{5, 4, 1}, saved)
+}
+
+func TestCopyMessagesInterrupted(t *testing.T) {
+	info := mailbox.Info{Name: "INBOX", Delimiter: "."}
+	source := mem.New()
+	source.GenerateFakeEmails(info, 20, 100, 1000)
+	dest := mem.New()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	saved := make([]mailbox.HistoryEntry, 0)
+	checkpoint := &Checkpoint{
+		Messages: 4,
+		Save: func(entries []mailbox.HistoryEntry) error {
+			saved = append(saved, entries...)
+			return nil
+		},
+	}
+	progress := &cancelProgress{at: 7, cancel: cancel}
+	result, err := CopyMessagesWithOptions(ctx, source, dest, info, progress, nil, CopyOptions{Checkpoint: checkpoint})
+	assert.ErrorIs(t, err, context.Canceled)
+	entries := result.Entries
+	// a cancelled message is not a failed message
+	assert.Empty(t, result.Failed)
+
+	// the message received with the cancellation is not copied
+	assert.Len(t, entries, 6)
+	// everything copied is saved
+	assert.Equal(t, entries, saved)
+
+	handle, err := dest.OpenMailbox(context.Background(), info)
+	require.NoError(t, err)
+	defer handle.Close()
+	assert.Equal(t, uint32(len(entries)), handle.Status().Messages)
+}
+
+// cancelAfterPutBackend cancels the context once the message number "at" is saved
+type cancelAfterPutBackend struct {
+	Backend
+	count  int
+	at     int
+	cancel context.CancelFunc
+}
+
+func (b *cancelAfterPutBackend) PutMessage(ctx context.Context, info mailbox.Info, props mailbox.MessageProperties, body io.Reader) (mailbox.MessageID, error) {
+	id, err := b.Backend.PutMessage(ctx, info, props, body)
+	b.count++
+	if b.count == b.at {
+		b.cancel()
+	}
+	return id, err
+}
+
+func TestCopyMessagesCancelledAfterPut(t *testing.T) {
+	info := mailbox.Info{Name: "INBOX", Delimiter: "."}
+	source := mem.New()
+	source.GenerateFakeEmails(info, 10, 100, 1000)
+	dest := mem.New()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	saved := make([]mailbox.HistoryEntry, 0)
+	checkpoint := &Checkpoint{
+		Messages: 4,
+		Save: func(entries []mailbox.HistoryEntry) error {
+			saved = append(saved, entries...)
+			return nil
+		},
+	}
+	backend := &cancelAfterPutBackend{Backend: dest, at: 3, cancel: cancel}
+	result, err := CopyMessagesWithOptions(ctx, source, backend, info, nil, nil, CopyOptions{Checkpoint: checkpoint})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, result.Failed)
+
+	// the message saved when the context was cancelled is in the history
+	require.Len(t, result.Entries, 3)
+	assert.Equal(t, result.Entries, saved)
+
+	handle, err := dest.OpenMailbox(context.Background(), info)
+	require.NoError(t, err)
+	defer handle.Close()
+	assert.Equal(t, uint32(3), handle.Status().Messages)
+}
+
+// flakyBackend fails to save some messages: the error is retryable when transient is true
+type flakyBackend struct {
+	Backend
+	failures  int
+	transient bool
+	calls     int
+}
+
+func (b *flakyBackend) PutMessage(ctx context.Context, info mailbox.Info, props mailbox.MessageProperties, body io.Reader) (mailbox.MessageID, error) {
+	b.calls++
+	if b.failures > 0 {
+		b.failures--
+		// read some of the body to make sure it's sent again in full
+		_, _ = io.CopyN(io.Discard, body, 10)
+		return mailbox.EmptyMessageID, &net.OpError{Op: "write", Err: os.ErrDeadlineExceeded}
+	}
+	return b.Backend.PutMessage(ctx, info, props, body)
+}
+
+func (b *flakyBackend) IsRetryable(err error) bool {
+	return b.transient
+}
+
+func TestCopyMessagesRetryTransientError(t *testing.T) {
+	info := mailbox.Info{Name: "INBOX", Delimiter: "."}
+	source := mem.New()
+	source.GenerateFakeEmails(info, 5, 100, 1000)
+	dest := &flakyBackend{Backend: mem.New(), failures: 2, transient: true}
+
+	result, err := CopyMessagesWithOptions(context.Background(), source, dest, info, nil, nil, CopyOptions{
+		Retry: RetryPolicy{Attempts: 3, Delay: time.Millisecond},
+	})
+	require.NoError(t, err)
+	assert.Len(t, result.Entries, 5)
+	assert.Empty(t, result.Failed)
+	assert.Equal(t, 7, dest.calls)
+
+	handle, err := dest.OpenMailbox(context.Background(), info)
+	require.NoError(t, err)
+	defer handle.Close()
+	assert.Equal(t, uint32(5), handle.Status().Messages)
+}
+
+func TestCopyMessagesFatalErrorNotRetried(t *testing.T) {
+	info := mailbox.Info{Name: "INBOX", Delimiter: "."}
+	source := mem.New()
+	source.GenerateFakeEmails(info, 5, 100, 1000)
+	dest := &flakyBackend{Backend: mem.New(), failures: 1, transient: false}
+
+	result, err := CopyMessagesWithOptions(context.Background(), source, dest, info, nil, nil, CopyOptions{
+		Retry: RetryPolicy{Attempts: 3, Delay: time.Millisecond},
+	})
+	require.NoError(t, err)
+	assert.Len(t, result.Entries, 4)
+	assert.Len(t, result.Failed, 1)
+	assert.Equal(t, 5, dest.calls)
+}
+
+func TestCopyMessagesWithoutClassifierNotRetried(t *testing.T) {
+	info := mailbox.Info{Name: "INBOX", Delimiter: "."}
+	source := mem.New()
+	source.GenerateFakeEmails(info, 5, 100, 1000)
+	flaky := &flakyBackend{Backend: mem.New(), failures: 1, transient: true}
+	// the body is not kept in memory to send it again
+	dest := struct{ Backend }{flaky}
+
+	result, err := CopyMessagesWithOptions(context.Background(), source, dest, info, nil, nil, CopyOptions{
+		Retry: RetryPolicy{Attempts: 3, Delay: time.Millisecond},
+	})
+	require.NoError(t, err)
+	assert.Len(t, result.Entries, 4)
+	assert.Len(t, result.Failed, 1)
+	assert.Equal(t, 5, flaky.calls)
+}
+
+func TestCopyMessagesRetryFailedFirst(t *testing.T) {
+	info := mailbox.Info{Name: "INBOX", Delimiter: "."}
+	source := mem.New()
+	source.GenerateFakeEmails(info, 5, 100, 1000)
+	dest := &flakyBackend{Backend: mem.New(), failures: 3, transient: true}
+	ctx := context.Background()
+
+	// the first message fails all its attempts
+	result, err := CopyMessagesWithOptions(ctx, source, dest, info, nil, nil, CopyOptions{
+		Retry: RetryPolicy{Attempts: 3, Delay: time.Millisecond},
+	})
+	require.NoError(t, err)
+	assert.Len(t, result.Entries, 4)
+	require.Len(t, result.Failed, 1)
+	assert.True(t, result.Failed[0].MessageID.IsZero())
+
+	history := &mailbox.History{Actions: []mailbox.HistoryAction{
+		{
+			SourceAccountTag: source.AccountID(),
+			SourceMailbox:    info.Name,
+			Date:             time.Now(),
+			Action:           mailbox.ActionCopy,
+			UidValidity:      uidValidity(t, source, info),
+			Entries:          result.Entries,
+		},
+		{
+			SourceAccountTag: source.AccountID(),
+			SourceMailbox:    info.Name,
+			Date:             time.Now(),
+			Action:           mailbox.ActionFailed,
+			UidValidity:      uidValidity(t, source, info),
+			Entries:          result.Failed,
+		},
+	}}
+	result, err = CopyMessagesWithOptions(ctx, source, dest, info, nil, history, CopyOptions{})
+	require.NoError(t, err)
+	require.Len(t, result.Entries, 1)
+	assert.Empty(t, result.Failed)
+	assert.Equal(t, history.Actions[1].Entries[0].SourceID, result.Entries[0].SourceID)
+
+	handle, err := dest.OpenMailbox(ctx, info)
+	require.NoError(t, err)
+	defer handle.Close()
+	assert.Equal(t, uint32(5), handle.Status().Messages)
+}
+
+func TestCopyMessagesMigratesMaildirKeys(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("maildir is not supported on Windows")
+		return
+	}
+	info := mailbox.Info{Name: "INBOX", Delimiter: "."}
+	generated := mem.New()
+	generated.GenerateFakeEmails(info, 5, 100, 1000)
+	source, err := mdir.New(t.TempDir())
+	require.NoError(t, err)
+	_, err = CopyMessages(t.Context(), generated, source, info, nil, nil)
+	require.NoError(t, err)
+	dest := mem.New()
+	ctx := t.Context()
+
+	// the history saved by an older version identified the maildir messages by their key
+	result, err := CopyMessagesWithOptions(ctx, source, dest, info, nil, nil, CopyOptions{})
+	require.NoError(t, err)
+	require.Len(t, result.Entries, 5)
+	ids, err := source.MigratedIDs(ctx, info)
+	require.NoError(t, err)
+	keys := make(map[mailbox.MessageID]string, len(ids))
+	for key, id := range ids {
+		keys[id] = key
+	}
+	for i, entry := range result.Entries {
+		result.Entries[i].SourceID = mailbox.NewMessageIDFromString(keys[entry.SourceID])
+	}
+	require.NoError(t, dest.AddToHistory(ctx, info, mailbox.HistoryAction{
+		SourceAccountTag: source.AccountID(),
+		Date:             time.Now(),
+		Action:           mailbox.ActionCopy,
+		UidValidity:      uidValidity(t, source, info),
+		Entries:          result.Entries,
+	}))
+
+	history, err := dest.GetHistory(ctx, info)
+	require.NoError(t, err)
+	result, err = CopyMessagesWithOptions(ctx, source, dest, info, nil, history, CopyOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, result.Entries)
+	assert.Equal(t, uint32(5), countMessages(t, dest, info))
+
+	// the history was saved with the UIDs
+	history, err = dest.GetHistory(ctx, info)
+	require.NoError(t, err)
+	assert.False(t, mailbox.HasStringSourceIDs(history, source.AccountID(), info.Name))
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{Attempts: 10, Delay: time.Second, MaxDelay: 10 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, delay := range expected {
+		assert.Equal(t, delay, policy.delay(i+1))
+	}
+
+	policy.MaxDelay = 0
+	assert.Equal(t, 32*time.Second, policy.delay(6))
+}
+
+func TestIsRetryable(t *testing.T) {
+	// without a classifier, only the timeouts are retried
+	backend := struct{ Backend }{mem.New()}
+	assert.False(t, IsRetryable(backend, nil))
+	assert.False(t, IsRetryable(backend, context.Canceled))
+	assert.False(t, IsRetryable(backend, errors.New("fatal")))
+	assert.True(t, IsRetryable(backend, &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}))
+
+	flaky := &flakyBackend{Backend: mem.New(), transient: true}
+	assert.True(t, IsRetryable(flaky, errors.New("busy")))
+	assert.False(t, IsRetryable(flaky, fmt.Errorf("wrapped: %w", lib.ErrMailboxNotFound)))
+}
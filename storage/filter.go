@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"slices"
+	"time"
+
+	"github.com/creativeprojects/imap/mailbox"
+)
+
+// MessageFilter selects the messages to copy. The zero value selects all the messages.
+type MessageFilter struct {
+	// Since and Before select the messages by internal date (zero to ignore)
+	Since  time.Time
+	Before time.Time
+	// OlderThan and NewerThan select the messages by age, at the time of the copy (zero to ignore)
+	OlderThan time.Duration
+	NewerThan time.Duration
+	// MinSize and MaxSize select the messages by size in bytes (zero to ignore)
+	MinSize uint32
+	MaxSize uint32
+	// Flags must all be set on the message
+	Flags []string
+	// ExcludeFlags must not be set on the message
+	ExcludeFlags []string
+}
+
+// Match returns true when the message should be copied
+func (f *MessageFilter) Match(msg *mailbox.Message, now time.Time) bool {
+	if f == nil {
+		return true
+	}
+	date := msg.InternalDate
+	if !f.Since.IsZero() && date.Before(f.Since) {
+		return false
+	}
+	if !f.Before.IsZero() && !date.Before(f.Before) {
+		return false
+	}
+	if f.OlderThan > 0 && date.After(now.Add(-f.OlderThan)) {
+		return false
+	}
+	if f.NewerThan > 0 && date.Before(now.Add(-f.NewerThan)) {
+		return false
+	}
+	if f.MinSize > 0 && msg.Size < f.MinSize {
+		return false
+	}
+	if f.MaxSize > 0 && msg.Size > f.MaxSize {
+		return false
+	}
+	for _, flag := range f.Flags {
+		if !slices.Contains(msg.Flags, flag) {
+			return false
+		}
+	}
+	for _, flag := range f.ExcludeFlags {
+		if slices.Contains(msg.Flags, flag) {
+			return false
+		}
+	}
+	return true
+}
+
+// since returns the earliest date of the messages selected by the filter (the zero time when there's no limit)
+func (f *MessageFilter) since(now time.Time) time.Time {
+	if f == nil {
+		return time.Time{}
+	}
+	since := f.Since
+	if f.NewerThan > 0 {
+		if newer := now.Add(-f.NewerThan); newer.After(since) {
+			since = newer
+		}
+	}
+	return since
+}
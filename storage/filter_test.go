@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/creativeprojects/imap/mailbox"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageFilter(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	message := &mailbox.Message{
+		MessageProperties: mailbox.MessageProperties{
+			Flags:        []string{"\\Seen", "$Label1"},
+			InternalDate: now.Add(-48 * time.Hour),
+			Size:         1000,
+		},
+	}
+
+	testData := []struct {
+		filter *MessageFilter
+		match  bool
+	}{
+		{nil, true},
+		{&MessageFilter{}, true},
+		{&MessageFilter{Since: now.Add(-72 * time.Hour)}, true},
+		{&MessageFilter{Since: now.Add(-24 * time.Hour)}, false},
+		{&MessageFilter{Before: now.Add(-24 * time.Hour)}, true},
+		{&MessageFilter{Before: now.Add(-48 * time.Hour)}, false},
+		{&MessageFilter{OlderThan: 24 * time.Hour}, true},
+		{&MessageFilter{OlderThan: 72 * time.Hour}, false},
+		{&MessageFilter{NewerThan: 72 * time.Hour}, true},
+		{&MessageFilter{NewerThan: 24 * time.Hour}, false},
+		{&MessageFilter{MinSize: 1000, MaxSize: 1000}, true},
+		{&MessageFilter{MinSize: 1001}, false},
+		{&MessageFilter{MaxSize: 999}, false},
+		{&MessageFilter{Flags: []string{"\\Seen", "$Label1"}}, true},
+		{&MessageFilter{Flags: []string{"\\Seen", "\\Flagged"}}, false},
+		{&MessageFilter{ExcludeFlags: []string{"\\Deleted"}}, true},
+		{&MessageFilter{ExcludeFlags: []string{"\\Deleted", "$Label1"}}, false},
+	}
+
+	for _, testItem := range testData {
+		assert.Equal(t, testItem.match, testItem.filter.Match(message, now), "%+v", testItem.filter)
+	}
+}
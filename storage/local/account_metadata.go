@@ -1,6 +1,50 @@
 package local
 
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/creativeprojects/imap/lib"
+	"github.com/creativeprojects/imap/lock"
+	bolt "go.etcd.io/bbolt"
+	bolterrors "go.etcd.io/bbolt/errors"
+)
+
 type accountMetadata struct {
 	Version   int
 	AccountID string
 }
+
+// ReadAccountID returns the account ID saved in the database file, without changing the file:
+// it's opened read-only and the database is neither upgraded nor given an ID.
+// It fails straight away when the file is open by another process.
+func ReadAccountID(filename string) (string, error) {
+	if _, err := os.Stat(filename); err != nil {
+		return "", err
+	}
+	options := boltOptions(time.Nanosecond)
+	options.ReadOnly = true
+	db, err := bolt.Open(filename, 0600, options)
+	if errors.Is(err, bolterrors.ErrTimeout) {
+		return "", &lock.LockedError{Path: filename}
+	}
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	store := &BoltStore{
+		dbFile: filename,
+		db:     db,
+	}
+	metadata, err := store.getMetadata()
+	if err != nil {
+		return "", fmt.Errorf("cannot read %q: %w", filename, err)
+	}
+	if metadata.AccountID == "" {
+		return "", lib.ErrNoAccountID
+	}
+	return metadata.AccountID, nil
+}
@@ -0,0 +1,282 @@
+package local
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/creativeprojects/imap/lib"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Message bodies are stored once in the bodies bucket, keyed by their SHA-256 hash.
+// The references bucket counts how many messages are pointing to each body.
+const (
+	bodiesBucket     = "bodies"
+	referencesBucket = "references"
+)
+
+// bodyKey returns the key of a body from its hash. On an encrypted database the hash is keyed
+// so it cannot be used to check if a known message is in the database.
+func (c *boxCipher) bodyKey(hash []byte) []byte {
+	if c == nil {
+		return hash
+	}
+	mac := hmac.New(sha256.New, c.hashKey)
+	mac.Write(hash)
+	return mac.Sum(nil)
+}
+
+// putBody saves the compressed body if it's not already in the database, and adds a reference to it
+func putBody(tx *bolt.Tx, hash, compressed []byte, crypt *boxCipher) error {
+	bodies, err := tx.CreateBucketIfNotExists([]byte(bodiesBucket))
+	if err != nil {
+		return err
+	}
+	references, err := tx.CreateBucketIfNotExists([]byte(referencesBucket))
+	if err != nil {
+		return err
+	}
+	key := crypt.bodyKey(hash)
+	if bodies.Get(key) == nil {
+		sealed, err := crypt.seal(compressed, valueLocation(key, bodiesBucket))
+		if err != nil {
+			return fmt.Errorf("cannot encrypt message body: %w", err)
+		}
+		err = bodies.Put(key, sealed)
+		if err != nil {
+			return fmt.Errorf("cannot save message body: %w", err)
+		}
+	}
+	return references.Put(key, serializeCount(deserializeCount(references.Get(key))+1))
+}
+
+// getBody returns the compressed body
+func getBody(tx *bolt.Tx, hash []byte, crypt *boxCipher) ([]byte, error) {
+	bodies := tx.Bucket([]byte(bodiesBucket))
+	if bodies == nil {
+		return nil, lib.ErrMessageNotFound
+	}
+	key := crypt.bodyKey(hash)
+	data := bodies.Get(key)
+	if data == nil {
+		return nil, lib.ErrMessageNotFound
+	}
+	return crypt.open(data, valueLocation(key, bodiesBucket))
+}
+
+// releaseBody removes a reference to a body, and deletes the body when it's no longer used
+func releaseBody(tx *bolt.Tx, hash []byte, crypt *boxCipher) error {
+	references := tx.Bucket([]byte(referencesBucket))
+	if references == nil {
+		return nil
+	}
+	key := crypt.bodyKey(hash)
+	count := deserializeCount(references.Get(key))
+	if count > 1 {
+		return references.Put(key, serializeCount(count-1))
+	}
+	err := references.Delete(key)
+	if err != nil {
+		return err
+	}
+	bodies := tx.Bucket([]byte(bodiesBucket))
+	if bodies == nil {
+		return nil
+	}
+	return bodies.Delete(key)
+}
+
+// collectHashes returns the hash of every message, in all mailboxes
+func collectHashes(tx *bolt.Tx, crypt *boxCipher) ([][]byte, error) {
+	hashes := make([][]byte, 0)
+	root := tx.Bucket([]byte(mailboxBucket))
+	if root == nil {
+		return hashes, nil
+	}
+	err := root.ForEach(func(name, value []byte) error {
+		if value != nil {
+			return nil
+		}
+		bucket := root.Bucket(name)
+		if bucket == nil {
+			return nil
+		}
+		mailboxHashes, err := collectMailboxHashes(bucket, string(name), crypt)
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, mailboxHashes...)
+		return nil
+	})
+	return hashes, err
+}
+
+// collectMailboxHashes returns the hash of every message in the mailbox
+func collectMailboxHashes(bucket *bolt.Bucket, name string, crypt *boxCipher) ([][]byte, error) {
+	hashes := make([][]byte, 0)
+	err := bucket.ForEach(func(key, value []byte) error {
+		if value == nil || !bytes.HasPrefix(key, []byte(msgPrefix)) {
+			return nil
+		}
+		props, err := decryptObject[msgProps](value, crypt, mailboxLocation(name, key))
+		if err != nil {
+			return fmt.Errorf("mailbox %q key %q: %w", name, string(key), err)
+		}
+		hashes = append(hashes, props.Hash)
+		return nil
+	})
+	return hashes, err
+}
+
+// rekeyBodies encrypts all the bodies referenced by a message with the new key. Unreferenced bodies are dropped.
+func rekeyBodies(tx *bolt.Tx, hashes [][]byte, oldCrypt, newCrypt *boxCipher) error {
+	bodies := tx.Bucket([]byte(bodiesBucket))
+	references := tx.Bucket([]byte(referencesBucket))
+	if bodies == nil || references == nil {
+		return nil
+	}
+	type body struct {
+		data  []byte
+		count []byte
+	}
+	moved := make(map[string]body, len(hashes))
+	for _, hash := range hashes {
+		newKey := string(newCrypt.bodyKey(hash))
+		if _, found := moved[newKey]; found {
+			continue
+		}
+		oldKey := oldCrypt.bodyKey(hash)
+		data := bodies.Get(oldKey)
+		if data == nil {
+			continue
+		}
+		plain, err := oldCrypt.open(data, valueLocation(oldKey, bodiesBucket))
+		if err != nil {
+			return err
+		}
+		sealed, err := newCrypt.seal(plain, valueLocation([]byte(newKey), bodiesBucket))
+		if err != nil {
+			return err
+		}
+		moved[newKey] = body{
+			data:  sealed,
+			count: bytes.Clone(references.Get(oldKey)),
+		}
+	}
+	for _, name := range []string{bodiesBucket, referencesBucket} {
+		err := tx.DeleteBucket([]byte(name))
+		if err != nil {
+			return err
+		}
+	}
+	bodies, err := tx.CreateBucket([]byte(bodiesBucket))
+	if err != nil {
+		return err
+	}
+	references, err = tx.CreateBucket([]byte(referencesBucket))
+	if err != nil {
+		return err
+	}
+	for key, body := range moved {
+		err = bodies.Put([]byte(key), body.data)
+		if err != nil {
+			return err
+		}
+		err = references.Put([]byte(key), body.count)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateToDeduplicatedBodies moves the bodies stored in each mailbox (version 1) to the bodies bucket (version 2)
+func migrateToDeduplicatedBodies(tx *bolt.Tx, crypt *boxCipher) error {
+	root := tx.Bucket([]byte(mailboxBucket))
+	if root == nil {
+		return nil
+	}
+	return root.ForEach(func(name, value []byte) error {
+		if value != nil {
+			return nil
+		}
+		mbox := root.Bucket(name)
+		if mbox == nil {
+			return nil
+		}
+		bodyKeys := make([][]byte, 0)
+		err := mbox.ForEach(func(key, _ []byte) error {
+			if bytes.HasPrefix(key, []byte(bodyPrefix)) {
+				bodyKeys = append(bodyKeys, bytes.Clone(key))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range bodyKeys {
+			compressed, err := crypt.open(mbox.Get(key), mailboxLocation(string(name), key))
+			if err != nil {
+				return fmt.Errorf("mailbox %q key %q: %w", string(name), string(key), err)
+			}
+			uid := DeserializeUID(bodyPrefix, key)
+			propsKey := SerializeUID(msgPrefix, uid)
+			props := &msgProps{}
+			if data := mbox.Get(propsKey); data != nil {
+				props, err = decryptObject[msgProps](data, crypt, mailboxLocation(string(name), propsKey))
+				if err != nil {
+					return fmt.Errorf("mailbox %q key %q: %w", string(name), string(propsKey), err)
+				}
+			}
+			if len(props.Hash) == 0 {
+				props.Hash, err = hashCompressedBody(compressed)
+				if err != nil {
+					return fmt.Errorf("mailbox %q key %q: %w", string(name), string(key), err)
+				}
+				err = storeUID(mbox, string(name), msgPrefix, uid, props, crypt)
+				if err != nil {
+					return err
+				}
+			}
+			err = putBody(tx, props.Hash, bytes.Clone(compressed), crypt)
+			if err != nil {
+				return err
+			}
+			err = mbox.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func hashCompressedBody(compressed []byte) ([]byte, error) {
+	reader, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, reader)
+	if err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
+
+func serializeCount(count uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, count)
+}
+
+func deserializeCount(data []byte) uint64 {
+	if len(data) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(data)
+}
@@ -0,0 +1,123 @@
+package local
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/creativeprojects/imap/mailbox"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestDeduplicatedBodies(t *testing.T) {
+	for _, passphrase := range []string{"", "passphrase"} {
+		t.Run("passphrase="+passphrase, func(t *testing.T) {
+			backend, err := NewBoltStoreWithConfig(Config{
+				Filename:   filepath.Join(t.TempDir(), "store.db"),
+				Passphrase: passphrase,
+			})
+			require.NoError(t, err)
+			defer backend.Close()
+
+			inbox := mailbox.Info{Delimiter: ".", Name: "INBOX"}
+			archive := mailbox.Info{Delimiter: ".", Name: "Archive"}
+			for _, info := range []mailbox.Info{inbox, archive} {
+				require.NoError(t, backend.CreateMailbox(context.Background(), info))
+				for range 2 {
+					_, err = backend.PutMessage(context.Background(), info, mailbox.MessageProperties{
+						InternalDate: time.Now(),
+					}, bytes.NewBufferString(secretMessage))
+					require.NoError(t, err)
+				}
+			}
+			assert.Equal(t, []uint64{4}, countReferences(t, backend))
+
+			require.NoError(t, backend.DeleteMailbox(context.Background(), inbox))
+			assert.Equal(t, []uint64{2}, countReferences(t, backend))
+			assert.Equal(t, secretMessage, fetchMessageFrom(t, backend, archive))
+
+			require.NoError(t, backend.DeleteMailbox(context.Background(), archive))
+			assert.Empty(t, countReferences(t, backend))
+		})
+	}
+}
+
+func TestUpgradeFromVersion1(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "store.db")
+	createVersion1Store(t, filename)
+
+	backend, err := NewBoltStore(filename)
+	require.NoError(t, err)
+	defer backend.Close()
+
+	metadata, err := backend.getMetadata()
+	require.NoError(t, err)
+	assert.Equal(t, boltFileVersion, metadata.Version)
+	assert.Equal(t, []uint64{2}, countReferences(t, backend))
+	assert.Equal(t, secretMessage, fetchMessageFrom(t, backend, mailbox.Info{Delimiter: ".", Name: "INBOX"}))
+}
+
+// createVersion1Store creates a database with 2 identical messages in INBOX, using the layout of version 1
+func createVersion1Store(t *testing.T, filename string) {
+	t.Helper()
+
+	backend, err := NewBoltStore(filename)
+	require.NoError(t, err)
+	info := mailbox.Info{Delimiter: ".", Name: "INBOX"}
+	require.NoError(t, backend.CreateMailbox(context.Background(), info))
+
+	// write messages using the layout of version 1
+	compressed := &bytes.Buffer{}
+	writer := zlib.NewWriter(compressed)
+	_, err = writer.Write([]byte(secretMessage))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	hash := sha256.Sum256([]byte(secretMessage))
+
+	err = backend.db.Update(func(tx *bolt.Tx) error {
+		mbox := tx.Bucket([]byte(mailboxBucket)).Bucket([]byte("INBOX"))
+		for uid := uint64(1); uid <= 2; uid++ {
+			err := mbox.Put(SerializeUID(bodyPrefix, uid), compressed.Bytes())
+			if err != nil {
+				return err
+			}
+			props := &msgProps{Size: uint32(len(secretMessage)), Date: time.Now()}
+			if uid == 1 {
+				props.Hash = hash[:]
+			}
+			err = storeUID(mbox, "INBOX", msgPrefix, uid, props, nil)
+			if err != nil {
+				return err
+			}
+		}
+		return setVersion(tx, 1)
+	})
+	require.NoError(t, err)
+	require.NoError(t, backend.Close())
+}
+
+func countReferences(t *testing.T, backend *BoltStore) []uint64 {
+	t.Helper()
+
+	counts := make([]uint64, 0)
+	err := backend.db.View(func(tx *bolt.Tx) error {
+		bodies := tx.Bucket([]byte(bodiesBucket))
+		references := tx.Bucket([]byte(referencesBucket))
+		if references == nil {
+			return nil
+		}
+		return references.ForEach(func(key, value []byte) error {
+			assert.NotNil(t, bodies.Get(key))
+			counts = append(counts, deserializeCount(value))
+			return nil
+		})
+	})
+	require.NoError(t, err)
+	return counts
+}
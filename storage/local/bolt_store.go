@@ -10,9 +10,12 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"syscall"
 	"time"
 
 	"github.com/creativeprojects/imap/lib"
+	"github.com/creativeprojects/imap/lock"
 	"github.com/creativeprojects/imap/mailbox"
 	bolt "go.etcd.io/bbolt"
 	bolterrors "go.etcd.io/bbolt/errors"
@@ -28,14 +31,38 @@ const (
 	msgPrefix       = "msg-"
 	versionKey      = "version"
 	accountKey      = "accountID"
-	boltFileVersion = 1
+	encryptionKey   = "encryption"
+	boltFileVersion = 3
+	// defaultLockTimeout is how long to wait for the database used by another process
+	defaultLockTimeout = 10 * time.Second
 )
 
+type Config struct {
+	Filename    string
+	DebugLogger lib.Logger
+	// Passphrase used to encrypt the database
+	Passphrase string
+	// KeyFile contains the secret used to encrypt the database (instead of a passphrase)
+	KeyFile string
+	// SkipUpgrade opens a database from an older version without running the migrations
+	SkipUpgrade bool
+	// SearchIndex builds a full-text search index when the database doesn't have one yet.
+	// Once created, the index is kept up to date until it's dropped.
+	SearchIndex bool
+	// LockTimeout is how long to wait for the database used by another process:
+	// zero for the default of 10 seconds, negative to fail straight away
+	LockTimeout time.Duration
+}
+
+// BoltStore is safe for concurrent use, but the selected mailbox is shared between all the callers: use OpenMailbox instead.
+// Encrypt and Rekey must not be called while the store is in use.
 type BoltStore struct {
-	dbFile   string
-	db       *bolt.DB
-	log      lib.Logger
-	selected string
+	dbFile      string
+	db          *bolt.DB
+	log         lib.Logger
+	selection   mailbox.Selection
+	crypt       *boxCipher
+	lockTimeout time.Duration
 }
 
 func NewBoltStore(filename string) (*BoltStore, error) {
@@ -43,27 +70,70 @@ func NewBoltStore(filename string) (*BoltStore, error) {
 }
 
 func NewBoltStoreWithLogger(filename string, logger lib.Logger) (*BoltStore, error) {
+	return NewBoltStoreWithConfig(Config{
+		Filename:    filename,
+		DebugLogger: logger,
+	})
+}
+
+func NewBoltStoreWithConfig(cfg Config) (*BoltStore, error) {
+	logger := cfg.DebugLogger
 	if logger == nil {
 		logger = &lib.NoLog{}
 	}
-	options := bolt.DefaultOptions
-	options.Timeout = 10 * time.Second
-
+	filename := cfg.Filename
 	err := os.MkdirAll(filepath.Dir(filename), 0700)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open %q: %w", filename, err)
 	}
 
-	db, err := bolt.Open(filename, 0600, options)
+	lockTimeout := cfg.LockTimeout
+	switch {
+	case lockTimeout == 0:
+		lockTimeout = defaultLockTimeout
+	case lockTimeout < 0:
+		// bolt waits forever with no timeout
+		lockTimeout = time.Nanosecond
+	}
+	db, err := bolt.Open(filename, 0600, boltOptions(lockTimeout))
+	if errors.Is(err, bolterrors.ErrTimeout) {
+		// the file lock is held by another process
+		return nil, &lock.LockedError{Path: filename}
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return &BoltStore{
-		dbFile: filename,
-		db:     db,
-		log:    logger,
-	}, nil
+	store := &BoltStore{
+		dbFile:      filename,
+		db:          db,
+		log:         logger,
+		lockTimeout: lockTimeout,
+	}
+	err = store.initEncryption(cfg.Passphrase, cfg.KeyFile)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	if cfg.SkipUpgrade {
+		// still refuse to open a file from a newer version
+		_, err = store.PendingMigrations()
+	} else {
+		err = store.Upgrade()
+	}
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	if cfg.SearchIndex && !cfg.SkipUpgrade && !store.HasSearchIndex() {
+		logger.Printf("Building the search index of %q", filename)
+		err = store.BuildSearchIndex()
+		if err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+	}
+	return store, nil
 }
 
 // AccountID is an internal ID used to tag accounts in history
@@ -100,8 +170,19 @@ func (s *BoltStore) Close() error {
 	return s.db.Close()
 }
 
+// IsRetryable returns true when the database file was busy
+func (s *BoltStore) IsRetryable(err error) bool {
+	return errors.Is(err, bolterrors.ErrTimeout) ||
+		errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.EAGAIN)
+}
+
 // CreateMailbox doesn't return an error if the mailbox already exists
-func (s *BoltStore) CreateMailbox(info mailbox.Info) error {
+func (s *BoltStore) CreateMailbox(ctx context.Context, info mailbox.Info) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	// Start the transaction.
 	tx, err := s.db.Begin(true)
 	if err != nil {
@@ -150,7 +231,11 @@ func (s *BoltStore) CreateMailbox(info mailbox.Info) error {
 	return nil
 }
 
-func (s *BoltStore) ListMailbox() ([]mailbox.Info, error) {
+func (s *BoltStore) ListMailbox(ctx context.Context) ([]mailbox.Info, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	list := make([]mailbox.Info, 0)
 	err := s.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(mailboxBucket))
@@ -181,19 +266,46 @@ func (s *BoltStore) ListMailbox() ([]mailbox.Info, error) {
 	return list, nil
 }
 
-func (s *BoltStore) DeleteMailbox(info mailbox.Info) error {
+func (s *BoltStore) DeleteMailbox(ctx context.Context, info mailbox.Info) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	return s.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(mailboxBucket))
 		if bucket == nil {
 			return nil
 		}
 		name := lib.VerifyDelimiter(info.Name, info.Delimiter, s.Delimiter())
-
+		mbox := bucket.Bucket([]byte(name))
+		if mbox == nil {
+			return bolterrors.ErrBucketNotFound
+		}
+		err := unindexMailbox(tx, s.crypt, name, mbox)
+		if err != nil {
+			return err
+		}
+		// release the bodies of all the messages in the mailbox
+		hashes, err := collectMailboxHashes(mbox, name, s.crypt)
+		if err != nil {
+			return err
+		}
+		for _, hash := range hashes {
+			err = releaseBody(tx, hash, s.crypt)
+			if err != nil {
+				return err
+			}
+		}
 		return bucket.DeleteBucket([]byte(name))
 	})
 }
 
-func (s *BoltStore) SelectMailbox(info mailbox.Info) (*mailbox.Status, error) {
+// OpenMailbox returns a handle on the mailbox, with its own status
+func (s *BoltStore) OpenMailbox(ctx context.Context, info mailbox.Info) (mailbox.Handle, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	var status *mailbox.Status
 	name := lib.VerifyDelimiter(info.Name, info.Delimiter, s.Delimiter())
 
@@ -217,11 +329,29 @@ func (s *BoltStore) SelectMailbox(info mailbox.Info) (*mailbox.Status, error) {
 	if err != nil {
 		return nil, err
 	}
-	s.selected = name
-	return status, nil
+	return &handle{
+		backend: s,
+		info: mailbox.Info{
+			Delimiter: s.Delimiter(),
+			Name:      name,
+		},
+		status: *status,
+	}, nil
+}
+
+func (s *BoltStore) SelectMailbox(ctx context.Context, info mailbox.Info) (*mailbox.Status, error) {
+	handle, err := s.OpenMailbox(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	return s.selection.Select(handle), nil
 }
 
-func (s *BoltStore) PutMessage(info mailbox.Info, props mailbox.MessageProperties, body io.Reader) (mailbox.MessageID, error) {
+func (s *BoltStore) PutMessage(ctx context.Context, info mailbox.Info, props mailbox.MessageProperties, body io.Reader) (mailbox.MessageID, error) {
+	if err := ctx.Err(); err != nil {
+		return mailbox.EmptyMessageID, err
+	}
+
 	var messageID mailbox.MessageID
 	err := s.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(mailboxBucket))
@@ -245,9 +375,16 @@ func (s *BoltStore) PutMessage(info mailbox.Info, props mailbox.MessagePropertie
 
 		// T reader for hashing
 		hasher := sha256.New()
-		tee := io.TeeReader(body, hasher)
+		tee := io.TeeReader(lib.NewContextReader(ctx, body), hasher)
 		buffer := &bytes.Buffer{}
 
+		// keep a copy of the message for the search index
+		var raw *bytes.Buffer
+		if tx.Bucket([]byte(searchTermsBucket)) != nil {
+			raw = &bytes.Buffer{}
+			tee = io.TeeReader(tee, raw)
+		}
+
 		// compression
 		writer := zlib.NewWriter(buffer)
 		read, err := io.Copy(writer, tee)
@@ -262,10 +399,10 @@ func (s *BoltStore) PutMessage(info mailbox.Info, props mailbox.MessagePropertie
 			return fmt.Errorf("message body size advertised as %d bytes but read %d bytes from buffer", props.Size, read)
 		}
 
-		msg := buffer.Bytes()
-		err = mbox.Put(SerializeUID(bodyPrefix, uid), msg)
+		hash := hasher.Sum(nil)
+		err = putBody(tx, hash, buffer.Bytes(), s.crypt)
 		if err != nil {
-			return fmt.Errorf("cannot save message body: %w", err)
+			return err
 		}
 		s.log.Printf("Message saved: mailbox=%q uid=%d size=%d flags=%+v date=%q", name, uid, read, props.Flags, props.InternalDate)
 
@@ -273,12 +410,18 @@ func (s *BoltStore) PutMessage(info mailbox.Info, props mailbox.MessagePropertie
 			Flags: props.Flags,
 			Date:  props.InternalDate,
 			Size:  uint32(read),
-			Hash:  hasher.Sum(nil),
+			Hash:  hash,
 		}
-		err = storeUID(mbox, msgPrefix, uid, props)
+		err = storeUID(mbox, name, msgPrefix, uid, props, s.crypt)
 		if err != nil {
 			return err
 		}
+		if raw != nil {
+			err = indexMessage(tx, s.crypt, name, uid, raw)
+			if err != nil {
+				return fmt.Errorf("cannot index message: %w", err)
+			}
+		}
 
 		status.Messages++
 		return setMailboxStatus(mbox, *status)
@@ -287,12 +430,11 @@ func (s *BoltStore) PutMessage(info mailbox.Info, props mailbox.MessagePropertie
 }
 
 func (s *BoltStore) FetchMessages(ctx context.Context, since time.Time, messages chan *mailbox.Message) error {
-	defer close(messages)
+	return s.selection.Fetch(ctx, since, messages)
+}
 
-	if s.selected == "" {
-		return lib.ErrNotSelected
-	}
-	name := s.selected
+func (s *BoltStore) fetchMessages(ctx context.Context, name string, since time.Time, messages chan *mailbox.Message) error {
+	defer close(messages)
 
 	// removes a day
 	since = lib.SafePadding(since)
@@ -314,29 +456,22 @@ func (s *BoltStore) FetchMessages(ctx context.Context, since time.Time, messages
 				return ctx.Err()
 			}
 			s.log.Printf("* Key %q", string(key))
-			if bytes.HasPrefix(key, []byte(bodyPrefix)) {
-				properties := &msgProps{}
-				propsKey := bytes.Replace(key, []byte(bodyPrefix), []byte(msgPrefix), 1)
-				propsData := mailboxBucket.Get(propsKey)
-				if propsData != nil {
-					properties, err = DeserializeObject[msgProps](propsData)
-					if err != nil {
-						return err
-					}
+			if bytes.HasPrefix(key, []byte(msgPrefix)) {
+				properties, err := decryptObject[msgProps](value, s.crypt, mailboxLocation(name, key))
+				if err != nil {
+					return err
 				}
 				if !since.IsZero() && properties.Date.Before(since) {
 					// skip this message
 					return nil
 				}
-				// uncompress data
-				reader, err := zlib.NewReader(bytes.NewReader(value))
+				reader, err := openBody(tx, properties, s.crypt)
 				if err != nil {
-					return err
+					return fmt.Errorf("cannot load body of message %q: %w", string(key), err)
 				}
-				reader.Close()
 
 				channelMessage(
-					mailbox.NewMessageIDFromUint(uint32(DeserializeUID(bodyPrefix, key))),
+					mailbox.NewMessageIDFromUint(uint32(DeserializeUID(msgPrefix, key))),
 					properties,
 					reader,
 					messages,
@@ -352,6 +487,79 @@ func (s *BoltStore) FetchMessages(ctx context.Context, since time.Time, messages
 	return nil
 }
 
+func (s *BoltStore) fetchUids(ctx context.Context, name string, uids []mailbox.MessageID, messages chan *mailbox.Message) error {
+	defer close(messages)
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		mbox, err := getMailboxBucket(tx, mailbox.Info{Name: name}, s.Delimiter())
+		if err != nil {
+			return err
+		}
+		for _, uid := range uids {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			key := SerializeUID(msgPrefix, uint64(uid.AsUint()))
+			data := mbox.Get(key)
+			if data == nil {
+				continue
+			}
+			properties, err := decryptObject[msgProps](data, s.crypt, mailboxLocation(name, key))
+			if err != nil {
+				return err
+			}
+			reader, err := openBody(tx, properties, s.crypt)
+			if err != nil {
+				return fmt.Errorf("cannot load body of message %d: %w", uid.AsUint(), err)
+			}
+			channelMessage(uid, properties, reader, messages)
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) uids(ctx context.Context, name string) ([]mailbox.MessageID, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	list := make([]uint32, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		mbox, err := getMailboxBucket(tx, mailbox.Info{Name: name}, s.Delimiter())
+		if err != nil {
+			return err
+		}
+		cursor := mbox.Cursor()
+		for key, _ := cursor.Seek([]byte(msgPrefix)); key != nil && bytes.HasPrefix(key, []byte(msgPrefix)); key, _ = cursor.Next() {
+			list = append(list, uint32(DeserializeUID(msgPrefix, key)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the keys are sorted as strings
+	slices.Sort(list)
+	uids := make([]mailbox.MessageID, len(list))
+	for i, uid := range list {
+		uids[i] = mailbox.NewMessageIDFromUint(uid)
+	}
+	return uids, nil
+}
+
+// openBody uncompresses the body of the message
+func openBody(tx *bolt.Tx, properties *msgProps, crypt *boxCipher) (io.ReadCloser, error) {
+	body, err := getBody(tx, properties.Hash, crypt)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := zlib.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	reader.Close()
+	return reader, nil
+}
+
 func channelMessage(uid mailbox.MessageID, properties *msgProps, body io.ReadCloser, to chan *mailbox.Message) {
 	to <- &mailbox.Message{
 		MessageProperties: mailbox.MessageProperties{
@@ -367,18 +575,18 @@ func channelMessage(uid mailbox.MessageID, properties *msgProps, body io.ReadClo
 
 // LatestDate returns the internal date of the latest message
 func (s *BoltStore) LatestDate(ctx context.Context) (time.Time, error) {
-	latest := time.Time{}
+	return s.selection.LatestDate(ctx)
+}
 
-	if s.selected == "" {
-		return latest, lib.ErrNotSelected
-	}
+func (s *BoltStore) latestDate(ctx context.Context, name string) (time.Time, error) {
+	latest := time.Time{}
 
 	err := s.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(mailboxBucket))
 		if bucket == nil {
 			return lib.ErrMailboxNotFound
 		}
-		mailboxBucket := bucket.Bucket([]byte(s.selected))
+		mailboxBucket := bucket.Bucket([]byte(name))
 		if mailboxBucket == nil {
 			return lib.ErrMailboxNotFound
 		}
@@ -399,7 +607,7 @@ func (s *BoltStore) LatestDate(ctx context.Context) (time.Time, error) {
 			s.log.Printf("* Key %q", string(key))
 			if bytes.HasPrefix(key, []byte(msgPrefix)) {
 				if value != nil {
-					properties, err := DeserializeObject[msgProps](value)
+					properties, err := decryptObject[msgProps](value, s.crypt, mailboxLocation(name, key))
 					if err != nil {
 						return err
 					}
@@ -421,11 +629,82 @@ func (s *BoltStore) LatestDate(ctx context.Context) (time.Time, error) {
 }
 
 func (s *BoltStore) UnselectMailbox() error {
-	s.selected = ""
-	return nil
+	return s.selection.Unselect()
 }
 
-func (s *BoltStore) AddToHistory(info mailbox.Info, actions ...mailbox.HistoryAction) error {
+func (s *BoltStore) SetMessageFlags(ctx context.Context, info mailbox.Info, uid mailbox.MessageID, flags []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		mbox, err := getMailboxBucket(tx, info, s.Delimiter())
+		if err != nil {
+			return err
+		}
+		key := SerializeUID(msgPrefix, uint64(uid.AsUint()))
+		data := mbox.Get(key)
+		if data == nil {
+			return lib.ErrMessageNotFound
+		}
+		name := lib.VerifyDelimiter(info.Name, info.Delimiter, s.Delimiter())
+		props, err := decryptObject[msgProps](data, s.crypt, mailboxLocation(name, key))
+		if err != nil {
+			return err
+		}
+		props.Flags = flags
+		return storeUID(mbox, name, msgPrefix, uint64(uid.AsUint()), props, s.crypt)
+	})
+}
+
+func (s *BoltStore) DeleteMessage(ctx context.Context, info mailbox.Info, uid mailbox.MessageID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		mbox, err := getMailboxBucket(tx, info, s.Delimiter())
+		if err != nil {
+			return err
+		}
+		key := SerializeUID(msgPrefix, uint64(uid.AsUint()))
+		data := mbox.Get(key)
+		if data == nil {
+			return lib.ErrMessageNotFound
+		}
+		name := lib.VerifyDelimiter(info.Name, info.Delimiter, s.Delimiter())
+		props, err := decryptObject[msgProps](data, s.crypt, mailboxLocation(name, key))
+		if err != nil {
+			return err
+		}
+		err = releaseBody(tx, props.Hash, s.crypt)
+		if err != nil {
+			return err
+		}
+		err = unindexMessage(tx, s.crypt, name, uint64(uid.AsUint()))
+		if err != nil {
+			return err
+		}
+		err = mbox.Delete(key)
+		if err != nil {
+			return err
+		}
+		status, err := getMailboxStatus(mbox)
+		if err != nil {
+			return err
+		}
+		if status.Messages > 0 {
+			status.Messages--
+		}
+		return setMailboxStatus(mbox, *status)
+	})
+}
+
+func (s *BoltStore) AddToHistory(ctx context.Context, info mailbox.Info, actions ...mailbox.HistoryAction) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	// Start the transaction.
 	tx, err := s.db.Begin(true)
 	if err != nil {
@@ -448,13 +727,14 @@ func (s *BoltStore) AddToHistory(info mailbox.Info, actions ...mailbox.HistoryAc
 		return err
 	}
 
-	history, err := getMailboxHistory(bucket)
+	// a mailbox without history returns an empty one: any error here would lose the saved history
+	history, err := getMailboxHistory(bucket, info.Name, s.crypt)
 	if err != nil {
-		history = &mailbox.History{}
+		return fmt.Errorf("cannot load history: %w", err)
 	}
 	history.Actions = append(history.Actions, actions...)
 
-	err = setMailboxHistory(bucket, *history)
+	err = setMailboxHistory(bucket, info.Name, *history, s.crypt)
 	if err != nil {
 		return err
 	}
@@ -466,7 +746,31 @@ func (s *BoltStore) AddToHistory(info mailbox.Info, actions ...mailbox.HistoryAc
 	return nil
 }
 
-func (s *BoltStore) GetHistory(info mailbox.Info) (*mailbox.History, error) {
+// ReplaceHistory replaces all the actions in the history of the mailbox
+func (s *BoltStore) ReplaceHistory(ctx context.Context, info mailbox.Info, history *mailbox.History) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	name := lib.VerifyDelimiter(info.Name, info.Delimiter, s.Delimiter())
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(mailboxBucket))
+		if bucket == nil {
+			return lib.ErrMailboxNotFound
+		}
+		mailboxBucket := bucket.Bucket([]byte(name))
+		if mailboxBucket == nil {
+			return lib.ErrMailboxNotFound
+		}
+		return setMailboxHistory(mailboxBucket, name, *history, s.crypt)
+	})
+}
+
+func (s *BoltStore) GetHistory(ctx context.Context, info mailbox.Info) (*mailbox.History, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	var history *mailbox.History
 	name := lib.VerifyDelimiter(info.Name, info.Delimiter, s.Delimiter())
 
@@ -481,7 +785,7 @@ func (s *BoltStore) GetHistory(info mailbox.Info) (*mailbox.History, error) {
 		if mailboxBucket == nil {
 			return lib.ErrMailboxNotFound
 		}
-		history, err = getMailboxHistory(mailboxBucket)
+		history, err = getMailboxHistory(mailboxBucket, name, s.crypt)
 		if err != nil {
 			return err
 		}
@@ -503,6 +807,39 @@ func (s *BoltStore) Backup(filename string) error {
 	return nil
 }
 
+// Compact rewrites the database into a new file, dropping the free pages which can still contain old data
+func (s *BoltStore) Compact() error {
+	tempFile := s.dbFile + ".compact"
+	dst, err := bolt.Open(tempFile, 0600, boltOptions(s.lockTimeout))
+	if err != nil {
+		return err
+	}
+	err = bolt.Compact(dst, s.db, 0)
+	_ = dst.Close()
+	if err != nil {
+		_ = os.Remove(tempFile)
+		return fmt.Errorf("cannot compact database: %w", err)
+	}
+	err = s.db.Close()
+	if err != nil {
+		_ = os.Remove(tempFile)
+		return err
+	}
+	renameErr := os.Rename(tempFile, s.dbFile)
+	if renameErr != nil {
+		_ = os.Remove(tempFile)
+	}
+	// reopen the compacted file, or the original one if it could not be replaced
+	s.db, err = bolt.Open(s.dbFile, 0600, boltOptions(s.lockTimeout))
+	if err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return fmt.Errorf("cannot replace database with the compacted copy: %w", renameErr)
+	}
+	return nil
+}
+
 func (s *BoltStore) setMetadata(metadata *accountMetadata) error {
 	err := s.db.Update(func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists([]byte(metadataBucket))
@@ -545,6 +882,26 @@ func (s *BoltStore) getMetadata() (*accountMetadata, error) {
 	return metadata, err
 }
 
+// getMailboxBucket returns the bucket of an existing mailbox, inside a transaction
+func getMailboxBucket(tx *bolt.Tx, info mailbox.Info, delimiter string) (*bolt.Bucket, error) {
+	bucket := tx.Bucket([]byte(mailboxBucket))
+	if bucket == nil {
+		return nil, lib.ErrMailboxNotFound
+	}
+	name := lib.VerifyDelimiter(info.Name, info.Delimiter, delimiter)
+	mbox := bucket.Bucket([]byte(name))
+	if mbox == nil {
+		return nil, lib.ErrMailboxNotFound
+	}
+	return mbox, nil
+}
+
+func boltOptions(lockTimeout time.Duration) *bolt.Options {
+	options := *bolt.DefaultOptions
+	options.Timeout = lockTimeout
+	return &options
+}
+
 func setMailboxInfo(bucket *bolt.Bucket, info mailbox.Info) error {
 	data, err := SerializeObject(&info)
 	if err != nil {
@@ -597,8 +954,8 @@ func getMailboxStatus(bucket *bolt.Bucket) (*mailbox.Status, error) {
 	return info, nil
 }
 
-func setMailboxHistory(bucket *bolt.Bucket, history mailbox.History) error {
-	data, err := SerializeObject(&history)
+func setMailboxHistory(bucket *bolt.Bucket, name string, history mailbox.History, crypt *boxCipher) error {
+	data, err := encryptObject(&history, crypt, mailboxLocation(name, []byte(historyKey)))
 	if err != nil {
 		return err
 	}
@@ -611,25 +968,26 @@ func setMailboxHistory(bucket *bolt.Bucket, history mailbox.History) error {
 	return nil
 }
 
-func getMailboxHistory(bucket *bolt.Bucket) (*mailbox.History, error) {
+func getMailboxHistory(bucket *bolt.Bucket, name string, crypt *boxCipher) (*mailbox.History, error) {
 	data := bucket.Get([]byte(historyKey))
 	if data == nil {
 		// return empty history instead of an error
 		return &mailbox.History{}, nil
 	}
-	history, err := DeserializeObject[mailbox.History](data)
+	history, err := decryptObject[mailbox.History](data, crypt, mailboxLocation(name, []byte(historyKey)))
 	if err != nil {
 		return nil, err
 	}
 	return history, nil
 }
 
-func storeUID[T any](bucket *bolt.Bucket, prefix string, uid uint64, data *T) error {
-	serialized, err := SerializeObject(data)
+func storeUID[T any](bucket *bolt.Bucket, name, prefix string, uid uint64, data *T, crypt *boxCipher) error {
+	key := SerializeUID(prefix, uid)
+	serialized, err := encryptObject(data, crypt, mailboxLocation(name, key))
 	if err != nil {
 		return err
 	}
-	err = bucket.Put(SerializeUID(prefix, uid), serialized)
+	err = bucket.Put(key, serialized)
 	if err != nil {
 		return err
 	}
@@ -1,10 +1,14 @@
 package local
 
 import (
+	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/creativeprojects/imap/lib"
+	"github.com/creativeprojects/imap/lock"
 	"github.com/creativeprojects/imap/storage/test"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -20,3 +24,49 @@ func TestStoreBackend(t *testing.T) {
 
 	test.RunTestsOnBackend(t, backend)
 }
+
+func TestStoreLockedByAnotherProcess(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "store.db")
+	backend, err := NewBoltStore(filename)
+	require.NoError(t, err)
+	defer backend.Close()
+
+	// bolt locks the file even inside the same process
+	_, err = NewBoltStoreWithConfig(Config{
+		Filename:    filename,
+		LockTimeout: -1,
+	})
+	require.ErrorIs(t, err, lock.ErrLocked)
+	require.ErrorContains(t, err, filename)
+}
+
+func TestReadAccountID(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "store.db")
+	_, err := ReadAccountID(filename)
+	require.Error(t, err)
+	assert.NoFileExists(t, filename)
+
+	backend, err := NewBoltStore(filename)
+	require.NoError(t, err)
+	_, err = ReadAccountID(filename)
+	require.ErrorIs(t, err, lock.ErrLocked)
+	require.NoError(t, backend.Close())
+
+	// no ID is given to the database
+	_, err = ReadAccountID(filename)
+	require.ErrorIs(t, err, lib.ErrNoAccountID)
+
+	backend, err = NewBoltStore(filename)
+	require.NoError(t, err)
+	accountID := backend.AccountID()
+	require.NoError(t, backend.Close())
+
+	before, err := os.Stat(filename)
+	require.NoError(t, err)
+	id, err := ReadAccountID(filename)
+	require.NoError(t, err)
+	assert.Equal(t, accountID, id)
+	after, err := os.Stat(filename)
+	require.NoError(t, err)
+	assert.Equal(t, before.ModTime(), after.ModTime())
+}
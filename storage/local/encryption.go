@@ -0,0 +1,486 @@
+package local
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	encryptionAlgorithm = "xchacha20-poly1305"
+	encryptionCheck     = "creativeprojects/imap"
+	saltLength          = 16
+	argon2Time          = 3
+	argon2Memory        = 64 * 1024
+	argon2Threads       = 4
+	// limits of the key derivation parameters read from the database, so a corrupted file can't exhaust the memory
+	argon2MaxTime   = 16
+	argon2MaxMemory = 1024 * 1024
+)
+
+var (
+	ErrEncryptionKeyRequired = errors.New("database is encrypted: a passphrase or a key file is required")
+	ErrInvalidEncryptionKey  = errors.New("invalid passphrase or key file")
+	ErrNotEncrypted          = errors.New("database is not encrypted")
+)
+
+// encryptionMetadata is saved in the metadata bucket of an encrypted database
+type encryptionMetadata struct {
+	Algorithm string
+	Salt      []byte
+	Time      uint32
+	Memory    uint32
+	Threads   uint8
+	// Check is a known value encrypted with the key, to detect a wrong passphrase
+	Check []byte
+}
+
+// boundValuesVersion is the version of the database file where the encrypted values are bound to their location
+const boundValuesVersion = 3
+
+// boxCipher encrypts and authenticates values stored in the database.
+// A nil *boxCipher leaves the values untouched.
+type boxCipher struct {
+	aead cipher.AEAD
+	// hashKey is used to key the hash of the message bodies
+	hashKey []byte
+	// unbound is set on a database from before version 3, where the location of the values was not authenticated
+	unbound bool
+}
+
+// newEncryption generates new encryption metadata (with a random salt) for the secret
+func newEncryption(secret []byte) (*encryptionMetadata, *boxCipher, error) {
+	metadata := &encryptionMetadata{
+		Algorithm: encryptionAlgorithm,
+		Salt:      make([]byte, saltLength),
+		Time:      argon2Time,
+		Memory:    argon2Memory,
+		Threads:   argon2Threads,
+	}
+	_, err := rand.Read(metadata.Salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	crypt, err := newBoxCipher(secret, metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+	metadata.Check, err = crypt.seal([]byte(encryptionCheck), checkLocation())
+	if err != nil {
+		return nil, nil, err
+	}
+	return metadata, crypt, nil
+}
+
+// openEncryption verifies the secret against the encryption metadata of the database
+func openEncryption(secret []byte, metadata *encryptionMetadata, unbound bool) (*boxCipher, error) {
+	crypt, err := newBoxCipher(secret, metadata)
+	if err != nil {
+		return nil, err
+	}
+	crypt.unbound = unbound
+	check, err := crypt.open(metadata.Check, checkLocation())
+	if err != nil || !bytes.Equal(check, []byte(encryptionCheck)) {
+		return nil, ErrInvalidEncryptionKey
+	}
+	return crypt, nil
+}
+
+func newBoxCipher(secret []byte, metadata *encryptionMetadata) (*boxCipher, error) {
+	if metadata.Algorithm != encryptionAlgorithm {
+		return nil, fmt.Errorf("unsupported encryption algorithm %q", metadata.Algorithm)
+	}
+	if metadata.Time == 0 || metadata.Time > argon2MaxTime || metadata.Memory == 0 || metadata.Memory > argon2MaxMemory || metadata.Threads == 0 {
+		return nil, fmt.Errorf("invalid encryption metadata: invalid key derivation parameters (time %d, memory %d KiB, threads %d)",
+			metadata.Time, metadata.Memory, metadata.Threads)
+	}
+	key := argon2.IDKey(secret, metadata.Salt, metadata.Time, metadata.Memory, metadata.Threads, chacha20poly1305.KeySize)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	hashKey, err := hkdf.Key(sha256.New, key, nil, "body hash", sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	return &boxCipher{
+		aead:    aead,
+		hashKey: hashKey,
+	}, nil
+}
+
+// bound returns a copy of the cipher which authenticates the location of the values
+func (c *boxCipher) bound() *boxCipher {
+	if c == nil {
+		return nil
+	}
+	bound := *c
+	bound.unbound = false
+	return &bound
+}
+
+// seal returns the nonce followed by the encrypted data. The location is authenticated with the data.
+func (c *boxCipher) seal(plain, location []byte) ([]byte, error) {
+	if c == nil {
+		return plain, nil
+	}
+	if c.unbound {
+		location = nil
+	}
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plain)+c.aead.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, plain, location), nil
+}
+
+// open decrypts the data: it fails if the value was sealed for another location
+func (c *boxCipher) open(data, location []byte) ([]byte, error) {
+	if c == nil {
+		return data, nil
+	}
+	if c.unbound {
+		location = nil
+	}
+	if len(data) < c.aead.NonceSize() {
+		return nil, errors.New("encrypted value is too short")
+	}
+	nonce, encrypted := data[:c.aead.NonceSize()], data[c.aead.NonceSize():]
+	plain, err := c.aead.Open(nil, nonce, encrypted, location)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt value: %w", err)
+	}
+	return plain, nil
+}
+
+// readSecret returns the passphrase or the content of the key file. It returns nil when none is set.
+func readSecret(passphrase, keyFile string) ([]byte, error) {
+	if passphrase != "" && keyFile != "" {
+		return nil, errors.New("passphrase and key file cannot be used together")
+	}
+	if passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	if keyFile != "" {
+		secret, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read key file: %w", err)
+		}
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("key file %q is empty", keyFile)
+		}
+		return secret, nil
+	}
+	return nil, nil
+}
+
+// valueLocation returns the names of the buckets followed by the key of a value, each one prefixed by its length.
+// It's used as associated data so an encrypted value cannot be moved to another key or mailbox.
+func valueLocation(key []byte, buckets ...string) []byte {
+	location := make([]byte, 0, 64)
+	for _, bucket := range buckets {
+		location = binary.BigEndian.AppendUint32(location, uint32(len(bucket)))
+		location = append(location, bucket...)
+	}
+	location = binary.BigEndian.AppendUint32(location, uint32(len(key)))
+	return append(location, key...)
+}
+
+// mailboxLocation returns the location of a value in the bucket of a mailbox
+func mailboxLocation(name string, key []byte) []byte {
+	return valueLocation(key, mailboxBucket, name)
+}
+
+func checkLocation() []byte {
+	return valueLocation([]byte(encryptionKey), metadataBucket)
+}
+
+func encryptObject[T any](data *T, crypt *boxCipher, location []byte) ([]byte, error) {
+	serialized, err := SerializeObject(data)
+	if err != nil {
+		return nil, err
+	}
+	return crypt.seal(serialized, location)
+}
+
+func decryptObject[T any](data []byte, crypt *boxCipher, location []byte) (*T, error) {
+	plain, err := crypt.open(data, location)
+	if err != nil {
+		return nil, err
+	}
+	return DeserializeObject[T](plain)
+}
+
+// IsEncrypted returns true when the database content is encrypted
+func (s *BoltStore) IsEncrypted() bool {
+	return s.crypt != nil
+}
+
+// initEncryption loads the encryption key of an existing database, or sets up a new empty database for encryption
+func (s *BoltStore) initEncryption(passphrase, keyFile string) error {
+	secret, err := readSecret(passphrase, keyFile)
+	if err != nil {
+		return err
+	}
+	metadata, err := s.getEncryptionMetadata()
+	if err != nil {
+		return err
+	}
+	if metadata == nil {
+		if secret == nil {
+			return nil
+		}
+		if !s.isEmpty() {
+			return fmt.Errorf("%w: use the \"db encrypt\" command to encrypt an existing database", ErrNotEncrypted)
+		}
+		return s.Rekey(passphrase, keyFile)
+	}
+	if secret == nil {
+		return ErrEncryptionKeyRequired
+	}
+	version, err := s.Version()
+	if err != nil {
+		return err
+	}
+	s.crypt, err = openEncryption(secret, metadata, version < boundValuesVersion)
+	return err
+}
+
+// Rekey encrypts the whole database with a new passphrase or key file.
+// The database is decrypted when both passphrase and key file are empty.
+func (s *BoltStore) Rekey(passphrase, keyFile string) error {
+	secret, err := readSecret(passphrase, keyFile)
+	if err != nil {
+		return err
+	}
+	pending, err := s.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return errors.New("the database file must be upgraded before changing the encryption key")
+	}
+	var metadata *encryptionMetadata
+	var crypt *boxCipher
+	if secret != nil {
+		metadata, crypt, err = newEncryption(secret)
+		if err != nil {
+			return err
+		}
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		hashes, err := collectHashes(tx, s.crypt)
+		if err != nil {
+			return err
+		}
+		err = rekeyBodies(tx, hashes, s.crypt, crypt)
+		if err != nil {
+			return err
+		}
+		err = reencryptMailboxes(tx, s.crypt, crypt)
+		if err != nil {
+			return err
+		}
+		if tx.Bucket([]byte(searchTermsBucket)) != nil {
+			// the terms are keyed with the encryption key
+			err = buildSearchIndex(tx, crypt)
+			if err != nil {
+				return err
+			}
+		}
+		bucket, err := tx.CreateBucketIfNotExists([]byte(metadataBucket))
+		if err != nil {
+			return err
+		}
+		if metadata == nil {
+			return bucket.Delete([]byte(encryptionKey))
+		}
+		data, err := SerializeObject(metadata)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(encryptionKey), data)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot change encryption key: %w", err)
+	}
+	s.crypt = crypt
+	// the previous version of the data is still in the free pages of the file
+	return s.Compact()
+}
+
+// reencryptMailboxes decrypts the message properties and history of all mailboxes with the old key and encrypts them with the new one
+func reencryptMailboxes(tx *bolt.Tx, oldCrypt, newCrypt *boxCipher) error {
+	root := tx.Bucket([]byte(mailboxBucket))
+	if root == nil {
+		return nil
+	}
+	return root.ForEach(func(name, value []byte) error {
+		if value != nil {
+			return nil
+		}
+		bucket := root.Bucket(name)
+		if bucket == nil {
+			return nil
+		}
+		return reencryptBucket(bucket, string(name), oldCrypt, newCrypt)
+	})
+}
+
+// reencryptBucket decrypts the message properties and history of a mailbox with the old key and encrypts them with the new one
+func reencryptBucket(bucket *bolt.Bucket, name string, oldCrypt, newCrypt *boxCipher) error {
+	values := make(map[string][]byte)
+	err := bucket.ForEach(func(key, value []byte) error {
+		if value == nil {
+			return nil
+		}
+		if !bytes.HasPrefix(key, []byte(msgPrefix)) &&
+			!bytes.Equal(key, []byte(historyKey)) {
+			return nil
+		}
+		plain, err := oldCrypt.open(value, mailboxLocation(name, key))
+		if err != nil {
+			return fmt.Errorf("mailbox %q key %q: %w", name, string(key), err)
+		}
+		// values from bolt must not be kept after the bucket is modified
+		values[string(key)] = bytes.Clone(plain)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for key, plain := range values {
+		sealed, err := newCrypt.seal(plain, mailboxLocation(name, []byte(key)))
+		if err != nil {
+			return err
+		}
+		err = bucket.Put([]byte(key), sealed)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reencryptSearchTerms decrypts the terms of the indexed messages with the old key and encrypts them with the new one
+func reencryptSearchTerms(tx *bolt.Tx, oldCrypt, newCrypt *boxCipher) error {
+	bucket := tx.Bucket([]byte(searchTermsBucket))
+	if bucket == nil {
+		return nil
+	}
+	values := make(map[string][]byte)
+	err := bucket.ForEach(func(ref, value []byte) error {
+		plain, err := oldCrypt.open(value, valueLocation(ref, searchTermsBucket))
+		if err != nil {
+			return fmt.Errorf("search terms %q: %w", string(ref), err)
+		}
+		values[string(ref)] = bytes.Clone(plain)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for ref, plain := range values {
+		sealed, err := newCrypt.seal(plain, valueLocation([]byte(ref), searchTermsBucket))
+		if err != nil {
+			return err
+		}
+		err = bucket.Put([]byte(ref), sealed)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateToBoundValues encrypts all the values again with their bucket and key as associated data (version 3)
+func migrateToBoundValues(tx *bolt.Tx, crypt *boxCipher) error {
+	if crypt == nil {
+		return nil
+	}
+	bound := crypt.bound()
+	hashes, err := collectHashes(tx, crypt)
+	if err != nil {
+		return err
+	}
+	err = rekeyBodies(tx, hashes, crypt, bound)
+	if err != nil {
+		return err
+	}
+	err = reencryptMailboxes(tx, crypt, bound)
+	if err != nil {
+		return err
+	}
+	err = reencryptSearchTerms(tx, crypt, bound)
+	if err != nil {
+		return err
+	}
+	bucket := tx.Bucket([]byte(metadataBucket))
+	if bucket == nil {
+		return nil
+	}
+	metadata, err := DeserializeObject[encryptionMetadata](bucket.Get([]byte(encryptionKey)))
+	if err != nil {
+		return fmt.Errorf("cannot read encryption metadata: %w", err)
+	}
+	check, err := crypt.open(metadata.Check, checkLocation())
+	if err != nil {
+		return err
+	}
+	metadata.Check, err = bound.seal(check, checkLocation())
+	if err != nil {
+		return err
+	}
+	data, err := SerializeObject(metadata)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(encryptionKey), data)
+}
+
+func (s *BoltStore) getEncryptionMetadata() (*encryptionMetadata, error) {
+	var metadata *encryptionMetadata
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(metadataBucket))
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get([]byte(encryptionKey))
+		if data == nil {
+			return nil
+		}
+		var err error
+		metadata, err = DeserializeObject[encryptionMetadata](data)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot read encryption metadata: %w", err)
+	}
+	return metadata, nil
+}
+
+// isEmpty returns true when the database contains no mailbox
+func (s *BoltStore) isEmpty() bool {
+	empty := true
+	_ = s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(mailboxBucket))
+		if bucket == nil {
+			return nil
+		}
+		key, _ := bucket.Cursor().First()
+		empty = key == nil
+		return nil
+	})
+	return empty
+}
@@ -0,0 +1,334 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/creativeprojects/imap/mailbox"
+	"github.com/creativeprojects/imap/search"
+	"github.com/creativeprojects/imap/storage/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+const secretMessage = "From: contact@example.org\r\n" +
+	"Subject: secret\r\n" +
+	"\r\n" +
+	"this message should never be stored in clear text\r\n"
+
+func TestEncryptedStoreBackend(t *testing.T) {
+	dir := t.TempDir()
+	backend, err := NewBoltStoreWithConfig(Config{
+		Filename:   filepath.Join(dir, "store.db"),
+		Passphrase: "passphrase",
+	})
+	require.NoError(t, err)
+
+	defer backend.Close()
+	assert.True(t, backend.IsEncrypted())
+
+	err = test.PrepareBackend(backend)
+	require.NoError(t, err)
+
+	test.RunTestsOnBackend(t, backend)
+}
+
+func TestOpenEncryptedStore(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "store.db")
+	keyFile := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(keyFile, []byte("random key content"), 0600))
+
+	backend, err := NewBoltStoreWithConfig(Config{Filename: filename, KeyFile: keyFile})
+	require.NoError(t, err)
+	putSecretMessage(t, backend)
+	require.NoError(t, backend.Close())
+
+	assertNotInClearText(t, filename)
+
+	_, err = NewBoltStoreWithConfig(Config{Filename: filename})
+	assert.ErrorIs(t, err, ErrEncryptionKeyRequired)
+
+	_, err = NewBoltStoreWithConfig(Config{Filename: filename, Passphrase: "wrong"})
+	assert.ErrorIs(t, err, ErrInvalidEncryptionKey)
+
+	backend, err = NewBoltStoreWithConfig(Config{Filename: filename, KeyFile: keyFile})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	assert.Equal(t, secretMessage, fetchSecretMessage(t, backend))
+}
+
+func TestOpenEncryptedStoreInvalidParameters(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "store.db")
+	backend, err := NewBoltStoreWithConfig(Config{Filename: filename, Passphrase: "passphrase"})
+	require.NoError(t, err)
+	require.NoError(t, backend.Close())
+
+	db, err := bolt.Open(filename, 0600, nil)
+	require.NoError(t, err)
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(metadataBucket))
+		metadata, err := DeserializeObject[encryptionMetadata](bucket.Get([]byte(encryptionKey)))
+		if err != nil {
+			return err
+		}
+		metadata.Threads = 0
+		data, err := SerializeObject(metadata)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(encryptionKey), data)
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	_, err = NewBoltStoreWithConfig(Config{Filename: filename, Passphrase: "passphrase"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid encryption metadata")
+}
+
+func TestEncryptExistingStore(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "store.db")
+
+	backend, err := NewBoltStore(filename)
+	require.NoError(t, err)
+	putSecretMessage(t, backend)
+	require.NoError(t, backend.Close())
+
+	// the database needs to be encrypted first
+	_, err = NewBoltStoreWithConfig(Config{Filename: filename, Passphrase: "passphrase"})
+	assert.ErrorIs(t, err, ErrNotEncrypted)
+
+	backend, err = NewBoltStore(filename)
+	require.NoError(t, err)
+	require.NoError(t, backend.Rekey("passphrase", ""))
+	require.NoError(t, backend.Close())
+
+	assertNotInClearText(t, filename)
+
+	backend, err = NewBoltStoreWithConfig(Config{Filename: filename, Passphrase: "passphrase"})
+	require.NoError(t, err)
+	assert.Equal(t, secretMessage, fetchSecretMessage(t, backend))
+
+	// change the passphrase
+	require.NoError(t, backend.Rekey("new passphrase", ""))
+	require.NoError(t, backend.Close())
+
+	_, err = NewBoltStoreWithConfig(Config{Filename: filename, Passphrase: "passphrase"})
+	assert.ErrorIs(t, err, ErrInvalidEncryptionKey)
+
+	backend, err = NewBoltStoreWithConfig(Config{Filename: filename, Passphrase: "new passphrase"})
+	require.NoError(t, err)
+	defer backend.Close()
+	assert.Equal(t, secretMessage, fetchSecretMessage(t, backend))
+
+	history, err := backend.GetHistory(context.Background(), mailbox.Info{Delimiter: ".", Name: "INBOX"})
+	require.NoError(t, err)
+	require.Len(t, history.Actions, 1)
+	assert.Equal(t, "secret source", history.Actions[0].SourceAccountTag)
+}
+
+func TestEncryptedValueCannotBeMoved(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "store.db")
+	backend, err := NewBoltStoreWithConfig(Config{Filename: filename, Passphrase: "passphrase"})
+	require.NoError(t, err)
+	defer backend.Close()
+	putSecretMessage(t, backend)
+
+	info := mailbox.Info{Delimiter: ".", Name: "Archive"}
+	require.NoError(t, backend.CreateMailbox(context.Background(), info))
+
+	// copy the encrypted properties of the message over another UID, and into another mailbox
+	err = backend.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(mailboxBucket))
+		value := bytes.Clone(root.Bucket([]byte("INBOX")).Get(SerializeUID(msgPrefix, 1)))
+		err := root.Bucket([]byte("INBOX")).Put(SerializeUID(msgPrefix, 2), value)
+		if err != nil {
+			return err
+		}
+		return root.Bucket([]byte("Archive")).Put(SerializeUID(msgPrefix, 1), value)
+	})
+	require.NoError(t, err)
+
+	for _, name := range []string{"INBOX", "Archive"} {
+		_, err = backend.SelectMailbox(context.Background(), mailbox.Info{Delimiter: ".", Name: name})
+		require.NoError(t, err)
+		receiver := make(chan *mailbox.Message, 10)
+		err = backend.FetchMessages(context.Background(), time.Time{}, receiver)
+		assert.ErrorContains(t, err, "cannot decrypt value", name)
+		require.NoError(t, backend.UnselectMailbox())
+	}
+}
+
+func TestAddToUnreadableHistory(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "store.db")
+	backend, err := NewBoltStoreWithConfig(Config{Filename: filename, Passphrase: "passphrase"})
+	require.NoError(t, err)
+	defer backend.Close()
+	putSecretMessage(t, backend)
+
+	info := mailbox.Info{Delimiter: ".", Name: "Archive"}
+	require.NoError(t, backend.CreateMailbox(context.Background(), info))
+
+	// the history of INBOX cannot be decrypted in another mailbox
+	var history []byte
+	err = backend.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(mailboxBucket))
+		history = bytes.Clone(root.Bucket([]byte("INBOX")).Get([]byte(historyKey)))
+		return root.Bucket([]byte("Archive")).Put([]byte(historyKey), history)
+	})
+	require.NoError(t, err)
+
+	err = backend.AddToHistory(context.Background(), info, mailbox.HistoryAction{
+		Date:   time.Now(),
+		Action: mailbox.ActionCopy,
+	})
+	assert.ErrorContains(t, err, "cannot decrypt value")
+
+	// the history is left as it was
+	err = backend.db.View(func(tx *bolt.Tx) error {
+		assert.Equal(t, history, tx.Bucket([]byte(mailboxBucket)).Bucket([]byte("Archive")).Get([]byte(historyKey)))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestUpgradeUnboundEncryptedStore(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "store.db")
+	backend, err := NewBoltStoreWithConfig(Config{Filename: filename, Passphrase: "passphrase", SearchIndex: true})
+	require.NoError(t, err)
+	putSecretMessage(t, backend)
+
+	// encrypt the values again like version 2 did, without their location
+	unbound := *backend.crypt
+	unbound.unbound = true
+	err = backend.db.Update(func(tx *bolt.Tx) error {
+		hashes, err := collectHashes(tx, backend.crypt)
+		if err != nil {
+			return err
+		}
+		err = rekeyBodies(tx, hashes, backend.crypt, &unbound)
+		if err != nil {
+			return err
+		}
+		err = reencryptMailboxes(tx, backend.crypt, &unbound)
+		if err != nil {
+			return err
+		}
+		err = reencryptSearchTerms(tx, backend.crypt, &unbound)
+		if err != nil {
+			return err
+		}
+		bucket := tx.Bucket([]byte(metadataBucket))
+		metadata, err := DeserializeObject[encryptionMetadata](bucket.Get([]byte(encryptionKey)))
+		if err != nil {
+			return err
+		}
+		metadata.Check, err = unbound.seal([]byte(encryptionCheck), nil)
+		if err != nil {
+			return err
+		}
+		data, err := SerializeObject(metadata)
+		if err != nil {
+			return err
+		}
+		err = bucket.Put([]byte(encryptionKey), data)
+		if err != nil {
+			return err
+		}
+		return setVersion(tx, 2)
+	})
+	require.NoError(t, err)
+	require.NoError(t, backend.Close())
+
+	backend, err = NewBoltStoreWithConfig(Config{Filename: filename, Passphrase: "passphrase", SkipUpgrade: true})
+	require.NoError(t, err)
+	assert.Equal(t, secretMessage, fetchSecretMessage(t, backend))
+	assert.Error(t, backend.Rekey("new passphrase", ""))
+	require.NoError(t, backend.CheckUpgrade())
+	require.NoError(t, backend.Close())
+
+	backend, err = NewBoltStoreWithConfig(Config{Filename: filename, Passphrase: "passphrase", SearchIndex: true})
+	require.NoError(t, err)
+	version, err := backend.Version()
+	require.NoError(t, err)
+	assert.Equal(t, boltFileVersion, version)
+	assert.False(t, backend.crypt.unbound)
+	assert.Equal(t, secretMessage, fetchSecretMessage(t, backend))
+	query, err := search.ParseQuery("secret")
+	require.NoError(t, err)
+	results, err := backend.Search(query)
+	require.NoError(t, err)
+	assert.Len(t, results, 1)
+	require.NoError(t, backend.Close())
+
+	backend, err = NewBoltStoreWithConfig(Config{Filename: filename, Passphrase: "passphrase"})
+	require.NoError(t, err)
+	defer backend.Close()
+	assert.Equal(t, secretMessage, fetchSecretMessage(t, backend))
+	require.NoError(t, backend.Rekey("new passphrase", ""))
+	assert.Equal(t, secretMessage, fetchSecretMessage(t, backend))
+}
+
+func putSecretMessage(t *testing.T, backend *BoltStore) {
+	t.Helper()
+
+	info := mailbox.Info{Delimiter: ".", Name: "INBOX"}
+	require.NoError(t, backend.CreateMailbox(context.Background(), info))
+	_, err := backend.PutMessage(context.Background(), info, mailbox.MessageProperties{
+		Flags:        []string{"\\Seen"},
+		InternalDate: time.Now(),
+		Size:         uint32(len(secretMessage)),
+	}, bytes.NewBufferString(secretMessage))
+	require.NoError(t, err)
+
+	err = backend.AddToHistory(context.Background(), info, mailbox.HistoryAction{
+		SourceAccountTag: "secret source",
+		Date:             time.Now(),
+		Action:           mailbox.ActionCopy,
+	})
+	require.NoError(t, err)
+}
+
+func fetchSecretMessage(t *testing.T, backend *BoltStore) string {
+	t.Helper()
+
+	return fetchMessageFrom(t, backend, mailbox.Info{Delimiter: ".", Name: "INBOX"})
+}
+
+// fetchMessageFrom returns the body of the last message received from the mailbox
+func fetchMessageFrom(t *testing.T, backend *BoltStore, info mailbox.Info) string {
+	t.Helper()
+
+	_, err := backend.SelectMailbox(context.Background(), info)
+	require.NoError(t, err)
+	defer backend.UnselectMailbox()
+
+	receiver := make(chan *mailbox.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- backend.FetchMessages(context.Background(), time.Time{}, receiver)
+	}()
+	body := ""
+	for msg := range receiver {
+		data, err := io.ReadAll(msg.Body)
+		assert.NoError(t, err)
+		body = string(data)
+	}
+	require.NoError(t, <-done)
+	return body
+}
+
+func assertNotInClearText(t *testing.T, filename string) {
+	t.Helper()
+
+	content, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), "secret source")
+}
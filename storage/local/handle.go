@@ -0,0 +1,52 @@
+package local
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/creativeprojects/imap/mailbox"
+)
+
+type handle struct {
+	backend *BoltStore
+	info    mailbox.Info
+	status  mailbox.Status
+}
+
+func (h *handle) Status() *mailbox.Status {
+	status := h.status
+	return &status
+}
+
+func (h *handle) Fetch(ctx context.Context, since time.Time, messages chan *mailbox.Message) error {
+	return h.backend.fetchMessages(ctx, h.info.Name, since, messages)
+}
+
+func (h *handle) FetchUids(ctx context.Context, uids []mailbox.MessageID, messages chan *mailbox.Message) error {
+	return h.backend.fetchUids(ctx, h.info.Name, uids, messages)
+}
+
+func (h *handle) Uids(ctx context.Context) ([]mailbox.MessageID, error) {
+	return h.backend.uids(ctx, h.info.Name)
+}
+
+func (h *handle) LatestDate(ctx context.Context) (time.Time, error) {
+	return h.backend.latestDate(ctx, h.info.Name)
+}
+
+func (h *handle) Put(ctx context.Context, props mailbox.MessageProperties, body io.Reader) (mailbox.MessageID, error) {
+	return h.backend.PutMessage(ctx, h.info, props, body)
+}
+
+func (h *handle) Delete(ctx context.Context, uid mailbox.MessageID) error {
+	return h.backend.DeleteMessage(ctx, h.info, uid)
+}
+
+func (h *handle) SetFlags(ctx context.Context, uid mailbox.MessageID, flags []string) error {
+	return h.backend.SetMessageFlags(ctx, h.info, uid, flags)
+}
+
+func (h *handle) Close() error {
+	return nil
+}
@@ -0,0 +1,305 @@
+package local
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/creativeprojects/imap/lib"
+	"github.com/creativeprojects/imap/mailbox"
+	"github.com/creativeprojects/imap/search"
+	bolt "go.etcd.io/bbolt"
+	bolterrors "go.etcd.io/bbolt/errors"
+)
+
+// The search index bucket contains one empty value per term and message: the key is the term followed by the message reference.
+// The search terms bucket contains the list of terms of each message, to remove them from the index when the message is deleted.
+// The index is maintained by PutMessage and DeleteMessage as soon as the buckets exist.
+const (
+	searchIndexBucket = "search-index"
+	searchTermsBucket = "search-terms"
+)
+
+var ErrNoSearchIndex = errors.New("no search index in the database")
+
+// SearchResult is a message matching a search query
+type SearchResult struct {
+	Mailbox string
+	UID     mailbox.MessageID
+	Date    time.Time
+	Size    uint32
+}
+
+// HasSearchIndex returns true when the database contains a full-text search index
+func (s *BoltStore) HasSearchIndex() bool {
+	found := false
+	_ = s.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket([]byte(searchTermsBucket)) != nil
+		return nil
+	})
+	return found
+}
+
+// BuildSearchIndex creates (or rebuilds) the full-text search index from all the messages in the database
+func (s *BoltStore) BuildSearchIndex() error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return buildSearchIndex(tx, s.crypt)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot build search index: %w", err)
+	}
+	return nil
+}
+
+// DropSearchIndex deletes the full-text search index
+func (s *BoltStore) DropSearchIndex() error {
+	return s.db.Update(dropSearchIndex)
+}
+
+// Search returns the messages matching the query, sorted by mailbox and UID
+func (s *BoltStore) Search(query *search.Query) ([]SearchResult, error) {
+	results := make([]SearchResult, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket([]byte(searchIndexBucket))
+		messages := tx.Bucket([]byte(searchTermsBucket))
+		if index == nil || messages == nil {
+			return ErrNoSearchIndex
+		}
+		root := tx.Bucket([]byte(mailboxBucket))
+		if root == nil {
+			return nil
+		}
+		var refs map[string]bool
+		if len(query.Terms) == 0 {
+			refs = make(map[string]bool)
+			err := messages.ForEach(func(ref, _ []byte) error {
+				refs[string(ref)] = true
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		for _, term := range query.Terms {
+			refs = lookupTerm(index, s.crypt.termKey(term), refs)
+			if len(refs) == 0 {
+				return nil
+			}
+		}
+		for ref := range refs {
+			name, uid := parseMessageRef([]byte(ref))
+			mbox := root.Bucket([]byte(name))
+			if mbox == nil {
+				continue
+			}
+			key := SerializeUID(msgPrefix, uid)
+			data := mbox.Get(key)
+			if data == nil {
+				continue
+			}
+			props, err := decryptObject[msgProps](data, s.crypt, mailboxLocation(name, key))
+			if err != nil {
+				return err
+			}
+			if !query.MatchDate(props.Date) {
+				continue
+			}
+			results = append(results, SearchResult{
+				Mailbox: name,
+				UID:     mailbox.NewMessageIDFromUint(uint32(uid)),
+				Date:    props.Date,
+				Size:    props.Size,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Mailbox != results[j].Mailbox {
+			return results[i].Mailbox < results[j].Mailbox
+		}
+		return results[i].UID.AsUint() < results[j].UID.AsUint()
+	})
+	return results, nil
+}
+
+// termKey returns the prefix of the index keys of a term. On an encrypted database the term is keyed
+// so the index doesn't reveal the words contained in the messages.
+func (c *boxCipher) termKey(term string) []byte {
+	if c == nil {
+		// the separator prevents a term from matching a longer one
+		return append([]byte(term), 0)
+	}
+	mac := hmac.New(sha256.New, c.hashKey)
+	mac.Write([]byte("term:" + term))
+	return mac.Sum(nil)
+}
+
+// messageRef identifies a message in the index: the name of the mailbox, a separator and the UID
+func messageRef(name string, uid uint64) []byte {
+	ref := append([]byte(name), 0)
+	return binary.BigEndian.AppendUint64(ref, uid)
+}
+
+func parseMessageRef(ref []byte) (string, uint64) {
+	if len(ref) < 9 {
+		return "", 0
+	}
+	return string(ref[:len(ref)-9]), binary.BigEndian.Uint64(ref[len(ref)-8:])
+}
+
+// lookupTerm returns the references of the messages containing the term.
+// When filter is not nil, only the references in the filter are returned.
+func lookupTerm(index *bolt.Bucket, prefix []byte, filter map[string]bool) map[string]bool {
+	found := make(map[string]bool)
+	cursor := index.Cursor()
+	for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+		ref := string(key[len(prefix):])
+		if filter != nil && !filter[ref] {
+			continue
+		}
+		found[ref] = true
+	}
+	return found
+}
+
+// indexMessage adds the terms of the message to the index.
+// A message which cannot be fully decoded is indexed with the text found before the error.
+func indexMessage(tx *bolt.Tx, crypt *boxCipher, name string, uid uint64, body io.Reader) error {
+	index := tx.Bucket([]byte(searchIndexBucket))
+	messages := tx.Bucket([]byte(searchTermsBucket))
+	if index == nil || messages == nil {
+		return nil
+	}
+	doc, _ := search.Extract(body)
+	terms := doc.Terms()
+	ref := messageRef(name, uid)
+	for _, term := range terms {
+		err := index.Put(append(crypt.termKey(term), ref...), []byte{})
+		if err != nil {
+			return err
+		}
+	}
+	data, err := encryptObject(&terms, crypt, valueLocation(ref, searchTermsBucket))
+	if err != nil {
+		return err
+	}
+	return messages.Put(ref, data)
+}
+
+// unindexMessage removes the terms of the message from the index
+func unindexMessage(tx *bolt.Tx, crypt *boxCipher, name string, uid uint64) error {
+	index := tx.Bucket([]byte(searchIndexBucket))
+	messages := tx.Bucket([]byte(searchTermsBucket))
+	if index == nil || messages == nil {
+		return nil
+	}
+	ref := messageRef(name, uid)
+	data := messages.Get(ref)
+	if data == nil {
+		return nil
+	}
+	terms, err := decryptObject[[]string](data, crypt, valueLocation(ref, searchTermsBucket))
+	if err != nil {
+		return fmt.Errorf("cannot read search terms of message %d in %q: %w", uid, name, err)
+	}
+	for _, term := range *terms {
+		err = index.Delete(append(crypt.termKey(term), ref...))
+		if err != nil {
+			return err
+		}
+	}
+	return messages.Delete(ref)
+}
+
+// unindexMailbox removes all the messages of the mailbox from the index
+func unindexMailbox(tx *bolt.Tx, crypt *boxCipher, name string, mbox *bolt.Bucket) error {
+	if tx.Bucket([]byte(searchTermsBucket)) == nil {
+		return nil
+	}
+	uids := make([]uint64, 0)
+	err := mbox.ForEach(func(key, value []byte) error {
+		if value != nil && bytes.HasPrefix(key, []byte(msgPrefix)) {
+			uids = append(uids, DeserializeUID(msgPrefix, key))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, uid := range uids {
+		err = unindexMessage(tx, crypt, name, uid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dropSearchIndex(tx *bolt.Tx) error {
+	for _, name := range []string{searchIndexBucket, searchTermsBucket} {
+		err := tx.DeleteBucket([]byte(name))
+		if err != nil && !errors.Is(err, bolterrors.ErrBucketNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildSearchIndex indexes all the messages of the database into new search buckets
+func buildSearchIndex(tx *bolt.Tx, crypt *boxCipher) error {
+	err := dropSearchIndex(tx)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{searchIndexBucket, searchTermsBucket} {
+		_, err = tx.CreateBucket([]byte(name))
+		if err != nil {
+			return err
+		}
+	}
+	root := tx.Bucket([]byte(mailboxBucket))
+	if root == nil {
+		return nil
+	}
+	return root.ForEach(func(name, value []byte) error {
+		if value != nil {
+			return nil
+		}
+		mbox := root.Bucket(name)
+		if mbox == nil {
+			return nil
+		}
+		return mbox.ForEach(func(key, value []byte) error {
+			if value == nil || !bytes.HasPrefix(key, []byte(msgPrefix)) {
+				return nil
+			}
+			props, err := decryptObject[msgProps](value, crypt, mailboxLocation(string(name), key))
+			if err != nil {
+				return fmt.Errorf("mailbox %q key %q: %w", string(name), string(key), err)
+			}
+			compressed, err := getBody(tx, props.Hash, crypt)
+			if err != nil {
+				if errors.Is(err, lib.ErrMessageNotFound) {
+					return nil
+				}
+				return err
+			}
+			reader, err := zlib.NewReader(bytes.NewReader(compressed))
+			if err != nil {
+				return fmt.Errorf("mailbox %q key %q: %w", string(name), string(key), err)
+			}
+			defer reader.Close()
+			return indexMessage(tx, crypt, string(name), DeserializeUID(msgPrefix, key), reader)
+		})
+	})
+}
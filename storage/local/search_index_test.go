@@ -0,0 +1,134 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/creativeprojects/imap/mailbox"
+	"github.com/creativeprojects/imap/search"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var searchMessages = []struct {
+	mailbox string
+	date    time.Time
+	body    string
+}{
+	{
+		mailbox: "INBOX",
+		date:    time.Date(2023, 1, 10, 12, 0, 0, 0, time.Local),
+		body:    "From: John Doe <john@example.com>\r\nTo: jane@example.com\r\nSubject: Budget meeting\r\n\r\nSee you tomorrow\r\n",
+	},
+	{
+		mailbox: "INBOX",
+		date:    time.Date(2023, 2, 10, 12, 0, 0, 0, time.Local),
+		body:    "From: jane@example.com\r\nTo: John Doe <john@example.com>\r\nSubject: Re: Budget meeting\r\n\r\nThe budget is attached\r\n",
+	},
+	{
+		mailbox: "Archive",
+		date:    time.Date(2022, 5, 1, 12, 0, 0, 0, time.Local),
+		body:    "From: newsletter@example.org\r\nTo: john@example.com\r\nSubject: Weekly news\r\n\r\nNothing about money\r\n",
+	},
+}
+
+func TestSearchIndex(t *testing.T) {
+	for _, passphrase := range []string{"", "passphrase"} {
+		t.Run("passphrase="+passphrase, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "store.db")
+			backend, err := NewBoltStoreWithConfig(Config{
+				Filename:    filename,
+				Passphrase:  passphrase,
+				SearchIndex: true,
+			})
+			require.NoError(t, err)
+			defer backend.Close()
+			assert.True(t, backend.HasSearchIndex())
+
+			putSearchMessages(t, backend)
+			assertSearch(t, backend)
+
+			if passphrase != "" {
+				content, err := os.ReadFile(filename)
+				require.NoError(t, err)
+				assert.NotContains(t, string(content), "newsletter")
+			}
+
+			// deleting a message removes it from the index
+			require.NoError(t, backend.DeleteMessage(context.Background(), mailbox.Info{Delimiter: ".", Name: "INBOX"}, mailbox.NewMessageIDFromUint(1)))
+			assert.Equal(t, []string{"INBOX:2"}, searchFor(t, backend, "subject:budget"))
+
+			require.NoError(t, backend.DeleteMailbox(context.Background(), mailbox.Info{Delimiter: ".", Name: "Archive"}))
+			assert.Empty(t, searchFor(t, backend, "newsletter"))
+		})
+	}
+}
+
+func TestBuildSearchIndexOnExistingStore(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "store.db")
+	backend, err := NewBoltStore(filename)
+	require.NoError(t, err)
+	putSearchMessages(t, backend)
+
+	query, err := search.ParseQuery("budget")
+	require.NoError(t, err)
+	_, err = backend.Search(query)
+	assert.ErrorIs(t, err, ErrNoSearchIndex)
+	require.NoError(t, backend.Close())
+
+	backend, err = NewBoltStoreWithConfig(Config{Filename: filename, SearchIndex: true})
+	require.NoError(t, err)
+	defer backend.Close()
+	assertSearch(t, backend)
+
+	// the index is rebuilt with the new key
+	require.NoError(t, backend.Rekey("passphrase", ""))
+	assertSearch(t, backend)
+
+	require.NoError(t, backend.DropSearchIndex())
+	assert.False(t, backend.HasSearchIndex())
+}
+
+func putSearchMessages(t *testing.T, backend *BoltStore) {
+	t.Helper()
+
+	for _, message := range searchMessages {
+		info := mailbox.Info{Delimiter: ".", Name: message.mailbox}
+		require.NoError(t, backend.CreateMailbox(context.Background(), info))
+		_, err := backend.PutMessage(context.Background(), info, mailbox.MessageProperties{
+			InternalDate: message.date,
+		}, bytes.NewBufferString(message.body))
+		require.NoError(t, err)
+	}
+}
+
+func assertSearch(t *testing.T, backend *BoltStore) {
+	t.Helper()
+
+	assert.Equal(t, []string{"INBOX:1", "INBOX:2"}, searchFor(t, backend, "budget"))
+	assert.Equal(t, []string{"INBOX:2"}, searchFor(t, backend, "from:jane budget"))
+	assert.Equal(t, []string{"Archive:1", "INBOX:2"}, searchFor(t, backend, "to:john"))
+	assert.Equal(t, []string{"INBOX:1"}, searchFor(t, backend, `subject:"budget meeting" tomorrow`))
+	assert.Equal(t, []string{"INBOX:2"}, searchFor(t, backend, "budget after:2023-02-01"))
+	assert.Equal(t, []string{"Archive:1", "INBOX:1"}, searchFor(t, backend, "before:2023-02-01"))
+	assert.Empty(t, searchFor(t, backend, "from:newsletter budget"))
+	assert.Empty(t, searchFor(t, backend, "budg"))
+}
+
+func searchFor(t *testing.T, backend *BoltStore, query string) []string {
+	t.Helper()
+
+	parsed, err := search.ParseQuery(query)
+	require.NoError(t, err)
+	results, err := backend.Search(parsed)
+	require.NoError(t, err)
+	found := make([]string, len(results))
+	for i, result := range results {
+		found[i] = result.Mailbox + ":" + result.UID.String()
+	}
+	return found
+}
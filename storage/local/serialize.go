@@ -58,6 +58,6 @@ func SerializeUID(prefix string, uid uint64) []byte {
 
 func DeserializeUID(prefix string, key []byte) uint64 {
 	key = bytes.TrimPrefix(key, []byte(prefix))
-	uid, _ := strconv.ParseUint(string(key), 10, 32)
+	uid, _ := strconv.ParseUint(string(key), 32, 32)
 	return uid
 }
@@ -51,3 +51,11 @@ func TestSerializationOfProperties(t *testing.T) {
 		})
 	}
 }
+
+func TestSerializationOfUID(t *testing.T) {
+	fixtures := []uint64{0, 1, 9, 10, 31, 32, 1000, 4294967295}
+	for _, uid := range fixtures {
+		key := SerializeUID(bodyPrefix, uid)
+		assert.Equal(t, uid, DeserializeUID(bodyPrefix, key))
+	}
+}
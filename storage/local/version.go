@@ -0,0 +1,151 @@
+package local
+
+import (
+	"errors"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	ErrUnsupportedVersion = errors.New("database file version is not supported")
+	errDryRun             = errors.New("dry run")
+)
+
+// Migration upgrades the database file to a version
+type Migration struct {
+	// Version of the database file after the migration
+	Version     int
+	Description string
+	migrate     func(tx *bolt.Tx, crypt *boxCipher) error
+}
+
+// migrations are run in order, from the version of the file up to boltFileVersion
+var migrations = []Migration{
+	{
+		Version:     2,
+		Description: "store message bodies once in a bucket keyed by hash, with reference counts",
+		migrate:     migrateToDeduplicatedBodies,
+	},
+	{
+		Version:     3,
+		Description: "bind the encrypted values to their bucket and key",
+		migrate:     migrateToBoundValues,
+	},
+}
+
+// Version returns the version of the database file
+func (s *BoltStore) Version() (int, error) {
+	metadata, err := s.getMetadata()
+	if err != nil {
+		return 0, err
+	}
+	if metadata.Version == 0 {
+		if s.isEmpty() {
+			return boltFileVersion, nil
+		}
+		// files created before the version was saved are version 1
+		return 1, nil
+	}
+	return metadata.Version, nil
+}
+
+// PendingMigrations returns the list of migrations needed to upgrade the file to the current version
+func (s *BoltStore) PendingMigrations() ([]Migration, error) {
+	version, err := s.Version()
+	if err != nil {
+		return nil, err
+	}
+	if version > boltFileVersion {
+		return nil, fmt.Errorf("%w: version %d is newer than %d", ErrUnsupportedVersion, version, boltFileVersion)
+	}
+	pending := make([]Migration, 0)
+	for _, migration := range migrations {
+		if migration.Version > version {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Upgrade runs all the pending migrations in a single transaction
+func (s *BoltStore) Upgrade() error {
+	return s.runMigrations(false)
+}
+
+// CheckUpgrade runs all the pending migrations in a transaction which is rolled back
+func (s *BoltStore) CheckUpgrade() error {
+	return s.runMigrations(true)
+}
+
+func (s *BoltStore) runMigrations(dryRun bool) error {
+	version, err := s.Version()
+	if err != nil {
+		return err
+	}
+	pending, err := s.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	if dryRun && len(pending) == 0 {
+		return nil
+	}
+	if len(pending) == 0 {
+		metadata, err := s.getMetadata()
+		if err != nil || metadata.Version == version {
+			return err
+		}
+		// save the version of a new file
+		return s.db.Update(func(tx *bolt.Tx) error {
+			return setVersion(tx, version)
+		})
+	}
+	if !dryRun {
+		backup := fmt.Sprintf("%s.v%d.backup", s.dbFile, version)
+		s.log.Printf("Saving a copy of the database to %q before upgrading", backup)
+		err = s.Backup(backup)
+		if err != nil {
+			return fmt.Errorf("cannot backup database file before upgrading: %w", err)
+		}
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		for _, migration := range pending {
+			s.log.Printf("Upgrading database to version %d: %s", migration.Version, migration.Description)
+			err := migration.migrate(tx, s.crypt)
+			if err != nil {
+				return fmt.Errorf("migration to version %d: %w", migration.Version, err)
+			}
+			err = setVersion(tx, migration.Version)
+			if err != nil {
+				return err
+			}
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if dryRun && errors.Is(err, errDryRun) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot upgrade database file: %w", err)
+	}
+	if !dryRun {
+		// the values are now encrypted with their location
+		s.crypt = s.crypt.bound()
+	}
+	return nil
+}
+
+func setVersion(tx *bolt.Tx, version int) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(metadataBucket))
+	if err != nil {
+		return err
+	}
+	data, err := SerializeInt(version)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(versionKey), data)
+}
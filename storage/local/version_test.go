@@ -0,0 +1,84 @@
+package local
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestMigrationsAreInOrder(t *testing.T) {
+	version := 1
+	for _, migration := range migrations {
+		assert.Greater(t, migration.Version, version)
+		assert.NotEmpty(t, migration.Description)
+		assert.NotNil(t, migration.migrate)
+		version = migration.Version
+	}
+	assert.Equal(t, boltFileVersion, version)
+}
+
+func TestNewStoreHasCurrentVersion(t *testing.T) {
+	backend, err := NewBoltStore(filepath.Join(t.TempDir(), "store.db"))
+	require.NoError(t, err)
+	defer backend.Close()
+
+	version, err := backend.Version()
+	require.NoError(t, err)
+	assert.Equal(t, boltFileVersion, version)
+
+	pending, err := backend.PendingMigrations()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func TestRefuseNewerVersion(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "store.db")
+	backend, err := NewBoltStore(filename)
+	require.NoError(t, err)
+	err = backend.db.Update(func(tx *bolt.Tx) error {
+		return setVersion(tx, boltFileVersion+1)
+	})
+	require.NoError(t, err)
+	require.NoError(t, backend.Close())
+
+	_, err = NewBoltStore(filename)
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+
+	_, err = NewBoltStoreWithConfig(Config{Filename: filename, SkipUpgrade: true})
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+}
+
+func TestCheckAndRunUpgrade(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "store.db")
+	createVersion1Store(t, filename)
+
+	backend, err := NewBoltStoreWithConfig(Config{Filename: filename, SkipUpgrade: true})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	pending, err := backend.PendingMigrations()
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	assert.Equal(t, 2, pending[0].Version)
+	assert.Equal(t, 3, pending[1].Version)
+
+	// dry run
+	require.NoError(t, backend.CheckUpgrade())
+	version, err := backend.Version()
+	require.NoError(t, err)
+	assert.Equal(t, 1, version)
+	assert.Empty(t, countReferences(t, backend))
+
+	require.NoError(t, backend.Upgrade())
+	version, err = backend.Version()
+	require.NoError(t, err)
+	assert.Equal(t, boltFileVersion, version)
+	assert.Equal(t, []uint64{2}, countReferences(t, backend))
+
+	_, err = os.Stat(filename + ".v1.backup")
+	assert.NoError(t, err)
+}
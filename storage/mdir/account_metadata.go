@@ -1,5 +1,19 @@
 package mdir
 
+import "github.com/creativeprojects/imap/lib"
+
 type AccountMetadata struct {
 	AccountID string
 }
+
+// ReadAccountID returns the account ID saved in the root directory of the maildir, without creating anything
+func ReadAccountID(root string) (string, error) {
+	metadata, err := (&Maildir{root: root}).getMetadata()
+	if err != nil {
+		return "", err
+	}
+	if metadata.AccountID == "" {
+		return "", lib.ErrNoAccountID
+	}
+	return metadata.AccountID, nil
+}
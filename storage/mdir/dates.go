@@ -0,0 +1,143 @@
+package mdir
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/creativeprojects/imap/lib"
+	"github.com/emersion/go-maildir"
+	"github.com/emersion/go-message/textproto"
+)
+
+// datesDotFile keeps the internal date of the messages of a maildir: the modification time of the files
+// cannot be trusted as it's reset by most backup and copy tools. Each line is "<key> <date>",
+// new messages are appended at the end of the file.
+const datesDotFile = ".imap-dates"
+
+// loadDates reads the internal dates saved in the maildir. A missing file means no date saved yet.
+func loadDates(dir string) (map[string]time.Time, error) {
+	dates := make(map[string]time.Time)
+	file, err := os.Open(filepath.Join(dir, datesDotFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return dates, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if !found {
+			continue
+		}
+		date, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			// an incomplete line after a crash: the date will be found again
+			continue
+		}
+		dates[key] = date
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", datesDotFile, err)
+	}
+	return dates, nil
+}
+
+// appendDates adds the internal dates at the end of the file
+func appendDates(dir string, dates map[string]time.Time) error {
+	if len(dates) == 0 {
+		return nil
+	}
+	file, err := os.OpenFile(filepath.Join(dir, datesDotFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(formatDates(dates))
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// saveDates replaces the file with the internal dates, dropping the messages which were deleted
+func saveDates(dir string, dates map[string]time.Time) error {
+	return lib.WriteFileAtomic(filepath.Join(dir, datesDotFile), 0600, func(w io.Writer) error {
+		_, err := io.WriteString(w, formatDates(dates))
+		return err
+	})
+}
+
+func formatDates(dates map[string]time.Time) string {
+	builder := &strings.Builder{}
+	for key, date := range dates {
+		builder.WriteString(key + " " + date.Format(time.RFC3339) + "\n")
+	}
+	return builder.String()
+}
+
+// guessDate finds the internal date of a message which is not in the dates file: from the delivery time
+// in the filename, or the last Received header (added by the server which delivered the message), or the Date header,
+// or the modification time of the file as a last resort.
+func guessDate(msg *maildir.Message) (time.Time, error) {
+	if date, ok := deliveryDate(msg.Key()); ok {
+		return date, nil
+	}
+	file, err := os.Open(msg.Filename())
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	header, err := textproto.ReadHeader(bufio.NewReader(file))
+	if err == nil {
+		if date, ok := receivedDate(header.Get("Received")); ok {
+			return date, nil
+		}
+		if date, err := mail.ParseDate(header.Get("Date")); err == nil {
+			return date, nil
+		}
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return stat.ModTime(), nil
+}
+
+// receivedDate returns the date at the end of a Received header ("from ... by ...; <date>")
+func receivedDate(received string) (time.Time, bool) {
+	index := strings.LastIndex(received, ";")
+	if index < 0 {
+		return time.Time{}, false
+	}
+	date, err := mail.ParseDate(strings.TrimSpace(received[index+1:]))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return date, true
+}
+
+// deliveryDate returns the time at the start of a maildir key ("<seconds>.<unique>.<host>")
+func deliveryDate(key string) (time.Time, bool) {
+	seconds, _, found := strings.Cut(key, ".")
+	if !found {
+		return time.Time{}, false
+	}
+	timestamp, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil || timestamp <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(timestamp, 0), true
+}
@@ -0,0 +1,125 @@
+package mdir
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/creativeprojects/imap/mailbox"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInternalDateSurvivesCopy(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("maildir is not supported on Windows")
+		return
+	}
+	root := t.TempDir()
+	backend, err := New(root)
+	require.NoError(t, err)
+
+	info := mailbox.Info{Delimiter: ".", Name: "INBOX"}
+	require.NoError(t, backend.CreateMailbox(t.Context(), info))
+	internalDate := time.Date(2020, 10, 20, 12, 11, 0, 0, time.UTC)
+	_, err = backend.PutMessage(t.Context(), info, mailbox.MessageProperties{InternalDate: internalDate}, bytes.NewBufferString("Subject: test\r\n\r\nbody\r\n"))
+	require.NoError(t, err)
+
+	// a copy of the maildir resets the modification time of the files
+	files, err := filepath.Glob(filepath.Join(root, "INBOX", "cur", "*"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.NoError(t, os.Chtimes(files[0], time.Now(), time.Now()))
+
+	messages := fetchMessages(t, backend, info)
+	require.Len(t, messages, 1)
+	assert.True(t, internalDate.Equal(messages[0].InternalDate))
+
+	_, err = backend.SelectMailbox(t.Context(), info)
+	require.NoError(t, err)
+	latest, err := backend.LatestDate(t.Context())
+	require.NoError(t, err)
+	assert.True(t, internalDate.Equal(latest))
+	require.NoError(t, backend.UnselectMailbox())
+}
+
+func TestGuessInternalDate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("maildir is not supported on Windows")
+		return
+	}
+	root := t.TempDir()
+	backend, err := New(root)
+	require.NoError(t, err)
+
+	info := mailbox.Info{Delimiter: ".", Name: "INBOX"}
+	require.NoError(t, backend.CreateMailbox(t.Context(), info))
+
+	// messages delivered by another program
+	cur := filepath.Join(root, "INBOX", "cur")
+	received := "Received: from mx.example.com\r\n by mail.example.org; Tue, 1 Jul 2003 10:52:37 +0200\r\n" +
+		"Received: from client by mx.example.com; Tue, 1 Jul 2003 10:50:00 +0200\r\n" +
+		"Date: Mon, 30 Jun 2003 08:00:00 +0000\r\n\r\nbody\r\n"
+	files := map[string]string{
+		// the delivery time in the filename comes first
+		"1600000001.M1P1.host:2,S": received,
+		// then the headers when the filename has no time
+		"M2P2.host:2,S": received,
+		"M3P3.host:2,S": "Date: Mon, 30 Jun 2003 08:00:00 +0000\r\n\r\nbody\r\n",
+		"M4P4.host:2,S": "Subject: no date\r\n\r\nbody\r\n",
+	}
+	modified := time.Unix(1600000004, 0)
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(cur, name), []byte(content), 0600))
+		require.NoError(t, os.Chtimes(filepath.Join(cur, name), modified, modified))
+	}
+
+	expected := []time.Time{
+		time.Unix(1600000001, 0),
+		time.Date(2003, 7, 1, 10, 52, 37, 0, time.FixedZone("", 2*60*60)),
+		time.Date(2003, 6, 30, 8, 0, 0, 0, time.UTC),
+		modified,
+	}
+	for range 2 {
+		// the second time, the dates are read from the dates file
+		messages := fetchMessages(t, backend, info)
+		require.Len(t, messages, len(expected))
+		for i, msg := range messages {
+			assert.True(t, expected[i].Equal(msg.InternalDate), "expected %s but found %s", expected[i], msg.InternalDate)
+		}
+	}
+	dates, err := loadDates(filepath.Join(root, "INBOX"))
+	require.NoError(t, err)
+	assert.Len(t, dates, len(expected))
+
+	// deleted messages are removed from the dates file
+	require.NoError(t, backend.DeleteMessage(t.Context(), info, mailbox.NewMessageIDFromUint(1)))
+	assert.Len(t, fetchMessages(t, backend, info), 3)
+	dates, err = loadDates(filepath.Join(root, "INBOX"))
+	require.NoError(t, err)
+	assert.Len(t, dates, 3)
+}
+
+func fetchMessages(t *testing.T, backend *Maildir, info mailbox.Info) []*mailbox.Message {
+	t.Helper()
+
+	_, err := backend.SelectMailbox(t.Context(), info)
+	require.NoError(t, err)
+	defer backend.UnselectMailbox()
+
+	receiver := make(chan *mailbox.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- backend.FetchMessages(t.Context(), time.Time{}, receiver)
+	}()
+	messages := make([]*mailbox.Message, 0)
+	for msg := range receiver {
+		msg.Body.Close()
+		messages = append(messages, msg)
+	}
+	require.NoError(t, <-done)
+	return messages
+}
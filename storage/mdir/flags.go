@@ -1,12 +1,17 @@
 package mdir
 
 import (
+	"strings"
+
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-maildir"
 )
 
-func toFlags(source []string) []maildir.Flag {
+// toFlags converts IMAP flags to maildir flags. Custom keywords are given a letter from the keywords of the maildir:
+// the keywords which cannot be given a letter are returned separately.
+func toFlags(source []string, keywords *keywords) ([]maildir.Flag, []string) {
 	flags := make([]maildir.Flag, 0, len(source))
+	dropped := make([]string, 0)
 	for _, sourceFlag := range source {
 		switch sourceFlag {
 		case imap.SeenFlag:
@@ -23,12 +28,24 @@ func toFlags(source []string) []maildir.Flag {
 
 		case imap.DraftFlag:
 			flags = append(flags, maildir.FlagDraft)
+
+		default:
+			if strings.HasPrefix(sourceFlag, "\\") {
+				// other system flags (like \Recent) are not saved
+				continue
+			}
+			flag, ok := keywords.flag(sourceFlag)
+			if !ok {
+				dropped = append(dropped, sourceFlag)
+				continue
+			}
+			flags = append(flags, flag)
 		}
 	}
-	return flags
+	return flags, dropped
 }
 
-func flagsToStrings(source []maildir.Flag) []string {
+func flagsToStrings(source []maildir.Flag, keywords *keywords) []string {
 	flags := make([]string, 0, len(source))
 	for _, sourceFlag := range source {
 		switch sourceFlag {
@@ -46,6 +63,11 @@ func flagsToStrings(source []maildir.Flag) []string {
 
 		case maildir.FlagDraft:
 			flags = append(flags, imap.DraftFlag)
+
+		default:
+			if keyword := keywords.keyword(sourceFlag); keyword != "" {
+				flags = append(flags, keyword)
+			}
 		}
 	}
 	return flags
@@ -0,0 +1,52 @@
+package mdir
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/creativeprojects/imap/mailbox"
+)
+
+type handle struct {
+	backend *Maildir
+	name    string
+	status  mailbox.Status
+}
+
+func (h *handle) Status() *mailbox.Status {
+	status := h.status
+	return &status
+}
+
+func (h *handle) Fetch(ctx context.Context, since time.Time, messages chan *mailbox.Message) error {
+	return h.backend.fetchMessages(ctx, h.name, since, messages)
+}
+
+func (h *handle) FetchUids(ctx context.Context, uids []mailbox.MessageID, messages chan *mailbox.Message) error {
+	return h.backend.fetchUids(ctx, h.name, uids, messages)
+}
+
+func (h *handle) Uids(ctx context.Context) ([]mailbox.MessageID, error) {
+	return h.backend.uids(ctx, h.name)
+}
+
+func (h *handle) LatestDate(ctx context.Context) (time.Time, error) {
+	return h.backend.latestDate(ctx, h.name)
+}
+
+func (h *handle) Put(ctx context.Context, props mailbox.MessageProperties, body io.Reader) (mailbox.MessageID, error) {
+	return h.backend.putMessage(ctx, h.name, props, body)
+}
+
+func (h *handle) Delete(ctx context.Context, uid mailbox.MessageID) error {
+	return h.backend.deleteMessage(ctx, h.name, uid)
+}
+
+func (h *handle) SetFlags(ctx context.Context, uid mailbox.MessageID, flags []string) error {
+	return h.backend.setMessageFlags(ctx, h.name, uid, flags)
+}
+
+func (h *handle) Close() error {
+	return nil
+}
@@ -0,0 +1,123 @@
+package mdir
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/creativeprojects/imap/lib"
+	"github.com/emersion/go-maildir"
+)
+
+const (
+	// keywordsFile is the Dovecot file mapping the custom keywords of a maildir to the letters a to z
+	keywordsFile = "dovecot-keywords"
+	maxKeywords  = 26
+)
+
+// keywords is the content of a dovecot-keywords file: the position of a keyword is its letter
+type keywords struct {
+	list    []string
+	changed bool
+}
+
+// loadKeywords reads the dovecot-keywords file of a maildir. A missing file means no keyword yet.
+func loadKeywords(dir string) (*keywords, error) {
+	k := &keywords{
+		list: make([]string, 0),
+	}
+	file, err := os.Open(filepath.Join(dir, keywordsFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		index, keyword, found := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if !found {
+			continue
+		}
+		position, err := strconv.Atoi(index)
+		if err != nil || position < 0 || position >= maxKeywords || keyword == "" {
+			continue
+		}
+		for len(k.list) <= position {
+			k.list = append(k.list, "")
+		}
+		k.list[position] = keyword
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", keywordsFile, err)
+	}
+	return k, nil
+}
+
+// save writes the dovecot-keywords file when new keywords were added
+func (k *keywords) save(dir string) error {
+	if !k.changed {
+		return nil
+	}
+	builder := &strings.Builder{}
+	for index, keyword := range k.list {
+		if keyword == "" {
+			continue
+		}
+		fmt.Fprintf(builder, "%d %s\n", index, keyword)
+	}
+	// write a new file and rename it, like Dovecot does
+	err := lib.WriteFileAtomic(filepath.Join(dir, keywordsFile), 0600, func(w io.Writer) error {
+		_, err := io.WriteString(w, builder.String())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	k.changed = false
+	return nil
+}
+
+// flag returns the letter of a keyword, adding the keyword to the list if needed.
+// It returns false when there's no letter left.
+func (k *keywords) flag(keyword string) (maildir.Flag, bool) {
+	free := -1
+	for index, existing := range k.list {
+		if strings.EqualFold(existing, keyword) {
+			return maildir.Flag('a' + index), true
+		}
+		if existing == "" && free < 0 {
+			free = index
+		}
+	}
+	if free < 0 {
+		if len(k.list) >= maxKeywords {
+			return 0, false
+		}
+		free = len(k.list)
+		k.list = append(k.list, "")
+	}
+	k.list[free] = keyword
+	k.changed = true
+	return maildir.Flag('a' + free), true
+}
+
+// keyword returns the keyword of a letter, or an empty string if the letter is not a keyword
+func (k *keywords) keyword(flag maildir.Flag) string {
+	if flag < 'a' || flag > 'z' {
+		return ""
+	}
+	index := int(flag - 'a')
+	if index >= len(k.list) {
+		return ""
+	}
+	return k.list[index]
+}
@@ -0,0 +1,48 @@
+package mdir
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-maildir"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeywordsFromDovecot(t *testing.T) {
+	dir := t.TempDir()
+	// file written by Dovecot, with a removed keyword
+	err := os.WriteFile(filepath.Join(dir, keywordsFile), []byte("0 $Label1\n2 Junk\n"), 0600)
+	require.NoError(t, err)
+
+	keywords, err := loadKeywords(dir)
+	require.NoError(t, err)
+
+	flags, dropped := toFlags([]string{imap.SeenFlag, imap.RecentFlag, "junk", "NonJunk", "$Label1"}, keywords)
+	assert.Empty(t, dropped)
+	// the free letter is used first
+	assert.Equal(t, []maildir.Flag{maildir.FlagSeen, 'c', 'b', 'a'}, flags)
+	assert.ElementsMatch(t, []string{imap.SeenFlag, "Junk", "NonJunk", "$Label1"}, flagsToStrings(flags, keywords))
+
+	require.NoError(t, keywords.save(dir))
+	content, err := os.ReadFile(filepath.Join(dir, keywordsFile))
+	require.NoError(t, err)
+	assert.Equal(t, "0 $Label1\n1 NonJunk\n2 Junk\n", string(content))
+}
+
+func TestTooManyKeywords(t *testing.T) {
+	keywords, err := loadKeywords(t.TempDir())
+	require.NoError(t, err)
+
+	source := make([]string, maxKeywords+2)
+	for i := range source {
+		source[i] = fmt.Sprintf("keyword%d", i)
+	}
+	flags, dropped := toFlags(source, keywords)
+	assert.Len(t, flags, maxKeywords)
+	assert.Equal(t, []string{"keyword26", "keyword27"}, dropped)
+	assert.Equal(t, "keyword25", keywords.keyword('z'))
+}
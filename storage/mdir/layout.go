@@ -0,0 +1,319 @@
+package mdir
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap/utf7"
+)
+
+// Layout is the way mailboxes are organised on disk
+type Layout string
+
+const (
+	// LayoutFlat is the historical layout of this tool: one maildir per mailbox in the root directory,
+	// with the metadata files beside the maildirs
+	LayoutFlat Layout = "flat"
+	// LayoutMaildirPlusPlus is the Maildir++ layout used by Dovecot and Courier: INBOX is the root directory
+	// and the other mailboxes are ".Sub.Folder" directories inside the root
+	LayoutMaildirPlusPlus Layout = "maildir++"
+	// LayoutFS uses plain nested directories ("Sub/Folder"), with INBOX in the root directory
+	LayoutFS Layout = "fs"
+)
+
+const (
+	inbox          = "INBOX"
+	statusDotFile  = ".imap-status.json"
+	historyDotFile = ".imap-history.json"
+	// lockFile is in the root directory with all the layouts
+	lockFile = ".imap.lock"
+	// maildirFolderFile marks the Maildir++ subfolders, for the delivery agents
+	maildirFolderFile = "maildirfolder"
+)
+
+// the subdirectories of a maildir
+var maildirSubdirs = []string{"cur", "new", "tmp"}
+
+// layout converts mailbox names to directories
+type layout interface {
+	delimiter() string
+	// dir returns the directory of the maildir
+	dir(root, name string) (string, error)
+	// list returns the names of all the mailboxes
+	list(root string) ([]string, error)
+	// exists returns true when the directory of the mailbox is a maildir
+	exists(dir string) bool
+	// subfolder returns true when the maildir is marked with a maildirfolder file
+	subfolder(name string) bool
+	statusFile(root, name string) string
+	historyFile(root, name string) string
+	// sharesDirectory returns true when the maildir can contain other mailboxes
+	sharesDirectory(name string) bool
+}
+
+func newLayout(name Layout) (layout, error) {
+	switch name {
+	case "", LayoutFlat:
+		return flatLayout{}, nil
+	case LayoutMaildirPlusPlus:
+		return maildirPlusPlusLayout{}, nil
+	case LayoutFS:
+		return fsLayout{}, nil
+	default:
+		return nil, fmt.Errorf("unknown maildir layout %q", name)
+	}
+}
+
+type flatLayout struct{}
+
+func (flatLayout) delimiter() string {
+	return "."
+}
+
+func (flatLayout) dir(root, name string) (string, error) {
+	return filepath.Join(root, name), nil
+}
+
+func (flatLayout) list(root string) ([]string, error) {
+	files, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		names = append(names, file.Name())
+	}
+	return names, nil
+}
+
+// exists doesn't need the maildir subdirectories: older versions listed all the directories as mailboxes
+func (flatLayout) exists(dir string) bool {
+	stat, err := os.Stat(dir)
+	return err == nil && stat.IsDir()
+}
+
+func (flatLayout) subfolder(name string) bool {
+	return false
+}
+
+func (flatLayout) statusFile(root, name string) string {
+	return filepath.Join(root, name+".json")
+}
+
+func (flatLayout) historyFile(root, name string) string {
+	return filepath.Join(root, name+".history.json")
+}
+
+func (flatLayout) sharesDirectory(name string) bool {
+	return false
+}
+
+type maildirPlusPlusLayout struct{}
+
+func (maildirPlusPlusLayout) delimiter() string {
+	return "."
+}
+
+func (maildirPlusPlusLayout) dir(root, name string) (string, error) {
+	if strings.EqualFold(name, inbox) {
+		return root, nil
+	}
+	if name == "" || strings.Contains(name, "/") {
+		return "", fmt.Errorf("invalid mailbox name %q", name)
+	}
+	encoded, err := encodeName(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, "."+encoded), nil
+}
+
+func (maildirPlusPlusLayout) list(root string) ([]string, error) {
+	files, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files)+1)
+	if isMaildir(root) {
+		names = append(names, inbox)
+	}
+	for _, file := range files {
+		if !file.IsDir() || !strings.HasPrefix(file.Name(), ".") || !isMaildir(filepath.Join(root, file.Name())) {
+			continue
+		}
+		name, err := decodeName(strings.TrimPrefix(file.Name(), "."))
+		if err != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (maildirPlusPlusLayout) exists(dir string) bool {
+	return isMaildir(dir)
+}
+
+func (maildirPlusPlusLayout) subfolder(name string) bool {
+	return !strings.EqualFold(name, inbox)
+}
+
+func (l maildirPlusPlusLayout) statusFile(root, name string) string {
+	dir, _ := l.dir(root, name)
+	return filepath.Join(dir, statusDotFile)
+}
+
+func (l maildirPlusPlusLayout) historyFile(root, name string) string {
+	dir, _ := l.dir(root, name)
+	return filepath.Join(dir, historyDotFile)
+}
+
+func (maildirPlusPlusLayout) sharesDirectory(name string) bool {
+	return strings.EqualFold(name, inbox)
+}
+
+type fsLayout struct{}
+
+func (fsLayout) delimiter() string {
+	return "/"
+}
+
+func (fsLayout) dir(root, name string) (string, error) {
+	if strings.EqualFold(name, inbox) {
+		return root, nil
+	}
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		if part == "" || part == "." || part == ".." || strings.HasPrefix(part, ".") {
+			return "", fmt.Errorf("invalid mailbox name %q", name)
+		}
+		if isMaildirSubdir(part) {
+			return "", fmt.Errorf("mailbox name %q is reserved in a maildir", part)
+		}
+		encoded, err := encodeName(part)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = encoded
+	}
+	return filepath.Join(append([]string{root}, parts...)...), nil
+}
+
+func (fsLayout) list(root string) ([]string, error) {
+	names := make([]string, 0)
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if path == root {
+			if isMaildir(root) {
+				names = append(names, inbox)
+			}
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), ".") || isMaildirSubdir(entry.Name()) && isMaildir(filepath.Dir(path)) {
+			return filepath.SkipDir
+		}
+		if !isMaildir(path) {
+			return nil
+		}
+		relative, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name, err := decodeName(filepath.ToSlash(relative))
+		if err != nil {
+			return nil
+		}
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (fsLayout) exists(dir string) bool {
+	return isMaildir(dir)
+}
+
+func (fsLayout) subfolder(name string) bool {
+	return false
+}
+
+func (l fsLayout) statusFile(root, name string) string {
+	dir, _ := l.dir(root, name)
+	return filepath.Join(dir, statusDotFile)
+}
+
+func (l fsLayout) historyFile(root, name string) string {
+	dir, _ := l.dir(root, name)
+	return filepath.Join(dir, historyDotFile)
+}
+
+func (fsLayout) sharesDirectory(name string) bool {
+	// a mailbox can always contain other mailboxes
+	return true
+}
+
+// isMaildir returns true when the directory contains a "cur" subdirectory
+func isMaildir(dir string) bool {
+	stat, err := os.Stat(filepath.Join(dir, "cur"))
+	return err == nil && stat.IsDir()
+}
+
+func isMaildirSubdir(name string) bool {
+	for _, subdir := range maildirSubdirs {
+		if name == subdir {
+			return true
+		}
+	}
+	return false
+}
+
+// removeMaildir deletes the messages and metadata of a maildir which can also contain other mailboxes
+func removeMaildir(root, dir string, files ...string) error {
+	for _, subdir := range maildirSubdirs {
+		err := os.RemoveAll(filepath.Join(dir, subdir))
+		if err != nil {
+			return err
+		}
+	}
+	for _, file := range files {
+		err := os.Remove(file)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if dir != root {
+		// the directory is only removed when it doesn't contain other mailboxes
+		_ = os.Remove(dir)
+	}
+	return nil
+}
+
+// encodeName converts a mailbox name to modified UTF-7, like Dovecot does by default
+func encodeName(name string) (string, error) {
+	encoded, err := utf7.Encoding.NewEncoder().String(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid mailbox name %q: %w", name, err)
+	}
+	return encoded, nil
+}
+
+func decodeName(name string) (string, error) {
+	return utf7.Encoding.NewDecoder().String(name)
+}
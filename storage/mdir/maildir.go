@@ -10,19 +10,35 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"sort"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/creativeprojects/imap/lib"
+	"github.com/creativeprojects/imap/lock"
 	"github.com/creativeprojects/imap/mailbox"
 	"github.com/emersion/go-maildir"
 )
 
+// Delimiter of the flat and Maildir++ layouts
 const Delimiter = "."
 
+type Config struct {
+	Root        string
+	Layout      Layout
+	DebugLogger lib.Logger
+}
+
+// Maildir is safe for concurrent use, but the selected mailbox is shared between all the callers: use OpenMailbox instead
 type Maildir struct {
-	root     string
-	log      lib.Logger
-	selected string
+	root      string
+	layout    layout
+	log       lib.Logger
+	selection mailbox.Selection
+	// mutex serialises the changes to the metadata files (status, history, dovecot-uidlist...)
+	mutex sync.Mutex
 }
 
 func New(root string) (*Maildir, error) {
@@ -30,20 +46,33 @@ func New(root string) (*Maildir, error) {
 }
 
 func NewWithLogger(root string, logger lib.Logger) (*Maildir, error) {
+	return NewWithConfig(Config{
+		Root:        root,
+		DebugLogger: logger,
+	})
+}
+
+func NewWithConfig(cfg Config) (*Maildir, error) {
 	if runtime.GOOS == "windows" {
 		return nil, errors.New("maildir is not supported on Windows")
 	}
+	logger := cfg.DebugLogger
 	if logger == nil {
 		logger = &lib.NoLog{}
 	}
-	err := os.MkdirAll(root, 0700)
+	layout, err := newLayout(cfg.Layout)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(cfg.Root, 0700)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Maildir{
-		root: root,
-		log:  logger,
+		root:   cfg.Root,
+		layout: layout,
+		log:    logger,
 	}, nil
 }
 
@@ -51,12 +80,31 @@ func (m *Maildir) Close() error {
 	return nil
 }
 
+// LockAccount locks the lock file in the root directory, so no other process can write to the maildir at the same time
+func (m *Maildir) LockAccount(ctx context.Context, timeout time.Duration) (func() error, error) {
+	accountLock, err := lock.Acquire(ctx, filepath.Join(m.root, lockFile), timeout, m.log)
+	if err != nil {
+		return nil, err
+	}
+	return accountLock.Release, nil
+}
+
+// IsRetryable returns true when the file system was temporarily unavailable
+func (m *Maildir) IsRetryable(err error) bool {
+	return errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EBUSY)
+}
+
 func (m *Maildir) Root() string {
 	return m.root
 }
 
 // AccountID is an internal ID used to tag accounts in history
 func (s *Maildir) AccountID() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	metadata, _ := s.getMetadata()
 	if metadata == nil || metadata.AccountID == "" {
 		metadata = &AccountMetadata{
@@ -68,7 +116,7 @@ func (s *Maildir) AccountID() string {
 }
 
 func (s *Maildir) Delimiter() string {
-	return Delimiter
+	return s.layout.delimiter()
 }
 
 func (s *Maildir) SupportMessageID() bool {
@@ -80,96 +128,222 @@ func (s *Maildir) SupportMessageHash() bool {
 }
 
 // CreateMailbox doesn't return an error if the mailbox already exists
-func (m *Maildir) CreateMailbox(info mailbox.Info) error {
-	name := lib.VerifyDelimiter(info.Name, info.Delimiter, Delimiter)
-	dirName := filepath.Join(m.root, name)
-	if _, err := os.Stat(dirName); err == nil || errors.Is(err, fs.ErrExist) {
-		// mailbox already exists
-		return nil
+func (m *Maildir) CreateMailbox(ctx context.Context, info mailbox.Info) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	mbox := maildir.Dir(dirName)
-	err := mbox.Init()
+	name := lib.VerifyDelimiter(info.Name, info.Delimiter, m.Delimiter())
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mbox, err := m.maildir(name)
 	if err != nil {
 		return err
 	}
-	// default status on new mailbox
-	err = m.setMailboxStatus(name, mailbox.Status{
-		Name:        name,
-		UidValidity: lib.NewUID(),
-	})
+	if m.mailboxExists(name) {
+		// a maildir created by another program has no status yet
+		_, err = m.mailboxStatus(name, mbox)
+		return err
+	}
+	err = os.MkdirAll(string(mbox), 0700)
+	if err != nil {
+		return err
+	}
+	err = mbox.Init()
+	if err != nil {
+		return err
+	}
+	if m.layout.subfolder(name) {
+		err = os.WriteFile(filepath.Join(string(mbox), maildirFolderFile), nil, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = m.newMailboxStatus(name, mbox)
 	if err != nil {
 		return err
 	}
 	// and sets an empty history
-	return m.AddToHistory(info)
+	return m.addToHistory(name)
 }
 
-func (m *Maildir) ListMailbox() ([]mailbox.Info, error) {
-	list := make([]mailbox.Info, 0)
-	files, err := os.ReadDir(m.root)
+func (m *Maildir) ListMailbox(ctx context.Context) ([]mailbox.Info, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	names, err := m.layout.list(m.root)
 	if err != nil {
 		return nil, err
 	}
-	for _, file := range files {
-		if !file.IsDir() {
-			continue
+	list := make([]mailbox.Info, len(names))
+	for i, name := range names {
+		list[i] = mailbox.Info{
+			Delimiter: m.Delimiter(),
+			Name:      name,
 		}
-		list = append(list, mailbox.Info{
-			Delimiter: ".",
-			Name:      file.Name(),
-		})
 	}
 	return list, nil
 }
 
-func (m *Maildir) DeleteMailbox(info mailbox.Info) error {
-	name := lib.VerifyDelimiter(info.Name, info.Delimiter, Delimiter)
-	_ = os.Remove(m.statusFile(name))
-	_ = os.Remove(m.historyFile(name))
-	return os.RemoveAll(filepath.Join(m.root, name))
+func (m *Maildir) DeleteMailbox(ctx context.Context, info mailbox.Info) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	name := lib.VerifyDelimiter(info.Name, info.Delimiter, m.Delimiter())
+	dir, err := m.layout.dir(m.root, name)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.layout.sharesDirectory(name) {
+		return removeMaildir(m.root, dir,
+			m.statusFile(name),
+			m.statusFile(name)+lib.BackupSuffix,
+			m.historyFile(name),
+			m.historyFile(name)+lib.BackupSuffix,
+			filepath.Join(dir, uidListFile),
+			filepath.Join(dir, keywordsFile),
+			filepath.Join(dir, datesDotFile),
+		)
+	}
+	for _, file := range []string{m.statusFile(name), m.historyFile(name)} {
+		_ = os.Remove(file)
+		_ = os.Remove(file + lib.BackupSuffix)
+	}
+	return os.RemoveAll(dir)
 }
 
-func (m *Maildir) SelectMailbox(info mailbox.Info) (*mailbox.Status, error) {
+// OpenMailbox returns a handle on the mailbox, with its own status
+func (m *Maildir) OpenMailbox(ctx context.Context, info mailbox.Info) (mailbox.Handle, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	name := lib.VerifyDelimiter(info.Name, info.Delimiter, m.Delimiter())
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	if !m.mailboxExists(name) {
 		return nil, lib.ErrMailboxNotFound
 	}
-	m.selected = name
-	return m.getMailboxStatus(name)
+	mbox, err := m.maildir(name)
+	if err != nil {
+		return nil, err
+	}
+	status, err := m.mailboxStatus(name, mbox)
+	if err != nil {
+		return nil, err
+	}
+	list, err := loadUIDList(string(mbox))
+	if err != nil {
+		return nil, err
+	}
+	if list != nil && list.uidValidity != status.UidValidity {
+		// the UIDs are given by the dovecot-uidlist file
+		status.UidValidity = list.uidValidity
+		err = m.setMailboxStatus(name, *status)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &handle{
+		backend: m,
+		name:    name,
+		status:  *status,
+	}, nil
 }
 
-func (m *Maildir) PutMessage(info mailbox.Info, props mailbox.MessageProperties, body io.Reader) (mailbox.MessageID, error) {
-	name := lib.VerifyDelimiter(info.Name, info.Delimiter, Delimiter)
-	mbox := maildir.Dir(filepath.Join(m.root, name))
-	msg, copied, err := m.createFromStream(mbox, props.Flags, body)
+func (m *Maildir) SelectMailbox(ctx context.Context, info mailbox.Info) (*mailbox.Status, error) {
+	handle, err := m.OpenMailbox(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	return m.selection.Select(handle), nil
+}
+
+func (m *Maildir) PutMessage(ctx context.Context, info mailbox.Info, props mailbox.MessageProperties, body io.Reader) (mailbox.MessageID, error) {
+	name := lib.VerifyDelimiter(info.Name, info.Delimiter, m.Delimiter())
+	return m.putMessage(ctx, name, props, body)
+}
+
+func (m *Maildir) putMessage(ctx context.Context, name string, props mailbox.MessageProperties, body io.Reader) (mailbox.MessageID, error) {
+	mbox, err := m.maildir(name)
+	if err != nil {
+		return mailbox.EmptyMessageID, err
+	}
+	m.mutex.Lock()
+	// a maildir created by another program gets its status before the new message is counted
+	_, err = m.mailboxStatus(name, mbox)
+	if err != nil {
+		m.mutex.Unlock()
+		return mailbox.EmptyMessageID, err
+	}
+	maildirFlags, err := m.toMaildirFlags(mbox, props.Flags)
+	m.mutex.Unlock()
 	if err != nil {
 		return mailbox.EmptyMessageID, err
 	}
+	// the message body is copied without holding the lock
+	msg, copied, err := createFromStream(mbox, maildirFlags, lib.NewContextReader(ctx, body))
+	if err != nil {
+		if msg != nil {
+			// don't leave a partial message in the maildir
+			_ = os.Remove(msg.Filename())
+		}
+		return mailbox.EmptyMessageID, err
+	}
 	if props.Size > 0 && copied != int64(props.Size) {
 		// delete the message
 		filename := msg.Filename()
 		_ = os.Remove(filename)
 		return mailbox.EmptyMessageID, fmt.Errorf("message body size advertised as %d bytes but read %d bytes from buffer", props.Size, copied)
 	}
-	m.log.Printf("Message saved: mailbox=%q key=%q size=%d flags=%v date=%q", name, msg, copied, props.Flags, props.InternalDate)
-
 	filename := msg.Filename()
-	_ = os.Chtimes(filename, time.Now(), props.InternalDate)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
 	status, err := m.getMailboxStatus(name)
 	if err != nil {
+		_ = os.Remove(filename)
 		return mailbox.EmptyMessageID, err
 	}
+	var uid uint32
+	err = updateUIDList(string(mbox), status.UidValidity, func(list *uidList) error {
+		uid = list.assign(msg.Key())
+		return nil
+	})
+	if err != nil {
+		_ = os.Remove(filename)
+		return mailbox.EmptyMessageID, fmt.Errorf("cannot save UID of new message: %w", err)
+	}
+	m.log.Printf("Message saved: mailbox=%q key=%q uid=%d size=%d flags=%v date=%q", name, msg, uid, copied, props.Flags, props.InternalDate)
+
+	internalDate := props.InternalDate
+	if internalDate.IsZero() {
+		internalDate = time.Now()
+	}
+	err = appendDates(string(mbox), map[string]time.Time{msg.Key(): internalDate})
+	if err != nil {
+		m.log.Printf("Cannot save internal date of message %q: %v", msg, err)
+	}
+	// also used by Dovecot as the internal date
+	_ = os.Chtimes(filename, time.Now(), internalDate)
+
 	status.Messages++
 	err = m.setMailboxStatus(name, *status)
 	if err != nil {
 		return mailbox.EmptyMessageID, err
 	}
-	return mailbox.NewMessageIDFromString(msg.Key()), nil
+	return mailbox.NewMessageIDFromUint(uid), nil
 }
 
-func (m *Maildir) createFromStream(mbox maildir.Dir, flags []string, body io.Reader) (*maildir.Message, int64, error) {
-	msg, writer, err := mbox.Create(toFlags(flags))
+func createFromStream(mbox maildir.Dir, flags []maildir.Flag, body io.Reader) (*maildir.Message, int64, error) {
+	msg, writer, err := mbox.Create(flags)
 	if err != nil {
 		return msg, 0, err
 	}
@@ -182,79 +356,116 @@ func (m *Maildir) createFromStream(mbox maildir.Dir, flags []string, body io.Rea
 }
 
 func (m *Maildir) FetchMessages(ctx context.Context, since time.Time, messages chan *mailbox.Message) error {
+	return m.selection.Fetch(ctx, since, messages)
+}
+
+func (m *Maildir) fetchMessages(ctx context.Context, name string, since time.Time, messages chan *mailbox.Message) error {
 	defer close(messages)
 
-	if m.selected == "" {
-		return lib.ErrNotSelected
+	// the messages are sent without holding the lock: the receiver can call the backend in the meantime
+	content, err := m.loadMailbox(name)
+	if err != nil {
+		return err
 	}
 
 	// removes a day
 	since = lib.SafePadding(since)
 
-	name := m.selected
-	mbox := maildir.Dir(filepath.Join(m.root, name))
-	msgs, err := mbox.Messages()
+	for _, msg := range content.messages {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !since.IsZero() && content.dates[msg.Key()].Before(since) {
+			// skip this message
+			continue
+		}
+		message, err := content.message(msg)
+		if err != nil {
+			return err
+		}
+		messages <- message
+	}
+	return nil
+}
+
+func (m *Maildir) fetchUids(ctx context.Context, name string, uids []mailbox.MessageID, messages chan *mailbox.Message) error {
+	defer close(messages)
+
+	content, err := m.loadMailbox(name)
 	if err != nil {
 		return err
 	}
-
-	for _, msg := range msgs {
+	byUID := make(map[uint32]*maildir.Message, len(content.messages))
+	for _, msg := range content.messages {
+		byUID[content.uids[msg.Key()]] = msg
+	}
+	for _, uid := range uids {
 		if ctx.Err() != nil {
 			return ctx.Err()
 		}
-		flags := msg.Flags()
-		filename := msg.Filename()
-		info, err := os.Stat(filename)
-		if err != nil {
-			return fmt.Errorf("cannot stat %q: %w", filename, err)
-		}
-		if !since.IsZero() && info.ModTime().Before(since) {
-			// skip this message
+		msg, found := byUID[uid.AsUint()]
+		if !found {
 			continue
 		}
-		file, err := msg.Open()
+		message, err := content.message(msg)
 		if err != nil {
-			return fmt.Errorf("cannot open key %q: %w", msg, err)
-		}
-		messages <- &mailbox.Message{
-			MessageProperties: mailbox.MessageProperties{
-				Flags:        flagsToStrings(flags),
-				InternalDate: info.ModTime(),
-				Size:         uint32(info.Size()),
-			},
-			Uid:  mailbox.NewMessageIDFromString(msg.Key()),
-			Body: file,
+			return err
 		}
+		messages <- message
 	}
 	return nil
 }
 
+func (m *Maildir) uids(ctx context.Context, name string) ([]mailbox.MessageID, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	content, err := m.loadMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]uint32, 0, len(content.messages))
+	for _, msg := range content.messages {
+		list = append(list, content.uids[msg.Key()])
+	}
+	slices.Sort(list)
+	uids := make([]mailbox.MessageID, len(list))
+	for i, uid := range list {
+		uids[i] = mailbox.NewMessageIDFromUint(uid)
+	}
+	return uids, nil
+}
+
 // LatestDate returns the internal date of the latest message
 func (m *Maildir) LatestDate(ctx context.Context) (time.Time, error) {
+	return m.selection.LatestDate(ctx)
+}
+
+func (m *Maildir) latestDate(ctx context.Context, name string) (time.Time, error) {
 	latest := time.Time{}
 
-	if m.selected == "" {
-		return latest, lib.ErrNotSelected
-	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
-	mbox := maildir.Dir(filepath.Join(m.root, m.selected))
+	mbox, err := m.maildir(name)
+	if err != nil {
+		return latest, err
+	}
 	msgs, err := mbox.Messages()
 	if err != nil {
 		return latest, err
 	}
+	dates, err := m.internalDates(mbox, msgs)
+	if err != nil {
+		return latest, err
+	}
 
 	for _, msg := range msgs {
 		if ctx.Err() != nil {
 			return latest, ctx.Err()
 		}
-		filename := msg.Filename()
-		info, err := os.Stat(filename)
-		if err != nil {
-			// should we keep going after an error?
-			return latest, fmt.Errorf("cannot stat %q: %w", filename, err)
-		}
-		if latest.Before(info.ModTime()) {
-			latest = info.ModTime()
+		if date := dates[msg.Key()]; latest.Before(date) {
+			latest = date
 		}
 	}
 
@@ -262,13 +473,296 @@ func (m *Maildir) LatestDate(ctx context.Context) (time.Time, error) {
 }
 
 func (m *Maildir) UnselectMailbox() error {
-	m.selected = ""
-	return nil
+	return m.selection.Unselect()
 }
 
-func (m *Maildir) AddToHistory(info mailbox.Info, actions ...mailbox.HistoryAction) error {
-	name := lib.VerifyDelimiter(info.Name, info.Delimiter, Delimiter)
-	history, err := m.GetHistory(info)
+func (m *Maildir) SetMessageFlags(ctx context.Context, info mailbox.Info, uid mailbox.MessageID, flags []string) error {
+	name := lib.VerifyDelimiter(info.Name, info.Delimiter, m.Delimiter())
+	return m.setMessageFlags(ctx, name, uid, flags)
+}
+
+func (m *Maildir) setMessageFlags(ctx context.Context, name string, uid mailbox.MessageID, flags []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.mailboxExists(name) {
+		return lib.ErrMailboxNotFound
+	}
+	mbox, err := m.maildir(name)
+	if err != nil {
+		return err
+	}
+	msg, err := m.messageByUID(mbox, uid)
+	if err != nil {
+		return err
+	}
+	maildirFlags, err := m.toMaildirFlags(mbox, flags)
+	if err != nil {
+		return err
+	}
+	return msg.SetFlags(maildirFlags)
+}
+
+// toMaildirFlags converts the flags, saving the new custom keywords in the dovecot-keywords file of the maildir
+func (m *Maildir) toMaildirFlags(mbox maildir.Dir, flags []string) ([]maildir.Flag, error) {
+	keywords, err := loadKeywords(string(mbox))
+	if err != nil {
+		return nil, err
+	}
+	maildirFlags, dropped := toFlags(flags, keywords)
+	if len(dropped) > 0 {
+		m.log.Printf("No more than %d keywords can be saved in a maildir: dropping %v", maxKeywords, dropped)
+	}
+	err = keywords.save(string(mbox))
+	if err != nil {
+		return nil, fmt.Errorf("cannot save %s: %w", keywordsFile, err)
+	}
+	return maildirFlags, nil
+}
+
+func (m *Maildir) DeleteMessage(ctx context.Context, info mailbox.Info, uid mailbox.MessageID) error {
+	name := lib.VerifyDelimiter(info.Name, info.Delimiter, m.Delimiter())
+	return m.deleteMessage(ctx, name, uid)
+}
+
+func (m *Maildir) deleteMessage(ctx context.Context, name string, uid mailbox.MessageID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.mailboxExists(name) {
+		return lib.ErrMailboxNotFound
+	}
+	mbox, err := m.maildir(name)
+	if err != nil {
+		return err
+	}
+	msg, err := m.messageByUID(mbox, uid)
+	if err != nil {
+		return err
+	}
+	status, err := m.mailboxStatus(name, mbox)
+	if err != nil {
+		return err
+	}
+	err = msg.Remove()
+	if err != nil {
+		return err
+	}
+	if status.Messages > 0 {
+		status.Messages--
+	}
+	err = m.setMailboxStatus(name, *status)
+	if err != nil {
+		return err
+	}
+	return updateUIDList(string(mbox), status.UidValidity, func(list *uidList) error {
+		list.remove(msg.Key())
+		return nil
+	})
+}
+
+// messageByUID finds a message from its UID in the dovecot-uidlist file.
+// The key of the message is also accepted, as it was used as an ID before.
+func (m *Maildir) messageByUID(mbox maildir.Dir, uid mailbox.MessageID) (*maildir.Message, error) {
+	key := uid.AsString()
+	if uid.IsUint() {
+		list, err := loadUIDList(string(mbox))
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		if list != nil {
+			key, found = list.key(uid.AsUint())
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: UID %d", lib.ErrMessageNotFound, uid.AsUint())
+		}
+	}
+	msg, err := mbox.MessageByKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", lib.ErrMessageNotFound, err)
+	}
+	return msg, nil
+}
+
+// internalDates returns the internal date of each message key. The dates of the messages
+// added by another program are guessed and saved, and the deleted messages are removed from the file.
+func (m *Maildir) internalDates(mbox maildir.Dir, msgs []*maildir.Message) (map[string]time.Time, error) {
+	saved, err := loadDates(string(mbox))
+	if err != nil {
+		return nil, err
+	}
+	dates := make(map[string]time.Time, len(msgs))
+	guessed := make(map[string]time.Time)
+	for _, msg := range msgs {
+		if date, found := saved[msg.Key()]; found {
+			dates[msg.Key()] = date
+			continue
+		}
+		date, err := guessDate(msg)
+		if err != nil {
+			return nil, fmt.Errorf("cannot find internal date of %q: %w", msg.Filename(), err)
+		}
+		m.log.Printf("Internal date of message %q not found: using %s", msg, date)
+		dates[msg.Key()] = date
+		guessed[msg.Key()] = date
+	}
+	if len(saved)+len(guessed) > len(dates) {
+		// some messages were deleted
+		err = saveDates(string(mbox), dates)
+	} else {
+		err = appendDates(string(mbox), guessed)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot save internal dates: %w", err)
+	}
+	return dates, nil
+}
+
+// maildirContent is the list of messages of a maildir, sorted by UID
+type maildirContent struct {
+	messages []*maildir.Message
+	uids     map[string]uint32
+	dates    map[string]time.Time
+	keywords *keywords
+}
+
+// message opens the body of the message
+func (c *maildirContent) message(msg *maildir.Message) (*mailbox.Message, error) {
+	filename := msg.Filename()
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot stat %q: %w", filename, err)
+	}
+	file, err := msg.Open()
+	if err != nil {
+		return nil, fmt.Errorf("cannot open key %q: %w", msg, err)
+	}
+	return &mailbox.Message{
+		MessageProperties: mailbox.MessageProperties{
+			Flags:        flagsToStrings(msg.Flags(), c.keywords),
+			InternalDate: c.dates[msg.Key()],
+			Size:         uint32(info.Size()),
+		},
+		Uid:  mailbox.NewMessageIDFromUint(c.uids[msg.Key()]),
+		Body: file,
+	}, nil
+}
+
+// loadMailbox synchronises the UIDs and the internal dates of the mailbox and returns its messages
+func (m *Maildir) loadMailbox(name string) (*maildirContent, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mbox, err := m.maildir(name)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := mbox.Messages()
+	if err != nil {
+		return nil, err
+	}
+	uids, err := m.syncUIDs(name, mbox, msgs)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		return uids[msgs[i].Key()] < uids[msgs[j].Key()]
+	})
+	dates, err := m.internalDates(mbox, msgs)
+	if err != nil {
+		return nil, err
+	}
+	keywords, err := loadKeywords(string(mbox))
+	if err != nil {
+		return nil, err
+	}
+	return &maildirContent{
+		messages: msgs,
+		uids:     uids,
+		dates:    dates,
+		keywords: keywords,
+	}, nil
+}
+
+// MigratedIDs returns the UID of the messages of the mailbox from their key,
+// which older versions were using as the message ID
+func (m *Maildir) MigratedIDs(ctx context.Context, info mailbox.Info) (map[string]mailbox.MessageID, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	name := lib.VerifyDelimiter(info.Name, info.Delimiter, m.Delimiter())
+	if !m.mailboxExists(name) {
+		return nil, lib.ErrMailboxNotFound
+	}
+	content, err := m.loadMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]mailbox.MessageID, len(content.uids))
+	for key, uid := range content.uids {
+		ids[key] = mailbox.NewMessageIDFromUint(uid)
+	}
+	return ids, nil
+}
+
+// syncUIDs gives a UID to the messages found in the maildir, and returns the UID of each message key
+func (m *Maildir) syncUIDs(name string, mbox maildir.Dir, msgs []*maildir.Message) (map[string]uint32, error) {
+	keys := make([]string, len(msgs))
+	for i, msg := range msgs {
+		keys[i] = msg.Key()
+	}
+	uids := make(map[string]uint32, len(msgs))
+	// the file is only locked and written when some messages were added or removed
+	list, err := loadUIDList(string(mbox))
+	if err != nil {
+		return nil, fmt.Errorf("cannot load %s: %w", uidListFile, err)
+	}
+	if list != nil && list.synced(keys) {
+		for _, key := range keys {
+			uids[key], _ = list.uid(key)
+		}
+		return uids, nil
+	}
+	uidValidity := lib.NewUID()
+	if status, err := m.getMailboxStatus(name); err == nil {
+		uidValidity = status.UidValidity
+	}
+	err = updateUIDList(string(mbox), uidValidity, func(list *uidList) error {
+		list.sync(keys)
+		for _, key := range keys {
+			uids[key], _ = list.uid(key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot update %s: %w", uidListFile, err)
+	}
+	return uids, nil
+}
+
+func (m *Maildir) AddToHistory(ctx context.Context, info mailbox.Info, actions ...mailbox.HistoryAction) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	name := lib.VerifyDelimiter(info.Name, info.Delimiter, m.Delimiter())
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.addToHistory(name, actions...)
+}
+
+func (m *Maildir) addToHistory(name string, actions ...mailbox.HistoryAction) error {
+	history, err := m.getHistory(name)
 	if err != nil {
 		// just create a new file instead of failing
 		history = &mailbox.History{
@@ -280,8 +774,35 @@ func (m *Maildir) AddToHistory(info mailbox.Info, actions ...mailbox.HistoryActi
 	return mailbox.SaveHistoryToFile(m.historyFile(name), history)
 }
 
-func (m *Maildir) GetHistory(info mailbox.Info) (*mailbox.History, error) {
-	name := lib.VerifyDelimiter(info.Name, info.Delimiter, Delimiter)
+// ReplaceHistory rewrites the history file of the mailbox
+func (m *Maildir) ReplaceHistory(ctx context.Context, info mailbox.Info, history *mailbox.History) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	name := lib.VerifyDelimiter(info.Name, info.Delimiter, m.Delimiter())
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.mailboxExists(name) {
+		return lib.ErrMailboxNotFound
+	}
+	return mailbox.SaveHistoryToFile(m.historyFile(name), history)
+}
+
+func (m *Maildir) GetHistory(ctx context.Context, info mailbox.Info) (*mailbox.History, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	name := lib.VerifyDelimiter(info.Name, info.Delimiter, m.Delimiter())
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.getHistory(name)
+}
+
+func (m *Maildir) getHistory(name string) (*mailbox.History, error) {
 	if !m.mailboxExists(name) {
 		return nil, lib.ErrMailboxNotFound
 	}
@@ -289,11 +810,19 @@ func (m *Maildir) GetHistory(info mailbox.Info) (*mailbox.History, error) {
 }
 
 func (m *Maildir) mailboxExists(name string) bool {
-	stat, err := os.Stat(filepath.Join(m.root, name))
-	if errors.Is(err, os.ErrNotExist) {
+	dir, err := m.layout.dir(m.root, name)
+	if err != nil {
 		return false
 	}
-	return stat.IsDir()
+	return m.layout.exists(dir)
+}
+
+func (m *Maildir) maildir(name string) (maildir.Dir, error) {
+	dir, err := m.layout.dir(m.root, name)
+	if err != nil {
+		return "", err
+	}
+	return maildir.Dir(dir), nil
 }
 
 func (m *Maildir) metadataFile() string {
@@ -301,75 +830,98 @@ func (m *Maildir) metadataFile() string {
 }
 
 func (m *Maildir) statusFile(name string) string {
-	return filepath.Join(m.root, name+".json")
+	return m.layout.statusFile(m.root, name)
 }
 
 func (m *Maildir) historyFile(name string) string {
-	return filepath.Join(m.root, name+".history.json")
+	return m.layout.historyFile(m.root, name)
 }
 
 func (m *Maildir) setMailboxStatus(name string, status mailbox.Status) error {
-	file, err := os.Create(m.statusFile(name))
-	if err != nil {
-		return err
-	}
-	defer file.Close()
+	return lib.WriteFileWithBackup(m.statusFile(name), 0600, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(status)
+	})
+}
 
-	encoder := json.NewEncoder(file)
-	err = encoder.Encode(status)
-	if err != nil {
-		return err
+// mailboxStatus returns the status of the mailbox. The status is created when the maildir was made by another program (like Dovecot).
+// The lock must be held by the caller.
+func (m *Maildir) mailboxStatus(name string, mbox maildir.Dir) (*mailbox.Status, error) {
+	status, err := m.getMailboxStatus(name)
+	if err == nil {
+		return status, nil
 	}
-
-	return nil
+	if !m.mailboxExists(name) {
+		return nil, lib.ErrMailboxNotFound
+	}
+	for _, file := range []string{m.statusFile(name), m.statusFile(name) + lib.BackupSuffix} {
+		if _, statErr := os.Stat(file); !errors.Is(statErr, fs.ErrNotExist) {
+			// the status file is there but cannot be read
+			return nil, err
+		}
+	}
+	return m.newMailboxStatus(name, mbox)
 }
 
-func (m *Maildir) getMailboxStatus(name string) (*mailbox.Status, error) {
-	file, err := os.Open(m.statusFile(name))
+// newMailboxStatus saves the status of a maildir which has none, keeping the UID validity of its dovecot-uidlist file.
+// The lock must be held by the caller.
+func (m *Maildir) newMailboxStatus(name string, mbox maildir.Dir) (*mailbox.Status, error) {
+	list, err := loadUIDList(string(mbox))
 	if err != nil {
-		return nil, fmt.Errorf("%w: %s", lib.ErrStatusNotFound, err)
+		return nil, fmt.Errorf("cannot load %s: %w", uidListFile, err)
+	}
+	uidValidity := lib.NewUID()
+	if list != nil {
+		uidValidity = list.uidValidity
+	} else {
+		err = updateUIDList(string(mbox), uidValidity, func(list *uidList) error {
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot create %s: %w", uidListFile, err)
+		}
 	}
-	defer file.Close()
-
-	status := &mailbox.Status{}
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(status)
+	msgs, err := mbox.Messages()
 	if err != nil {
-		return nil, fmt.Errorf("%w: %s", lib.ErrStatusNotFound, err)
+		return nil, err
 	}
-
-	return status, nil
-}
-
-func (m *Maildir) setMetadata(metadata *AccountMetadata) error {
-	file, err := os.Create(m.metadataFile())
-	if err != nil {
-		return err
+	status := mailbox.Status{
+		Name:        name,
+		UidValidity: uidValidity,
+		Messages:    uint32(len(msgs)),
 	}
-	defer file.Close()
-
-	encoder := json.NewEncoder(file)
-	err = encoder.Encode(metadata)
+	err = m.setMailboxStatus(name, status)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	return nil
+	return &status, nil
 }
 
-func (m *Maildir) getMetadata() (*AccountMetadata, error) {
-	file, err := os.Open(m.metadataFile())
+func (m *Maildir) getMailboxStatus(name string) (*mailbox.Status, error) {
+	var status *mailbox.Status
+	err := lib.ReadFileWithBackup(m.statusFile(name), func(r io.Reader) error {
+		status = &mailbox.Status{}
+		return json.NewDecoder(r).Decode(status)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("%w: %s", lib.ErrStatusNotFound, err)
 	}
-	defer file.Close()
+	return status, nil
+}
 
-	metadata := &AccountMetadata{}
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(metadata)
+func (m *Maildir) setMetadata(metadata *AccountMetadata) error {
+	return lib.WriteFileWithBackup(m.metadataFile(), 0600, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(metadata)
+	})
+}
+
+func (m *Maildir) getMetadata() (*AccountMetadata, error) {
+	var metadata *AccountMetadata
+	err := lib.ReadFileWithBackup(m.metadataFile(), func(r io.Reader) error {
+		metadata = &AccountMetadata{}
+		return json.NewDecoder(r).Decode(metadata)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("%w: %s", lib.ErrStatusNotFound, err)
 	}
-
 	return metadata, nil
 }
@@ -1,14 +1,114 @@
 package mdir
 
 import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
 	"runtime"
 	"testing"
 
+	"github.com/creativeprojects/imap/lib"
+	"github.com/creativeprojects/imap/lock"
+	"github.com/creativeprojects/imap/mailbox"
 	"github.com/creativeprojects/imap/storage/test"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestMaildirBackend(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("maildir is not supported on Windows")
+		return
+	}
+	for _, layout := range []Layout{LayoutFlat, LayoutMaildirPlusPlus, LayoutFS} {
+		t.Run(string(layout), func(t *testing.T) {
+			root := t.TempDir()
+			backend, err := NewWithConfig(Config{Root: root, Layout: layout})
+			require.NoError(t, err)
+
+			defer backend.Close()
+
+			err = test.PrepareBackend(backend)
+			require.NoError(t, err)
+
+			test.RunTestsOnBackend(t, backend)
+		})
+	}
+}
+
+func TestUnknownLayout(t *testing.T) {
+	_, err := NewWithConfig(Config{Root: t.TempDir(), Layout: "mbox"})
+	assert.Error(t, err)
+}
+
+func TestLayoutOnDisk(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("maildir is not supported on Windows")
+		return
+	}
+	fixtures := []struct {
+		layout   Layout
+		expected []string
+		absent   []string
+	}{
+		{
+			layout: LayoutMaildirPlusPlus,
+			expected: []string{
+				"cur", "new", "tmp", statusDotFile, historyDotFile,
+				".Sub.Folder/cur", ".Sub.Folder/" + statusDotFile, ".Sub.Folder/" + historyDotFile,
+				".Sub.Folder/" + maildirFolderFile, ".Envoy&AOk-s/cur", ".Envoy&AOk-s/" + maildirFolderFile,
+			},
+			absent: []string{"INBOX", "Sub", "INBOX.json", "Sub.Folder.json", maildirFolderFile},
+		},
+		{
+			layout: LayoutFS,
+			expected: []string{
+				"cur", "new", "tmp", statusDotFile, historyDotFile,
+				"Sub/Folder/cur", "Sub/Folder/" + statusDotFile, "Sub/Folder/" + historyDotFile,
+				"Envoy&AOk-s/cur",
+			},
+			absent: []string{"INBOX", "Sub/cur", ".Sub.Folder", "Sub/Folder/" + maildirFolderFile},
+		},
+	}
+
+	for _, fixture := range fixtures {
+		t.Run(string(fixture.layout), func(t *testing.T) {
+			root := t.TempDir()
+			backend, err := NewWithConfig(Config{Root: root, Layout: fixture.layout})
+			require.NoError(t, err)
+
+			for _, name := range []string{"INBOX", "Sub.Folder", "Envoyés"} {
+				require.NoError(t, backend.CreateMailbox(context.Background(), mailbox.Info{Delimiter: ".", Name: name}))
+			}
+			for _, path := range fixture.expected {
+				_, err = os.Stat(filepath.Join(root, path))
+				assert.NoError(t, err)
+			}
+			for _, path := range fixture.absent {
+				_, err = os.Stat(filepath.Join(root, path))
+				assert.ErrorIs(t, err, fs.ErrNotExist, path)
+			}
+
+			list, err := backend.ListMailbox(context.Background())
+			require.NoError(t, err)
+			names := make([]string, len(list))
+			for i, info := range list {
+				names[i] = lib.VerifyDelimiter(info.Name, info.Delimiter, ".")
+			}
+			assert.ElementsMatch(t, []string{"INBOX", "Sub.Folder", "Envoyés"}, names)
+
+			// deleting INBOX keeps the other mailboxes
+			require.NoError(t, backend.DeleteMailbox(context.Background(), mailbox.Info{Delimiter: ".", Name: "INBOX"}))
+			list, err = backend.ListMailbox(context.Background())
+			require.NoError(t, err)
+			assert.Len(t, list, 2)
+			assert.DirExists(t, root)
+		})
+	}
+}
+
+func TestFlatLayoutDirectoryWithoutMaildir(t *testing.T) {
 	if runtime.GOOS == "windows" {
 		t.Skip("maildir is not supported on Windows")
 		return
@@ -16,11 +116,63 @@ func TestMaildirBackend(t *testing.T) {
 	root := t.TempDir()
 	backend, err := New(root)
 	require.NoError(t, err)
+	require.NoError(t, os.Mkdir(filepath.Join(root, "Archive"), 0700))
+
+	// older versions listed all the directories as mailboxes
+	list, err := backend.ListMailbox(t.Context())
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, "Archive", list[0].Name)
+	assert.True(t, backend.mailboxExists("Archive"))
+}
 
-	defer backend.Close()
+func TestLockAccount(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("maildir is not supported on Windows")
+		return
+	}
+	root := t.TempDir()
+	first, err := NewWithConfig(Config{Root: root, Layout: LayoutMaildirPlusPlus})
+	require.NoError(t, err)
+	second, err := NewWithConfig(Config{Root: root, Layout: LayoutMaildirPlusPlus})
+	require.NoError(t, err)
+
+	release, err := first.LockAccount(t.Context(), 0)
+	require.NoError(t, err)
+
+	_, err = second.LockAccount(t.Context(), 0)
+	assert.ErrorIs(t, err, lock.ErrLocked)
 
-	err = test.PrepareBackend(backend)
+	require.NoError(t, release())
+	release, err = second.LockAccount(t.Context(), 0)
 	require.NoError(t, err)
+	require.NoError(t, release())
 
-	test.RunTestsOnBackend(t, backend)
+	// the lock file is not a mailbox
+	mailboxes, err := first.ListMailbox(t.Context())
+	require.NoError(t, err)
+	for _, mbox := range mailboxes {
+		assert.NotContains(t, mbox.Name, "lock")
+	}
+}
+
+func TestReadAccountID(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("maildir is not supported on Windows")
+		return
+	}
+	root := filepath.Join(t.TempDir(), "maildir")
+	_, err := ReadAccountID(root)
+	assert.Error(t, err)
+	assert.NoDirExists(t, root)
+
+	backend, err := New(root)
+	require.NoError(t, err)
+	_, err = ReadAccountID(root)
+	assert.ErrorIs(t, err, lib.ErrStatusNotFound)
+
+	accountID := backend.AccountID()
+	id, err := ReadAccountID(root)
+	require.NoError(t, err)
+	assert.Equal(t, accountID, id)
 }
@@ -0,0 +1,385 @@
+package mdir
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// uidListFile is the Dovecot file keeping the UID of each message of a maildir
+	uidListFile = "dovecot-uidlist"
+	// the lock file is also the new version of the file being written, like Dovecot does
+	uidListLockFile    = uidListFile + ".lock"
+	uidListVersion     = 3
+	uidListLockTimeout = 10 * time.Second
+	// a lock older than this is left over by a crashed process
+	uidListStaleLock = 2 * time.Minute
+)
+
+var ErrUIDListLocked = errors.New("dovecot-uidlist is locked by another process")
+
+type uidRecord struct {
+	uid uint32
+	key string
+	// extensions are kept as they are (Dovecot saves the size of the message or its GUID)
+	extensions []string
+}
+
+// uidList is the content of a dovecot-uidlist file (version 3)
+type uidList struct {
+	uidValidity uint32
+	nextUID     uint32
+	// other header fields are kept as they are
+	headers []string
+	records []uidRecord
+	// index of the records by key and by UID
+	byKey   map[string]int
+	byUID   map[uint32]int
+	changed bool
+}
+
+func newUIDList(uidValidity uint32) *uidList {
+	return &uidList{
+		uidValidity: uidValidity,
+		nextUID:     1,
+		headers:     []string{"G" + newGUID()},
+		records:     make([]uidRecord, 0),
+		byKey:       make(map[string]int),
+		byUID:       make(map[uint32]int),
+		changed:     true,
+	}
+}
+
+// loadUIDList reads the dovecot-uidlist file of a maildir. It returns nil when the file doesn't exist.
+func loadUIDList(dir string) (*uidList, error) {
+	file, err := os.Open(filepath.Join(dir, uidListFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	list := &uidList{
+		headers: make([]string, 0),
+		records: make([]uidRecord, 0),
+		byKey:   make(map[string]int),
+		byUID:   make(map[uint32]int),
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("%s: missing header: %w", uidListFile, scanner.Err())
+	}
+	version, err := list.parseHeader(scanner.Text())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", uidListFile, err)
+	}
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		record, err := parseUIDRecord(line, version)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", uidListFile, err)
+		}
+		list.add(record)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", uidListFile, err)
+	}
+	return list, nil
+}
+
+func (l *uidList) parseHeader(line string) (int, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return 0, errors.New("empty header")
+	}
+	version, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid version %q", fields[0])
+	}
+	switch version {
+	case 1:
+		// version 1 header is "1 <uidvalidity> <nextuid>"
+		if len(fields) < 3 {
+			return 0, fmt.Errorf("invalid header %q", line)
+		}
+		l.uidValidity = parseUint32(fields[1])
+		l.nextUID = parseUint32(fields[2])
+	case uidListVersion:
+		for _, field := range fields[1:] {
+			switch field[0] {
+			case 'V':
+				l.uidValidity = parseUint32(field[1:])
+			case 'N':
+				l.nextUID = parseUint32(field[1:])
+			default:
+				l.headers = append(l.headers, field)
+			}
+		}
+	default:
+		return 0, fmt.Errorf("unsupported version %d", version)
+	}
+	if l.uidValidity == 0 {
+		return 0, fmt.Errorf("missing UID validity in header %q", line)
+	}
+	if l.nextUID == 0 {
+		l.nextUID = 1
+	}
+	return version, nil
+}
+
+// parseUIDRecord reads a line "<uid> [<extensions>] :<key>" (or "<uid> <key>" in version 1)
+func parseUIDRecord(line string, version int) (uidRecord, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return uidRecord{}, fmt.Errorf("invalid line %q", line)
+	}
+	uid, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil || uid == 0 {
+		return uidRecord{}, fmt.Errorf("invalid UID in line %q", line)
+	}
+	record := uidRecord{
+		uid:        uint32(uid),
+		extensions: make([]string, 0),
+	}
+	if version == 1 {
+		record.key = fields[1]
+		return record, nil
+	}
+	for i, field := range fields[1:] {
+		if strings.HasPrefix(field, ":") {
+			// the filename cannot contain spaces but we keep the rest of the line anyway
+			record.key = strings.TrimPrefix(strings.Join(fields[i+1:], " "), ":")
+			break
+		}
+		record.extensions = append(record.extensions, field)
+	}
+	if record.key == "" {
+		return uidRecord{}, fmt.Errorf("missing filename in line %q", line)
+	}
+	return record, nil
+}
+
+func (l *uidList) add(record uidRecord) {
+	if index, found := l.byKey[record.key]; found {
+		delete(l.byUID, l.records[index].uid)
+		l.records[index] = record
+		l.byUID[record.uid] = index
+	} else {
+		l.byKey[record.key] = len(l.records)
+		l.byUID[record.uid] = len(l.records)
+		l.records = append(l.records, record)
+	}
+	if record.uid >= l.nextUID {
+		l.nextUID = record.uid + 1
+	}
+}
+
+// uid returns the UID of a message from its key
+func (l *uidList) uid(key string) (uint32, bool) {
+	index, found := l.byKey[key]
+	if !found {
+		return 0, false
+	}
+	return l.records[index].uid, true
+}
+
+// key returns the key of a message from its UID
+func (l *uidList) key(uid uint32) (string, bool) {
+	index, found := l.byUID[uid]
+	if !found {
+		return "", false
+	}
+	return l.records[index].key, true
+}
+
+// assign returns the UID of the message, giving it the next UID if it doesn't have one yet
+func (l *uidList) assign(key string) uint32 {
+	if uid, found := l.uid(key); found {
+		return uid
+	}
+	uid := l.nextUID
+	l.add(uidRecord{
+		uid:        uid,
+		key:        key,
+		extensions: make([]string, 0),
+	})
+	l.changed = true
+	return uid
+}
+
+// remove deletes the UID of a message which doesn't exist anymore
+func (l *uidList) remove(key string) {
+	index, found := l.byKey[key]
+	if !found {
+		return
+	}
+	l.records = append(l.records[:index], l.records[index+1:]...)
+	l.reindex()
+	l.changed = true
+}
+
+func (l *uidList) reindex() {
+	l.byKey = make(map[string]int, len(l.records))
+	l.byUID = make(map[uint32]int, len(l.records))
+	for i, record := range l.records {
+		l.byKey[record.key] = i
+		l.byUID[record.uid] = i
+	}
+}
+
+// synced returns true when the list has the UID of all the messages of the maildir, and nothing else
+func (l *uidList) synced(keys []string) bool {
+	if len(keys) != len(l.records) {
+		return false
+	}
+	for _, key := range keys {
+		if _, found := l.byKey[key]; !found {
+			return false
+		}
+	}
+	return true
+}
+
+// sync gives a UID to the new messages (in order of their keys, which start with the delivery time)
+// and removes the messages which are no longer in the maildir
+func (l *uidList) sync(keys []string) {
+	existing := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		existing[key] = true
+	}
+	records := make([]uidRecord, 0, len(l.records))
+	for _, record := range l.records {
+		if existing[record.key] {
+			records = append(records, record)
+		}
+	}
+	if len(records) < len(l.records) {
+		l.records = records
+		l.reindex()
+		l.changed = true
+	}
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		l.assign(key)
+	}
+}
+
+func (l *uidList) String() string {
+	builder := &strings.Builder{}
+	fmt.Fprintf(builder, "%d V%d N%d", uidListVersion, l.uidValidity, l.nextUID)
+	for _, header := range l.headers {
+		builder.WriteString(" " + header)
+	}
+	builder.WriteString("\n")
+	records := append([]uidRecord(nil), l.records...)
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].uid < records[j].uid
+	})
+	for _, record := range records {
+		builder.WriteString(strconv.FormatUint(uint64(record.uid), 10))
+		for _, extension := range record.extensions {
+			builder.WriteString(" " + extension)
+		}
+		builder.WriteString(" :" + record.key + "\n")
+	}
+	return builder.String()
+}
+
+// updateUIDList locks the dovecot-uidlist file of the maildir, calls update with its content and saves it when it changed.
+// When the file doesn't exist, a new list is created with the UID validity.
+func updateUIDList(dir string, uidValidity uint32, update func(list *uidList) error) error {
+	lockFile := filepath.Join(dir, uidListLockFile)
+	lock, err := createLockFile(lockFile)
+	if err != nil {
+		return err
+	}
+	saved := false
+	defer func() {
+		if !saved {
+			_ = lock.Close()
+			_ = os.Remove(lockFile)
+		}
+	}()
+
+	list, err := loadUIDList(dir)
+	if err != nil {
+		return err
+	}
+	if list == nil {
+		list = newUIDList(uidValidity)
+	}
+	err = update(list)
+	if err != nil || !list.changed {
+		return err
+	}
+	_, err = lock.WriteString(list.String())
+	if err != nil {
+		return err
+	}
+	err = lock.Sync()
+	if err != nil {
+		return err
+	}
+	err = lock.Close()
+	if err != nil {
+		return err
+	}
+	// renaming the lock file also releases the lock
+	err = os.Rename(lockFile, filepath.Join(dir, uidListFile))
+	if err != nil {
+		return err
+	}
+	saved = true
+	list.changed = false
+	return nil
+}
+
+// createLockFile creates the lock file, waiting for another process to release it
+func createLockFile(filename string) (*os.File, error) {
+	deadline := time.Now().Add(uidListLockTimeout)
+	for {
+		file, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			return file, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		if stat, err := os.Stat(filename); err == nil && time.Since(stat.ModTime()) > uidListStaleLock {
+			_ = os.Remove(filename)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w: %s", ErrUIDListLocked, filename)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func parseUint32(value string) uint32 {
+	parsed, _ := strconv.ParseUint(value, 10, 32)
+	return uint32(parsed)
+}
+
+func newGUID() string {
+	guid := make([]byte, 16)
+	_, _ = rand.Read(guid)
+	return hex.EncodeToString(guid)
+}
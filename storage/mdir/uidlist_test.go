@@ -0,0 +1,205 @@
+package mdir
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/creativeprojects/imap/mailbox"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const dovecotUIDList = "3 V1650000000 N5 G4d6a3e1a8f2b0c9d1e2f3a4b5c6d7e8f\n" +
+	"1 :1650000001.M1P1.host,S=100,W=102\n" +
+	"3 G0123456789abcdef0123456789abcdef :1650000003.M3P3.host,S=300,W=303\n"
+
+func TestLoadDovecotUIDList(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, uidListFile), []byte(dovecotUIDList), 0600))
+
+	list, err := loadUIDList(dir)
+	require.NoError(t, err)
+	require.NotNil(t, list)
+	assert.Equal(t, uint32(1650000000), list.uidValidity)
+	assert.Equal(t, uint32(5), list.nextUID)
+
+	uid, found := list.uid("1650000003.M3P3.host,S=300,W=303")
+	assert.True(t, found)
+	assert.Equal(t, uint32(3), uid)
+
+	// the extensions and header fields are saved back
+	assert.Equal(t, dovecotUIDList, list.String())
+
+	key, found := list.key(3)
+	assert.True(t, found)
+	assert.Equal(t, "1650000003.M3P3.host,S=300,W=303", key)
+
+	// new messages are given the next UID, in the order of their keys
+	list.sync([]string{"1650000009.M9P9.host", "1650000003.M3P3.host,S=300,W=303", "1650000008.M8P8.host"})
+	assert.Equal(t, "3 V1650000000 N7 G4d6a3e1a8f2b0c9d1e2f3a4b5c6d7e8f\n"+
+		"3 G0123456789abcdef0123456789abcdef :1650000003.M3P3.host,S=300,W=303\n"+
+		"5 :1650000008.M8P8.host\n"+
+		"6 :1650000009.M9P9.host\n", list.String())
+	_, found = list.key(1)
+	assert.False(t, found)
+	key, _ = list.key(6)
+	assert.Equal(t, "1650000009.M9P9.host", key)
+}
+
+func TestInvalidUIDList(t *testing.T) {
+	for _, content := range []string{
+		"",
+		"2 V1 N1\n",
+		"3 N1\n",
+		"3 V1 N1\n1 no-filename\n",
+		"3 V1 N1\nfirst :key\n",
+	} {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, uidListFile), []byte(content), 0600))
+		_, err := loadUIDList(dir)
+		assert.Error(t, err, content)
+	}
+}
+
+func TestUIDListLock(t *testing.T) {
+	dir := t.TempDir()
+	lockFile := filepath.Join(dir, uidListLockFile)
+
+	// stale lock from a crashed process
+	require.NoError(t, os.WriteFile(lockFile, nil, 0600))
+	old := time.Now().Add(-uidListStaleLock - time.Minute)
+	require.NoError(t, os.Chtimes(lockFile, old, old))
+
+	err := updateUIDList(dir, 123, func(list *uidList) error {
+		list.assign("key")
+		return nil
+	})
+	require.NoError(t, err)
+	assert.NoFileExists(t, lockFile)
+
+	list, err := loadUIDList(dir)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(123), list.uidValidity)
+	uid, _ := list.uid("key")
+	assert.Equal(t, uint32(1), uid)
+}
+
+func TestStableUIDs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("maildir is not supported on Windows")
+		return
+	}
+	root := t.TempDir()
+	backend, err := New(root)
+	require.NoError(t, err)
+
+	info := mailbox.Info{Delimiter: ".", Name: "INBOX"}
+	require.NoError(t, backend.CreateMailbox(context.Background(), info))
+	for i := range 2 {
+		uid, err := backend.PutMessage(context.Background(), info, mailbox.MessageProperties{InternalDate: time.Now()}, bytes.NewBufferString("Subject: test\r\n\r\nbody\r\n"))
+		require.NoError(t, err)
+		assert.Equal(t, uint32(i+1), uid.AsUint())
+	}
+
+	// another client delivers a message
+	external := filepath.Join(root, "INBOX", "cur", "1000000000.M1P1.otherhost:2,S")
+	require.NoError(t, os.WriteFile(external, []byte("Subject: external\r\n\r\nbody\r\n"), 0600))
+	assert.Equal(t, []uint32{1, 2, 3}, fetchUIDs(t, backend, info))
+
+	require.NoError(t, backend.DeleteMessage(context.Background(), info, mailbox.NewMessageIDFromUint(1)))
+	assert.Equal(t, []uint32{2, 3}, fetchUIDs(t, backend, info))
+
+	// the UIDs are not reused
+	uid, err := backend.PutMessage(context.Background(), info, mailbox.MessageProperties{InternalDate: time.Now()}, bytes.NewBufferString("Subject: test\r\n\r\nbody\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(4), uid.AsUint())
+
+	// reading the mailbox again doesn't rewrite the files when nothing changed
+	files := []string{filepath.Join(root, "INBOX", uidListFile), filepath.Join(root, "INBOX", datesDotFile)}
+	before := make([]os.FileInfo, len(files))
+	for i, file := range files {
+		before[i], err = os.Stat(file)
+		require.NoError(t, err)
+	}
+	// nor lock the dovecot-uidlist file
+	lockFile := filepath.Join(root, "INBOX", uidListLockFile)
+	require.NoError(t, os.WriteFile(lockFile, nil, 0600))
+	assert.Equal(t, []uint32{2, 3, 4}, fetchUIDs(t, backend, info))
+	require.NoError(t, os.Remove(lockFile))
+	for i, file := range files {
+		after, err := os.Stat(file)
+		require.NoError(t, err)
+		assert.True(t, os.SameFile(before[i], after), file)
+		assert.Equal(t, before[i].Size(), after.Size(), file)
+	}
+
+	// the UID validity is the one from the dovecot-uidlist file
+	status, err := backend.SelectMailbox(context.Background(), info)
+	require.NoError(t, err)
+	list, err := loadUIDList(filepath.Join(root, "INBOX"))
+	require.NoError(t, err)
+	assert.Equal(t, list.uidValidity, status.UidValidity)
+}
+
+func fetchUIDs(t *testing.T, backend *Maildir, info mailbox.Info) []uint32 {
+	t.Helper()
+
+	uids := make([]uint32, 0)
+	for _, msg := range fetchMessages(t, backend, info) {
+		uids = append(uids, msg.Uid.AsUint())
+	}
+	return uids
+}
+
+func TestMaildirCreatedByDovecot(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("maildir is not supported on Windows")
+		return
+	}
+	root := t.TempDir()
+	// Dovecot owns INBOX (the root) and created the Sent folder, with one message
+	sent := filepath.Join(root, ".Sent")
+	for _, dir := range []string{root, sent} {
+		for _, sub := range []string{"cur", "new", "tmp"} {
+			require.NoError(t, os.MkdirAll(filepath.Join(dir, sub), 0700))
+		}
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(sent, "maildirfolder"), nil, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(sent, uidListFile), []byte("3 V1650000000 N2\n1 :1650000001.M1P1.host\n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(sent, "cur", "1650000001.M1P1.host:2,S"), []byte("Subject: sent\r\n\r\nbody\r\n"), 0600))
+
+	backend, err := NewWithConfig(Config{Root: root, Layout: LayoutMaildirPlusPlus})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	info := mailbox.Info{Delimiter: ".", Name: "Sent"}
+	// creating a mailbox which already exists keeps it as it is
+	require.NoError(t, backend.CreateMailbox(context.Background(), info))
+	handle, err := backend.OpenMailbox(context.Background(), info)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1650000000), handle.Status().UidValidity)
+	assert.Equal(t, uint32(1), handle.Status().Messages)
+	require.NoError(t, handle.Close())
+
+	uid, err := backend.PutMessage(context.Background(), info, mailbox.MessageProperties{InternalDate: time.Now()}, bytes.NewBufferString("Subject: test\r\n\r\nbody\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), uid.AsUint())
+	assert.Equal(t, []uint32{1, 2}, fetchUIDs(t, backend, info))
+
+	inbox := mailbox.Info{Delimiter: ".", Name: "INBOX"}
+	uid, err = backend.PutMessage(context.Background(), inbox, mailbox.MessageProperties{InternalDate: time.Now()}, bytes.NewBufferString("Subject: test\r\n\r\nbody\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), uid.AsUint())
+	status, err := backend.SelectMailbox(context.Background(), inbox)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), status.Messages)
+	list, err := loadUIDList(root)
+	require.NoError(t, err)
+	require.NotNil(t, list)
+	assert.Equal(t, list.uidValidity, status.UidValidity)
+}
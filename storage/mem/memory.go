@@ -6,8 +6,11 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"maps"
 	"runtime"
+	"slices"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/creativeprojects/imap/lib"
@@ -17,11 +20,21 @@ import (
 
 const Delimiter = "."
 
+type Config struct {
+	// Snapshot is a file saved by SaveToFile: the backend starts with its content
+	Snapshot    string
+	DebugLogger lib.Logger
+}
+
+// Backend keeps the mailboxes in memory. It's safe for concurrent use,
+// but the selected mailbox is shared between all the callers: use OpenMailbox instead.
 type Backend struct {
-	data     map[string]*memMailbox
-	log      lib.Logger
-	selected string
-	tag      string
+	selection mailbox.Selection
+	// mutex protects all the fields below
+	mutex sync.RWMutex
+	data  map[string]*memMailbox
+	log   lib.Logger
+	tag   string
 }
 
 func New() *Backend {
@@ -38,7 +51,25 @@ func NewWithLogger(logger lib.Logger) *Backend {
 	}
 }
 
+// NewWithConfig creates a memory backend, loading the snapshot file if any
+func NewWithConfig(cfg Config) (*Backend, error) {
+	backend := NewWithLogger(cfg.DebugLogger)
+	if cfg.Snapshot == "" {
+		return backend, nil
+	}
+	err := backend.LoadFromFile(cfg.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return backend, nil
+}
+
 func (m *Backend) Close() error {
+	_ = m.selection.Unselect()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	m.data = make(map[string]*memMailbox)
 	runtime.GC()
 	return nil
@@ -46,6 +77,9 @@ func (m *Backend) Close() error {
 
 // AccountID is an internal ID used to tag accounts in history
 func (m *Backend) AccountID() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	if m.tag == "" {
 		m.tag = lib.RandomTag("memory")
 	}
@@ -65,9 +99,15 @@ func (m *Backend) SupportMessageHash() bool {
 }
 
 // CreateMailbox doesn't return an error if the mailbox already exists
-func (m *Backend) CreateMailbox(info mailbox.Info) error {
+func (m *Backend) CreateMailbox(ctx context.Context, info mailbox.Info) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	name := lib.VerifyDelimiter(info.Name, info.Delimiter, Delimiter)
 
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	if _, ok := m.data[name]; ok {
 		// already exists
 		return nil
@@ -80,7 +120,14 @@ func (m *Backend) CreateMailbox(info mailbox.Info) error {
 	return nil
 }
 
-func (m *Backend) ListMailbox() ([]mailbox.Info, error) {
+func (m *Backend) ListMailbox(ctx context.Context) ([]mailbox.Info, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
 	list := make([]mailbox.Info, len(m.data))
 	index := 0
 	for name := range m.data {
@@ -93,34 +140,63 @@ func (m *Backend) ListMailbox() ([]mailbox.Info, error) {
 	return list, nil
 }
 
-func (m *Backend) DeleteMailbox(info mailbox.Info) error {
+func (m *Backend) DeleteMailbox(ctx context.Context, info mailbox.Info) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	name := lib.VerifyDelimiter(info.Name, info.Delimiter, Delimiter)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	delete(m.data, name)
 	return nil
 }
 
-func (m *Backend) SelectMailbox(info mailbox.Info) (*mailbox.Status, error) {
-	name := lib.VerifyDelimiter(info.Name, info.Delimiter, m.Delimiter())
+// OpenMailbox returns a handle on the mailbox, with its own status
+func (m *Backend) OpenMailbox(ctx context.Context, info mailbox.Info) (mailbox.Handle, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	name := lib.VerifyDelimiter(info.Name, info.Delimiter, Delimiter)
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
 	mbox, ok := m.data[name]
 	if !ok {
 		return nil, lib.ErrMailboxNotFound
 	}
-	m.selected = name
-	return &mailbox.Status{
-		Name:        name,
-		Messages:    uint32(len(mbox.messages)),
-		Unseen:      0,
-		UidValidity: mbox.uidValidity,
+	return &handle{
+		backend: m,
+		name:    name,
+		status: mailbox.Status{
+			Name:        name,
+			Messages:    uint32(len(mbox.messages)),
+			Unseen:      0,
+			UidValidity: mbox.uidValidity,
+		},
 	}, nil
 }
 
-func (m *Backend) PutMessage(info mailbox.Info, props mailbox.MessageProperties, body io.Reader) (mailbox.MessageID, error) {
+func (m *Backend) SelectMailbox(ctx context.Context, info mailbox.Info) (*mailbox.Status, error) {
+	handle, err := m.OpenMailbox(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	return m.selection.Select(handle), nil
+}
+
+func (m *Backend) PutMessage(ctx context.Context, info mailbox.Info, props mailbox.MessageProperties, body io.Reader) (mailbox.MessageID, error) {
 	name := lib.VerifyDelimiter(info.Name, info.Delimiter, Delimiter)
-	_, ok := m.data[name]
-	if !ok {
+	return m.putMessage(ctx, name, props, body)
+}
+
+func (m *Backend) putMessage(ctx context.Context, name string, props mailbox.MessageProperties, body io.Reader) (mailbox.MessageID, error) {
+	if !m.mailboxExists(name) {
 		return mailbox.EmptyMessageID, lib.ErrMailboxNotFound
 	}
-	limitReader := limitio.NewReader(body)
+	limitReader := limitio.NewReader(lib.NewContextReader(ctx, body))
 	limitReader.SetRateLimit(1024*1024, 1024) // limit 1MiB/s
 
 	hasher := sha256.New()
@@ -133,21 +209,37 @@ func (m *Backend) PutMessage(info mailbox.Info, props mailbox.MessageProperties,
 	if props.Size > 0 && read != int64(props.Size) {
 		return mailbox.EmptyMessageID, fmt.Errorf("message body size advertised as %d bytes but read %d bytes from buffer", props.Size, read)
 	}
-	uid := m.data[name].newMessage(buffer.Bytes(), props.Flags, props.InternalDate, hasher.Sum(nil))
+
+	// the message body is read before locking the backend
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mbox, ok := m.data[name]
+	if !ok {
+		// deleted in the meantime
+		return mailbox.EmptyMessageID, lib.ErrMailboxNotFound
+	}
+	uid := mbox.newMessage(buffer.Bytes(), props.Flags, props.InternalDate, hasher.Sum(nil))
 	return mailbox.NewMessageIDFromUint(uid), nil
 }
 
 func (m *Backend) FetchMessages(ctx context.Context, since time.Time, messages chan *mailbox.Message) error {
+	return m.selection.Fetch(ctx, since, messages)
+}
+
+func (m *Backend) fetchMessages(ctx context.Context, name string, since time.Time, messages chan *mailbox.Message) error {
 	defer close(messages)
 
-	if m.selected == "" {
-		return lib.ErrNotSelected
+	// the messages are sent without holding the lock: the receiver can call the backend in the meantime
+	list, err := m.messages(name)
+	if err != nil {
+		return err
 	}
 
 	// removes a day
 	since = lib.SafePadding(since)
 
-	for uid, msg := range m.data[m.selected].messages {
+	for uid, msg := range list {
 		if ctx.Err() != nil {
 			return ctx.Err()
 		}
@@ -155,33 +247,82 @@ func (m *Backend) FetchMessages(ctx context.Context, since time.Time, messages c
 			// skip this message
 			continue
 		}
-		limitReader := limitio.NewReader(bytes.NewReader(msg.content))
-		limitReader.SetRateLimit(1024*1024, 1024) // limit 1MiB/s
-
-		messages <- &mailbox.Message{
-			MessageProperties: mailbox.MessageProperties{
-				Flags:        msg.flags,
-				InternalDate: msg.date,
-				Size:         uint32(len(msg.content)),
-				Hash:         msg.hash,
-			},
-			Uid:  mailbox.NewMessageIDFromUint(uid),
-			Body: io.NopCloser(limitReader),
-		}
+		messages <- newMessage(uid, msg)
 	}
 
 	return nil
 }
 
+func (m *Backend) fetchUids(ctx context.Context, name string, uids []mailbox.MessageID, messages chan *mailbox.Message) error {
+	defer close(messages)
+
+	list, err := m.messages(name)
+	if err != nil {
+		return err
+	}
+	for _, uid := range uids {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		msg, found := list[uid.AsUint()]
+		if !found {
+			continue
+		}
+		messages <- newMessage(uid.AsUint(), msg)
+	}
+	return nil
+}
+
+func (m *Backend) uids(ctx context.Context, name string) ([]mailbox.MessageID, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	list, err := m.messages(name)
+	if err != nil {
+		return nil, err
+	}
+	keys := slices.Sorted(maps.Keys(list))
+	uids := make([]mailbox.MessageID, len(keys))
+	for i, uid := range keys {
+		uids[i] = mailbox.NewMessageIDFromUint(uid)
+	}
+	return uids, nil
+}
+
+func newMessage(uid uint32, msg memMessage) *mailbox.Message {
+	limitReader := limitio.NewReader(bytes.NewReader(msg.content))
+	limitReader.SetRateLimit(1024*1024, 1024) // limit 1MiB/s
+
+	return &mailbox.Message{
+		MessageProperties: mailbox.MessageProperties{
+			Flags:        msg.flags,
+			InternalDate: msg.date,
+			Size:         uint32(len(msg.content)),
+			Hash:         msg.hash,
+		},
+		Uid:  mailbox.NewMessageIDFromUint(uid),
+		Body: io.NopCloser(limitReader),
+	}
+}
+
 // LatestDate returns the internal date of the latest message
 func (m *Backend) LatestDate(ctx context.Context) (time.Time, error) {
-	latest := time.Time{}
+	return m.selection.LatestDate(ctx)
+}
 
-	if m.selected == "" {
-		return latest, lib.ErrNotSelected
+func (m *Backend) latestDate(ctx context.Context, name string) (time.Time, error) {
+	latest := time.Time{}
+	if err := ctx.Err(); err != nil {
+		return latest, err
 	}
 
-	mailbox := m.data[m.selected]
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	mailbox, ok := m.data[name]
+	if !ok {
+		return latest, lib.ErrMailboxNotFound
+	}
 	if len(mailbox.messages) == 0 {
 		return latest, nil
 	}
@@ -197,42 +338,152 @@ func (m *Backend) LatestDate(ctx context.Context) (time.Time, error) {
 }
 
 func (m *Backend) UnselectMailbox() error {
-	m.selected = ""
+	return m.selection.Unselect()
+}
+
+func (m *Backend) SetMessageFlags(ctx context.Context, info mailbox.Info, uid mailbox.MessageID, flags []string) error {
+	name := lib.VerifyDelimiter(info.Name, info.Delimiter, Delimiter)
+	return m.setMessageFlags(ctx, name, uid, flags)
+}
+
+func (m *Backend) setMessageFlags(ctx context.Context, name string, uid mailbox.MessageID, flags []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mbox, ok := m.data[name]
+	if !ok {
+		return lib.ErrMailboxNotFound
+	}
+	msg, ok := mbox.messages[uid.AsUint()]
+	if !ok {
+		return lib.ErrMessageNotFound
+	}
+	msg.flags = flags
 	return nil
 }
 
-func (m *Backend) AddToHistory(info mailbox.Info, actions ...mailbox.HistoryAction) error {
+func (m *Backend) DeleteMessage(ctx context.Context, info mailbox.Info, uid mailbox.MessageID) error {
 	name := lib.VerifyDelimiter(info.Name, info.Delimiter, Delimiter)
-	_, ok := m.data[name]
+	return m.deleteMessage(ctx, name, uid)
+}
+
+func (m *Backend) deleteMessage(ctx context.Context, name string, uid mailbox.MessageID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mbox, ok := m.data[name]
 	if !ok {
 		return lib.ErrMailboxNotFound
 	}
-	if m.data[name].history == nil {
-		m.data[name].history = make([]mailbox.HistoryAction, 0, len(actions))
+	if _, ok := mbox.messages[uid.AsUint()]; !ok {
+		return lib.ErrMessageNotFound
 	}
-	m.data[name].history = append(m.data[name].history, actions...)
+	delete(mbox.messages, uid.AsUint())
 	return nil
 }
 
-func (m *Backend) GetHistory(info mailbox.Info) (*mailbox.History, error) {
+func (m *Backend) AddToHistory(ctx context.Context, info mailbox.Info, actions ...mailbox.HistoryAction) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	name := lib.VerifyDelimiter(info.Name, info.Delimiter, Delimiter)
-	_, ok := m.data[name]
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mbox, ok := m.data[name]
+	if !ok {
+		return lib.ErrMailboxNotFound
+	}
+	if mbox.history == nil {
+		mbox.history = make([]mailbox.HistoryAction, 0, len(actions))
+	}
+	mbox.history = append(mbox.history, actions...)
+	return nil
+}
+
+// ReplaceHistory replaces all the actions in the history of the mailbox
+func (m *Backend) ReplaceHistory(ctx context.Context, info mailbox.Info, history *mailbox.History) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	name := lib.VerifyDelimiter(info.Name, info.Delimiter, Delimiter)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mbox, ok := m.data[name]
+	if !ok {
+		return lib.ErrMailboxNotFound
+	}
+	mbox.history = slices.Clone(history.Actions)
+	return nil
+}
+
+func (m *Backend) GetHistory(ctx context.Context, info mailbox.Info) (*mailbox.History, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	name := lib.VerifyDelimiter(info.Name, info.Delimiter, Delimiter)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mbox, ok := m.data[name]
 	if !ok {
 		return nil, lib.ErrMailboxNotFound
 	}
-	sort.SliceStable(m.data[name].history, func(i, j int) bool {
-		return m.data[name].history[i].Date.Before(m.data[name].history[j].Date)
+	sort.SliceStable(mbox.history, func(i, j int) bool {
+		return mbox.history[i].Date.Before(mbox.history[j].Date)
 	})
 
+	// the caller gets a copy it can change
+	actions := make([]mailbox.HistoryAction, len(mbox.history))
+	copy(actions, mbox.history)
 	return &mailbox.History{
-		Actions: m.data[name].history,
+		Actions: actions,
 	}, nil
 }
 
+func (m *Backend) mailboxExists(name string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	_, ok := m.data[name]
+	return ok
+}
+
+// messages returns a copy of the messages of the mailbox
+func (m *Backend) messages(name string) (map[uint32]memMessage, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	mbox, ok := m.data[name]
+	if !ok {
+		return nil, lib.ErrMailboxNotFound
+	}
+	list := make(map[uint32]memMessage, len(mbox.messages))
+	for uid, msg := range mbox.messages {
+		list[uid] = *msg
+	}
+	return list, nil
+}
+
 func (m *Backend) GenerateFakeEmails(info mailbox.Info, count uint32, minSize, maxSize int) {
-	_ = m.CreateMailbox(info)
+	_ = m.CreateMailbox(context.Background(), info)
 	name := lib.VerifyDelimiter(info.Name, info.Delimiter, Delimiter)
 
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	var i uint32
 	for i = 1; i <= count; i++ {
 		msg := lib.GenerateEmail("user1@example.com", "user2@example.com", i, minSize, maxSize)
@@ -0,0 +1,154 @@
+package mem
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/creativeprojects/imap/lib"
+	"github.com/creativeprojects/imap/mailbox"
+)
+
+// snapshotVersion is increased when the format of the snapshot changes
+const snapshotVersion = 1
+
+type snapshot struct {
+	Version   int
+	Tag       string
+	Mailboxes map[string]snapshotMailbox
+}
+
+type snapshotMailbox struct {
+	UidValidity uint32
+	CurrentUid  uint32
+	Messages    map[uint32]snapshotMessage
+	History     []mailbox.HistoryAction
+}
+
+type snapshotMessage struct {
+	Content []byte
+	Flags   []string
+	Date    time.Time
+	Hash    []byte
+}
+
+// Save writes a snapshot of all the mailboxes (messages, flags, dates, hashes and history)
+// and of the account ID. The snapshot can be loaded back with Load.
+func (m *Backend) Save(writer io.Writer) error {
+	tag := m.AccountID()
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	data := snapshot{
+		Version:   snapshotVersion,
+		Tag:       tag,
+		Mailboxes: make(map[string]snapshotMailbox, len(m.data)),
+	}
+	for name, mbox := range m.data {
+		messages := make(map[uint32]snapshotMessage, len(mbox.messages))
+		for uid, msg := range mbox.messages {
+			messages[uid] = snapshotMessage{
+				Content: msg.content,
+				Flags:   msg.flags,
+				Date:    msg.date,
+				Hash:    msg.hash,
+			}
+		}
+		data.Mailboxes[name] = snapshotMailbox{
+			UidValidity: mbox.uidValidity,
+			CurrentUid:  mbox.currentUid,
+			Messages:    messages,
+			History:     mbox.history,
+		}
+	}
+	err := gob.NewEncoder(writer).Encode(&data)
+	if err != nil {
+		return fmt.Errorf("cannot save snapshot: %w", err)
+	}
+	return nil
+}
+
+// Load replaces the content of the backend with a snapshot written by Save
+func (m *Backend) Load(reader io.Reader) error {
+	data := snapshot{}
+	err := gob.NewDecoder(reader).Decode(&data)
+	if err != nil {
+		return fmt.Errorf("cannot load snapshot: %w", err)
+	}
+	if data.Version > snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d (expected %d or lower)", data.Version, snapshotVersion)
+	}
+	mailboxes := make(map[string]*memMailbox, len(data.Mailboxes))
+	for name, mbox := range data.Mailboxes {
+		messages := make(map[uint32]*memMessage, len(mbox.Messages))
+		for uid, msg := range mbox.Messages {
+			messages[uid] = &memMessage{
+				content: msg.Content,
+				flags:   msg.Flags,
+				date:    msg.Date,
+				hash:    msg.Hash,
+			}
+		}
+		mailboxes[name] = &memMailbox{
+			uidValidity: mbox.UidValidity,
+			currentUid:  mbox.CurrentUid,
+			messages:    messages,
+			history:     mbox.History,
+		}
+	}
+
+	_ = m.selection.Unselect()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.data = mailboxes
+	m.tag = data.Tag
+	return nil
+}
+
+// SaveToFile writes a snapshot of the backend into the file
+func (m *Backend) SaveToFile(filename string) error {
+	err := lib.WriteFileAtomic(filename, 0600, m.Save)
+	if err != nil {
+		return fmt.Errorf("cannot save snapshot: %w", err)
+	}
+	return nil
+}
+
+// LoadFromFile replaces the content of the backend with the snapshot saved in the file
+func (m *Backend) LoadFromFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("cannot load snapshot: %w", err)
+	}
+	defer file.Close()
+
+	return m.Load(file)
+}
+
+// ReadAccountID returns the account ID saved in the snapshot file, without loading the snapshot into a backend
+func ReadAccountID(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// the other fields of the snapshot are skipped
+	data := struct {
+		Version int
+		Tag     string
+	}{}
+	err = gob.NewDecoder(file).Decode(&data)
+	if err != nil {
+		return "", fmt.Errorf("cannot load snapshot: %w", err)
+	}
+	if data.Tag == "" {
+		return "", lib.ErrNoAccountID
+	}
+	return data.Tag, nil
+}
@@ -0,0 +1,122 @@
+package mem
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/creativeprojects/imap/lib"
+	"github.com/creativeprojects/imap/mailbox"
+	"github.com/creativeprojects/imap/storage/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	backend := New()
+	defer backend.Close()
+
+	info := mailbox.Info{Delimiter: ".", Name: "INBOX"}
+	backend.GenerateFakeEmails(info, 10, 100, 1000)
+	require.NoError(t, backend.CreateMailbox(context.Background(), mailbox.Info{Delimiter: "/", Name: "Empty/Folder"}))
+	history := mailbox.HistoryAction{
+		SourceAccountTag: "source",
+		Date:             time.Date(2022, 2, 2, 10, 0, 0, 0, time.UTC),
+		Action:           mailbox.ActionCopy,
+		UidValidity:      123,
+		Entries: []mailbox.HistoryEntry{
+			{
+				SourceID:           mailbox.NewMessageIDFromString("key"),
+				SourceInternalDate: time.Date(2022, 2, 1, 10, 0, 0, 0, time.UTC),
+				MessageID:          mailbox.NewMessageIDFromUint(1),
+			},
+		},
+	}
+	require.NoError(t, backend.AddToHistory(context.Background(), info, history))
+
+	buffer := &bytes.Buffer{}
+	require.NoError(t, backend.Save(buffer))
+
+	loaded := New()
+	defer loaded.Close()
+	require.NoError(t, loaded.Load(buffer))
+
+	assert.Equal(t, backend.AccountID(), loaded.AccountID())
+	require.Len(t, loaded.data, len(backend.data))
+	for name, mbox := range backend.data {
+		loadedMailbox := loaded.data[name]
+		require.NotNil(t, loadedMailbox, name)
+		assert.Equal(t, mbox.uidValidity, loadedMailbox.uidValidity)
+		assert.Equal(t, mbox.currentUid, loadedMailbox.currentUid)
+		require.Len(t, loadedMailbox.messages, len(mbox.messages))
+		for uid, msg := range mbox.messages {
+			loadedMessage := loadedMailbox.messages[uid]
+			require.NotNil(t, loadedMessage, uid)
+			assert.Equal(t, msg.content, loadedMessage.content)
+			assert.ElementsMatch(t, msg.flags, loadedMessage.flags)
+			assert.True(t, msg.date.Equal(loadedMessage.date))
+			assert.Equal(t, msg.hash, loadedMessage.hash)
+		}
+	}
+
+	loadedHistory, err := loaded.GetHistory(context.Background(), info)
+	require.NoError(t, err)
+	assert.Equal(t, []mailbox.HistoryAction{history}, loadedHistory.Actions)
+
+	// new messages are not reusing the UIDs of the snapshot
+	uid, err := loaded.PutMessage(context.Background(), info, mailbox.MessageProperties{InternalDate: time.Now()}, bytes.NewBufferString("Subject: test\r\n\r\nbody\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(11), uid.AsUint())
+}
+
+func TestSnapshotFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "snapshot.bin")
+
+	backend := New()
+	defer backend.Close()
+	require.NoError(t, test.PrepareBackend(backend))
+	require.NoError(t, backend.SaveToFile(filename))
+
+	loaded, err := NewWithConfig(Config{Snapshot: filename})
+	require.NoError(t, err)
+	defer loaded.Close()
+
+	list, err := loaded.ListMailbox(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, list, len(backend.data))
+
+	test.RunTestsOnBackend(t, loaded)
+}
+
+func TestReadAccountIDFromSnapshot(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "snapshot.bin")
+	_, err := ReadAccountID(filename)
+	assert.Error(t, err)
+
+	backend := New()
+	defer backend.Close()
+	require.NoError(t, test.PrepareBackend(backend))
+	require.NoError(t, backend.SaveToFile(filename))
+
+	id, err := ReadAccountID(filename)
+	require.NoError(t, err)
+	assert.Equal(t, backend.AccountID(), id)
+}
+
+func TestSnapshotMissingFile(t *testing.T) {
+	_, err := NewWithConfig(Config{Snapshot: filepath.Join(t.TempDir(), "missing")})
+	assert.Error(t, err)
+}
+
+func TestSnapshotInvalid(t *testing.T) {
+	backend := New()
+	defer backend.Close()
+	require.NoError(t, backend.CreateMailbox(context.Background(), mailbox.Info{Delimiter: ".", Name: "INBOX"}))
+
+	assert.Error(t, backend.Load(bytes.NewBufferString("not a snapshot")))
+	// the backend is left untouched
+	_, err := backend.SelectMailbox(context.Background(), mailbox.Info{Delimiter: ".", Name: "INBOX"})
+	assert.NotErrorIs(t, err, lib.ErrMailboxNotFound)
+}
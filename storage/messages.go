@@ -10,13 +10,15 @@ import (
 	"github.com/creativeprojects/imap/mailbox"
 )
 
-func LoadMessageProperties(ctx context.Context, backend Backend, mbox mailbox.Info, pbar Progresser) ([]mailbox.Message, error) {
+// LoadMessageProperties returns the properties of all the messages of the mailbox, with their hash.
+// The handle is not closed.
+func LoadMessageProperties(ctx context.Context, handle MailboxHandle, pbar Progresser) ([]mailbox.Message, error) {
 	messages := make([]mailbox.Message, 0)
 
 	receiver := make(chan *mailbox.Message, 10)
 	done := make(chan error, 1)
 	go func() {
-		done <- backend.FetchMessages(ctx, time.Time{}, receiver)
+		done <- handle.Fetch(ctx, time.Time{}, receiver)
 	}()
 
 	for msg := range receiver {
@@ -38,7 +40,6 @@ func LoadMessageProperties(ctx context.Context, backend Backend, mbox mailbox.In
 	}
 	// wait until all the messages arrived
 	err := <-done
-	_ = backend.UnselectMailbox()
 	if err != nil {
 		return messages, fmt.Errorf("error loading messages: %w", err)
 	}
@@ -0,0 +1,599 @@
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/creativeprojects/imap/lib"
+	"github.com/creativeprojects/imap/mailbox"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+// HistoryStore is where the history of the mailboxes is saved
+type HistoryStore string
+
+const (
+	// HistoryLocal saves the history in files in the cache directory (default)
+	HistoryLocal HistoryStore = "local"
+	// HistoryServer saves the history on the server: in the METADATA of each mailbox when the server supports it,
+	// in the hidden history mailbox otherwise
+	HistoryServer HistoryStore = "server"
+	// HistoryMailbox saves the history as messages of the hidden history mailbox
+	HistoryMailbox HistoryStore = "mailbox"
+	// HistoryMetadata saves the history in the METADATA of each mailbox (RFC 5464)
+	HistoryMetadata HistoryStore = "metadata"
+)
+
+const (
+	// HistoryMailboxName is the mailbox keeping one message with the history of each mailbox.
+	// It's hidden from the list of mailboxes, so it's never copied.
+	HistoryMailboxName = "imap-history"
+	// historyHeader contains the name of the mailbox in the history messages
+	historyHeader = "X-Imap-History-Mailbox"
+	// historyEntry is the METADATA entry of a mailbox containing its history
+	historyEntry = "/private/vendor/creativeprojects-imap/history"
+)
+
+// historyStore loads and saves the history of the mailboxes.
+// The commands lock must NOT be held by the caller.
+type historyStore interface {
+	// load returns an empty history when the mailbox has none
+	load(ctx context.Context, name string) (*mailbox.History, error)
+	save(ctx context.Context, name string, history *mailbox.History) error
+	remove(ctx context.Context, name string) error
+}
+
+// newHistoryStore returns the store of this kind, and the kind of store picked for HistoryServer
+func (i *Imap) newHistoryStore(kind HistoryStore) (historyStore, HistoryStore, error) {
+	switch kind {
+	case "", HistoryLocal:
+		return &fileHistory{dir: filepath.Join(i.cacheDir, i.tag)}, HistoryLocal, nil
+	case HistoryServer:
+		if i.supportMetadata() {
+			return &metadataHistory{backend: i}, HistoryMetadata, nil
+		}
+		return &mailboxHistory{backend: i}, HistoryMailbox, nil
+	case HistoryMailbox:
+		return &mailboxHistory{backend: i}, HistoryMailbox, nil
+	case HistoryMetadata:
+		if !i.supportMetadata() {
+			return nil, "", fmt.Errorf("%w: the server doesn't support the METADATA extension", lib.ErrNotSupported)
+		}
+		return &metadataHistory{backend: i}, HistoryMetadata, nil
+	default:
+		return nil, "", fmt.Errorf("unknown history store %q", kind)
+	}
+}
+
+func (i *Imap) supportMetadata() bool {
+	i.commands.Lock()
+	defer i.commands.Unlock()
+
+	supported, err := i.client.Support("METADATA")
+	return err == nil && supported
+}
+
+// HistoryStore returns where the history is saved: HistoryLocal, HistoryMailbox or HistoryMetadata
+func (i *Imap) HistoryStore() HistoryStore {
+	return i.historyKind
+}
+
+func (i *Imap) AddToHistory(ctx context.Context, info mailbox.Info, actions ...mailbox.HistoryAction) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	i.history.Lock()
+	defer i.history.Unlock()
+
+	reconnected, err := i.reconnect(ctx)
+	if err != nil {
+		return err
+	}
+	if reconnected != nil {
+		defer reconnected.Close()
+		return reconnected.AddToHistory(ctx, info, actions...)
+	}
+	name := lib.VerifyDelimiter(info.Name, info.Delimiter, i.Delimiter())
+
+	history, err := i.loadHistory(ctx, name)
+	if err != nil {
+		if i.historyKind != HistoryLocal {
+			// the history on the server would be replaced
+			return fmt.Errorf("cannot load history: %w", err)
+		}
+		// just create a new file instead of failing
+		history = &mailbox.History{
+			Actions: make([]mailbox.HistoryAction, 0),
+		}
+	}
+	history.Actions = append(history.Actions, actions...)
+
+	return i.historyStore.save(ctx, name, history)
+}
+
+func (i *Imap) GetHistory(ctx context.Context, info mailbox.Info) (*mailbox.History, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	name := lib.VerifyDelimiter(info.Name, info.Delimiter, i.Delimiter())
+
+	i.history.RLock()
+	defer i.history.RUnlock()
+
+	return i.loadHistory(ctx, name)
+}
+
+// ReplaceHistory saves the history of the mailbox in the history store, replacing the previous one
+func (i *Imap) ReplaceHistory(ctx context.Context, info mailbox.Info, history *mailbox.History) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	i.history.Lock()
+	defer i.history.Unlock()
+
+	reconnected, err := i.reconnect(ctx)
+	if err != nil {
+		return err
+	}
+	if reconnected != nil {
+		defer reconnected.Close()
+		return reconnected.ReplaceHistory(ctx, info, history)
+	}
+	name := lib.VerifyDelimiter(info.Name, info.Delimiter, i.Delimiter())
+
+	return i.historyStore.save(ctx, name, history)
+}
+
+// reconnect opens a new connection to save the history on the server when the connection was closed
+// by a cancelled command: a copy which was interrupted still saves the messages copied.
+// It returns nil when the connection is still open, or when the history is saved locally.
+// The history lock must be held by the caller.
+func (i *Imap) reconnect(ctx context.Context) (*Imap, error) {
+	if i.historyKind == HistoryLocal {
+		return nil, nil
+	}
+	select {
+	case <-i.client.LoggedOut():
+	default:
+		return nil, nil
+	}
+	i.log.Print("Connection closed: opening a new connection to save the history")
+	cfg := i.config
+	cfg.HistoryStore = i.historyKind
+	backend, err := NewImapWithContext(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("cannot save history: %w", err)
+	}
+	return backend, nil
+}
+
+// loadHistory falls back to the local cache when the history is saved on the server but not migrated yet,
+// so changing the store doesn't start a full copy again
+func (i *Imap) loadHistory(ctx context.Context, name string) (*mailbox.History, error) {
+	history, err := i.historyStore.load(ctx, name)
+	if err != nil || len(history.Actions) > 0 || i.historyKind == HistoryLocal {
+		return history, err
+	}
+	local := &fileHistory{dir: filepath.Join(i.cacheDir, i.tag)}
+	cached, err := local.load(ctx, name)
+	if err != nil || len(cached.Actions) == 0 {
+		return history, nil
+	}
+	i.log.Printf("history of mailbox %q loaded from the local cache", name)
+	return cached, nil
+}
+
+// MigrateHistory moves the history of all the mailboxes from a store to the other.
+// The history already in the destination store is merged. It returns the number of mailboxes moved.
+func (i *Imap) MigrateHistory(ctx context.Context, from, to HistoryStore) (int, error) {
+	source, sourceKind, err := i.newHistoryStore(from)
+	if err != nil {
+		return 0, err
+	}
+	destination, destinationKind, err := i.newHistoryStore(to)
+	if err != nil {
+		return 0, err
+	}
+	if sourceKind == destinationKind {
+		return 0, fmt.Errorf("the history is already saved in the %s store", destinationKind)
+	}
+	mailboxes, err := i.ListMailbox(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	i.history.Lock()
+	defer i.history.Unlock()
+
+	moved := 0
+	for _, info := range mailboxes {
+		history, err := source.load(ctx, info.Name)
+		if err != nil {
+			return moved, fmt.Errorf("cannot load history of mailbox %q: %w", info.Name, err)
+		}
+		if len(history.Actions) == 0 {
+			continue
+		}
+		existing, err := destination.load(ctx, info.Name)
+		if err != nil {
+			return moved, fmt.Errorf("cannot load history of mailbox %q: %w", info.Name, err)
+		}
+		err = destination.save(ctx, info.Name, mailbox.MergeHistory(existing, history))
+		if err != nil {
+			return moved, fmt.Errorf("cannot save history of mailbox %q: %w", info.Name, err)
+		}
+		err = source.remove(ctx, info.Name)
+		if err != nil {
+			return moved, fmt.Errorf("cannot remove previous history of mailbox %q: %w", info.Name, err)
+		}
+		i.log.Printf("history of mailbox %q moved from %s to %s", info.Name, sourceKind, destinationKind)
+		moved++
+	}
+	return moved, nil
+}
+
+// fileHistory saves the history in the cache directory
+type fileHistory struct {
+	dir string
+}
+
+func (h *fileHistory) filename(name string) string {
+	_ = os.MkdirAll(h.dir, 0700)
+	return filepath.Join(h.dir, name+".history.json")
+}
+
+func (h *fileHistory) load(ctx context.Context, name string) (*mailbox.History, error) {
+	return mailbox.GetHistoryFromFile(h.filename(name))
+}
+
+func (h *fileHistory) save(ctx context.Context, name string, history *mailbox.History) error {
+	return mailbox.SaveHistoryToFile(h.filename(name), history)
+}
+
+func (h *fileHistory) remove(ctx context.Context, name string) error {
+	filename := h.filename(name)
+	for _, file := range []string{filename, filename + lib.BackupSuffix} {
+		err := os.Remove(file)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// metadataHistory saves the history in a METADATA entry of each mailbox
+type metadataHistory struct {
+	backend *Imap
+}
+
+func (h *metadataHistory) load(ctx context.Context, name string) (*mailbox.History, error) {
+	i := h.backend
+	i.commands.Lock()
+	defer i.commands.Unlock()
+
+	var value []byte
+	err := i.run(ctx, func() error {
+		handler := responses.HandlerFunc(func(resp imap.Resp) error {
+			respName, fields, ok := imap.ParseNamedResp(resp)
+			if !ok || respName != "METADATA" || len(fields) < 2 {
+				return responses.ErrUnhandled
+			}
+			entries, ok := fields[1].([]any)
+			if !ok || len(entries) < 2 || entries[1] == nil {
+				return nil
+			}
+			data, err := imap.ParseString(entries[1])
+			if err != nil {
+				return err
+			}
+			value = []byte(data)
+			return nil
+		})
+		status, err := i.client.Execute(&imap.Command{
+			Name:      "GETMETADATA",
+			Arguments: []any{mailboxName(name), historyEntry},
+		}, handler)
+		if err != nil {
+			return err
+		}
+		return status.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	history := &mailbox.History{}
+	if len(value) == 0 {
+		return history, nil
+	}
+	err = json.Unmarshal(value, history)
+	if err != nil {
+		return nil, fmt.Errorf("error reading history of mailbox %q: %w", name, err)
+	}
+	return history, nil
+}
+
+func (h *metadataHistory) save(ctx context.Context, name string, history *mailbox.History) error {
+	data, err := json.Marshal(history)
+	if err != nil {
+		return fmt.Errorf("cannot encode history: %w", err)
+	}
+	return h.set(ctx, name, bytes.NewBuffer(data))
+}
+
+func (h *metadataHistory) remove(ctx context.Context, name string) error {
+	return h.set(ctx, name, nil)
+}
+
+// set replaces the METADATA entry, or removes it when the value is nil
+func (h *metadataHistory) set(ctx context.Context, name string, value *bytes.Buffer) error {
+	i := h.backend
+	i.commands.Lock()
+	defer i.commands.Unlock()
+
+	var field any
+	if value != nil {
+		field = imap.Literal(value)
+	}
+	return i.run(ctx, func() error {
+		status, err := i.client.Execute(&imap.Command{
+			Name:      "SETMETADATA",
+			Arguments: []any{mailboxName(name), []any{historyEntry, field}},
+		}, nil)
+		if err != nil {
+			return err
+		}
+		if status.Code == "METADATA" {
+			// the value is too large, or the server has too many entries
+			return fmt.Errorf("cannot save history in the METADATA of mailbox %q (%s %v): use the %q history store instead", name, status.Info, status.Arguments, HistoryMailbox)
+		}
+		return status.Err()
+	})
+}
+
+// mailboxName encodes the mailbox name in modified UTF-7 for a command
+func mailboxName(name string) any {
+	encoded, _ := utf7.Encoding.NewEncoder().String(name)
+	return imap.FormatMailboxName(encoded)
+}
+
+// mailboxHistory saves the history of each mailbox as a message of the hidden history mailbox.
+// A new message is added each time the history is saved, then the previous ones are deleted.
+type mailboxHistory struct {
+	backend *Imap
+	// created is true once the history mailbox is known to exist (protected by the commands lock)
+	created bool
+}
+
+func (h *mailboxHistory) load(ctx context.Context, name string) (*mailbox.History, error) {
+	i := h.backend
+	i.commands.Lock()
+	defer i.commands.Unlock()
+
+	history := &mailbox.History{}
+	err := i.run(ctx, func() error {
+		exists, err := h.exists(false)
+		if err != nil || !exists {
+			return err
+		}
+		uids, err := h.find(name)
+		if err != nil || len(uids) == 0 {
+			return err
+		}
+		// the last one is the latest version
+		history, err = h.fetch(uids[len(uids)-1])
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+func (h *mailboxHistory) save(ctx context.Context, name string, history *mailbox.History) error {
+	body, err := historyMessage(name, history)
+	if err != nil {
+		return err
+	}
+
+	i := h.backend
+	i.commands.Lock()
+	defer i.commands.Unlock()
+
+	return i.run(ctx, func() error {
+		_, err := h.exists(true)
+		if err != nil {
+			return err
+		}
+		err = i.client.Append(HistoryMailboxName, []string{imap.SeenFlag}, time.Now(), body)
+		if err != nil {
+			return fmt.Errorf("cannot save history of mailbox %q: %w", name, err)
+		}
+		uids, err := h.find(name)
+		if err != nil || len(uids) < 2 {
+			return err
+		}
+		return h.delete(uids[:len(uids)-1])
+	})
+}
+
+func (h *mailboxHistory) remove(ctx context.Context, name string) error {
+	i := h.backend
+	i.commands.Lock()
+	defer i.commands.Unlock()
+
+	return i.run(ctx, func() error {
+		exists, err := h.exists(false)
+		if err != nil || !exists {
+			return err
+		}
+		uids, err := h.find(name)
+		if err != nil || len(uids) == 0 {
+			return err
+		}
+		return h.delete(uids)
+	})
+}
+
+// exists returns true when the history mailbox exists, after creating it if asked to.
+// The commands lock must be held by the caller.
+func (h *mailboxHistory) exists(create bool) (bool, error) {
+	if h.created {
+		return true, nil
+	}
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	err := h.backend.client.List("", HistoryMailboxName, mailboxes)
+	if err != nil {
+		return false, err
+	}
+	for range mailboxes {
+		h.created = true
+	}
+	if h.created || !create {
+		return h.created, nil
+	}
+	h.backend.log.Printf("Creating history mailbox %q", HistoryMailboxName)
+	err = h.backend.client.Create(HistoryMailboxName)
+	if err != nil {
+		return false, fmt.Errorf("cannot create history mailbox %q: %w", HistoryMailboxName, err)
+	}
+	h.created = true
+	return true, nil
+}
+
+// find returns the UIDs of the history messages of the mailbox, in ascending order.
+// The commands lock must be held by the caller.
+func (h *mailboxHistory) find(name string) ([]uint32, error) {
+	i := h.backend
+	count, err := i.countMessages(HistoryMailboxName)
+	if err != nil || count == 0 {
+		return nil, err
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, count)
+	section := &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier, Fields: []string{historyHeader}},
+		Peek:         true,
+	}
+	receiver := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- i.client.Fetch(seqset, []imap.FetchItem{imap.FetchUid, section.FetchItem()}, receiver)
+	}()
+
+	uids := make([]uint32, 0, 1)
+	decoder := &mime.WordDecoder{}
+	for msg := range receiver {
+		for _, body := range msg.Body {
+			if body == nil {
+				continue
+			}
+			header, err := textproto.ReadHeader(bufio.NewReader(body))
+			if err != nil {
+				continue
+			}
+			value, err := decoder.DecodeHeader(header.Get(historyHeader))
+			if err == nil && value == name {
+				uids = append(uids, msg.Uid)
+			}
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	slices.Sort(uids)
+	return uids, nil
+}
+
+// fetch decodes the history message. The commands lock must be held by the caller.
+func (h *mailboxHistory) fetch(uid uint32) (*mailbox.History, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+	section := &imap.BodySectionName{Peek: true}
+	receiver := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- h.backend.client.UidFetch(seqset, []imap.FetchItem{section.FetchItem()}, receiver)
+	}()
+
+	var body io.Reader
+	for msg := range receiver {
+		for _, literal := range msg.Body {
+			body = literal
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	if body == nil {
+		return nil, fmt.Errorf("history message %d not found", uid)
+	}
+	entity, err := message.Read(body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read history message %d: %w", uid, err)
+	}
+	history := &mailbox.History{}
+	err = json.NewDecoder(entity.Body).Decode(history)
+	if err != nil {
+		return nil, fmt.Errorf("error reading history message %d: %w", uid, err)
+	}
+	return history, nil
+}
+
+// delete removes the messages from the history mailbox. The commands lock must be held by the caller.
+func (h *mailboxHistory) delete(uids []uint32) error {
+	i := h.backend
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	err := i.client.UidStore(seqset, imap.FormatFlagsOp(imap.AddFlags, true), []any{imap.DeletedFlag}, nil)
+	if err != nil {
+		return err
+	}
+	if i.uidplusClient != nil {
+		return i.uidplusClient.UidExpunge(seqset, nil)
+	}
+	// the history mailbox only contains history messages
+	return i.client.Expunge(nil)
+}
+
+// historyMessage creates the message containing the history of the mailbox
+func historyMessage(name string, history *mailbox.History) (*bytes.Buffer, error) {
+	header := message.Header{}
+	header.Set("From", "imap <imap@localhost>")
+	header.Set("Date", time.Now().Format(time.RFC1123Z))
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", "History of mailbox "+name))
+	header.Set(historyHeader, mime.QEncoding.Encode("utf-8", name))
+	header.SetContentType("application/json", map[string]string{"charset": "utf-8"})
+	header.Set("Content-Transfer-Encoding", "base64")
+
+	buffer := &bytes.Buffer{}
+	writer, err := message.CreateWriter(buffer, header)
+	if err != nil {
+		return nil, err
+	}
+	err = json.NewEncoder(writer).Encode(history)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode history: %w", err)
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buffer, nil
+}
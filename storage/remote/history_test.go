@@ -0,0 +1,344 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/creativeprojects/imap/lib"
+	"github.com/creativeprojects/imap/mailbox"
+	"github.com/creativeprojects/imap/storage/test"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/nettest"
+)
+
+// metadataExtension implements GETMETADATA and SETMETADATA for a single entry
+type metadataExtension struct {
+	mutex   sync.Mutex
+	entries map[string]string
+	maxSize int
+}
+
+func (ext *metadataExtension) Capabilities(c server.Conn) []string {
+	return []string{"METADATA"}
+}
+
+func (ext *metadataExtension) Command(name string) server.HandlerFactory {
+	switch name {
+	case "GETMETADATA":
+		return func() server.Handler { return &getMetadata{ext: ext} }
+	case "SETMETADATA":
+		return func() server.Handler { return &setMetadata{ext: ext} }
+	default:
+		return nil
+	}
+}
+
+type getMetadata struct {
+	ext     *metadataExtension
+	mailbox string
+	entry   string
+}
+
+func (cmd *getMetadata) Parse(fields []any) error {
+	var err error
+	cmd.mailbox, err = imap.ParseString(fields[0])
+	if err != nil {
+		return err
+	}
+	cmd.entry, err = imap.ParseString(fields[1])
+	return err
+}
+
+func (cmd *getMetadata) Handle(conn server.Conn) error {
+	cmd.ext.mutex.Lock()
+	value, ok := cmd.ext.entries[cmd.mailbox+cmd.entry]
+	cmd.ext.mutex.Unlock()
+
+	var field any
+	if ok {
+		field = imap.Literal(bytes.NewBufferString(value))
+	}
+	return conn.WriteResp(&imap.DataResp{
+		Fields: []any{imap.RawString("METADATA"), cmd.mailbox, []any{cmd.entry, field}},
+	})
+}
+
+type setMetadata struct {
+	ext     *metadataExtension
+	mailbox string
+	entry   string
+	value   *string
+}
+
+func (cmd *setMetadata) Parse(fields []any) error {
+	var err error
+	cmd.mailbox, err = imap.ParseString(fields[0])
+	if err != nil {
+		return err
+	}
+	entry := fields[1].([]any)
+	cmd.entry, err = imap.ParseString(entry[0])
+	if err != nil || entry[1] == nil {
+		return err
+	}
+	value, err := imap.ParseString(entry[1])
+	cmd.value = &value
+	return err
+}
+
+func (cmd *setMetadata) Handle(conn server.Conn) error {
+	cmd.ext.mutex.Lock()
+	defer cmd.ext.mutex.Unlock()
+
+	if cmd.value == nil {
+		delete(cmd.ext.entries, cmd.mailbox+cmd.entry)
+		return nil
+	}
+	if cmd.ext.maxSize > 0 && len(*cmd.value) > cmd.ext.maxSize {
+		return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+			Type:      imap.StatusRespNo,
+			Code:      "METADATA",
+			Arguments: []any{"MAXSIZE", uint32(cmd.ext.maxSize)},
+			Info:      "value too large",
+		}}
+	}
+	cmd.ext.entries[cmd.mailbox+cmd.entry] = *cmd.value
+	return nil
+}
+
+// startHistoryServer starts a memory IMAP server, with the METADATA extension when metadata is not nil
+func startHistoryServer(t *testing.T, metadata *metadataExtension) string {
+	t.Helper()
+	imapServer := server.New(memory.New())
+	imapServer.ErrorLog = lib.NewTestLogger(t, "server")
+	imapServer.AllowInsecureAuth = true
+	if metadata != nil {
+		imapServer.Enable(metadata)
+	}
+
+	listener, err := nettest.NewLocalListener("tcp")
+	require.NoError(t, err)
+	wg := sync.WaitGroup{}
+	wg.Go(func() {
+		_ = imapServer.Serve(listener)
+	})
+	t.Cleanup(func() {
+		_ = imapServer.Close()
+		wg.Wait()
+	})
+	return listener.Addr().String()
+}
+
+func newHistoryBackend(t *testing.T, address, cacheDir string, store HistoryStore) *Imap {
+	t.Helper()
+	backend, err := NewImap(Config{
+		ServerURL:    address,
+		Username:     "username",
+		Password:     "password",
+		NoTLS:        true,
+		CacheDir:     cacheDir,
+		HistoryStore: store,
+		DebugLogger:  lib.NewTestLogger(t, "client"),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = backend.Close()
+	})
+	return backend
+}
+
+func historyAction(uidValidity uint32) mailbox.HistoryAction {
+	return mailbox.HistoryAction{
+		SourceAccountTag: "source",
+		Date:             time.Date(2024, 1, 1, 10, 0, int(uidValidity), 0, time.UTC),
+		Action:           mailbox.ActionCopy,
+		UidValidity:      uidValidity,
+		Entries: []mailbox.HistoryEntry{
+			{SourceID: mailbox.NewMessageIDFromUint(uidValidity), MessageID: mailbox.NewMessageIDFromUint(uidValidity + 100)},
+		},
+	}
+}
+
+func TestImapBackendHistoryOnServer(t *testing.T) {
+	testCases := []struct {
+		store    HistoryStore
+		metadata bool
+		expected HistoryStore
+	}{
+		{HistoryMailbox, true, HistoryMailbox},
+		{HistoryMetadata, true, HistoryMetadata},
+		{HistoryServer, true, HistoryMetadata},
+		{HistoryServer, false, HistoryMailbox},
+	}
+	for _, testCase := range testCases {
+		t.Run(string(testCase.expected), func(t *testing.T) {
+			var metadata *metadataExtension
+			if testCase.metadata {
+				metadata = &metadataExtension{entries: make(map[string]string)}
+			}
+			address := startHistoryServer(t, metadata)
+			backend := newHistoryBackend(t, address, t.TempDir(), testCase.store)
+			assert.Equal(t, testCase.expected, backend.HistoryStore())
+
+			test.RunTestsOnBackend(t, backend)
+		})
+	}
+}
+
+func TestImapMetadataNotSupported(t *testing.T) {
+	address := startHistoryServer(t, nil)
+	_, err := NewImap(Config{
+		ServerURL:    address,
+		Username:     "username",
+		Password:     "password",
+		NoTLS:        true,
+		CacheDir:     t.TempDir(),
+		HistoryStore: HistoryMetadata,
+	})
+	assert.ErrorIs(t, err, lib.ErrNotSupported)
+}
+
+func TestImapHistoryMailbox(t *testing.T) {
+	ctx := t.Context()
+	address := startHistoryServer(t, nil)
+	backend := newHistoryBackend(t, address, t.TempDir(), HistoryMailbox)
+	info := mailbox.Info{Name: "INBOX", Delimiter: "/"}
+
+	for uidValidity := range uint32(3) {
+		require.NoError(t, backend.AddToHistory(ctx, info, historyAction(uidValidity)))
+	}
+	history, err := backend.GetHistory(ctx, info)
+	require.NoError(t, err)
+	assert.Equal(t, []mailbox.HistoryAction{historyAction(0), historyAction(1), historyAction(2)}, history.Actions)
+
+	// the history mailbox is hidden, and only keeps the latest version
+	mailboxes, err := backend.ListMailbox(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []mailbox.Info{{Name: "INBOX", Delimiter: "/"}}, mailboxes)
+	status, err := backend.SelectMailbox(ctx, mailbox.Info{Name: HistoryMailboxName, Delimiter: "/"})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), status.Messages)
+	require.NoError(t, backend.UnselectMailbox())
+
+	// another machine finds the same history
+	other := newHistoryBackend(t, address, t.TempDir(), HistoryMailbox)
+	history, err = other.GetHistory(ctx, info)
+	require.NoError(t, err)
+	assert.Len(t, history.Actions, 3)
+}
+
+func TestImapHistoryMetadataTooLarge(t *testing.T) {
+	address := startHistoryServer(t, &metadataExtension{entries: make(map[string]string), maxSize: 10})
+	backend := newHistoryBackend(t, address, t.TempDir(), HistoryMetadata)
+
+	err := backend.AddToHistory(t.Context(), mailbox.Info{Name: "INBOX", Delimiter: "/"}, historyAction(1))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `use the "mailbox" history store`)
+}
+
+func TestImapMigrateHistory(t *testing.T) {
+	ctx := t.Context()
+	address := startHistoryServer(t, &metadataExtension{entries: make(map[string]string)})
+	cacheDir := t.TempDir()
+	info := mailbox.Info{Name: "INBOX", Delimiter: "/"}
+
+	local := newHistoryBackend(t, address, cacheDir, HistoryLocal)
+	require.NoError(t, local.AddToHistory(ctx, info, historyAction(1)))
+
+	// the history not migrated yet is loaded from the local cache
+	server := newHistoryBackend(t, address, cacheDir, HistoryServer)
+	history, err := server.GetHistory(ctx, info)
+	require.NoError(t, err)
+	assert.Equal(t, []mailbox.HistoryAction{historyAction(1)}, history.Actions)
+
+	moved, err := server.MigrateHistory(ctx, HistoryLocal, HistoryServer)
+	require.NoError(t, err)
+	assert.Equal(t, 1, moved)
+
+	history, err = local.GetHistory(ctx, info)
+	require.NoError(t, err)
+	assert.Empty(t, history.Actions)
+	require.NoError(t, server.AddToHistory(ctx, info, historyAction(2)))
+
+	// a history left in the local cache is merged when moving back
+	require.NoError(t, local.AddToHistory(ctx, info, historyAction(1)))
+	moved, err = server.MigrateHistory(ctx, HistoryServer, HistoryLocal)
+	require.NoError(t, err)
+	assert.Equal(t, 1, moved)
+
+	history, err = local.GetHistory(ctx, info)
+	require.NoError(t, err)
+	assert.Equal(t, []mailbox.HistoryAction{historyAction(1), historyAction(2)}, history.Actions)
+
+	_, err = server.MigrateHistory(ctx, HistoryMetadata, HistoryServer)
+	assert.Error(t, err)
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = server.GetHistory(ctx, info)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// cancelLiteral cancels the context while the message is sent to the server
+type cancelLiteral struct {
+	*bytes.Buffer
+	cancel context.CancelFunc
+}
+
+func (l *cancelLiteral) Read(p []byte) (int, error) {
+	l.cancel()
+	return l.Buffer.Read(p)
+}
+
+func TestImapHistorySavedAfterCancel(t *testing.T) {
+	testCases := []struct {
+		store    HistoryStore
+		metadata bool
+	}{
+		{HistoryMailbox, false},
+		{HistoryMetadata, true},
+	}
+	for _, testCase := range testCases {
+		t.Run(string(testCase.store), func(t *testing.T) {
+			var metadata *metadataExtension
+			if testCase.metadata {
+				metadata = &metadataExtension{entries: make(map[string]string)}
+			}
+			address := startHistoryServer(t, metadata)
+			backend := newHistoryBackend(t, address, t.TempDir(), testCase.store)
+			info := mailbox.Info{Name: "INBOX", Delimiter: "/"}
+			ctx, cancel := context.WithCancel(t.Context())
+
+			body := "Subject: interrupted\r\n\r\nbody\r\n"
+			_, err := backend.PutMessage(ctx, info, mailbox.MessageProperties{
+				InternalDate: time.Now(),
+				Size:         uint32(len(body)),
+			}, &cancelLiteral{Buffer: bytes.NewBufferString(body), cancel: cancel})
+			require.ErrorIs(t, err, context.Canceled)
+
+			// the connection was closed by the cancelled command
+			_, err = backend.ListMailbox(context.WithoutCancel(ctx))
+			require.Error(t, err)
+
+			require.NoError(t, backend.AddToHistory(context.WithoutCancel(ctx), info, historyAction(1)))
+			require.NoError(t, backend.AddToHistory(context.WithoutCancel(ctx), info, historyAction(2)))
+
+			other := newHistoryBackend(t, address, t.TempDir(), testCase.store)
+			history, err := other.GetHistory(t.Context(), info)
+			require.NoError(t, err)
+			assert.Equal(t, []mailbox.HistoryAction{historyAction(1), historyAction(2)}, history.Actions)
+
+			require.NoError(t, backend.ReplaceHistory(context.WithoutCancel(ctx), info, &mailbox.History{}))
+			history, err = other.GetHistory(t.Context(), info)
+			require.NoError(t, err)
+			assert.Empty(t, history.Actions)
+		})
+	}
+}
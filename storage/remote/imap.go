@@ -7,39 +7,69 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/creativeprojects/imap/lib"
+	"github.com/creativeprojects/imap/lock"
 	"github.com/creativeprojects/imap/mailbox"
 	"github.com/emersion/go-imap"
 	uidplus "github.com/emersion/go-imap-uidplus"
 	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
 )
 
 type Config struct {
-	ServerURL           string
-	Username            string
-	Password            string
-	CacheDir            string
+	ServerURL string
+	Username  string
+	Password  string
+	CacheDir  string
+	// HistoryStore is where the history is saved: HistoryLocal in the CacheDir (default), or on the server
+	HistoryStore        HistoryStore
 	DebugLogger         lib.Logger
 	NoTLS               bool
 	SkipTLSVerification bool
 }
 
+// Imap is safe for concurrent use, but the selected mailbox is shared between all the callers: use OpenMailbox instead.
+// The commands are sent to the server one at a time.
 type Imap struct {
+	// config is kept to open a new connection when the history must be saved after the connection was closed
+	config        Config
 	client        *client.Client
 	uidplusClient *uidplus.Client
 	log           lib.Logger
-	delimiter     string
-	selected      *mailbox.Status
 	tag           string
 	cacheDir      string
+	selection     mailbox.Selection
+	// commands serialises the commands: the IMAP client cannot send a command before the previous one has finished
+	commands sync.Mutex
+	// current is the mailbox selected on the connection (protected by commands)
+	current string
+	// mutex protects the delimiter and the watcher
+	mutex     sync.Mutex
+	delimiter string
+	// history serialises the changes to the history
+	history      sync.RWMutex
+	historyStore historyStore
+	historyKind  HistoryStore
+	// updates receives the unilateral messages from the server
+	updates chan client.Update
+	// watcher is notified of the changes in the mailbox watched (protected by mutex)
+	watcher chan<- struct{}
 }
 
 func NewImap(cfg Config) (*Imap, error) {
+	return NewImapWithContext(context.Background(), cfg)
+}
+
+// NewImapWithContext connects to the server: the context can cancel the connection and the login.
+// It's not used afterwards.
+func NewImapWithContext(ctx context.Context, cfg Config) (*Imap, error) {
 	log := cfg.DebugLogger
 	if log == nil {
 		log = &lib.NoLog{}
@@ -51,8 +81,10 @@ func NewImap(cfg Config) (*Imap, error) {
 	var imapClient *client.Client
 	var err error
 	log.Printf("Connecting to server %s...", cfg.ServerURL)
+	dialer := &contextDialer{ctx: ctx}
+	defer dialer.release()
 	if cfg.NoTLS {
-		imapClient, err = client.Dial(cfg.ServerURL)
+		imapClient, err = client.DialWithDialer(dialer, cfg.ServerURL)
 	} else {
 		tlsConfig := &tls.Config{
 			MinVersion: tls.VersionTLS12,
@@ -60,17 +92,30 @@ func NewImap(cfg Config) (*Imap, error) {
 		if cfg.SkipTLSVerification {
 			tlsConfig.InsecureSkipVerify = true
 		}
-		imapClient, err = client.DialTLS(cfg.ServerURL, tlsConfig)
+		imapClient, err = client.DialWithDialerTLS(dialer, cfg.ServerURL, tlsConfig)
 	}
 	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
 		return nil, fmt.Errorf("cannot connect to server %s: %w", cfg.ServerURL, err)
 	}
 	log.Print("Connected")
+	// the updates must be read all the time, or the client would block
+	updates := make(chan client.Update, 100)
+	imapClient.Updates = updates
 
 	if err := imapClient.Login(cfg.Username, cfg.Password); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
 		return nil, fmt.Errorf("authentication failure: %w", err)
 	}
 	log.Printf("Logged in as %s", cfg.Username)
+	if !dialer.release() {
+		// the connection was closed by the context just after the login
+		return nil, fmt.Errorf("cannot connect to server %s: %w", cfg.ServerURL, ctx.Err())
+	}
 
 	if caps, err := imapClient.Capability(); err == nil {
 		log.Printf("capabilities: %+v", caps)
@@ -91,29 +136,117 @@ func NewImap(cfg Config) (*Imap, error) {
 		cacheDir = filepath.Join(wd, ".cache")
 	}
 
-	return &Imap{
+	backend := &Imap{
+		config:        cfg,
 		client:        imapClient,
 		uidplusClient: uidExt,
 		log:           log,
 		tag:           lib.AccountTag(cfg.ServerURL, cfg.Username),
 		cacheDir:      cacheDir,
-	}, nil
+		updates:       updates,
+	}
+	go backend.dispatchUpdates()
+
+	backend.historyStore, backend.historyKind, err = backend.newHistoryStore(cfg.HistoryStore)
+	if err != nil {
+		_ = backend.Close()
+		return nil, err
+	}
+	if backend.historyKind != HistoryLocal {
+		log.Printf("History saved on the server (%s)", backend.historyKind)
+	}
+	return backend, nil
 }
 
 func (i *Imap) Close() error {
 	i.log.Print("Closing connection")
+
+	i.commands.Lock()
+	defer i.commands.Unlock()
+
 	return i.client.Logout()
 }
 
+// response codes of a command which failed temporarily (RFC 5530)
+const (
+	codeUnavailable imap.StatusRespCode = "UNAVAILABLE"
+	codeInUse       imap.StatusRespCode = "INUSE"
+)
+
+// ErrUnknownOutcome is returned when the connection failed before the server answered the command:
+// it might have been executed anyway.
+var ErrUnknownOutcome = errors.New("no answer from the server")
+
+// StatusError is a NO or BAD answer of the server, with its response code
+type StatusError struct {
+	Type imap.StatusRespType
+	Code imap.StatusRespCode
+	Info string
+}
+
+func newStatusError(status *imap.StatusResp) *StatusError {
+	return &StatusError{
+		Type: status.Type,
+		Code: status.Code,
+		Info: status.Info,
+	}
+}
+
+func (e *StatusError) Error() string {
+	if e.Code == "" {
+		return e.Info
+	}
+	return fmt.Sprintf("[%s] %s", e.Code, e.Info)
+}
+
+// IsRetryable returns true when the server answered it's temporarily unable to run the command ([UNAVAILABLE] or [INUSE]),
+// or the network timed out. Any other NO or BAD answer is definitive, and a command without an answer is not sent again
+// as it might have been executed (an APPEND would save the message twice).
+// Nothing can be retried once the connection is closed.
+func (i *Imap) IsRetryable(err error) bool {
+	select {
+	case <-i.client.LoggedOut():
+		return false
+	default:
+	}
+	if errors.Is(err, ErrUnknownOutcome) {
+		return false
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Type == imap.StatusRespNo && (statusErr.Code == codeUnavailable || statusErr.Code == codeInUse)
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// LockAccount locks a file in the cache directory, so no other process can copy to the account or change its history at the same time
+func (i *Imap) LockAccount(ctx context.Context, timeout time.Duration) (func() error, error) {
+	accountLock, err := lock.Acquire(ctx, filepath.Join(i.cacheDir, i.tag+".lock"), timeout, i.log)
+	if err != nil {
+		return nil, err
+	}
+	return accountLock.Release, nil
+}
+
 // AccountID is an internal ID used to tag accounts in history
 func (i *Imap) AccountID() string {
 	return i.tag
 }
 
+// Delimiter is loaded from the list of mailboxes the first time it's needed
 func (i *Imap) Delimiter() string {
-	if i.delimiter == "" {
-		_, _ = i.ListMailbox()
+	if delimiter := i.getDelimiter(); delimiter != "" {
+		return delimiter
 	}
+	_, _ = i.ListMailbox(context.Background())
+	return i.getDelimiter()
+}
+
+func (i *Imap) getDelimiter() string {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
 	return i.delimiter
 }
 
@@ -125,25 +258,43 @@ func (i *Imap) SupportMessageHash() bool {
 	return false
 }
 
-func (i *Imap) ListMailbox() ([]mailbox.Info, error) {
+func (i *Imap) ListMailbox(ctx context.Context) ([]mailbox.Info, error) {
+	i.commands.Lock()
+	defer i.commands.Unlock()
+
 	mailboxes := make(chan *imap.MailboxInfo, 10)
 	done := make(chan error, 1)
 	go func() {
-		done <- i.client.List("", "*", mailboxes)
+		sent := false
+		err := i.run(ctx, func() error {
+			sent = true
+			return i.client.List("", "*", mailboxes)
+		})
+		if !sent {
+			// the channel is only closed by the command
+			close(mailboxes)
+		}
+		done <- err
 	}()
 
 	i.log.Print("Listing mailboxes:")
 	info := make([]mailbox.Info, 0, 10)
 	for m := range mailboxes {
 		i.log.Printf("* %q: %+v (delimiter = %q)", m.Name, m.Attributes, m.Delimiter)
+		if m.Name == HistoryMailboxName {
+			// the history is not a mailbox of the account
+			continue
+		}
 		info = append(info, mailbox.Info{
 			Delimiter: m.Delimiter,
 			Name:      m.Name,
 		})
 		// sets the delimiter (if not already set)
+		i.mutex.Lock()
 		if i.delimiter == "" {
 			i.delimiter = m.Delimiter
 		}
+		i.mutex.Unlock()
 	}
 
 	if err := <-done; err != nil {
@@ -153,9 +304,9 @@ func (i *Imap) ListMailbox() ([]mailbox.Info, error) {
 }
 
 // CreateMailbox doesn't return an error if the mailbox already exists
-func (i *Imap) CreateMailbox(info mailbox.Info) error {
+func (i *Imap) CreateMailbox(ctx context.Context, info mailbox.Info) error {
 	name := info.Name
-	mailboxes, err := i.ListMailbox()
+	mailboxes, err := i.ListMailbox(ctx)
 	if err != nil {
 		return err
 	}
@@ -170,38 +321,111 @@ func (i *Imap) CreateMailbox(info mailbox.Info) error {
 	}
 
 	i.log.Printf("Creating mailbox %q using delimiter %q", name, i.Delimiter())
-	return i.client.Create(name)
+
+	i.commands.Lock()
+	defer i.commands.Unlock()
+
+	return i.run(ctx, func() error {
+		return i.client.Create(name)
+	})
 }
 
-func (i *Imap) DeleteMailbox(info mailbox.Info) error {
+func (i *Imap) DeleteMailbox(ctx context.Context, info mailbox.Info) error {
 	name := lib.VerifyDelimiter(info.Name, info.Delimiter, i.Delimiter())
 	i.log.Printf("Deleting mailbox %q using delimiter %q", name, i.Delimiter())
-	return i.client.Delete(name)
+
+	i.commands.Lock()
+	defer i.commands.Unlock()
+
+	return i.run(ctx, func() error {
+		return i.client.Delete(name)
+	})
 }
 
-func (i *Imap) SelectMailbox(info mailbox.Info) (*mailbox.Status, error) {
+// OpenMailbox selects the mailbox on the server and returns a handle on it. The handle selects
+// its mailbox again when another mailbox was selected on the connection in the meantime.
+func (i *Imap) OpenMailbox(ctx context.Context, info mailbox.Info) (mailbox.Handle, error) {
 	name := lib.VerifyDelimiter(info.Name, info.Delimiter, i.Delimiter())
 	i.log.Printf("Selecting mailbox %q using delimiter %q", name, i.Delimiter())
-	status, err := i.client.Select(name, false)
+
+	i.commands.Lock()
+	defer i.commands.Unlock()
+
+	var status *imap.MailboxStatus
+	err := i.run(ctx, func() error {
+		var err error
+		status, err = i.client.Select(name, false)
+		return err
+	})
 	if err != nil {
+		i.current = ""
 		return nil, err
 	}
-	i.selected = &mailbox.Status{
-		Name:        status.Name,
-		Messages:    status.Messages,
-		Unseen:      status.Unseen,
-		UidValidity: status.UidValidity,
+	i.current = name
+	return &handle{
+		backend: i,
+		name:    name,
+		status: mailbox.Status{
+			Name:        status.Name,
+			Messages:    status.Messages,
+			Unseen:      status.Unseen,
+			UidValidity: status.UidValidity,
+		},
+	}, nil
+}
+
+func (i *Imap) SelectMailbox(ctx context.Context, info mailbox.Info) (*mailbox.Status, error) {
+	handle, err := i.OpenMailbox(ctx, info)
+	if err != nil {
+		return nil, err
 	}
-	return i.selected, nil
+	return i.selection.Select(handle), nil
 }
 
-func (i *Imap) PutMessage(info mailbox.Info, props mailbox.MessageProperties, body io.Reader) (mailbox.MessageID, error) {
-	name := lib.VerifyDelimiter(info.Name, info.Delimiter, i.Delimiter())
-	buffer := &bytes.Buffer{}
-	read, err := buffer.ReadFrom(body)
+// selectMailbox makes sure the mailbox is selected on the connection. The commands lock must be held by the caller.
+func (i *Imap) selectMailbox(name string) error {
+	if i.current == name {
+		return nil
+	}
+	i.log.Printf("Selecting mailbox %q again", name)
+	_, err := i.client.Select(name, false)
 	if err != nil {
-		return mailbox.EmptyMessageID, fmt.Errorf("cannot read message body: %w", err)
+		i.current = ""
+		return err
+	}
+	i.current = name
+	return nil
+}
+
+// closeMailbox unselects the mailbox if it's still selected on the connection
+func (i *Imap) closeMailbox(name string) error {
+	i.commands.Lock()
+	defer i.commands.Unlock()
+
+	if i.current != name {
+		return nil
 	}
+	i.current = ""
+	return i.client.Unselect()
+}
+
+func (i *Imap) PutMessage(ctx context.Context, info mailbox.Info, props mailbox.MessageProperties, body io.Reader) (mailbox.MessageID, error) {
+	name := lib.VerifyDelimiter(info.Name, info.Delimiter, i.Delimiter())
+	return i.putMessage(ctx, name, props, body)
+}
+
+func (i *Imap) putMessage(ctx context.Context, name string, props mailbox.MessageProperties, body io.Reader) (mailbox.MessageID, error) {
+	// the size of the message is sent first: it's read in memory unless it's already there
+	buffer, ok := body.(imap.Literal)
+	if !ok {
+		content := &bytes.Buffer{}
+		_, err := content.ReadFrom(lib.NewContextReader(ctx, body))
+		if err != nil {
+			return mailbox.EmptyMessageID, fmt.Errorf("cannot read message body: %w", err)
+		}
+		buffer = content
+	}
+	read := int64(buffer.Len())
 	if props.Size > 0 && read != int64(props.Size) {
 		return mailbox.EmptyMessageID, fmt.Errorf("message body size advertised as %d bytes but read %d bytes from buffer", props.Size, read)
 	}
@@ -209,12 +433,15 @@ func (i *Imap) PutMessage(info mailbox.Info, props mailbox.MessageProperties, bo
 	// IMAP server cannot accept the recent flag
 	flags := lib.StripRecentFlag(props.Flags)
 
+	i.commands.Lock()
+	defer i.commands.Unlock()
+
 	var uid uint32
-	if i.uidplusClient != nil {
-		_, uid, err = i.uidplusClient.Append(name, flags, props.InternalDate, buffer)
-	} else {
-		err = i.client.Append(name, flags, props.InternalDate, buffer)
-	}
+	err := i.run(ctx, func() error {
+		var err error
+		uid, err = i.append(name, flags, props.InternalDate, buffer)
+		return err
+	})
 	if err != nil {
 		return mailbox.EmptyMessageID,
 			fmt.Errorf("cannot append new message to IMAP server (mailbox=%q size=%d flags=%v): %w",
@@ -226,11 +453,49 @@ func (i *Imap) PutMessage(info mailbox.Info, props mailbox.MessageProperties, bo
 	return mailbox.NewMessageIDFromUint(uid), nil
 }
 
+// append sends the APPEND command and returns the UID of the new message when the server supports UIDPLUS.
+// The error keeps the answer of the server. The commands lock must be held by the caller.
+func (i *Imap) append(name string, flags []string, date time.Time, body imap.Literal) (uint32, error) {
+	status, err := i.client.Execute(&commands.Append{
+		Mailbox: name,
+		Flags:   flags,
+		Date:    date,
+		Message: body,
+	}, nil)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrUnknownOutcome, err)
+	}
+	if status.Type == imap.StatusRespNo || status.Type == imap.StatusRespBad {
+		return 0, newStatusError(status)
+	}
+	var uid uint32
+	if status.Code == uidplus.CodeAppendUid && len(status.Arguments) >= 2 {
+		uid, _ = imap.ParseNumber(status.Arguments[1])
+	}
+	return uid, nil
+}
+
 func (i *Imap) FetchMessages(ctx context.Context, since time.Time, messages chan *mailbox.Message) error {
+	return i.selection.Fetch(ctx, since, messages)
+}
+
+func (i *Imap) fetchMessages(ctx context.Context, name string, since time.Time, messages chan *mailbox.Message) error {
 	defer close(messages)
 
-	if i.selected == nil {
-		return lib.ErrNotSelected
+	// the lock is held until all the messages are received
+	i.commands.Lock()
+	defer i.commands.Unlock()
+
+	return i.run(ctx, func() error {
+		return i.fetch(name, since, messages)
+	})
+}
+
+// fetch sends the messages to the channel. The commands lock must be held by the caller.
+func (i *Imap) fetch(name string, since time.Time, messages chan *mailbox.Message) error {
+	count, err := i.countMessages(name)
+	if err != nil || count == 0 {
+		return err
 	}
 
 	var seqset *imap.SeqSet
@@ -253,9 +518,62 @@ func (i *Imap) FetchMessages(ctx context.Context, since time.Time, messages chan
 	if seqset == nil {
 		// download all messages
 		seqset = new(imap.SeqSet)
-		seqset.AddRange(1, i.selected.Messages)
+		seqset.AddRange(1, count)
+	}
+	return i.fetchSet(seqset, false, messages)
+}
+
+func (i *Imap) fetchUids(ctx context.Context, name string, uids []mailbox.MessageID, messages chan *mailbox.Message) error {
+	defer close(messages)
+
+	if len(uids) == 0 {
+		return nil
+	}
+	seqset := new(imap.SeqSet)
+	for _, uid := range uids {
+		seqset.AddNum(uid.AsUint())
+	}
+
+	// the lock is held until all the messages are received
+	i.commands.Lock()
+	defer i.commands.Unlock()
+
+	return i.run(ctx, func() error {
+		err := i.selectMailbox(name)
+		if err != nil {
+			return err
+		}
+		return i.fetchSet(seqset, true, messages)
+	})
+}
+
+func (i *Imap) uids(ctx context.Context, name string) ([]mailbox.MessageID, error) {
+	i.commands.Lock()
+	defer i.commands.Unlock()
+
+	var list []uint32
+	err := i.run(ctx, func() error {
+		err := i.selectMailbox(name)
+		if err != nil {
+			return err
+		}
+		list, err = i.client.UidSearch(&imap.SearchCriteria{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(list)
+	uids := make([]mailbox.MessageID, len(list))
+	for i, uid := range list {
+		uids[i] = mailbox.NewMessageIDFromUint(uid)
 	}
+	return uids, nil
+}
 
+// fetchSet sends the messages to the channel, from their sequence numbers or their UIDs.
+// The commands lock must be held by the caller.
+func (i *Imap) fetchSet(seqset *imap.SeqSet, uid bool, messages chan *mailbox.Message) error {
 	section := &imap.BodySectionName{Peek: true}
 	items := []imap.FetchItem{section.FetchItem(), imap.FetchFlags, imap.FetchUid, imap.FetchInternalDate}
 	i.log.Printf("items: %+v", items)
@@ -264,6 +582,10 @@ func (i *Imap) FetchMessages(ctx context.Context, since time.Time, messages chan
 	done := make(chan error, 1)
 	// fetch messages in the background
 	go func() {
+		if uid {
+			done <- i.client.UidFetch(seqset, items, receiver)
+			return
+		}
 		done <- i.client.Fetch(seqset, items, receiver)
 	}()
 
@@ -294,19 +616,35 @@ func (i *Imap) FetchMessages(ctx context.Context, since time.Time, messages chan
 
 // LatestDate returns the internal date of the latest message
 func (i *Imap) LatestDate(ctx context.Context) (time.Time, error) {
+	return i.selection.LatestDate(ctx)
+}
+
+func (i *Imap) latestDate(ctx context.Context, name string) (time.Time, error) {
 	latest := time.Time{}
 
-	if i.selected == nil {
-		return latest, lib.ErrNotSelected
-	}
+	i.commands.Lock()
+	defer i.commands.Unlock()
+
+	err := i.run(ctx, func() error {
+		var err error
+		latest, err = i.latest(name)
+		return err
+	})
+	return latest, err
+}
 
-	if i.selected.Messages == 0 {
+// latest returns the internal date of the last message. The commands lock must be held by the caller.
+func (i *Imap) latest(name string) (time.Time, error) {
+	latest := time.Time{}
+
+	count, err := i.countMessages(name)
+	if err != nil || count == 0 {
 		// mailbox is empty
-		return latest, nil
+		return latest, err
 	}
 
 	seqset := new(imap.SeqSet)
-	seqset.AddRange(i.selected.Messages, i.selected.Messages)
+	seqset.AddRange(count, count)
 
 	items := []imap.FetchItem{imap.FetchFlags, imap.FetchUid, imap.FetchInternalDate}
 
@@ -316,9 +654,11 @@ func (i *Imap) LatestDate(ctx context.Context) (time.Time, error) {
 		done <- i.client.Fetch(seqset, items, receiver)
 	}()
 
-	msg := <-receiver
-	i.log.Printf("Received IMAP message seq=%d flags=%+v date=%q", msg.SeqNum, msg.Flags, msg.InternalDate)
-	latest = msg.InternalDate
+	// the receiver is closed without any message when the fetch failed (or the message was expunged in the meantime)
+	for msg := range receiver {
+		i.log.Printf("Received IMAP message seq=%d flags=%+v date=%q", msg.SeqNum, msg.Flags, msg.InternalDate)
+		latest = msg.InternalDate
+	}
 
 	if err := <-done; err != nil {
 		return latest, err
@@ -328,31 +668,195 @@ func (i *Imap) LatestDate(ctx context.Context) (time.Time, error) {
 }
 
 func (i *Imap) UnselectMailbox() error {
-	i.selected = nil
-	return i.client.Unselect()
+	return i.selection.Unselect()
 }
 
-func (i *Imap) AddToHistory(info mailbox.Info, actions ...mailbox.HistoryAction) error {
-	name := lib.VerifyDelimiter(info.Name, info.Delimiter, i.Delimiter())
-	history, err := i.GetHistory(info)
+// countMessages selects the mailbox and returns its current number of messages. The commands lock must be held by the caller.
+func (i *Imap) countMessages(name string) (uint32, error) {
+	if i.current == name {
+		// receives the messages added since the mailbox was selected
+		err := i.client.Noop()
+		if err != nil {
+			return 0, err
+		}
+	}
+	err := i.selectMailbox(name)
 	if err != nil {
-		// just create a new file instead of failing
-		history = &mailbox.History{
-			Actions: make([]mailbox.HistoryAction, 0),
+		return 0, err
+	}
+	status := i.client.Mailbox()
+	if status == nil {
+		return 0, lib.ErrNotSelected
+	}
+	return status.Messages, nil
+}
+
+// setMessageFlags replaces the flags of a message of the mailbox
+func (i *Imap) setMessageFlags(ctx context.Context, name string, uid mailbox.MessageID, flags []string) error {
+	i.commands.Lock()
+	defer i.commands.Unlock()
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid.AsUint())
+	// IMAP server cannot accept the recent flag
+	values := make([]any, 0, len(flags))
+	for _, flag := range lib.StripRecentFlag(flags) {
+		values = append(values, flag)
+	}
+	return i.run(ctx, func() error {
+		err := i.selectMailbox(name)
+		if err != nil {
+			return err
 		}
+		return i.client.UidStore(seqset, imap.FormatFlagsOp(imap.SetFlags, true), values, nil)
+	})
+}
+
+// deleteMessage removes a message from the mailbox: the UIDPLUS extension is needed
+// so the other messages marked as deleted are not expunged at the same time
+func (i *Imap) deleteMessage(ctx context.Context, name string, uid mailbox.MessageID) error {
+	if i.uidplusClient == nil {
+		return fmt.Errorf("%w: deleting a single message needs the UIDPLUS extension", lib.ErrNotSupported)
 	}
-	history.Actions = append(history.Actions, actions...)
+	i.commands.Lock()
+	defer i.commands.Unlock()
 
-	return mailbox.SaveHistoryToFile(i.historyFile(name), history)
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid.AsUint())
+	return i.run(ctx, func() error {
+		err := i.selectMailbox(name)
+		if err != nil {
+			return err
+		}
+		err = i.client.UidStore(seqset, imap.FormatFlagsOp(imap.AddFlags, true), []any{imap.DeletedFlag}, nil)
+		if err != nil {
+			return err
+		}
+		return i.uidplusClient.UidExpunge(seqset, nil)
+	})
 }
 
-func (i *Imap) GetHistory(info mailbox.Info) (*mailbox.History, error) {
+// Watch selects the mailbox and waits for changes with the IDLE command, or polls the server with NOOP every pollInterval
+// when it doesn't support IDLE (zero for the default of one minute).
+// A notification is sent to changed once the mailbox is selected, so the caller can catch up with the changes made before,
+// then each time messages are added or expunged: it never blocks, so changed should be buffered.
+// Watch keeps the connection busy until the context is cancelled (it then returns the context error) or the connection is lost:
+// use a backend dedicated to watching the mailbox.
+func (i *Imap) Watch(ctx context.Context, info mailbox.Info, pollInterval time.Duration, changed chan<- struct{}) error {
 	name := lib.VerifyDelimiter(info.Name, info.Delimiter, i.Delimiter())
-	return mailbox.GetHistoryFromFile(i.historyFile(name))
+
+	i.commands.Lock()
+	defer i.commands.Unlock()
+
+	err := i.run(ctx, func() error {
+		return i.selectMailbox(name)
+	})
+	if err != nil {
+		return err
+	}
+	i.log.Printf("Watching mailbox %q", name)
+
+	i.mutex.Lock()
+	i.watcher = changed
+	i.mutex.Unlock()
+	defer func() {
+		i.mutex.Lock()
+		i.watcher = nil
+		i.mutex.Unlock()
+	}()
+	select {
+	case changed <- struct{}{}:
+	default:
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- i.client.Idle(stop, &client.IdleOptions{PollInterval: pollInterval})
+	}()
+	select {
+	case <-ctx.Done():
+		close(stop)
+		if err := <-done; err != nil {
+			i.log.Printf("Stop watching mailbox %q: %s", name, err)
+		}
+		return ctx.Err()
+	case err := <-done:
+		if err == nil {
+			err = errors.New("connection closed while watching the mailbox")
+		}
+		return err
+	}
+}
+
+// dispatchUpdates reads the updates sent by the server until the connection is closed.
+// The new messages and the messages expunged are notified to the watcher.
+func (i *Imap) dispatchUpdates() {
+	for {
+		select {
+		case update := <-i.updates:
+			switch update.(type) {
+			case *client.MailboxUpdate, *client.ExpungeUpdate:
+				i.mutex.Lock()
+				watcher := i.watcher
+				i.mutex.Unlock()
+				if watcher == nil {
+					continue
+				}
+				select {
+				case watcher <- struct{}{}:
+				default:
+					// a notification is already waiting
+				}
+			}
+		case <-i.client.LoggedOut():
+			return
+		}
+	}
 }
 
-func (i *Imap) historyFile(name string) string {
-	filename := filepath.Join(i.cacheDir, i.tag)
-	_ = os.MkdirAll(filename, 0700)
-	return filepath.Join(filename, name+".history.json")
+// run sends the command to the server. The IMAP client cannot abort a command:
+// the connection is closed when the context is cancelled in the meantime, and the backend cannot be used afterwards.
+// The commands lock must be held by the caller.
+func (i *Imap) run(ctx context.Context, command func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		i.log.Print("Command cancelled: closing connection")
+		_ = i.client.Terminate()
+	})
+	err := command()
+	if !stop() {
+		// the connection was closed by the context
+		<-i.client.LoggedOut()
+		return ctx.Err()
+	}
+	return err
+}
+
+// contextDialer closes the connection when the context is cancelled before it's released
+type contextDialer struct {
+	ctx  context.Context
+	stop func() bool
+}
+
+func (d *contextDialer) Dial(network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(d.ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	d.stop = context.AfterFunc(d.ctx, func() {
+		_ = conn.Close()
+	})
+	return conn, nil
+}
+
+// release returns false if the connection was already closed by the context
+func (d *contextDialer) release() bool {
+	if d.stop == nil {
+		return true
+	}
+	return d.stop()
 }
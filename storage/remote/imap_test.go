@@ -1,11 +1,20 @@
 package remote
 
 import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/creativeprojects/imap/lib"
+	"github.com/creativeprojects/imap/mailbox"
 	"github.com/creativeprojects/imap/storage/test"
 	compress "github.com/emersion/go-imap-compress"
 	"github.com/emersion/go-imap/backend/memory"
@@ -57,3 +66,349 @@ func TestImapBackend(t *testing.T) {
 	assert.NoError(t, err)
 	wg.Wait()
 }
+
+func TestImapConnectionDeadline(t *testing.T) {
+	// the server accepts the connection but never sends the greeting
+	listener, err := nettest.NewLocalListener("tcp")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	wg := sync.WaitGroup{}
+	wg.Go(func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		// wait until the client gives up
+		_, _ = conn.Read(make([]byte, 1))
+		conn.Close()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	_, err = NewImapWithContext(ctx, Config{
+		ServerURL: listener.Addr().String(),
+		Username:  "username",
+		Password:  "password",
+		NoTLS:     true,
+		CacheDir:  t.TempDir(),
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	wg.Wait()
+}
+
+// fakeWatchServer answers the commands needed to watch INBOX. The lines from push are sent while idling,
+// or with the response to NOOP. The connection is closed when push is closed.
+func fakeWatchServer(conn net.Conn, idle bool, push <-chan string) {
+	defer conn.Close()
+
+	capabilities := "IMAP4rev1"
+	if idle {
+		capabilities += " IDLE"
+	}
+	write := func(lines ...string) {
+		for _, line := range lines {
+			_, _ = fmt.Fprintf(conn, "%s\r\n", line)
+		}
+	}
+	reader := bufio.NewReader(conn)
+	write("* OK [CAPABILITY " + capabilities + "] ready")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		tag, command, _ := strings.Cut(strings.TrimSpace(line), " ")
+		command, _, _ = strings.Cut(command, " ")
+		switch strings.ToUpper(command) {
+		case "LOGIN":
+			write(tag + " OK logged in")
+		case "CAPABILITY":
+			write("* CAPABILITY "+capabilities, tag+" OK done")
+		case "LIST":
+			write(`* LIST () "/" INBOX`, tag+" OK done")
+		case "SELECT":
+			write("* 1 EXISTS", "* OK [UIDVALIDITY 1] ok", tag+" OK [READ-WRITE] selected")
+		case "NOOP":
+			select {
+			case update, ok := <-push:
+				if !ok {
+					return
+				}
+				write(update)
+			default:
+			}
+			write(tag + " OK done")
+		case "IDLE":
+			write("+ idling")
+			stop := make(chan struct{})
+			go func() {
+				for {
+					select {
+					case update, ok := <-push:
+						if !ok {
+							_ = conn.Close()
+							return
+						}
+						write(update)
+					case <-stop:
+						return
+					}
+				}
+			}()
+			_, err := reader.ReadString('\n')
+			close(stop)
+			if err != nil {
+				return
+			}
+			write(tag + " OK idle done")
+		case "LOGOUT":
+			write("* BYE", tag+" OK done")
+			return
+		default:
+			write(tag + " BAD unknown command")
+		}
+	}
+}
+
+func TestImapWatch(t *testing.T) {
+	for _, idle := range []bool{true, false} {
+		t.Run(fmt.Sprintf("idle=%v", idle), func(t *testing.T) {
+			listener, err := nettest.NewLocalListener("tcp")
+			require.NoError(t, err)
+			defer listener.Close()
+
+			push := make(chan string)
+			wg := sync.WaitGroup{}
+			defer wg.Wait()
+			wg.Go(func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				fakeWatchServer(conn, idle, push)
+			})
+
+			watcher, err := NewImap(Config{
+				ServerURL:   listener.Addr().String(),
+				Username:    "username",
+				Password:    "password",
+				NoTLS:       true,
+				CacheDir:    t.TempDir(),
+				DebugLogger: lib.NewTestLogger(t, "watcher"),
+			})
+			require.NoError(t, err)
+
+			changed := make(chan struct{}, 1)
+			done := make(chan error, 1)
+			go func() {
+				done <- watcher.Watch(t.Context(), mailbox.Info{Name: "INBOX", Delimiter: "/"}, 10*time.Millisecond, changed)
+			}()
+
+			// a first notification when the mailbox is selected
+			select {
+			case <-changed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("no notification when starting")
+			}
+			for _, update := range []string{"* 2 EXISTS", "* 1 EXPUNGE"} {
+				push <- update
+				select {
+				case <-changed:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("no notification for %q", update)
+				}
+			}
+
+			// the connection is lost
+			close(push)
+			select {
+			case err := <-done:
+				assert.Error(t, err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("watch didn't stop when the connection was closed")
+			}
+			_ = watcher.Close()
+		})
+	}
+}
+
+func TestImapWatchCancel(t *testing.T) {
+	listener, err := nettest.NewLocalListener("tcp")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	push := make(chan string)
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	wg.Go(func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		fakeWatchServer(conn, true, push)
+	})
+
+	watcher, err := NewImap(Config{
+		ServerURL: listener.Addr().String(),
+		Username:  "username",
+		Password:  "password",
+		NoTLS:     true,
+		CacheDir:  t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	err = watcher.Watch(ctx, mailbox.Info{Name: "INBOX", Delimiter: "/"}, 0, make(chan struct{}, 1))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// the backend can still be used after watching
+	_, err = watcher.ListMailbox(t.Context())
+	assert.NoError(t, err)
+	assert.NoError(t, watcher.Close())
+}
+
+func TestImapLatestDateFetchError(t *testing.T) {
+	listener, err := nettest.NewLocalListener("tcp")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// the fake server doesn't know the FETCH command
+	push := make(chan string)
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	wg.Go(func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		fakeWatchServer(conn, false, push)
+	})
+	defer close(push)
+
+	backend, err := NewImap(Config{
+		ServerURL:   listener.Addr().String(),
+		Username:    "username",
+		Password:    "password",
+		NoTLS:       true,
+		CacheDir:    t.TempDir(),
+		DebugLogger: lib.NewTestLogger(t, "backend"),
+	})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	_, err = backend.SelectMailbox(t.Context(), mailbox.Info{Name: "INBOX", Delimiter: "/"})
+	require.NoError(t, err)
+	_, err = backend.LatestDate(t.Context())
+	assert.Error(t, err)
+}
+
+// fakeAppendServer answers each APPEND command with the next answer (without its tag).
+// The connection is closed instead of answering an empty string.
+func fakeAppendServer(conn net.Conn, answers []string) {
+	defer conn.Close()
+
+	write := func(lines ...string) {
+		for _, line := range lines {
+			_, _ = fmt.Fprintf(conn, "%s\r\n", line)
+		}
+	}
+	reader := bufio.NewReader(conn)
+	write("* OK [CAPABILITY IMAP4rev1 UIDPLUS] ready")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		tag, command, _ := strings.Cut(line, " ")
+		command, _, _ = strings.Cut(command, " ")
+		switch strings.ToUpper(command) {
+		case "LOGIN":
+			write(tag + " OK logged in")
+		case "CAPABILITY":
+			write("* CAPABILITY IMAP4rev1 UIDPLUS", tag+" OK done")
+		case "LIST":
+			write(`* LIST () "/" INBOX`, tag+" OK done")
+		case "APPEND":
+			// the message is sent as a literal "{size}"
+			start := strings.LastIndex(line, "{")
+			size, err := strconv.Atoi(strings.TrimSuffix(line[start+1:], "}"))
+			if err != nil {
+				return
+			}
+			write("+ ready")
+			if _, err = io.CopyN(io.Discard, reader, int64(size)); err != nil {
+				return
+			}
+			if _, err = reader.ReadString('\n'); err != nil {
+				return
+			}
+			if len(answers) == 0 || answers[0] == "" {
+				return
+			}
+			write(tag + " " + answers[0])
+			answers = answers[1:]
+		case "LOGOUT":
+			write("* BYE", tag+" OK done")
+			return
+		default:
+			write(tag + " BAD unknown command")
+		}
+	}
+}
+
+func TestImapAppendErrors(t *testing.T) {
+	listener, err := nettest.NewLocalListener("tcp")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	wg.Go(func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		fakeAppendServer(conn, []string{
+			"NO [UNAVAILABLE] try again later",
+			"NO [INUSE] mailbox locked",
+			"NO [OVERQUOTA] mailbox full",
+			"BAD invalid command",
+			"OK [APPENDUID 1 5] saved",
+			"",
+		})
+	})
+
+	backend, err := NewImap(Config{
+		ServerURL:   listener.Addr().String(),
+		Username:    "username",
+		Password:    "password",
+		NoTLS:       true,
+		CacheDir:    t.TempDir(),
+		DebugLogger: lib.NewTestLogger(t, "backend"),
+	})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	put := func() (mailbox.MessageID, error) {
+		return backend.PutMessage(t.Context(), mailbox.Info{Name: "INBOX", Delimiter: "/"}, mailbox.MessageProperties{}, strings.NewReader("Subject: test\r\n\r\nbody\r\n"))
+	}
+	for _, retryable := range []bool{true, true, false, false} {
+		_, err = put()
+		require.Error(t, err)
+		assert.Equal(t, retryable, backend.IsRetryable(err), err.Error())
+	}
+	uid, err := put()
+	require.NoError(t, err)
+	assert.Equal(t, uint32(5), uid.AsUint())
+
+	// the message might have been saved when there's no answer
+	assert.True(t, backend.IsRetryable(os.ErrDeadlineExceeded))
+	assert.False(t, backend.IsRetryable(fmt.Errorf("%w: %w", ErrUnknownOutcome, os.ErrDeadlineExceeded)))
+	_, err = put()
+	require.Error(t, err)
+	assert.False(t, backend.IsRetryable(err))
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/creativeprojects/imap/lib"
+	"github.com/creativeprojects/imap/term"
+)
+
+// RetryClassifier is implemented by the backends able to tell a transient error, worth retrying, from a fatal one.
+// The messages copied to the other backends are sent once, without keeping their body in memory.
+type RetryClassifier interface {
+	IsRetryable(err error) bool
+}
+
+// RetryPolicy tells how many times a message is sent again to the destination after a transient error
+type RetryPolicy struct {
+	// Attempts is the maximum number of attempts for each message (one or less doesn't retry)
+	Attempts int
+	// Delay before the first retry: it doubles after each attempt
+	Delay time.Duration
+	// MaxDelay caps the delay between two attempts (zero for no limit)
+	MaxDelay time.Duration
+}
+
+// IsRetryable tells if the error returned by the backend is transient.
+// The backends implementing RetryClassifier decide, otherwise only the network timeouts are retried.
+func IsRetryable(backend Backend, err error) bool {
+	if err == nil ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, lib.ErrMailboxNotFound) ||
+		errors.Is(err, lib.ErrNotSupported) {
+		return false
+	}
+	if classifier, ok := backend.(RetryClassifier); ok {
+		return classifier.IsRetryable(err)
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// delay before the retry number (starting at 1)
+func (p RetryPolicy) delay(retry int) time.Duration {
+	delay := p.Delay
+	for i := 1; i < retry; i++ {
+		delay *= 2
+		if p.MaxDelay > 0 && delay >= p.MaxDelay {
+			break
+		}
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// run calls the operation until it succeeds, fails with a fatal error, or there's no attempt left
+func (p RetryPolicy) run(ctx context.Context, backend Backend, operation func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := operation()
+		if err == nil || attempt >= p.Attempts || !IsRetryable(backend, err) {
+			return err
+		}
+		delay := p.delay(attempt)
+		term.Warnf("attempt %d of %d failed, retrying in %s: %s", attempt, p.Attempts, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/creativeprojects/imap/mailbox"
+	"github.com/creativeprojects/imap/term"
+)
+
+// DeleteCopiedMessages removes from the source mailbox the messages already copied to the destination, according to its history.
+// It finishes a move, even when a previous one was interrupted. It returns the number of messages deleted.
+// Only the messages copied from this mailbox with its current UID validity are deleted.
+func DeleteCopiedMessages(ctx context.Context, backendSource Backend, mbox mailbox.Info, history *mailbox.History) (int, error) {
+	source, err := backendSource.OpenMailbox(ctx, mbox)
+	if err != nil {
+		return 0, fmt.Errorf("cannot open mailbox at source: %w", err)
+	}
+	defer source.Close()
+
+	history = mailbox.SourceMailboxHistory(history, backendSource.AccountID(), mbox.Name, source.Status().UidValidity)
+	copied := mailbox.FindCopiedEntries(backendSource.AccountID(), history)
+	if len(copied) == 0 {
+		return 0, nil
+	}
+	uids, err := source.Uids(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("cannot list messages at source: %w", err)
+	}
+	deleted := 0
+	for _, uid := range uids {
+		if _, found := copied[uid]; !found {
+			continue
+		}
+		err = source.Delete(ctx, uid)
+		if err != nil {
+			return deleted, fmt.Errorf("cannot delete message at source: %w", err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// MirrorDeletions removes from the destination mailbox the messages copied from the source which are no longer in the source mailbox.
+// Only the messages copied from this mailbox with its current UID validity are considered.
+// It returns the entries deleted: save them in the history with the ActionDelete action.
+func MirrorDeletions(ctx context.Context, backendSource, backendDest Backend, mbox, destination mailbox.Info, history *mailbox.History) ([]mailbox.HistoryEntry, error) {
+	deleted := make([]mailbox.HistoryEntry, 0)
+	source, err := backendSource.OpenMailbox(ctx, mbox)
+	if err != nil {
+		return deleted, fmt.Errorf("cannot open mailbox at source: %w", err)
+	}
+	defer source.Close()
+
+	history = mailbox.SourceMailboxHistory(history, backendSource.AccountID(), mbox.Name, source.Status().UidValidity)
+	copied := mailbox.FindCopiedEntries(backendSource.AccountID(), history)
+	if len(copied) == 0 {
+		return deleted, nil
+	}
+	uids, err := source.Uids(ctx)
+	if err != nil {
+		return deleted, fmt.Errorf("cannot list messages at source: %w", err)
+	}
+	for _, uid := range uids {
+		delete(copied, uid)
+	}
+	if len(copied) == 0 {
+		return deleted, nil
+	}
+
+	dest, err := backendDest.OpenMailbox(ctx, destination)
+	if err != nil {
+		return deleted, fmt.Errorf("cannot open mailbox at destination: %w", err)
+	}
+	defer dest.Close()
+
+	for _, entry := range copied {
+		if entry.MessageID.IsZero() {
+			continue
+		}
+		err = dest.Delete(ctx, entry.MessageID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return deleted, ctx.Err()
+			}
+			// the message may have been deleted from the destination already
+			term.Warnf("cannot delete message %s at destination: %s", entry.MessageID, err)
+		}
+		deleted = append(deleted, entry)
+	}
+	return deleted, nil
+}
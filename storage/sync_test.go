@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/creativeprojects/imap/mailbox"
+	"github.com/creativeprojects/imap/storage/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// copyWithHistory copies the mailbox and returns the history as it would be saved by the copy command
+func copyWithHistory(t *testing.T, source, dest Backend, info mailbox.Info, history *mailbox.History, options CopyOptions) *mailbox.History {
+	t.Helper()
+	result, err := CopyMessagesWithOptions(context.Background(), source, dest, info, nil, history, options)
+	require.NoError(t, err)
+	if history == nil {
+		history = &mailbox.History{}
+	}
+	history.Actions = append(history.Actions, mailbox.HistoryAction{
+		SourceAccountTag: source.AccountID(),
+		SourceMailbox:    info.Name,
+		Date:             time.Now(),
+		Action:           mailbox.ActionCopy,
+		UidValidity:      uidValidity(t, source, info),
+		Entries:          result.Entries,
+	})
+	return history
+}
+
+// uidValidity returns the UID validity the copy command saves in the history
+func uidValidity(t *testing.T, backend Backend, info mailbox.Info) uint32 {
+	t.Helper()
+	handle, err := backend.OpenMailbox(context.Background(), info)
+	require.NoError(t, err)
+	defer handle.Close()
+	return handle.Status().UidValidity
+}
+
+func countMessages(t *testing.T, backend Backend, info mailbox.Info) uint32 {
+	t.Helper()
+	handle, err := backend.OpenMailbox(context.Background(), info)
+	require.NoError(t, err)
+	defer handle.Close()
+	return handle.Status().Messages
+}
+
+func TestCopyMessagesToAnotherMailbox(t *testing.T) {
+	info := mailbox.Info{Name: "INBOX", Delimiter: "."}
+	archive := mailbox.Info{Name: "Archive.INBOX", Delimiter: "."}
+	source := mem.New()
+	source.GenerateFakeEmails(info, 10, 100, 1000)
+	dest := mem.New()
+
+	result, err := CopyMessagesWithOptions(context.Background(), source, dest, info, nil, nil, CopyOptions{
+		Destination: archive,
+		Filter:      &MessageFilter{MaxSize: 500},
+		RateLimit:   10 * 1024 * 1024,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 10, len(result.Entries)+result.Skipped)
+	assert.Equal(t, uint32(len(result.Entries)), countMessages(t, dest, archive))
+
+	_, err = dest.OpenMailbox(context.Background(), info)
+	assert.Error(t, err)
+}
+
+func TestDeleteCopiedMessages(t *testing.T) {
+	info := mailbox.Info{Name: "INBOX", Delimiter: "."}
+	source := mem.New()
+	source.GenerateFakeEmails(info, 10, 100, 1000)
+	dest := mem.New()
+
+	history := copyWithHistory(t, source, dest, info, nil, CopyOptions{})
+	// a new message arrives after the copy
+	source.GenerateFakeEmails(info, 1, 100, 1000)
+
+	deleted, err := DeleteCopiedMessages(context.Background(), source, info, history)
+	require.NoError(t, err)
+	assert.Equal(t, 10, deleted)
+	assert.Equal(t, uint32(1), countMessages(t, source, info))
+	assert.Equal(t, uint32(10), countMessages(t, dest, info))
+}
+
+func TestMirrorDeletions(t *testing.T) {
+	ctx := context.Background()
+	info := mailbox.Info{Name: "INBOX", Delimiter: "."}
+	source := mem.New()
+	source.GenerateFakeEmails(info, 10, 100, 1000)
+	dest := mem.New()
+
+	history := copyWithHistory(t, source, dest, info, nil, CopyOptions{})
+
+	handle, err := source.OpenMailbox(ctx, info)
+	require.NoError(t, err)
+	uids, err := handle.Uids(ctx)
+	require.NoError(t, err)
+	require.NoError(t, handle.Delete(ctx, uids[0]))
+	require.NoError(t, handle.Delete(ctx, uids[5]))
+	handle.Close()
+
+	deleted, err := MirrorDeletions(ctx, source, dest, info, info, history)
+	require.NoError(t, err)
+	assert.Len(t, deleted, 2)
+	assert.Equal(t, uint32(8), countMessages(t, dest, info))
+
+	history.Actions = append(history.Actions, mailbox.HistoryAction{
+		SourceAccountTag: source.AccountID(),
+		SourceMailbox:    info.Name,
+		Date:             time.Now(),
+		Action:           mailbox.ActionDelete,
+		UidValidity:      history.Actions[0].UidValidity,
+		Entries:          deleted,
+	})
+	// nothing left to delete
+	deleted, err = MirrorDeletions(ctx, source, dest, info, info, history)
+	require.NoError(t, err)
+	assert.Empty(t, deleted)
+}
+
+// recreateMailbox empties the mailbox and gives it a new UID validity: the UIDs start again from 1
+func recreateMailbox(t *testing.T, backend Backend, info mailbox.Info, count uint32) {
+	t.Helper()
+	require.NoError(t, backend.DeleteMailbox(context.Background(), info))
+	backend.(*mem.Backend).GenerateFakeEmails(info, count, 100, 1000)
+}
+
+func TestDeleteCopiedMessagesAfterUidValidityChanged(t *testing.T) {
+	info := mailbox.Info{Name: "INBOX", Delimiter: "."}
+	source := mem.New()
+	source.GenerateFakeEmails(info, 10, 100, 1000)
+	dest := mem.New()
+
+	history := copyWithHistory(t, source, dest, info, nil, CopyOptions{})
+	// the same UIDs are given to new messages
+	recreateMailbox(t, source, info, 5)
+
+	deleted, err := DeleteCopiedMessages(context.Background(), source, info, history)
+	require.NoError(t, err)
+	assert.Zero(t, deleted)
+	assert.Equal(t, uint32(5), countMessages(t, source, info))
+}
+
+func TestMirrorDeletionsAfterUidValidityChanged(t *testing.T) {
+	info := mailbox.Info{Name: "INBOX", Delimiter: "."}
+	source := mem.New()
+	source.GenerateFakeEmails(info, 10, 100, 1000)
+	dest := mem.New()
+
+	history := copyWithHistory(t, source, dest, info, nil, CopyOptions{})
+	recreateMailbox(t, source, info, 5)
+
+	deleted, err := MirrorDeletions(context.Background(), source, dest, info, info, history)
+	require.NoError(t, err)
+	assert.Empty(t, deleted)
+	assert.Equal(t, uint32(10), countMessages(t, dest, info))
+}
+
+func TestSyncDeletionsOfMergedMailboxes(t *testing.T) {
+	ctx := context.Background()
+	first := mailbox.Info{Name: "Archive.2023", Delimiter: "."}
+	second := mailbox.Info{Name: "Archive.2024", Delimiter: "."}
+	archive := mailbox.Info{Name: "Archive", Delimiter: "."}
+	source := mem.New()
+	source.GenerateFakeEmails(first, 5, 100, 1000)
+	source.GenerateFakeEmails(second, 10, 100, 1000)
+	dest := mem.New()
+
+	// both mailboxes have the same UIDs
+	history := copyWithHistory(t, source, dest, first, nil, CopyOptions{Destination: archive})
+	history = copyWithHistory(t, source, dest, second, history, CopyOptions{Destination: archive})
+	require.Equal(t, uint32(15), countMessages(t, dest, archive))
+
+	// the messages of the second mailbox are not missing from the first one
+	deleted, err := MirrorDeletions(ctx, source, dest, first, archive, history)
+	require.NoError(t, err)
+	assert.Empty(t, deleted)
+	assert.Equal(t, uint32(15), countMessages(t, dest, archive))
+
+	// only the messages copied from the first mailbox are moved
+	count, err := DeleteCopiedMessages(ctx, source, first, history)
+	require.NoError(t, err)
+	assert.Equal(t, 5, count)
+	assert.Equal(t, uint32(10), countMessages(t, source, second))
+}
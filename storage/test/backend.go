@@ -4,6 +4,11 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -49,7 +54,7 @@ func RunTestsOnBackend(t *testing.T, backend storage.Backend) {
 	})
 
 	t.Run("ListMailbox", func(t *testing.T) {
-		list, err := backend.ListMailbox()
+		list, err := backend.ListMailbox(context.Background())
 		require.NoError(t, err)
 
 		// check there's at least one mailbox
@@ -59,12 +64,12 @@ func RunTestsOnBackend(t *testing.T, backend storage.Backend) {
 	})
 
 	t.Run("CreateExistingMailbox", func(t *testing.T) {
-		list, err := backend.ListMailbox()
+		list, err := backend.ListMailbox(context.Background())
 		require.NoError(t, err)
 
 		assert.True(t, mailboxExists("INBOX", list))
 
-		err = backend.CreateMailbox(mailbox.Info{
+		err = backend.CreateMailbox(context.Background(), mailbox.Info{
 			Delimiter: backend.Delimiter(),
 			Name:      "INBOX",
 		})
@@ -79,7 +84,7 @@ func RunTestsOnBackend(t *testing.T, backend storage.Backend) {
 		createMailbox(t, backend, info)
 		deleteMailbox(t, backend, info)
 		// also deletes the "Path" one if exists (it should on IMAP)
-		_ = backend.DeleteMailbox(mailbox.Info{
+		_ = backend.DeleteMailbox(context.Background(), mailbox.Info{
 			Delimiter: backend.Delimiter(),
 			Name:      "Path",
 		})
@@ -93,7 +98,7 @@ func RunTestsOnBackend(t *testing.T, backend storage.Backend) {
 		createMailbox(t, backend, info)
 		deleteMailbox(t, backend, info)
 		// also deletes the "Path" one if exists (it should on IMAP)
-		_ = backend.DeleteMailbox(mailbox.Info{
+		_ = backend.DeleteMailbox(context.Background(), mailbox.Info{
 			Delimiter: backend.Delimiter(),
 			Name:      "Path",
 		})
@@ -104,7 +109,7 @@ func RunTestsOnBackend(t *testing.T, backend storage.Backend) {
 			Delimiter: backend.Delimiter(),
 			Name:      "No mailbox at that name",
 		}
-		status, err := backend.SelectMailbox(info)
+		status, err := backend.SelectMailbox(context.Background(), info)
 		assert.Nil(t, status)
 		require.Error(t, err)
 		// IMAP doesn't have a specific error (it's up to the server implementation)
@@ -116,7 +121,7 @@ func RunTestsOnBackend(t *testing.T, backend storage.Backend) {
 			Delimiter: backend.Delimiter(),
 			Name:      "INBOX",
 		}
-		status, err := backend.SelectMailbox(info)
+		status, err := backend.SelectMailbox(context.Background(), info)
 		require.NoError(t, err)
 		t.Logf("%v", status)
 		assert.Equal(t, info.Name, status.Name)
@@ -130,7 +135,7 @@ func RunTestsOnBackend(t *testing.T, backend storage.Backend) {
 	})
 
 	t.Run("NewMailboxHasNoHistory", func(t *testing.T) {
-		history, err := backend.GetHistory(mailbox.Info{
+		history, err := backend.GetHistory(context.Background(), mailbox.Info{
 			Delimiter: backend.Delimiter(),
 			Name:      "Work",
 		})
@@ -144,7 +149,7 @@ func RunTestsOnBackend(t *testing.T, backend storage.Backend) {
 			Delimiter: backend.Delimiter(),
 			Name:      "Work",
 		}
-		_, err := backend.SelectMailbox(info)
+		_, err := backend.SelectMailbox(context.Background(), info)
 		require.NoError(t, err)
 
 		latest, err := backend.LatestDate(context.Background())
@@ -166,14 +171,14 @@ func RunTestsOnBackend(t *testing.T, backend storage.Backend) {
 			Size:         uint32(len(sampleMessage)),
 		}
 		body := bytes.NewBufferString(sampleMessage)
-		uid, err := backend.PutMessage(info, props, body)
+		uid, err := backend.PutMessage(context.Background(), info, props, body)
 		require.NoError(t, err)
 		if backend.SupportMessageID() {
 			assert.NotZero(t, uid)
 		}
 
 		// Verify the mailbox shows 1 message
-		status, err := backend.SelectMailbox(info)
+		status, err := backend.SelectMailbox(context.Background(), info)
 		require.NoError(t, err)
 		t.Logf("%v", status)
 		assert.Equal(t, info.Name, status.Name)
@@ -222,7 +227,7 @@ func RunTestsOnBackend(t *testing.T, backend storage.Backend) {
 			Delimiter: backend.Delimiter(),
 			Name:      "Work",
 		}
-		_, err := backend.SelectMailbox(info)
+		_, err := backend.SelectMailbox(context.Background(), info)
 		require.NoError(t, err)
 
 		latest, err := backend.LatestDate(context.Background())
@@ -245,7 +250,7 @@ func RunTestsOnBackend(t *testing.T, backend storage.Backend) {
 				Size:         uint32(len(sampleMessage)),
 			}
 			body := bytes.NewBufferString(sampleMessage)
-			uid, err := backend.PutMessage(info, props, body)
+			uid, err := backend.PutMessage(context.Background(), info, props, body)
 			require.NoError(t, err)
 			if backend.SupportMessageID() {
 				assert.NotZero(t, uid)
@@ -253,7 +258,7 @@ func RunTestsOnBackend(t *testing.T, backend storage.Backend) {
 		}
 
 		// Verify the mailbox shows 3 messages
-		status, err := backend.SelectMailbox(info)
+		status, err := backend.SelectMailbox(context.Background(), info)
 		require.NoError(t, err)
 		t.Logf("%v", status)
 		assert.Equal(t, info.Name, status.Name)
@@ -269,7 +274,7 @@ func RunTestsOnBackend(t *testing.T, backend storage.Backend) {
 			Delimiter: backend.Delimiter(),
 			Name:      "Work",
 		}
-		_, err := backend.SelectMailbox(info)
+		_, err := backend.SelectMailbox(context.Background(), info)
 		require.NoError(t, err)
 
 		receiver := make(chan *mailbox.Message, 10)
@@ -311,46 +316,95 @@ func RunTestsOnBackend(t *testing.T, backend storage.Backend) {
 		assert.NoError(t, err)
 	})
 
-	// FIXME: temporary fail for imap backend
-	// t.Run("FetchAndCancelContext", func(t *testing.T) {
-	// 	info := mailbox.Info{
-	// 		Delimiter: backend.Delimiter(),
-	// 		Name:      "Work",
-	// 	}
-	// 	_, err := backend.SelectMailbox(info)
-	// 	require.NoError(t, err)
-
-	// 	// cancel the context right away
-	// 	ctx, cancel := context.WithCancel(context.Background())
-	// 	cancel()
-
-	// 	receiver := make(chan *mailbox.Message, 10)
-	// 	done := make(chan error, 1)
-	// 	go func() {
-	// 		done <- backend.FetchMessages(ctx, receiver)
-	// 	}()
-
-	// 	wg := sync.WaitGroup{}
-	// 	wg.Add(1)
-	// 	go func() {
-	// 		defer wg.Done()
-	// 		count := 0
-	// 		for msg := range receiver {
-	// 			count++
-	// 			msg.Body.Close()
-	// 		}
-	// 		// no message should have been downloaded
-	// 		assert.Equal(t, 0, count)
-	// 	}()
-	// 	// wait until all the messages arrived
-	// 	err = <-done
-	// 	assert.ErrorIs(t, err, context.Canceled)
-
-	// 	wg.Wait()
-
-	// 	err = backend.UnselectMailbox()
-	// 	assert.NoError(t, err)
-	// })
+	t.Run("FetchAndCancelContext", func(t *testing.T) {
+		info := mailbox.Info{
+			Delimiter: backend.Delimiter(),
+			Name:      "Work",
+		}
+		_, err := backend.SelectMailbox(context.Background(), info)
+		require.NoError(t, err)
+
+		// cancel the context right away
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		receiver := make(chan *mailbox.Message, 10)
+		done := make(chan error, 1)
+		go func() {
+			done <- backend.FetchMessages(ctx, time.Time{}, receiver)
+		}()
+
+		count := 0
+		for msg := range receiver {
+			count++
+			msg.Body.Close()
+		}
+		// no message should have been downloaded
+		assert.Equal(t, 0, count)
+		// wait until all the messages arrived
+		err = <-done
+		assert.ErrorIs(t, err, context.Canceled)
+
+		err = backend.UnselectMailbox()
+		assert.NoError(t, err)
+	})
+
+	t.Run("CancelledContext", func(t *testing.T) {
+		info := mailbox.Info{
+			Delimiter: backend.Delimiter(),
+			Name:      "Work",
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := backend.ListMailbox(ctx)
+		assert.ErrorIs(t, err, context.Canceled)
+
+		err = backend.CreateMailbox(ctx, mailbox.Info{
+			Delimiter: backend.Delimiter(),
+			Name:      "Cancelled",
+		})
+		assert.ErrorIs(t, err, context.Canceled)
+
+		_, err = backend.OpenMailbox(ctx, info)
+		assert.ErrorIs(t, err, context.Canceled)
+
+		_, err = backend.GetHistory(ctx, info)
+		assert.ErrorIs(t, err, context.Canceled)
+
+		// the backend can still be used with another context
+		list, err := backend.ListMailbox(context.Background())
+		require.NoError(t, err)
+		assert.False(t, mailboxExists("Cancelled", list))
+	})
+
+	t.Run("AppendMessageAndCancelContext", func(t *testing.T) {
+		info := mailbox.Info{
+			Delimiter: backend.Delimiter(),
+			Name:      "Work",
+		}
+		props := mailbox.MessageProperties{
+			Flags:        sampleMessageFlags,
+			InternalDate: sampleMessageDate,
+			Size:         uint32(len(sampleMessage)),
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// the context is cancelled while the body is read
+		body := &cancelReader{
+			reader: strings.NewReader(sampleMessage),
+			cancel: cancel,
+		}
+		_, err := backend.PutMessage(ctx, info, props, body)
+		assert.ErrorIs(t, err, context.Canceled)
+
+		// Verify the mailbox still shows 3 messages
+		status, err := backend.SelectMailbox(context.Background(), info)
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(3), status.Messages)
+		assert.Len(t, fetchAllMessages(t, backend, info), 3)
+	})
 
 	t.Run("AppendMessageWithWrongSize", func(t *testing.T) {
 		info := mailbox.Info{
@@ -363,11 +417,11 @@ func RunTestsOnBackend(t *testing.T, backend storage.Backend) {
 			Size:         uint32(len(sampleMessage)) - 1,
 		}
 		body := bytes.NewBufferString(sampleMessage)
-		_, err := backend.PutMessage(info, props, body)
+		_, err := backend.PutMessage(context.Background(), info, props, body)
 		assert.Error(t, err)
 
 		// Verify the mailbox still shows 3 messages
-		status, err := backend.SelectMailbox(info)
+		status, err := backend.SelectMailbox(context.Background(), info)
 		assert.NoError(t, err)
 		t.Logf("%v", status)
 		assert.Equal(t, uint32(3), status.Messages)
@@ -387,11 +441,11 @@ func RunTestsOnBackend(t *testing.T, backend storage.Backend) {
 			Size:         uint32(len(sampleMessage)),
 		}
 		body := bytes.NewBufferString(sampleMessage)
-		_, err := backend.PutMessage(info, props, body)
+		_, err := backend.PutMessage(context.Background(), info, props, body)
 		assert.NoError(t, err)
 
 		// Verify the mailbox has 4 messages
-		status, err := backend.SelectMailbox(info)
+		status, err := backend.SelectMailbox(context.Background(), info)
 		assert.NoError(t, err)
 		assert.Equal(t, uint32(4), status.Messages)
 
@@ -427,7 +481,7 @@ func RunTestsOnBackend(t *testing.T, backend storage.Backend) {
 			Delimiter: backend.Delimiter(),
 			Name:      "Work",
 		}
-		_, err := backend.SelectMailbox(info)
+		_, err := backend.SelectMailbox(context.Background(), info)
 		require.NoError(t, err)
 
 		latest, err := backend.LatestDate(context.Background())
@@ -438,6 +492,206 @@ func RunTestsOnBackend(t *testing.T, backend storage.Backend) {
 		assert.NoError(t, err)
 	})
 
+	t.Run("SetMessageFlags", func(t *testing.T) {
+		updater, ok := backend.(storage.FlagsUpdater)
+		if !ok {
+			t.Skip("backend cannot update message flags")
+		}
+		info := mailbox.Info{
+			Delimiter: backend.Delimiter(),
+			Name:      "Work",
+		}
+		messages := fetchAllMessages(t, backend, info)
+		require.NotEmpty(t, messages)
+		uid := messages[0].Uid
+
+		err := updater.SetMessageFlags(context.Background(), info, uid, []string{imap.FlaggedFlag})
+		require.NoError(t, err)
+
+		for _, msg := range fetchAllMessages(t, backend, info) {
+			if msg.Uid.String() == uid.String() {
+				assert.ElementsMatch(t, []string{imap.FlaggedFlag}, msg.Flags)
+				return
+			}
+		}
+		t.Errorf("message %s not found after updating flags", uid)
+	})
+
+	t.Run("DeleteMessage", func(t *testing.T) {
+		deleter, ok := backend.(storage.MessageDeleter)
+		if !ok {
+			t.Skip("backend cannot delete a message")
+		}
+		info := mailbox.Info{
+			Delimiter: backend.Delimiter(),
+			Name:      "Work",
+		}
+		messages := fetchAllMessages(t, backend, info)
+		require.Len(t, messages, 4)
+
+		err := deleter.DeleteMessage(context.Background(), info, messages[0].Uid)
+		require.NoError(t, err)
+
+		status, err := backend.SelectMailbox(context.Background(), info)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(3), status.Messages)
+		err = backend.UnselectMailbox()
+		assert.NoError(t, err)
+
+		assert.Len(t, fetchAllMessages(t, backend, info), 3)
+	})
+
+	t.Run("AppendMessageWithKeywords", func(t *testing.T) {
+		info := mailbox.Info{
+			Delimiter: backend.Delimiter(),
+			Name:      "Labels",
+		}
+		createMailbox(t, backend, info)
+		defer deleteMailbox(t, backend, info)
+
+		flags := []string{imap.SeenFlag, "$Label1", "Junk", "NonJunk"}
+		_, err := backend.PutMessage(context.Background(), info, mailbox.MessageProperties{
+			Flags:        flags,
+			InternalDate: sampleMessageDate,
+			Size:         uint32(len(sampleMessage)),
+		}, bytes.NewBufferString(sampleMessage))
+		require.NoError(t, err)
+
+		messages := fetchAllMessages(t, backend, info)
+		require.Len(t, messages, 1)
+		assertSameFlags(t, flags, messages[0].Flags)
+
+		updater, ok := backend.(storage.FlagsUpdater)
+		if !ok {
+			return
+		}
+		flags = []string{"Junk", "$Forwarded"}
+		err = updater.SetMessageFlags(context.Background(), info, messages[0].Uid, flags)
+		require.NoError(t, err)
+
+		messages = fetchAllMessages(t, backend, info)
+		require.Len(t, messages, 1)
+		assertSameFlags(t, flags, messages[0].Flags)
+	})
+
+	t.Run("FetchUids", func(t *testing.T) {
+		info := mailbox.Info{
+			Delimiter: backend.Delimiter(),
+			Name:      "Work",
+		}
+		handle, err := backend.OpenMailbox(context.Background(), info)
+		require.NoError(t, err)
+		defer handle.Close()
+
+		all := fetchHandleMessages(t, handle)
+		require.Greater(t, len(all), 1)
+
+		receiver := make(chan *mailbox.Message, 10)
+		done := make(chan error, 1)
+		go func() {
+			// the unknown UID is skipped
+			done <- handle.FetchUids(context.Background(), []mailbox.MessageID{all[1].Uid, mailbox.NewMessageIDFromUint(99999)}, receiver)
+		}()
+		messages := make([]*mailbox.Message, 0)
+		for msg := range receiver {
+			msg.Body.Close()
+			messages = append(messages, msg)
+		}
+		require.NoError(t, <-done)
+		require.Len(t, messages, 1)
+		assert.Equal(t, all[1].Uid, messages[0].Uid)
+		assert.True(t, all[1].InternalDate.Equal(messages[0].InternalDate))
+	})
+
+	t.Run("Uids", func(t *testing.T) {
+		info := mailbox.Info{
+			Delimiter: backend.Delimiter(),
+			Name:      "Work",
+		}
+		handle, err := backend.OpenMailbox(context.Background(), info)
+		require.NoError(t, err)
+		defer handle.Close()
+
+		all := fetchHandleMessages(t, handle)
+		expected := make([]uint32, len(all))
+		for i, msg := range all {
+			expected[i] = msg.Uid.AsUint()
+		}
+		slices.Sort(expected)
+
+		uids, err := handle.Uids(context.Background())
+		require.NoError(t, err)
+		found := make([]uint32, len(uids))
+		for i, uid := range uids {
+			found[i] = uid.AsUint()
+		}
+		assert.Equal(t, expected, found)
+	})
+
+	t.Run("MailboxHandles", func(t *testing.T) {
+		first := mailbox.Info{
+			Delimiter: backend.Delimiter(),
+			Name:      "Handle1",
+		}
+		second := mailbox.Info{
+			Delimiter: backend.Delimiter(),
+			Name:      "Handle2",
+		}
+		createMailbox(t, backend, first)
+		defer deleteMailbox(t, backend, first)
+		createMailbox(t, backend, second)
+		defer deleteMailbox(t, backend, second)
+
+		// both mailboxes are opened at the same time
+		firstHandle, err := backend.OpenMailbox(context.Background(), first)
+		require.NoError(t, err)
+		defer firstHandle.Close()
+		secondHandle, err := backend.OpenMailbox(context.Background(), second)
+		require.NoError(t, err)
+		defer secondHandle.Close()
+
+		assert.Equal(t, "Handle1", firstHandle.Status().Name)
+		assert.Equal(t, "Handle2", secondHandle.Status().Name)
+
+		for i, handle := range []storage.MailboxHandle{firstHandle, secondHandle, firstHandle} {
+			_, err = handle.Put(context.Background(), mailbox.MessageProperties{
+				Flags:        sampleMessageFlags,
+				InternalDate: sampleMessageDate.Add(time.Duration(i) * time.Hour),
+				Size:         uint32(len(sampleMessage)),
+			}, bytes.NewBufferString(sampleMessage))
+			require.NoError(t, err)
+		}
+
+		firstMessages := fetchHandleMessages(t, firstHandle)
+		assert.Len(t, firstMessages, 2)
+		assert.Len(t, fetchHandleMessages(t, secondHandle), 1)
+		latest, err := firstHandle.LatestDate(context.Background())
+		require.NoError(t, err)
+		assert.True(t, latest.Equal(sampleMessageDate.Add(2*time.Hour)), "unexpected latest date %s", latest)
+
+		secondMessages := fetchHandleMessages(t, secondHandle)
+		require.Len(t, secondMessages, 1)
+		latest, err = secondHandle.LatestDate(context.Background())
+		require.NoError(t, err)
+		assert.True(t, latest.Equal(sampleMessageDate.Add(time.Hour)), "unexpected latest date %s", latest)
+
+		err = firstHandle.SetFlags(context.Background(), firstMessages[0].Uid, []string{imap.FlaggedFlag})
+		require.NoError(t, err)
+		for _, msg := range fetchHandleMessages(t, firstHandle) {
+			if msg.Uid.String() == firstMessages[0].Uid.String() {
+				assert.ElementsMatch(t, []string{imap.FlaggedFlag}, msg.Flags)
+			}
+		}
+
+		err = secondHandle.Delete(context.Background(), secondMessages[0].Uid)
+		if errors.Is(err, lib.ErrNotSupported) {
+			return
+		}
+		require.NoError(t, err)
+		assert.Empty(t, fetchHandleMessages(t, secondHandle))
+		assert.Len(t, fetchHandleMessages(t, firstHandle), 2)
+	})
+
 	t.Run("StoreOneAction", func(t *testing.T) {
 		info := mailbox.Info{
 			Delimiter: backend.Delimiter(),
@@ -456,7 +710,7 @@ func RunTestsOnBackend(t *testing.T, backend storage.Backend) {
 			},
 		}
 
-		err := backend.AddToHistory(info, action)
+		err := backend.AddToHistory(context.Background(), info, action)
 		assert.NoError(t, err)
 	})
 
@@ -465,7 +719,7 @@ func RunTestsOnBackend(t *testing.T, backend storage.Backend) {
 			Delimiter: backend.Delimiter(),
 			Name:      "INBOX",
 		}
-		history, err := backend.GetHistory(info)
+		history, err := backend.GetHistory(context.Background(), info)
 		require.NoError(t, err)
 		assert.NotNil(t, history)
 		assert.Empty(t, history.Actions)
@@ -476,7 +730,7 @@ func RunTestsOnBackend(t *testing.T, backend storage.Backend) {
 			Delimiter: backend.Delimiter(),
 			Name:      "Work",
 		}
-		history, err := backend.GetHistory(info)
+		history, err := backend.GetHistory(context.Background(), info)
 		require.NoError(t, err)
 		require.NotNil(t, history)
 		require.Len(t, history.Actions, 1)
@@ -488,6 +742,44 @@ func RunTestsOnBackend(t *testing.T, backend storage.Backend) {
 		assert.Equal(t, "c11", history.Actions[0].Entries[0].MessageID.AsString())
 	})
 
+	t.Run("ReplaceHistory", func(t *testing.T) {
+		replacer, ok := backend.(storage.HistoryReplacer)
+		if !ok {
+			t.Skip("backend cannot replace the history")
+		}
+		info := mailbox.Info{
+			Delimiter: backend.Delimiter(),
+			Name:      "Work",
+		}
+		previous, err := backend.GetHistory(context.Background(), info)
+		require.NoError(t, err)
+
+		replaced := &mailbox.History{Actions: []mailbox.HistoryAction{{
+			SourceAccountTag: "other",
+			Date:             time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			Action:           mailbox.ActionCopy,
+			UidValidity:      456,
+		}}}
+		err = replacer.ReplaceHistory(context.Background(), info, replaced)
+		require.NoError(t, err)
+
+		history, err := backend.GetHistory(context.Background(), info)
+		require.NoError(t, err)
+		require.Len(t, history.Actions, 1)
+		assert.Equal(t, "other", history.Actions[0].SourceAccountTag)
+		assert.Equal(t, uint32(456), history.Actions[0].UidValidity)
+
+		err = replacer.ReplaceHistory(context.Background(), info, previous)
+		require.NoError(t, err)
+		history, err = backend.GetHistory(context.Background(), info)
+		require.NoError(t, err)
+		assert.Len(t, history.Actions, len(previous.Actions))
+	})
+
+	t.Run("ConcurrentCallers", func(t *testing.T) {
+		runConcurrentTests(t, backend)
+	})
+
 	t.Run("DeleteSimpleMailbox", func(t *testing.T) {
 		deleteMailbox(t, backend, mailbox.Info{
 			Delimiter: backend.Delimiter(),
@@ -497,12 +789,134 @@ func RunTestsOnBackend(t *testing.T, backend storage.Backend) {
 
 }
 
+// runConcurrentTests calls the backend from multiple goroutines: run the tests with the race detector.
+// Only one goroutine is selecting a mailbox as the selected mailbox is shared between the callers.
+func runConcurrentTests(t *testing.T, backend storage.Backend) {
+	const (
+		workers  = 4
+		messages = 3
+	)
+	mutex := sync.Mutex{}
+	errs := make([]error, 0)
+	check := func(err error) {
+		if err != nil {
+			mutex.Lock()
+			errs = append(errs, err)
+			mutex.Unlock()
+		}
+	}
+	// each worker is using its own mailbox and the shared one
+	shared := mailbox.Info{
+		Delimiter: backend.Delimiter(),
+		Name:      "Concurrent",
+	}
+	createMailbox(t, backend, shared)
+	mailboxes := make([]mailbox.Info, workers)
+	for i := range mailboxes {
+		mailboxes[i] = mailbox.Info{
+			Delimiter: backend.Delimiter(),
+			Name:      fmt.Sprintf("Concurrent%d", i+1),
+		}
+	}
+
+	stop := make(chan struct{})
+	reader := sync.WaitGroup{}
+	reader.Go(func() {
+		info := mailbox.Info{
+			Delimiter: backend.Delimiter(),
+			Name:      "INBOX",
+		}
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_, err := backend.SelectMailbox(context.Background(), info)
+			check(err)
+			_, err = backend.LatestDate(context.Background())
+			check(err)
+			receiver := make(chan *mailbox.Message, 10)
+			done := make(chan error, 1)
+			go func() {
+				done <- backend.FetchMessages(context.Background(), time.Time{}, receiver)
+			}()
+			for msg := range receiver {
+				msg.Body.Close()
+			}
+			check(<-done)
+			check(backend.UnselectMailbox())
+			// leave some room for the writers
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	wg := sync.WaitGroup{}
+	for _, info := range mailboxes {
+		wg.Go(func() {
+			_ = backend.AccountID()
+			_ = backend.Delimiter()
+			check(backend.CreateMailbox(context.Background(), info))
+			for i := range messages {
+				for _, target := range []mailbox.Info{info, shared} {
+					_, err := backend.PutMessage(context.Background(), target, mailbox.MessageProperties{
+						Flags:        []string{imap.SeenFlag},
+						InternalDate: sampleMessageDate,
+						Size:         uint32(len(sampleMessage)),
+					}, bytes.NewBufferString(sampleMessage))
+					check(err)
+					check(backend.AddToHistory(context.Background(), target, mailbox.HistoryAction{
+						SourceAccountTag: "concurrent",
+						Date:             time.Now(),
+						Action:           "TEST",
+						UidValidity:      uint32(i + 1),
+					}))
+					_, err = backend.GetHistory(context.Background(), target)
+					check(err)
+				}
+				_, err := backend.ListMailbox(context.Background())
+				check(err)
+			}
+		})
+	}
+	wg.Wait()
+	close(stop)
+	reader.Wait()
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+
+	for _, info := range append(mailboxes, shared) {
+		expected := messages
+		if info.Name == shared.Name {
+			expected = workers * messages
+		}
+		// no message and no history was lost
+		status, err := backend.SelectMailbox(context.Background(), info)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(expected), status.Messages)
+		require.NoError(t, backend.UnselectMailbox())
+		assert.Len(t, fetchAllMessages(t, backend, info), expected)
+
+		history, err := backend.GetHistory(context.Background(), info)
+		require.NoError(t, err)
+		count := 0
+		for _, action := range history.Actions {
+			if action.SourceAccountTag == "concurrent" {
+				count++
+			}
+		}
+		assert.Equal(t, expected, count)
+		deleteMailbox(t, backend, info)
+	}
+}
+
 func PrepareBackend(backend storage.Backend) error {
 	info := mailbox.Info{
 		Delimiter: backend.Delimiter(),
 		Name:      "INBOX",
 	}
-	existing, err := backend.ListMailbox()
+	existing, err := backend.ListMailbox(context.Background())
 	if err != nil {
 		return err
 	}
@@ -510,7 +924,7 @@ func PrepareBackend(backend storage.Backend) error {
 		// no need to create the mailbox and add a message to it
 		return nil
 	}
-	err = backend.CreateMailbox(info)
+	err = backend.CreateMailbox(context.Background(), info)
 	if err != nil {
 		return err
 	}
@@ -520,20 +934,90 @@ func PrepareBackend(backend storage.Backend) error {
 		Size:         uint32(len(sampleMessage)),
 	}
 	buffer := bytes.NewBufferString(sampleMessage)
-	_, err = backend.PutMessage(info, props, buffer)
+	_, err = backend.PutMessage(context.Background(), info, props, buffer)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// cancelReader cancels the context after the first read
+type cancelReader struct {
+	reader io.Reader
+	cancel context.CancelFunc
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	defer r.cancel()
+	return r.reader.Read(p)
+}
+
+// fetchAllMessages returns the messages from the mailbox (with their body already closed)
+func fetchAllMessages(t *testing.T, backend storage.Backend, info mailbox.Info) []*mailbox.Message {
+	t.Helper()
+
+	_, err := backend.SelectMailbox(context.Background(), info)
+	require.NoError(t, err)
+
+	receiver := make(chan *mailbox.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- backend.FetchMessages(context.Background(), time.Time{}, receiver)
+	}()
+
+	messages := make([]*mailbox.Message, 0)
+	for msg := range receiver {
+		msg.Body.Close()
+		messages = append(messages, msg)
+	}
+	err = <-done
+	require.NoError(t, err)
+
+	err = backend.UnselectMailbox()
+	require.NoError(t, err)
+	return messages
+}
+
+// fetchHandleMessages returns the messages from the mailbox handle (with their body already closed)
+func fetchHandleMessages(t *testing.T, handle storage.MailboxHandle) []*mailbox.Message {
+	t.Helper()
+
+	receiver := make(chan *mailbox.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- handle.Fetch(context.Background(), time.Time{}, receiver)
+	}()
+
+	messages := make([]*mailbox.Message, 0)
+	for msg := range receiver {
+		msg.Body.Close()
+		messages = append(messages, msg)
+	}
+	require.NoError(t, <-done)
+	return messages
+}
+
+// assertSameFlags compares the flags without case: IMAP servers can return the keywords in lowercase
+func assertSameFlags(t *testing.T, expected, actual []string) {
+	t.Helper()
+
+	lower := func(flags []string) []string {
+		result := make([]string, len(flags))
+		for i, flag := range flags {
+			result[i] = strings.ToLower(flag)
+		}
+		return result
+	}
+	assert.ElementsMatch(t, lower(expected), lower(actual))
+}
+
 func createMailbox(t *testing.T, backend storage.Backend, info mailbox.Info) {
 	t.Helper()
 
-	err := backend.CreateMailbox(info)
+	err := backend.CreateMailbox(context.Background(), info)
 	require.NoError(t, err)
 
-	list, err := backend.ListMailbox()
+	list, err := backend.ListMailbox(context.Background())
 	require.NoError(t, err)
 
 	name := lib.VerifyDelimiter(info.Name, info.Delimiter, backend.Delimiter())
@@ -543,10 +1027,10 @@ func createMailbox(t *testing.T, backend storage.Backend, info mailbox.Info) {
 func deleteMailbox(t *testing.T, backend storage.Backend, info mailbox.Info) {
 	t.Helper()
 
-	err := backend.DeleteMailbox(info)
+	err := backend.DeleteMailbox(context.Background(), info)
 	require.NoError(t, err)
 
-	list, err := backend.ListMailbox()
+	list, err := backend.ListMailbox(context.Background())
 	require.NoError(t, err)
 
 	name := lib.VerifyDelimiter(info.Name, info.Delimiter, backend.Delimiter())
@@ -1,6 +1,10 @@
 package term
 
-import "github.com/pterm/pterm"
+import (
+	"io"
+
+	"github.com/pterm/pterm"
+)
 
 type Level int
 
@@ -18,6 +22,11 @@ func SetLevel(level Level) {
 	lvl = level
 }
 
+// SetOutput sends the messages to w instead of stdout (when stdout is read by a script)
+func SetOutput(w io.Writer) {
+	pterm.SetDefaultOutput(w)
+}
+
 func Debug(a ...any) {
 	if lvl > LevelDebug {
 		return